@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Aggregation of the quakes into the cells of a grid or of hexagons, for zoomed out maps.
+ * outputFormat=json&aggregate=grid:0.5 or aggregate=hex:0.5 bins the filtered quakes in SQL,
+ * the size is the width of a cell in the units of srsName (degrees by default).
+ * Each cell is a GeoJSON polygon with the count, maximum magnitude and latest origin time of its quakes.
+ * maxFeatures, startIndex and sortBy are not applied, all the filtered quakes are binned.
+ */
+const (
+	AGGREGATE_GRID         = "grid"
+	AGGREGATE_HEX          = "hex"
+	AGGREGATE_DEFAULT_SIZE = 0.5
+)
+
+type aggregation struct {
+	shape string
+	size  float64 //the width of a cell
+}
+
+// parseAggregate reads grid[:size] or hex[:size], nil for none
+func parseAggregate(s string) (*aggregation, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.SplitN(s, ":", 2)
+	a := &aggregation{shape: strings.ToLower(fields[0]), size: AGGREGATE_DEFAULT_SIZE}
+	if a.shape != AGGREGATE_GRID && a.shape != AGGREGATE_HEX {
+		return nil, errors.New("invalid aggregate " + s + ", use grid:<size> or hex:<size>")
+	}
+	if len(fields) == 2 {
+		size, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || size <= 0 || math.IsInf(size, 0) {
+			return nil, errors.New("invalid aggregate size " + fields[1] + ", expecting a positive number")
+		}
+		a.size = size
+	}
+	return a, nil
+}
+
+/**
+ * hexRowHeight is the distance between the rows of a hexagon grid of pointy topped hexagons,
+ * the centres are on two rectangular grids of width x 2 * hexRowHeight, the second offset by half a cell.
+ */
+func (a *aggregation) hexRowHeight() float64 {
+	return a.size * math.Sqrt(3) / 2
+}
+
+/**
+ * sql is the aggregation of the filtered quakes in filtered, a query of their x, y, magnitude and origintime.
+ * It selects the x,y of the centre of each cell, the count, maximum magnitude and latest origintime.
+ */
+func (a *aggregation) sql(filtered string) string {
+	aggregates := `count(*), max(magnitude), to_char(max(origintime), 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"')`
+	if a.shape == AGGREGATE_GRID {
+		half := a.size / 2
+		return fmt.Sprintf(`select ST_X(cell), ST_Y(cell), %s from
+     (select ST_SnapToGrid(ST_MakePoint(x, y), %g, %g, %g, %g) as cell, magnitude, origintime from (%s) q) c
+     group by cell`, aggregates, half, half, a.size, a.size, filtered)
+	}
+	//the nearer of the centres of the two grids
+	w, h := a.size, 2*a.hexRowHeight()
+	return fmt.Sprintf(`select cx, cy, %s from
+     (select case when (x-x1)^2 + (y-y1)^2 <= (x-x2)^2 + (y-y2)^2 then x1 else x2 end as cx,
+       case when (x-x1)^2 + (y-y1)^2 <= (x-x2)^2 + (y-y2)^2 then y1 else y2 end as cy, magnitude, origintime from
+       (select x, y, round(x / %[2]g) * %[2]g as x1, round(y / %[3]g) * %[3]g as y1,
+         floor(x / %[2]g) * %[2]g + %[4]g as x2, floor(y / %[3]g) * %[3]g + %[5]g as y2, magnitude, origintime
+         from (%[6]s) q) g) c
+     group by cx, cy`, aggregates, w, h, w/2, h/2, filtered)
+}
+
+// polygon is the ring of the cell centred on x,y
+func (a *aggregation) polygon(x, y float64) [][]float64 {
+	if a.shape == AGGREGATE_GRID {
+		half := a.size / 2
+		return [][]float64{{x - half, y - half}, {x + half, y - half}, {x + half, y + half}, {x - half, y + half}, {x - half, y - half}}
+	}
+	//pointy topped, the radius to the vertices is 2/3 of the row height
+	r := a.hexRowHeight() * 2 / 3
+	ring := make([][]float64, 0, 7)
+	for i := 0; i <= 6; i++ {
+		angle := math.Pi/6 + float64(i%6)*math.Pi/3
+		ring = append(ring, []float64{roundCoord(x + r*math.Cos(angle)), roundCoord(y + r*math.Sin(angle))})
+	}
+	return ring
+}
+
+// roundCoord drops the floating point noise of the vertices
+func roundCoord(f float64) float64 {
+	return math.Round(f*1e9) / 1e9
+}
+
+type PolygonGeometry struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
+type AggregateProperties struct {
+	Count            int64   `json:"count"`
+	Maxmagnitude     float64 `json:"maxmagnitude,omitempty"`
+	Latestorigintime string  `json:"latestorigintime"`
+}
+
+/**
+ * getQuakesAggregate writes the cells of params.aggregate as a GeoJSON FeatureCollection,
+ * in the CRS and axis order of srsName.
+ */
+func getQuakesAggregate(h http.Header, b *bytes.Buffer, params *QueryParams) *result {
+	if params.outputFormat != "JSON" {
+		return badRequest("aggregate is for outputFormat=json only")
+	}
+	g := transformSql(params.layer.Geometry, params.srid)
+	sqlPre := "select ST_X(" + g + ") as x, ST_Y(" + g + ") as y, magnitude, origintime from " + params.layer.Table
+	filtered, args, err := getSqlQueryString(sqlPre, params.unpaged())
+	if err != nil {
+		return badRequest(err.Error())
+	}
+
+	rows, err := db.Query(params.aggregate.sql(filtered), args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+
+	features := make([]Feature, 0)
+	for rows.Next() {
+		var (
+			x, y       float64
+			count      int64
+			magnitude  sql.NullFloat64
+			origintime string
+		)
+		if err := rows.Scan(&x, &y, &count, &magnitude, &origintime); err != nil {
+			return internalServerError(err)
+		}
+		ring := params.aggregate.polygon(x, y)
+		if params.latLon {
+			for _, c := range ring {
+				c[0], c[1] = c[1], c[0]
+			}
+		}
+		features = append(features, Feature{Type: "Feature",
+			Geometry:   PolygonGeometry{Type: "Polygon", Coordinates: [][][]float64{ring}},
+			Properties: AggregateProperties{Count: count, Maxmagnitude: magnitude.Float64, Latestorigintime: origintime}})
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+
+	jsonBytes, err := json.Marshal(GeoJsonFeatureCollection{Type: "FeatureCollection", Features: features, Crs: params.geoJsonCrs()})
+	if err != nil {
+		return internalServerError(err)
+	}
+	b.Write(jsonBytes)
+	h.Set("Content-Type", V1GeoJSON)
+	return &statusOK
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseAggregate(t *testing.T) {
+	tests := map[string]aggregation{
+		"grid:0.5":   {AGGREGATE_GRID, 0.5},
+		"grid":       {AGGREGATE_GRID, AGGREGATE_DEFAULT_SIZE},
+		"HEX:10000":  {AGGREGATE_HEX, 10000},
+		"hex":        {AGGREGATE_HEX, AGGREGATE_DEFAULT_SIZE},
+		"grid:1e-01": {AGGREGATE_GRID, 0.1},
+	}
+	for s, expected := range tests {
+		a, err := parseAggregate(s)
+		if err != nil || *a != expected {
+			t.Errorf("%s: expected %v got %v %v", s, expected, a, err)
+		}
+	}
+	if a, err := parseAggregate(""); a != nil || err != nil {
+		t.Errorf("expected no aggregation, got %v %v", a, err)
+	}
+	for _, s := range []string{"square", "grid:", "grid:0", "hex:-1", "grid:abc", "grid:Inf"} {
+		if _, err := parseAggregate(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestAggregateSql(t *testing.T) {
+	params, err := getQueryParams(map[string][]string{
+		"outputFormat": {"json"},
+		"aggregate":    {"grid:0.5"},
+		"cql_filter":   {"magnitude>4"},
+		"maxFeatures":  {"10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `select ST_X(cell), ST_Y(cell), count(*), max(magnitude), to_char(max(origintime), 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') from
+     (select ST_SnapToGrid(ST_MakePoint(x, y), 0.25, 0.25, 0.5, 0.5) as cell, magnitude, origintime from (filtered) q) c
+     group by cell`
+	if s := params.aggregate.sql("filtered"); s != expected {
+		t.Errorf("got %s", s)
+	}
+	hex := &aggregation{AGGREGATE_HEX, 2}
+	if s := hex.sql("filtered"); !strings.Contains(s, "round(x / 2) * 2 as x1, round(y / 3.4641016151377544) * 3.4641016151377544 as y1") ||
+		!strings.Contains(s, "floor(x / 2) * 2 + 1 as x2") || !strings.Contains(s, "from (filtered) q") {
+		t.Errorf("got %s", s)
+	}
+}
+
+func TestAggregatePolygon(t *testing.T) {
+	grid := &aggregation{AGGREGATE_GRID, 0.5}
+	ring := grid.polygon(172.25, -41.75)
+	if len(ring) != 5 || ring[0][0] != 172 || ring[0][1] != -42 || ring[2][0] != 172.5 || ring[2][1] != -41.5 {
+		t.Errorf("got %v", ring)
+	}
+
+	hex := &aggregation{AGGREGATE_HEX, 2}
+	ring = hex.polygon(0, 0)
+	if len(ring) != 7 || ring[0][0] != ring[6][0] || ring[0][1] != ring[6][1] {
+		t.Fatalf("expected a closed hexagon, got %v", ring)
+	}
+	//the width across the flat sides is the size, the neighbours in the next row share a side
+	if ring[0][0]-ring[3][0] != 2 || ring[1][0] != 0 || math.Abs(ring[1][1]-2/math.Sqrt(3)) > 1e-9 {
+		t.Errorf("got %v", ring)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+/**
+ * OGC CQL2 (OGC 21-065) filters, selected with filter-lang=cql2-text or cql2-json.
+ * Both encodings are parsed into the same filter model as the ECQL cql_filter:
+ *
+ * S_INTERSECTS(origin_geom, POLYGON((172 -41,175 -41,175 -44,172 -41)))
+ * S_WITHIN(origin_geom, BBOX(172,-44,175,-41))
+ * T_AFTER(origintime, TIMESTAMP('2016-01-01T00:00:00Z'))
+ * T_DURING(origintime, INTERVAL('2016-01-01', '..'))
+ * CASEI(magnitudetype) = CASEI('ml') AND eventtype IN ('earthquake', 'quarry blast')
+ */
+const (
+	FILTER_LANG_CQL2_TEXT = "cql2-text"
+	FILTER_LANG_CQL2_JSON = "cql2-json"
+	CQL2_OPEN_END         = ".." //an open start or end of an INTERVAL
+)
+
+// the CQL2 temporal operators that can compare an instant property
+var cql2TemporalOps = map[string]bool{
+	"t_after":      true,
+	"t_before":     true,
+	"t_during":     true,
+	"t_equals":     true,
+	"t_intersects": true,
+	"t_disjoint":   true,
+}
+
+// NewCql2Converter returns a converter for CQL2 text.
+func NewCql2Converter(cql string) *CqlConverter {
+	c := NewCqlConverter(cql)
+	c.cql2 = true
+	return c
+}
+
+// cql2TokenType classifies the S_ and T_ predicates, the ECQL predicate names are plain words in CQL2
+func cql2TokenType(lval string) int {
+	if strings.HasPrefix(lval, "s_") && lval != "s_relate" && spatialFunctions[lval[2:]] != "" {
+		return TT_SPATIAL
+	}
+	if strings.HasPrefix(lval, "t_") {
+		return TT_TEMPORAL
+	}
+	return TT_WORD
+}
+
+/**
+ * S_INTERSECTS(origin_geom, POINT(175 -41)), the geometry is WKT or a BBOX(minx,miny,maxx,maxy) literal.
+ */
+func (cql *CqlConverter) parseCql2Spatial() (*spatialFilter, error) {
+	name := strings.ToUpper(cql.currentToken)
+	args, err := cql.readArguments(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, errors.New("not valid " + name + ", expecting " + name + "(geometry,WKT)!!")
+	}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "\"") && strings.HasSuffix(arg, "\"") && len(arg) > 1 {
+			args[i] = arg[1 : len(arg)-1]
+		} else if strings.HasPrefix(strings.ToUpper(arg), "BBOX") {
+			g, err := parseCql2BBox(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = g.String()
+		}
+	}
+	return newSpatialFilterFromArgs(name[2:], args[0], args[1])
+}
+
+// parseCql2BBox converts a BBOX(minx,miny,maxx,maxy) literal to a polygon
+func parseCql2BBox(arg string) (*Geometry, error) {
+	inner := strings.TrimSpace(arg[len("BBOX"):])
+	if !strings.HasPrefix(inner, "(") || !strings.HasSuffix(inner, ")") {
+		return nil, errors.New("not valid bbox " + arg)
+	}
+	coords, err := parseCoordinates(strings.Split(inner[1:len(inner)-1], ","))
+	if err != nil {
+		return nil, err
+	}
+	return newBBoxGeometry(coords)
+}
+
+// newBBoxGeometry makes the polygon of minx,miny,maxx,maxy, or of the 2D corners of a 3D bbox
+func newBBoxGeometry(coords []float64) (*Geometry, error) {
+	if len(coords) == 6 {
+		coords = []float64{coords[0], coords[1], coords[3], coords[4]}
+	}
+	if len(coords) != 4 {
+		return nil, errors.New("not valid bbox, expecting minx,miny,maxx,maxy!!")
+	}
+	if err := checkLongitudes(coords[0], coords[2]); err != nil {
+		return nil, errors.New("not valid bbox, " + err.Error())
+	}
+	minx, miny, maxx, maxy := normaliseBBox(coords[0], coords[1], coords[2], coords[3])
+	return newEnvelopeGeometry(minx, miny, maxx, maxy), nil
+}
+
+// newEnvelopeGeometry makes the polygon of an envelope as it is, e.g. in a projected CRS
+func newEnvelopeGeometry(minx, miny, maxx, maxy float64) *Geometry {
+	return &Geometry{Type: WKT_POLYGON, Rings: [][]Coord{{
+		{minx, miny}, {maxx, miny}, {maxx, maxy}, {minx, maxy}, {minx, miny},
+	}}}
+}
+
+/**
+ * T_AFTER(origintime, TIMESTAMP('2016-01-01T00:00:00Z'))
+ * T_DURING(origintime, INTERVAL('2016-01-01T00:00:00Z', '2016-02-01T00:00:00Z'))
+ */
+func (cql *CqlConverter) parseCql2Temporal() (filterNode, error) {
+	op := strings.ToLower(cql.currentToken)
+	cql.NextToken()
+	if !cql.isToken(TT_PARENTHESIS, "(") {
+		return nil, cql.unexpectedToken("'(' after " + strings.ToUpper(op))
+	}
+	cql.NextToken()
+	expr, err := cql.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if cql.currentTokenType != TT_COMMA {
+		return nil, cql.unexpectedToken("',' in " + strings.ToUpper(op))
+	}
+	cql.NextToken()
+
+	var start, end filterNode
+	interval := cql.isToken(TT_WORD, "interval") && cql.isFunctionCall()
+	if interval {
+		cql.NextToken()
+		if start, err = cql.parseCql2IntervalEnd(); err != nil {
+			return nil, err
+		}
+		if cql.currentTokenType != TT_COMMA {
+			return nil, cql.unexpectedToken("',' in INTERVAL")
+		}
+		cql.NextToken()
+		if end, err = cql.parseCql2IntervalEnd(); err != nil {
+			return nil, err
+		}
+		if !cql.isToken(TT_PARENTHESIS, ")") {
+			return nil, cql.unexpectedToken("')' after INTERVAL")
+		}
+		cql.NextToken()
+	} else if start, err = cql.parseExpression(); err != nil {
+		return nil, err
+	}
+	if !cql.isToken(TT_PARENTHESIS, ")") {
+		return nil, cql.unexpectedToken("')' after " + strings.ToUpper(op))
+	}
+	return newCql2TemporalFilter(op, expr, start, end, interval)
+}
+
+// parseCql2IntervalEnd parses a start or end of an INTERVAL, '..' is open and returns nil
+func (cql *CqlConverter) parseCql2IntervalEnd() (filterNode, error) {
+	if cql.isToken(TT_STRING, CQL2_OPEN_END) {
+		cql.NextToken()
+		return nil, nil
+	}
+	return cql.parseExpression()
+}
+
+// parseCql2Instant parses TIMESTAMP('2016-01-01T00:00:00Z') or DATE('2016-01-01'), the current token is '('
+func (cql *CqlConverter) parseCql2Instant(name string) (filterNode, error) {
+	cql.NextToken()
+	if cql.currentTokenType != TT_TIMESTRING {
+		return nil, cql.unexpectedToken("a quoted ISO 8601 " + name)
+	}
+	t := &timeExpr{value: cql.currentToken}
+	cql.NextToken()
+	if !cql.isToken(TT_PARENTHESIS, ")") {
+		return nil, cql.unexpectedToken("')' after " + strings.ToUpper(name))
+	}
+	cql.NextToken()
+	return t, nil
+}
+
+/**
+ * newCql2TemporalFilter compares a time property with an instant (interval is false)
+ * or an interval whose start or end is nil when open.
+ */
+func newCql2TemporalFilter(op string, expr filterNode, start filterNode, end filterNode, interval bool) (filterNode, error) {
+	name := strings.ToUpper(op)
+	if !cql2TemporalOps[op] {
+		return nil, errors.New("unsupported temporal operator " + name + ", the time properties are instants")
+	}
+	if !interval {
+		switch op {
+		case "t_after":
+			return &comparisonFilter{op: ">", left: expr, right: start}, nil
+		case "t_before":
+			return &comparisonFilter{op: "<", left: expr, right: start}, nil
+		case "t_equals", "t_intersects":
+			return &comparisonFilter{op: "=", left: expr, right: start}, nil
+		case "t_disjoint":
+			return &comparisonFilter{op: "<>", left: expr, right: start}, nil
+		}
+		return nil, errors.New(name + " needs an INTERVAL")
+	}
+
+	var lower, upper filterNode
+	switch op {
+	case "t_after":
+		if end == nil {
+			return nil, errors.New(name + " needs an interval with an end")
+		}
+		return &comparisonFilter{op: ">", left: expr, right: end}, nil
+	case "t_before":
+		if start == nil {
+			return nil, errors.New(name + " needs an interval with a start")
+		}
+		return &comparisonFilter{op: "<", left: expr, right: start}, nil
+	case "t_during":
+		lower, upper = cql2Bound(">", expr, start), cql2Bound("<", expr, end)
+	case "t_intersects":
+		lower, upper = cql2Bound(">=", expr, start), cql2Bound("<=", expr, end)
+	case "t_disjoint":
+		lower, upper = cql2Bound("<", expr, start), cql2Bound(">", expr, end)
+		if lower != nil && upper != nil {
+			return &logicFilter{op: "OR", children: []filterNode{lower, upper}}, nil
+		}
+	default:
+		return nil, errors.New(name + " needs a time instant")
+	}
+	switch {
+	case lower != nil && upper != nil:
+		return &logicFilter{op: "AND", children: []filterNode{lower, upper}}, nil
+	case lower != nil:
+		return lower, nil
+	case upper != nil:
+		return upper, nil
+	}
+	//an interval open at both ends
+	if op == "t_disjoint" {
+		return nil, errors.New(name + " with an interval open at both ends matches nothing")
+	}
+	return &nullFilter{expr: expr, not: true}, nil
+}
+
+func cql2Bound(op string, expr filterNode, t filterNode) filterNode {
+	if t == nil {
+		return nil
+	}
+	return &comparisonFilter{op: op, left: expr, right: t}
+}
+
+/**
+ * parseFilterLang parses a filter in CQL2 text or CQL2-JSON, returns nil for an empty filter.
+ * Without a filter-lang an XML document is an FES filter of layer l, anything else is CQL2 text.
+ */
+func parseFilterLang(filter string, lang string, l *featureLayer) (filterNode, error) {
+	switch strings.ToLower(lang) {
+	case "":
+		if strings.HasPrefix(strings.TrimSpace(filter), "<") {
+			return ParseFesFilter(filter, l)
+		}
+		return NewCql2Converter(filter).Parse()
+	case FILTER_LANG_CQL2_TEXT:
+		return NewCql2Converter(filter).Parse()
+	case FILTER_LANG_CQL2_JSON:
+		return ParseCql2Json([]byte(filter))
+	}
+	return nil, errors.New("unsupported filter-lang " + lang + ", should be " + FILTER_LANG_CQL2_TEXT + " or " + FILTER_LANG_CQL2_JSON)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func cql2Sql(f filterNode) string {
+	w := &sqlWriter{inline: true}
+	if err := f.writeSql(w); err != nil {
+		return err.Error()
+	}
+	return w.String()
+}
+
+func TestCql2Text(t *testing.T) {
+	tests := map[string]string{
+		`S_INTERSECTS(origin_geom, POINT(175 -41))`:                          `ST_Intersects(origin_geom, ST_GeomFromText('POINT(175 -41)', 4326))`,
+		`s_within("origin_geom", BBOX(172,-44,175,-41))`:                     `ST_Within(origin_geom, ST_GeomFromText('POLYGON((172 -44,175 -44,175 -41,172 -41,172 -44))', 4326))`,
+		`T_AFTER(origintime, TIMESTAMP('2016-01-01T00:00:00Z'))`:             `origintime > '2016-01-01T00:00:00Z'::timestamptz`,
+		`T_BEFORE(origintime, DATE('2016-01-01'))`:                           `origintime < '2016-01-01'::timestamptz`,
+		`T_DURING(origintime, INTERVAL('2016-01-01', '2016-02-01'))`:         `origintime > '2016-01-01'::timestamptz AND origintime < '2016-02-01'::timestamptz`,
+		`T_INTERSECTS(origintime, INTERVAL('2016-01-01T00:00:00Z', '..'))`:   `origintime >= '2016-01-01T00:00:00Z'::timestamptz`,
+		`T_DISJOINT(origintime, INTERVAL('2016-01-01', '2016-02-01'))`:       `origintime < '2016-01-01'::timestamptz OR origintime > '2016-02-01'::timestamptz`,
+		`CASEI(magnitudetype) = CASEI('ML') AND eventtype IN ('earthquake')`: `lower(magnitudetype) = lower('ML'::text) AND eventtype IN ('earthquake')`,
+		`magnitude >= 4 AND NOT depth > 100`:                                 `magnitude >= 4 AND NOT (depth > 100)`,
+	}
+	for cqlString, expected := range tests {
+		f, err := parseFilterLang(cqlString, "cql2-text", featureLayers[0])
+		if err != nil || cql2Sql(f) != expected {
+			t.Errorf("%s: expected %s got %v %v", cqlString, expected, f, err)
+			if f != nil {
+				t.Errorf("got %s", cql2Sql(f))
+			}
+		}
+	}
+
+	for _, cqlString := range []string{
+		`BBOX(origin_geom,174,-41,175,-42)`,
+		`origintime AFTER 2016-01-01T00:00:00Z`,
+		`T_AFTER(origintime, TIMESTAMP('yesterday'))`,
+		`T_DURING(origintime, TIMESTAMP('2016-01-01T00:00:00Z'))`,
+		`T_STARTS(origintime, INTERVAL('2016-01-01', '2016-02-01'))`,
+		`S_INTERSECTS(origin_geom, BBOX(172,-44))`,
+	} {
+		if f, err := parseFilterLang(cqlString, "CQL2-TEXT", featureLayers[0]); err == nil {
+			t.Errorf("expected error for %s, got %s", cqlString, cql2Sql(f))
+		}
+	}
+}
+
+func TestCql2Json(t *testing.T) {
+	tests := map[string]string{
+		`{"op":"and","args":[{"op":">=","args":[{"property":"magnitude"},4]},{"op":"<","args":[{"property":"depth"},100.5]}]}`:                 `magnitude >= 4 AND depth < 100.5`,
+		`{"op":"s_intersects","args":[{"property":"origin_geom"},{"type":"Point","coordinates":[175,-41]}]}`:                                   `ST_Intersects(origin_geom, ST_GeomFromText('POINT(175 -41)', 4326))`,
+		`{"op":"s_within","args":[{"property":"origin_geom"},{"bbox":[172,-44,175,-41]}]}`:                                                     `ST_Within(origin_geom, ST_GeomFromText('POLYGON((172 -44,175 -44,175 -41,172 -41,172 -44))', 4326))`,
+		`{"op":"s_contains","args":[{"type":"Polygon","coordinates":[[[172,-44],[175,-44],[175,-41],[172,-44]]]},{"property":"origin_geom"}]}`: `ST_Contains(ST_GeomFromText('POLYGON((172 -44,175 -44,175 -41,172 -44))', 4326), origin_geom)`,
+		`{"op":"t_after","args":[{"property":"origintime"},{"timestamp":"2016-01-01T00:00:00Z"}]}`:                                             `origintime > '2016-01-01T00:00:00Z'::timestamptz`,
+		`{"op":"t_during","args":[{"property":"origintime"},{"interval":["2016-01-01",".."]}]}`:                                                `origintime > '2016-01-01'::timestamptz`,
+		`{"op":"=","args":[{"op":"casei","args":[{"property":"magnitudetype"}]},{"op":"casei","args":["ML"]}]}`:                                `lower(magnitudetype) = lower('ML'::text)`,
+		`{"op":"in","args":[{"property":"eventtype"},["earthquake","quarry blast"]]}`:                                                          `eventtype IN ('earthquake', 'quarry blast')`,
+		`{"op":"not","args":[{"op":"isNull","args":[{"property":"depth"}]}]}`:                                                                  `NOT (depth IS NULL)`,
+		`{"op":"between","args":[{"op":"*","args":[{"property":"depth"},1000]},5000,10000]}`:                                                   `(depth * 1000) BETWEEN 5000 AND 10000`,
+		`{"op":"like","args":[{"property":"publicid"},"2016%"]}`:                                                                               `publicid LIKE '2016%'`,
+	}
+	for cqlString, expected := range tests {
+		f, err := parseFilterLang(cqlString, "cql2-json", featureLayers[0])
+		if err != nil || cql2Sql(f) != expected {
+			t.Errorf("%s: expected %s got %v", cqlString, expected, err)
+			if f != nil {
+				t.Errorf("got %s", cql2Sql(f))
+			}
+		}
+	}
+
+	for _, cqlString := range []string{
+		`{"op":"and","args":[{"op":">=","args":[{"property":"magnitude"},4]}]}`,
+		`{"op":"=","args":[{"property":"magnitude;drop table x"},4]}`,
+		`{"op":"pg_sleep","args":[10]}`,
+		`{"op":"=","args":[{"op":"pg_sleep","args":[10]},1]}`,
+		`{"op":"s_intersects","args":[{"property":"origin_geom"},{"type":"Polygon","coordinates":[[[172,-44],[175,-44],[175,-41]]]}]}`,
+		`{"op":"s_intersects","args":[{"property":"origin_geom"},{"type":"Point","coordinates":[175,-41,10]}]}`,
+		`{"op":"t_after","args":[{"property":"origintime"},{"interval":["..",".."]}]}`,
+		`{"op":">","args":[{"property":"magnitude"},4]} {}`,
+		`{"op":">","args":[{"property":"magnitude"}`,
+	} {
+		if f, err := parseFilterLang(cqlString, "cql2-json", featureLayers[0]); err == nil {
+			t.Errorf("expected error for %s, got %s", cqlString, cql2Sql(f))
+		}
+	}
+
+	if _, err := parseFilterLang(`magnitude > 4`, "ecql", featureLayers[0]); err == nil {
+		t.Error("expected error for an unknown filter-lang")
+	}
+}
+
+func TestGetQueryFilter(t *testing.T) {
+	params := &QueryParams{
+		cqlFilter:  "magnitude > 4 OR depth < 10",
+		filter:     `{"op":"t_after","args":[{"property":"origintime"},{"timestamp":"2016-01-01"}]}`,
+		filterLang: "cql2-json",
+	}
+	f, err := getQueryFilter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql := cql2Sql(f); sql != `(magnitude > 4 OR depth < 10) AND origintime > '2016-01-01'::timestamptz` {
+		t.Errorf("got %s", sql)
+	}
+
+	if _, err := getQueryFilter(&QueryParams{filterLang: "cql2-text"}); err == nil {
+		t.Error("expected error for filter-lang without a filter")
+	}
+}
+
+func TestFeatureIdParams(t *testing.T) {
+	tests := map[string]string{
+		"featureID=quake.2016p123456":                     `publicid = '2016p123456'`,
+		"resourceId=quake.2016p123456,quake.2016p654321":  `publicid IN ('2016p123456', '2016p654321')`,
+		"featureID=quake.2016p123456&cql_filter=depth<10": `depth < 10 AND publicid = '2016p123456'`,
+	}
+	for query, expected := range tests {
+		v, _ := url.ParseQuery(query)
+		params, _ := getQueryParams(v)
+		f, err := getQueryFilter(params)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if sql := cql2Sql(f); sql != expected {
+			t.Errorf("%s: expected %s got %s", query, expected, sql)
+		}
+	}
+
+	v, _ := url.ParseQuery("featureID=station.WEL")
+	params, _ := getQueryParams(v)
+	if _, err := getQueryFilter(params); err == nil {
+		t.Error("expected error for a feature id of another type")
+	}
+
+	for _, path := range []string{"/quake/", "/quake/2016p123456/origin", "/quake/2016p123456?maxFeatures=1"} {
+		r, _ := http.NewRequest("GET", path, nil)
+		if res := getQuake(r, http.Header{}, nil); res.code != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request got %d", path, res.code)
+		}
+	}
+}
+
+func TestBBoxParam(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		bounds   string
+	}{
+		{"bbox=174,-42,175,-41&cql_filter=magnitude>4",
+			`magnitude > 4 AND ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)`, "174,-42,175,-41"},
+		{"BBOX=-42,174,-41,175,urn:ogc:def:crs:EPSG::4326&version=2.0.0",
+			`ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)`, "174,-42,175,-41"},
+		{"bbox=174,-42,175,-41,urn:ogc:def:crs:EPSG::4326&version=1.0.0",
+			`ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)`, "174,-42,175,-41"},
+		{"bbox=1500000,5300000,1600000,5400000,EPSG:2193&cql_filter=BBOX(origin_geom,170,-45,178,-40)",
+			`ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(170 -45,178 -40)'::geometry),4326),origin_geom) AND ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(1500000, 5300000, 1600000, 5400000, 2193), 10000), 4326), origin_geom)`, "170,-45,178,-40"},
+	}
+	for _, test := range tests {
+		v, _ := url.ParseQuery(test.query)
+		params, err := getQueryParams(v)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		f, err := getQueryFilter(params)
+		if err != nil || cql2Sql(f) != test.expected || params.bbox != test.bounds {
+			t.Errorf("%s: expected %s %s got %v %s %v", test.query, test.expected, test.bounds, f, params.bbox, err)
+		}
+	}
+
+	for _, query := range []string{"bbox=174,-42,175", "bbox=174,-42,175,-41,EPSG:27200", "bbox=174,-41,175,-42"} {
+		v, _ := url.ParseQuery(query)
+		if _, err := getQueryParams(v); err == nil {
+			t.Errorf("expected error for %s", query)
+		}
+	}
+}
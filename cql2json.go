@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/**
+ * CQL2-JSON filters, e.g.
+ * {"op":"and","args":[
+ *   {"op":">=","args":[{"property":"magnitude"},4]},
+ *   {"op":"s_intersects","args":[{"property":"origin_geom"},{"type":"Point","coordinates":[175,-41]}]},
+ *   {"op":"t_after","args":[{"property":"origintime"},{"timestamp":"2016-01-01T00:00:00Z"}]}]}
+ */
+func ParseCql2Json(data []byte) (filterNode, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.New("invalid CQL2-JSON, " + err.Error())
+	}
+	if d.More() {
+		return nil, errors.New("invalid CQL2-JSON, unexpected data after the filter")
+	}
+	return parseCql2JsonFilter(v)
+}
+
+// cql2JsonOp returns the lower case op and the args of {"op":"...","args":[...]}
+func cql2JsonOp(v interface{}) (string, []interface{}, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("invalid CQL2-JSON, expecting an {\"op\":...,\"args\":[...]} object, found %v", v)
+	}
+	op, ok := m["op"].(string)
+	if !ok {
+		return "", nil, errors.New("invalid CQL2-JSON, missing op")
+	}
+	args, ok := m["args"].([]interface{})
+	if !ok && m["args"] != nil {
+		return "", nil, errors.New("invalid CQL2-JSON, the args of " + op + " should be an array")
+	}
+	return strings.ToLower(op), args, nil
+}
+
+func parseCql2JsonFilter(v interface{}) (filterNode, error) {
+	op, args, err := cql2JsonOp(v)
+	if err != nil {
+		return nil, err
+	}
+	argCount := map[string]int{"not": 1, "isnull": 1, "like": 2, "in": 2, "between": 3}
+	if n, ok := argCount[op]; ok && len(args) != n {
+		return nil, fmt.Errorf("invalid CQL2-JSON, %s takes %d args", op, n)
+	}
+
+	switch op {
+	case "and", "or":
+		if len(args) < 2 {
+			return nil, errors.New("invalid CQL2-JSON, " + op + " takes at least 2 args")
+		}
+		f := &logicFilter{op: strings.ToUpper(op)}
+		for _, arg := range args {
+			child, err := parseCql2JsonFilter(arg)
+			if err != nil {
+				return nil, err
+			}
+			f.children = append(f.children, child)
+		}
+		return f, nil
+	case "not":
+		child, err := parseCql2JsonFilter(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{child: child}, nil
+	case "isnull":
+		expr, err := parseCql2JsonExpr(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &nullFilter{expr: expr}, nil
+	case "like":
+		exprs, err := parseCql2JsonExprs(args)
+		if err != nil {
+			return nil, err
+		}
+		return &likeFilter{expr: exprs[0], pattern: exprs[1]}, nil
+	case "between":
+		exprs, err := parseCql2JsonExprs(args)
+		if err != nil {
+			return nil, err
+		}
+		return &betweenFilter{expr: exprs[0], lower: exprs[1], upper: exprs[2]}, nil
+	case "in":
+		list, ok := args[1].([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, errors.New("invalid CQL2-JSON, the second arg of in should be a list of values")
+		}
+		expr, err := parseCql2JsonExpr(args[0])
+		if err != nil {
+			return nil, err
+		}
+		values, err := parseCql2JsonExprs(list)
+		if err != nil {
+			return nil, err
+		}
+		return &inFilter{expr: expr, values: values}, nil
+	}
+
+	if relationOps[op] != "" && op != "==" && op != "!=" {
+		if len(args) != 2 {
+			return nil, errors.New("invalid CQL2-JSON, " + op + " takes 2 args")
+		}
+		exprs, err := parseCql2JsonExprs(args)
+		if err != nil {
+			return nil, err
+		}
+		return &comparisonFilter{op: op, left: exprs[0], right: exprs[1]}, nil
+	}
+	if cql2TokenType(op) == TT_SPATIAL {
+		return parseCql2JsonSpatial(op, args)
+	}
+	if cql2TokenType(op) == TT_TEMPORAL {
+		return parseCql2JsonTemporal(op, args)
+	}
+	return nil, errors.New("invalid CQL2-JSON, unknown operator " + op)
+}
+
+func parseCql2JsonExprs(args []interface{}) ([]filterNode, error) {
+	exprs := make([]filterNode, len(args))
+	for i, arg := range args {
+		e, err := parseCql2JsonExpr(arg)
+		if err != nil {
+			return nil, err
+		}
+		exprs[i] = e
+	}
+	return exprs, nil
+}
+
+// parseCql2JsonExpr parses a value, {"property":...}, {"timestamp":...}, {"date":...} or an arithmetic or function op
+func parseCql2JsonExpr(v interface{}) (filterNode, error) {
+	switch val := v.(type) {
+	case string:
+		return &literalExpr{value: val}, nil
+	case bool:
+		return &literalExpr{value: val}, nil
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return &literalExpr{value: i}, nil
+		}
+		f, err := val.Float64()
+		if err != nil {
+			return nil, errors.New("invalid CQL2-JSON number " + val.String())
+		}
+		return &literalExpr{value: f}, nil
+	case map[string]interface{}:
+		if p, ok := val["property"]; ok {
+			name, _ := p.(string)
+			return newPropertyExpr(name)
+		}
+		for _, key := range []string{"timestamp", "date"} {
+			if t, ok := val[key]; ok {
+				s, _ := t.(string)
+				if !PatternMatch(ISO_TIME_PATTERN, s) {
+					return nil, fmt.Errorf("invalid CQL2-JSON %s %v", key, t)
+				}
+				return &timeExpr{value: s}, nil
+			}
+		}
+		if _, ok := val["op"]; ok {
+			op, args, err := cql2JsonOp(val)
+			if err != nil {
+				return nil, err
+			}
+			exprs, err := parseCql2JsonExprs(args)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "+", "-", "*", "/":
+				if len(exprs) != 2 {
+					return nil, errors.New("invalid CQL2-JSON, " + op + " takes 2 args")
+				}
+				return newArithmeticExpr(op, exprs[0], exprs[1])
+			}
+			return newFunctionExpr(op, exprs)
+		}
+	}
+	return nil, fmt.Errorf("invalid CQL2-JSON, expecting a property, value or function, found %v", v)
+}
+
+/**
+ * {"op":"s_within","args":[{"property":"origin_geom"},{"bbox":[172,-44,175,-41]}]},
+ * the geometry is GeoJSON or a bbox.
+ */
+func parseCql2JsonSpatial(op string, args []interface{}) (filterNode, error) {
+	if len(args) != 2 {
+		return nil, errors.New("invalid CQL2-JSON, " + op + " takes 2 args")
+	}
+	geometryFirst := false
+	property, ok := cql2JsonProperty(args[0])
+	geomArg := args[1]
+	if !ok {
+		geometryFirst = true
+		property, ok = cql2JsonProperty(args[1])
+		geomArg = args[0]
+	}
+	if !ok {
+		return nil, errors.New("invalid CQL2-JSON, " + op + " needs a geometry property and a geometry")
+	}
+	geom, err := parseCql2JsonGeometry(geomArg)
+	if err != nil {
+		return nil, err
+	}
+	f := newSpatialFilter(strings.ToUpper(op[2:]), property, geom)
+	f.geometryFirst = geometryFirst
+	return f, nil
+}
+
+func cql2JsonProperty(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := m["property"].(string)
+	return name, ok && IsPropertyName(name)
+}
+
+func parseCql2JsonGeometry(v interface{}) (*Geometry, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid CQL2-JSON geometry %v", v)
+	}
+	if bbox, ok := m["bbox"].([]interface{}); ok && m["type"] == nil {
+		coords := make([]float64, len(bbox))
+		for i, c := range bbox {
+			n, ok := c.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("invalid CQL2-JSON bbox %v", bbox)
+			}
+			coords[i], _ = n.Float64()
+		}
+		return newBBoxGeometry(coords)
+	}
+
+	typ, _ := m["type"].(string)
+	g := &Geometry{Type: strings.ToUpper(typ)}
+	var err error
+	switch g.Type {
+	case WKT_POINT:
+		var c Coord
+		c, err = geoJsonCoord(m["coordinates"])
+		g.Rings = [][]Coord{{c}}
+	case WKT_LINESTRING, WKT_MULTIPOINT:
+		var line []Coord
+		line, err = geoJsonCoords(m["coordinates"])
+		if g.Type == WKT_LINESTRING {
+			g.Rings = [][]Coord{line}
+		}
+		for _, c := range line {
+			g.Parts = append(g.Parts, &Geometry{Type: WKT_POINT, Rings: [][]Coord{{c}}})
+		}
+	case WKT_POLYGON, WKT_MULTILINESTRING:
+		var rings [][]Coord
+		rings, err = geoJsonRings(m["coordinates"])
+		if g.Type == WKT_POLYGON {
+			g.Rings = rings
+		}
+		for _, ring := range rings {
+			g.Parts = append(g.Parts, &Geometry{Type: WKT_LINESTRING, Rings: [][]Coord{ring}})
+		}
+	case WKT_MULTIPOLYGON:
+		polygons, ok := m["coordinates"].([]interface{})
+		if !ok {
+			err = errors.New("invalid CQL2-JSON MultiPolygon coordinates")
+		}
+		for _, p := range polygons {
+			var rings [][]Coord
+			if rings, err = geoJsonRings(p); err != nil {
+				break
+			}
+			g.Parts = append(g.Parts, &Geometry{Type: WKT_POLYGON, Rings: rings})
+		}
+	default:
+		return nil, fmt.Errorf("invalid CQL2-JSON, unsupported geometry %v", v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.Type != WKT_MULTIPOINT && g.Type != WKT_MULTILINESTRING && g.Type != WKT_MULTIPOLYGON {
+		g.Parts = nil
+	}
+	//validate the rings and coordinate counts
+	return ParseWkt(g.String())
+}
+
+func geoJsonCoord(v interface{}) (Coord, error) {
+	c, ok := v.([]interface{})
+	if !ok || len(c) != 2 {
+		return Coord{}, fmt.Errorf("invalid CQL2-JSON coordinate %v, only 2D coordinates are supported", v)
+	}
+	x, ok1 := c[0].(json.Number)
+	y, ok2 := c[1].(json.Number)
+	if !ok1 || !ok2 {
+		return Coord{}, fmt.Errorf("invalid CQL2-JSON coordinate %v", v)
+	}
+	xf, err1 := x.Float64()
+	yf, err2 := y.Float64()
+	if err1 != nil || err2 != nil {
+		return Coord{}, fmt.Errorf("invalid CQL2-JSON coordinate %v", v)
+	}
+	return Coord{xf, yf}, nil
+}
+
+func geoJsonCoords(v interface{}) ([]Coord, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("invalid CQL2-JSON coordinates %v", v)
+	}
+	coords := make([]Coord, len(list))
+	for i, c := range list {
+		var err error
+		if coords[i], err = geoJsonCoord(c); err != nil {
+			return nil, err
+		}
+	}
+	return coords, nil
+}
+
+func geoJsonRings(v interface{}) ([][]Coord, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("invalid CQL2-JSON coordinates %v", v)
+	}
+	rings := make([][]Coord, len(list))
+	for i, r := range list {
+		var err error
+		if rings[i], err = geoJsonCoords(r); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+/**
+ * {"op":"t_during","args":[{"property":"origintime"},{"interval":["2016-01-01","2016-02-01"]}]},
+ * the interval ends are ISO 8601 strings, ".." for open, or timestamp or date objects.
+ */
+func parseCql2JsonTemporal(op string, args []interface{}) (filterNode, error) {
+	if len(args) != 2 {
+		return nil, errors.New("invalid CQL2-JSON, " + op + " takes 2 args")
+	}
+	expr, err := parseCql2JsonExpr(args[0])
+	if err != nil {
+		return nil, err
+	}
+	m, ok := args[1].(map[string]interface{})
+	interval, isInterval := m["interval"].([]interface{})
+	if !ok || !isInterval {
+		instant, err := parseCql2JsonExpr(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return newCql2TemporalFilter(op, expr, instant, nil, false)
+	}
+	if len(interval) != 2 {
+		return nil, errors.New("invalid CQL2-JSON, an interval has a start and an end")
+	}
+	ends := make([]filterNode, 2)
+	for i, end := range interval {
+		if s, ok := end.(string); ok {
+			if s == CQL2_OPEN_END {
+				continue
+			}
+			if !PatternMatch(ISO_TIME_PATTERN, s) {
+				return nil, errors.New("invalid CQL2-JSON interval time " + s)
+			}
+			ends[i] = &timeExpr{value: s}
+		} else if ends[i], err = parseCql2JsonExpr(end); err != nil {
+			return nil, err
+		}
+	}
+	return newCql2TemporalFilter(op, expr, ends[0], ends[1], true)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,10 +17,19 @@ import (
 const (
 	DATE_PATTERN      = "(\\d{4})-(\\d{1,2})-(\\d{1,2})"
 	DATE_TIME_PATTERN = "(\\d{4})-(\\d{1,2})-(\\d{1,2})T(\\d{1,2}):(\\d{1,2}):(\\d{1,2})"
+	//a whole ISO 8601 date or date time, e.g. 2016-04-12, 2016-04-12T22:00:00.5Z, 2016-04-12T22:00:00+12:00
+	ISO_TIME_PATTERN = "^\\d{4}-\\d{1,2}-\\d{1,2}([T ]\\d{1,2}:\\d{1,2}(:\\d{1,2}(\\.\\d+)?)?)?(Z|[+-]\\d{2}(:?\\d{2})?)?$"
+	//an ISO 8601 duration, e.g. P7D, P1M, PT12H, P1Y2M3DT4H5M6S
+	ISO_DURATION_PATTERN = "^P(\\d+Y)?(\\d+M)?(\\d+W)?(\\d+D)?(T(\\d+H)?(\\d+M)?(\\d+(\\.\\d+)?S)?)?$"
+	//an unquoted date time or number at the start of the remaining CQL, the - and + in them aren't arithmetic
+	TIME_PREFIX_PATTERN   = "^\\d{4}-\\d{1,2}-\\d{1,2}(T\\d{1,2}:\\d{1,2}(:\\d{1,2}(\\.\\d+)?)?)?(Z|[+-]\\d{2}(:?\\d{2})?)?"
+	NUMBER_PREFIX_PATTERN = "^(\\d+(\\.\\d*)?|\\.\\d+)([eE][-+]?\\d+)?"
+	//the widest longitude accepted, beyond both the -180..180 and the 0–360 conventions
+	MAX_LONGITUDE = 540
 	//token types
 	TT_EOF          = -1
 	TT_WORD         = -3
-	TT_STRING       = 999  // quoted string
+	TT_STRING       = 999  // single quoted string, 'quarry blast'
 	TT_SORTBY       = 1008 // The "sortby" operator
 	TT_PARENTHESIS  = 1100 //()
 	TT_LOGIC_OPS    = 1101 //and or
@@ -27,6 +38,12 @@ const (
 	TT_BBOX         = 1104 //BBOX(origin_geom,174,-41,175,-42)
 	TT_WITHIN       = 1105 //WITHIN(origin_geom,POLYGON((172.951 -41.767, 172.001 -42.832, 169.564 -44.341,+172.312 -45.412, 175.748 -42.908, 172.951 -41.767)))
 	TT_DWITHIN      = 1106 //DWITHIN(origin_geom,Point+(175+-41),0.5,feet)
+	TT_SPATIAL      = 1107 //INTERSECTS, CONTAINS, DISJOINT, CROSSES, OVERLAPS, TOUCHES, EQUALS, RELATE
+	TT_BEYOND       = 1108 //BEYOND(origin_geom,POINT(175 -41),50,kilometers)
+	TT_COMPARE_OPS  = 1109 //between, in, like, ilike, is
+	TT_COMMA        = 1110 //,
+	TT_ARITH_OPS    = 1111 //+ - * /, the / also separates a time period, 2016-01-01/P1M
+	TT_TEMPORAL     = 1112 //before, after, during, tequals
 )
 
 type CqlConverter struct {
@@ -35,6 +52,8 @@ type CqlConverter struct {
 	currentIndex     int    //current index in the cqlCharArray
 	currentTokenType int    //current token type in the CQL string
 	currentToken     string //current token in the CQL
+	tokenErr         error  //error found by the tokenizer, e.g. an unterminated string
+	cql2             bool   //OGC CQL2 text, S_INTERSECTS, T_AFTER... instead of the ECQL predicates
 	BBOX             string
 }
 
@@ -77,6 +96,18 @@ func (cql *CqlConverter) Render() string {
 		ret = "relation"
 	case TT_DWITHIN:
 		ret = "dwithin"
+	case TT_SPATIAL:
+		ret = "spatial"
+	case TT_BEYOND:
+		ret = "beyond"
+	case TT_COMPARE_OPS:
+		ret = "compare"
+	case TT_COMMA:
+		ret = "comma"
+	case TT_ARITH_OPS:
+		ret = "arithmetic"
+	case TT_TEMPORAL:
+		ret = "temporal"
 	case TT_TIMESTRING:
 		ret = "time"
 	case TT_WORD:
@@ -94,7 +125,7 @@ func (cql *CqlConverter) Render() string {
 
 /**
  * move to next token, update token and type
- * token separators: "()/<>= \t\r\n"
+ * token separators: "()/+-*<>=!,'\" \t\r\n"
  */
 func (cql *CqlConverter) NextToken() {
 	//eat whitespace
@@ -117,6 +148,14 @@ func (cql *CqlConverter) NextToken() {
 		cql.currentTokenType = TT_PARENTHESIS
 		cql.currentToken = c
 		cql.currentIndex++
+	} else if "," == c {
+		cql.currentTokenType = TT_COMMA
+		cql.currentToken = c
+		cql.currentIndex++
+	} else if SearchStringInString("+-*/", c) {
+		cql.currentTokenType = TT_ARITH_OPS
+		cql.currentToken = c
+		cql.currentIndex++
 		//2. comparitor
 	} else if SearchStringInString("<>=!", c) {
 		cql.currentIndex++
@@ -136,74 +175,118 @@ func (cql *CqlConverter) NextToken() {
 			}
 		}
 		if !twoCharOps { //single char ops
+			cql.currentToken = c
 			if SearchStringInString("<>=", c) {
-				cql.currentToken = c
 				cql.currentTokenType = TT_RELATION_OPS
-			} else { //only the ! char
-				cql.currentIndex--
+			} else { //only the ! char, rejected by the parser
+				cql.currentTokenType = TT_WORD
 			}
 		}
-		//3. quoted string
-	} else if SearchStringInString("\"", c) { //no single-quotes
-		cql.currentTokenType = TT_STRING
+		//3. quoted string, 'string literal' or "property name", a quote char is escaped by doubling it
+	} else if SearchStringInString("'\"", c) {
 		//remember quote char
 		mark := c
 		cql.currentIndex++
-		escaped := false
+		terminated := false
 
 		buf.Reset() //reset buffer
 		for cql.currentIndex < cql.cqlLen {
-			if !escaped && (string(cql.cqlCharArray[cql.currentIndex]) == mark) { //terminator
-				break
-			}
-			if escaped && SearchStringInString("*?^\\", string(cql.cqlCharArray[cql.currentIndex])) { //no escaping for d-quote
-				buf.WriteString("\\")
-			}
-			if !escaped && string(cql.cqlCharArray[cql.currentIndex]) == "\\" { //escape-char
-				escaped = true
-				cql.currentIndex++
-				continue
-			}
-			escaped = false //reset escape
-			buf.WriteString(string(cql.cqlCharArray[cql.currentIndex]))
+			d := string(cql.cqlCharArray[cql.currentIndex])
 			cql.currentIndex++
+			if d == mark {
+				if cql.currentIndex < cql.cqlLen && string(cql.cqlCharArray[cql.currentIndex]) == mark { //escaped quote
+					cql.currentIndex++
+				} else { //terminator
+					terminated = true
+					break
+				}
+			}
+			buf.WriteString(d)
 		}
 		cql.currentToken = buf.String()
-		lval = strings.ToLower(cql.currentToken)
-		if cql.currentIndex < cql.cqlLen {
-			cql.currentIndex++
-		} else { //unterminated
+		if !terminated {
 			cql.currentTokenType = TT_EOF //notify error
+			cql.tokenErr = errors.New("unterminated quoted string " + mark + cql.currentToken)
+		} else if mark == "\"" {
+			cql.currentTokenType = TT_WORD
+		} else if PatternMatch(ISO_TIME_PATTERN, cql.currentToken) {
+			cql.currentTokenType = TT_TIMESTRING
+		} else {
+			cql.currentTokenType = TT_STRING
 		}
-	} else { //4. WORD, including: logic ops, bbox, within, dwithin, timestring
+	} else if prefix := numberPrefix(cql.cqlCharArray[cql.currentIndex:]); prefix != "" {
+		//4. unquoted date time or number, 2016-04-12T22:00:00Z, 1.5e-3
+		cql.currentToken = prefix
+		cql.currentIndex += len(prefix)
+		cql.currentTokenType = TT_WORD
+		if PatternMatch(ISO_TIME_PATTERN, prefix) {
+			cql.currentTokenType = TT_TIMESTRING
+		}
+	} else { //5. WORD, including: logic ops, bbox, within, dwithin
 		cql.currentTokenType = TT_WORD
 		buf.Reset() //reset buffer
-		for cql.currentIndex < cql.cqlLen && !SearchStringInString("()/<>= \t\r\n", string(cql.cqlCharArray[cql.currentIndex])) {
+		for cql.currentIndex < cql.cqlLen && !SearchStringInString("()+-*/<>=!,'\" \t\r\n", string(cql.cqlCharArray[cql.currentIndex])) {
 			buf.WriteString(string(cql.cqlCharArray[cql.currentIndex]))
 			cql.currentIndex++
 		}
 		cql.currentToken = buf.String()
 		lval = strings.ToLower(cql.currentToken)
-		//strip leading and tailing single quotes
-		stripVal := strings.TrimLeft(cql.currentToken, "'")
-		stripVal = strings.TrimRight(stripVal, "'")
 
 		if lval == "or" || lval == "and" || lval == "not" {
 			cql.currentTokenType = TT_LOGIC_OPS
+		} else if lval == "between" || lval == "in" || lval == "like" || lval == "ilike" || lval == "is" {
+			cql.currentTokenType = TT_COMPARE_OPS
+		} else if cql.cql2 {
+			cql.currentTokenType = cql2TokenType(lval)
+		} else if lval == "before" || lval == "after" || lval == "during" || lval == "tequals" {
+			cql.currentTokenType = TT_TEMPORAL
 		} else if lval == "bbox" {
 			cql.currentTokenType = TT_BBOX
 		} else if lval == "within" {
 			cql.currentTokenType = TT_WITHIN
 		} else if lval == "dwithin" {
 			cql.currentTokenType = TT_DWITHIN
+		} else if lval == "beyond" {
+			cql.currentTokenType = TT_BEYOND
+		} else if spatialFunctions[lval] != "" {
+			cql.currentTokenType = TT_SPATIAL
 		} else if lval == "sortby" {
 			cql.currentTokenType = TT_SORTBY
-		} else if PatternMatch(DATE_PATTERN, stripVal) || PatternMatch(DATE_TIME_PATTERN, stripVal) {
-			cql.currentTokenType = TT_TIMESTRING
 		}
 	}
 }
 
+var (
+	timePrefixRegexp   = regexp.MustCompile(TIME_PREFIX_PATTERN)
+	numberPrefixRegexp = regexp.MustCompile(NUMBER_PREFIX_PATTERN)
+)
+
+// numberPrefix returns the date time or number the remaining CQL starts with, if any
+func numberPrefix(rest []rune) string {
+	s := string(rest)
+	if prefix := timePrefixRegexp.FindString(s); prefix != "" {
+		return prefix
+	}
+	return numberPrefixRegexp.FindString(s)
+}
+
+type cqlState struct {
+	index     int
+	tokenType int
+	token     string
+	tokenErr  error
+	bbox      string
+}
+
+// saveState and restoreState let the parser look ahead and back track
+func (cql *CqlConverter) saveState() cqlState {
+	return cqlState{cql.currentIndex, cql.currentTokenType, cql.currentToken, cql.tokenErr, cql.BBOX}
+}
+
+func (cql *CqlConverter) restoreState(s cqlState) {
+	cql.currentIndex, cql.currentTokenType, cql.currentToken, cql.tokenErr, cql.BBOX = s.index, s.tokenType, s.token, s.tokenErr, s.bbox
+}
+
 /**
   *sql:
   *  BBOX(origin_geom,174,-41,175,-42)
@@ -212,54 +295,133 @@ func (cql *CqlConverter) NextToken() {
   * @param sql
 */
 func (cql *CqlConverter) ToBBoxSql(sql *bytes.Buffer) error {
-	token := cql.currentToken //bbox
-	//log.Println("token1 " + token)
-	cql.NextToken()
-
-	if cql.currentTokenType != TT_PARENTHESIS {
-		//log.Fatalln("Error, not valid bbox!!")
-		return errors.New("not valid bbox!!")
+	f, err := cql.parseBBox()
+	if err != nil {
+		return err
 	}
-	tokens := make([]string, 0)
+	return writeInlineSql(sql, f)
+}
 
-	for ")" != cql.currentToken { //move until the close parenthesis
-		cql.NextToken()
-		token = cql.currentToken // origin_geom,174,-41,175,-42
-		//log.Println("token2 " + token)
-		if ")" != token {
-			for _, value := range strings.Split(token, ",") {
-				if value != "" {
-					tokens = append(tokens, value)
-				}
-			}
+func (cql *CqlConverter) parseBBox() (*bboxFilter, error) {
+	args, err := cql.readArguments("bbox")
+	if err != nil {
+		return nil, err
+	}
+	srid, latLon := SRID_WGS84, false
+	if len(args) == 6 { //optional crs, latitude first for the urn of EPSG:4326
+		crs := strings.Trim(args[5], "'\"")
+		if srid, latLon, err = parseCrs(crs); err != nil {
+			return nil, errors.New("not valid bbox, unsupported crs " + crs)
 		}
+		args = args[:5]
+	}
+	if len(args) != 5 {
+		return nil, errors.New("not valid bbox, expecting BBOX(geometry,minx,miny,maxx,maxy)!!")
 	}
+	if !IsPropertyName(args[0]) {
+		return nil, errors.New("not valid bbox, invalid geometry property " + args[0])
+	}
+	coords, err := parseCoordinates(args[1:])
+	if err != nil {
+		return nil, errors.New("not valid bbox, " + err.Error())
+	}
+	if latLon {
+		coords = []float64{coords[1], coords[0], coords[3], coords[2]}
+	}
+	if !isWgs84(srid) {
+		return &bboxFilter{property: args[0], minx: coords[0], miny: coords[1], maxx: coords[2], maxy: coords[3], srid: srid}, nil
+	}
+	if err := checkLongitudes(coords[0], coords[2]); err != nil {
+		return nil, errors.New("not valid bbox, " + err.Error())
+	}
+	minx, miny, maxx, maxy := normaliseBBox(coords[0], coords[1], coords[2], coords[3])
+	//keep the bbox string for later user
+	cql.BBOX = formatCoord(minx) + "," + formatCoord(miny) + "," + formatCoord(maxx) + "," + formatCoord(maxy)
+	return &bboxFilter{property: args[0], minx: minx, miny: miny, maxx: maxx, maxy: maxy}, nil
+}
 
-	//log.Println("## tokens", len(tokens))
+/**
+ * write the sql for a bbox, a box with minx > maxx crosses the antimeridian (e.g. 170,-40,-175,-30)
+ * and is split into two envelopes either side of 180°
+ */
+func writeBBoxSql(sql *bytes.Buffer, geom string, minx, miny, maxx, maxy float64) {
+	if minx <= maxx {
+		writeEnvelopeSql(sql, geom, minx, miny, maxx, maxy)
+		return
+	}
+	sql.WriteString("(")
+	writeEnvelopeSql(sql, geom, minx, miny, 180, maxy)
+	sql.WriteString(" OR ")
+	writeEnvelopeSql(sql, geom, -180, miny, maxx, maxy)
+	sql.WriteString(")")
+}
+
+func writeEnvelopeSql(sql *bytes.Buffer, geom string, minx, miny, maxx, maxy float64) {
+	sql.WriteString("ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(")
+	sql.WriteString(formatCoord(minx))
+	sql.WriteString(" ")
+	sql.WriteString(formatCoord(miny))
+	sql.WriteString(",")
+	sql.WriteString(formatCoord(maxx))
+	sql.WriteString(" ")
+	sql.WriteString(formatCoord(maxy))
+	sql.WriteString(")'::geometry),4326),")
+	sql.WriteString(geom)
+	sql.WriteString(")")
+}
 
-	if cql.currentTokenType != TT_PARENTHESIS {
-		//log.Fatal("Error, not valid bbox!!")
-		return errors.New("not valid bbox!!")
+/**
+ * normalise the longitudes of a bbox into -180..180, a box that covers
+ * 360° or more of longitude becomes the whole world.
+ */
+func normaliseBBox(minx, miny, maxx, maxy float64) (float64, float64, float64, float64) {
+	if maxx-minx >= 360 {
+		return -180, miny, 180, maxy
 	}
-	//String[] bboxContents = token3.split("[, ]+");
-	if len(tokens) == 5 {
-		sql.WriteString("ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(")
-		sql.WriteString(tokens[1])
-		sql.WriteString(" ")
-		sql.WriteString(tokens[2])
-		sql.WriteString(",")
-		sql.WriteString(tokens[3])
-		sql.WriteString(" ")
-		sql.WriteString(tokens[4])
-		sql.WriteString(")'::geometry),4326),")
-		sql.WriteString(tokens[0])
-		sql.WriteString(")")
-		//keep the bbox string for later user
-		cql.BBOX = tokens[1] + "," + tokens[2] + "," + tokens[3] + "," + tokens[4]
+	return normaliseLongitude(minx), miny, normaliseLongitude(maxx), maxy
+}
+
+/**
+ * longitudes in the 0–360 convention (e.g. 185) are mapped back into -180..180
+ */
+func normaliseLongitude(lon float64) float64 {
+	//math.Mod is exact, so a longitude such as 182.1 still becomes -177.9
+	lon = math.Mod(lon, 360)
+	if lon > 180 {
+		lon -= 360
+	} else if lon < -180 {
+		lon += 360
+	}
+	return lon
+}
+
+// checkLongitudes rejects a longitude beyond MAX_LONGITUDE, which no longitude convention reaches
+func checkLongitudes(lons ...float64) error {
+	for _, lon := range lons {
+		if lon < -MAX_LONGITUDE || lon > MAX_LONGITUDE {
+			return errors.New("invalid longitude " + formatCoord(lon))
+		}
 	}
 	return nil
 }
 
+// parseCoordinates converts numeric tokens to float64 values
+func parseCoordinates(tokens []string) ([]float64, error) {
+	coords := make([]float64, 0, len(tokens))
+	for _, token := range tokens {
+		val, err := strconv.ParseFloat(strings.TrimSpace(token), 64)
+		if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil, errors.New("invalid coordinate: " + token)
+		}
+		coords = append(coords, val)
+	}
+	return coords, nil
+}
+
+func formatCoord(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
 /**
 * get comma separated tokens between parenthesis
 * (origin_geom,POLYGON((172.951 -41.767,172.001 -42.832,169.564 -44.341,172.312 -45.412,175.748 -42.908,172.951 -41.767)))
@@ -274,6 +436,11 @@ func (cql *CqlConverter) GetParenthesisedTokens() []string {
 	for true {
 		cql.NextToken()
 		token = cql.currentToken // origin_geom,174,-41,175,-42
+		if cql.isToken(TT_ARITH_OPS, "-") || cql.isToken(TT_ARITH_OPS, "+") {
+			//the sign of a number
+			cql.NextToken()
+			token += cql.currentToken
+		}
 		//log.Println("token2 " + token)
 
 		for _, value := range strings.Split(token, ",") {
@@ -297,6 +464,79 @@ func (cql *CqlConverter) GetParenthesisedTokens() []string {
 	return tokens
 }
 
+/**
+ * read the comma separated arguments of a function call, the current token is the function name.
+ * (origin_geom,POLYGON((172.951 -41.767,172.001 -42.832,169.564 -44.341,172.951 -41.767)),5000,meters)
+ * commas inside nested parenthesis or quotes don't separate arguments.
+ */
+func (cql *CqlConverter) readArguments(name string) ([]string, error) {
+	cql.NextToken()
+	if "(" != cql.currentToken {
+		return nil, errors.New("not valid " + name + ", expecting '(' after " + name + "!!")
+	}
+	args := make([]string, 0)
+	var buf bytes.Buffer
+	depth := 1
+	quote := ""
+	for cql.currentIndex < cql.cqlLen {
+		c := string(cql.cqlCharArray[cql.currentIndex])
+		cql.currentIndex++
+		if quote != "" { //inside a quoted string
+			if c == quote {
+				quote = ""
+			}
+			buf.WriteString(c)
+			continue
+		}
+		if SearchStringInString("'\"", c) {
+			quote = c
+		} else if "(" == c {
+			depth++
+		} else if ")" == c {
+			depth--
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(buf.String()))
+				cql.currentTokenType = TT_PARENTHESIS
+				cql.currentToken = c
+				return args, nil
+			}
+		} else if "," == c && depth == 1 {
+			args = append(args, strings.TrimSpace(buf.String()))
+			buf.Reset()
+			continue
+		}
+		buf.WriteString(c)
+	}
+	return nil, errors.New("not valid " + name + ", missing close parenthesis!!")
+}
+
+/**
+ * the binary spatial predicates, ECQL name to PostGIS function.
+ * RELATE takes an extra DE-9IM pattern, e.g. RELATE(origin_geom,POINT(175 -41),'T*F**F***')
+ */
+var spatialFunctions = map[string]string{
+	"intersects": "ST_Intersects",
+	"contains":   "ST_Contains",
+	"disjoint":   "ST_Disjoint",
+	"crosses":    "ST_Crosses",
+	"overlaps":   "ST_Overlaps",
+	"touches":    "ST_Touches",
+	"equals":     "ST_Equals",
+	"within":     "ST_Within",
+	"relate":     "ST_Relate",
+}
+
+// distance units for DWITHIN and BEYOND, in meters
+var distanceUnits = map[string]float64{
+	"meters":         1,
+	"m":              1,
+	"kilometers":     1000,
+	"km":             1000,
+	"feet":           0.3048,
+	"statute miles":  1609.344,
+	"nautical miles": 1852,
+}
+
 /**
   * cql:
   WITHIN(origin_geom,POLYGON((172.951 -41.767,172.001 -42.832,169.564 -44.341,172.312 -45.412,175.748 -42.908,172.951 -41.767)))
@@ -306,63 +546,54 @@ func (cql *CqlConverter) GetParenthesisedTokens() []string {
   * @param sql
 */
 func (cql *CqlConverter) ToWithinSql(sql *bytes.Buffer) error {
-	token := cql.currentToken //within
-	//log.Println("token1 " + token)
-	cql.NextToken()
+	return cql.ToSpatialSql(sql)
+}
 
-	if "(" != cql.currentToken {
-		//log.Fatalln("Error, not valid WITHIN!!")
-		return errors.New("not valid WITHIN!!")
+/**
+ * cql:
+ * INTERSECTS(origin_geom,MULTIPOLYGON(((170 -40,175 -40,175 -45,170 -40)),((176 -38,178 -38,178 -36,176 -38))))
+ * sql:
+ * ST_Intersects(origin_geom, ST_GeomFromText('MULTIPOLYGON(((170 -40,175 -40,175 -45,170 -40)),((176 -38,178 -38,178 -36,176 -38)))', 4326))
+ *
+ * the geometry property and the WKT can be given in either order,
+ * CONTAINS(POLYGON(...),origin_geom) is the same as WITHIN(origin_geom,POLYGON(...)).
+ */
+func (cql *CqlConverter) ToSpatialSql(sql *bytes.Buffer) error {
+	f, err := cql.parseSpatial()
+	if err != nil {
+		return err
 	}
+	return writeInlineSql(sql, f)
+}
 
-	//get all tokens for the WITHIN claus, parse all comma separated tokens
-	tokens := cql.GetParenthesisedTokens()
-	//log.Println((tokens))
-
-	sql.WriteString("ST_Within(")
-	sql.WriteString(tokens[0])
-	sql.WriteString(", ST_GeomFromText('")
-
-	openParenthesis := 0
-	closeParenthesis := 0
-	i := 1 //start from 1
-	numeric := 0
-	//get the polygon contents
-	for i < len(tokens) {
-		token = tokens[i]
-		i++
-		if "(" == token {
-			openParenthesis++
+func (cql *CqlConverter) parseSpatial() (*spatialFilter, error) {
+	name := strings.ToUpper(cql.currentToken)
+	if spatialFunctions[strings.ToLower(name)] == "" {
+		return nil, errors.New("unknown spatial predicate " + name)
+	}
+	args, err := cql.readArguments(name)
+	if err != nil {
+		return nil, err
+	}
+	pattern := ""
+	if name == "RELATE" {
+		if len(args) != 3 {
+			return nil, errors.New("not valid RELATE, expecting RELATE(geometry,WKT,pattern)!!")
 		}
-		if ")" == token {
-			closeParenthesis++
+		pattern = strings.ToUpper(strings.Trim(args[2], "'\""))
+		if !PatternMatch("^[TF*012]{9}$", pattern) {
+			return nil, errors.New("not valid RELATE, invalid DE-9IM pattern " + args[2])
 		}
+	} else if len(args) != 2 {
+		return nil, errors.New("not valid " + name + ", expecting " + name + "(geometry,WKT)!!")
+	}
 
-		if "POLYGON" == strings.ToUpper(token) {
-			sql.WriteString("POLYGON((")
-			numeric = 0
-		}
-		//get the coordinates
-		if openParenthesis == 2 && closeParenthesis == 0 {
-			if PatternMatch("-?[.\\d]+", token) { //numeric
-				numeric++
-				if numeric > 1 {
-					if numeric%2 == 0 {
-						sql.WriteString(" ")
-					} else {
-						sql.WriteString(",")
-					}
-				}
-				sql.WriteString(token)
-			}
-		}
-		//fmt.Printf("openParenthesis %d closeParenthesis %d", openParenthesis, closeParenthesis)
-		if openParenthesis == closeParenthesis && closeParenthesis > 0 {
-			break
-		}
+	f, err := newSpatialFilterFromArgs(name, args[0], args[1])
+	if err != nil {
+		return nil, err
 	}
-	sql.WriteString("))', 4326))")
-	return nil
+	f.pattern = pattern
+	return f, nil
 }
 
 /**
@@ -371,154 +602,650 @@ func (cql *CqlConverter) ToWithinSql(sql *bytes.Buffer) error {
  * sql:
  * ST_DWithin(origin_geom::Geography, ST_GeomFromText('POINT(172.951 -41.767)', 4326)::Geography, 5000)
  *
- * !!!WE ONLY DO METERS!!
+ * BEYOND is the negation: NOT ST_DWithin(...)
+ * units are meters, kilometers, feet, statute miles or nautical miles, the default is meters.
  * @param sql
  */
 func (cql *CqlConverter) ToDWithinSql(sql *bytes.Buffer) error {
-	token := cql.currentToken //within
-	//log.Println("token1 " + token)
+	f, err := cql.parseDistance()
+	if err != nil {
+		return err
+	}
+	return writeInlineSql(sql, f)
+}
+
+func (cql *CqlConverter) parseDistance() (*spatialFilter, error) {
+	name := strings.ToUpper(cql.currentToken)
+	args, err := cql.readArguments(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errors.New("not valid " + name + ", expecting " + name + "(geometry,WKT,distance,units)!!")
+	}
+
+	distance, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || distance < 0 || math.IsInf(distance, 0) {
+		return nil, errors.New("error parsing distance!!")
+	}
+	if len(args) == 4 { //get unit
+		unit, ok := distanceUnits[strings.ToLower(strings.Join(strings.Fields(args[3]), " "))]
+		if !ok {
+			return nil, errors.New("wrong unit for distance, should be in [meters, kilometers, feet, statute miles, nautical miles]!!")
+		}
+		distance = unit * distance
+	}
+
+	f, err := newSpatialFilterFromArgs(name, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	f.distance = distance
+	return f, nil
+}
+
+/**
+ * the two geometry arguments of a spatial predicate, one is a geometry property
+ * and the other a WKT geometry or a named region, REGION('canterbury').
+ */
+func newSpatialFilterFromArgs(name string, arg1 string, arg2 string) (*spatialFilter, error) {
+	geometryFirst := IsWkt(arg1) || isRegionLiteral(arg1)
+	property, wkt := arg1, arg2
+	if geometryFirst {
+		property, wkt = arg2, arg1
+	}
+	if !IsPropertyName(property) {
+		return nil, errors.New("not valid " + name + ", expecting a geometry property and a WKT geometry!!")
+	}
+	geom, err := parseGeometryArg(wkt)
+	if err != nil {
+		return nil, errors.New("not valid " + name + ", " + err.Error())
+	}
+	f := newSpatialFilter(name, property, geom)
+	f.geometryFirst = geometryFirst
+	return f, nil
+}
+
+// IsPropertyName checks s is a plain column name, e.g. origin_geom
+func IsPropertyName(s string) bool {
+	return PatternMatch("^[A-Za-z_][A-Za-z0-9_]*$", s)
+}
+
+// writeInlineSql writes a filter with its literal values quoted in the sql
+func writeInlineSql(sql *bytes.Buffer, f filterNode) error {
+	w := &sqlWriter{inline: true}
+	if err := f.writeSql(w); err != nil {
+		return err
+	}
+	sql.Write(w.Bytes())
+	return nil
+}
+
+/**
+ * parse the CQL into a filter:
+ *
+ * filter    := and {OR and}
+ * and       := not {AND not}
+ * not       := NOT not | primary
+ * primary   := ( filter ) | BBOX(...) | WITHIN(...) | DWITHIN(...) | INTERSECTS(...) ... | predicate
+ * predicate := expr relation expr | expr [NOT] BETWEEN expr AND expr | expr [NOT] IN (expr {, expr})
+ *              | expr [NOT] LIKE expr | expr [NOT] ILIKE expr | expr IS [NOT] NULL
+ * expr      := term {+|- term}
+ * term      := unary {*|/ unary}
+ * unary     := -unary | +unary | factor
+ * factor    := ( expr ) | function(expr {, expr}) | NOW() | property | 'string' | number | true | false | date time
+ *
+ * returns nil for an empty CQL string.
+ */
+func (cql *CqlConverter) Parse() (filterNode, error) {
 	cql.NextToken()
+	if cql.currentTokenType == TT_EOF {
+		return nil, cql.tokenErr
+	}
+	f, err := cql.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if cql.currentTokenType != TT_EOF {
+		return nil, cql.unexpectedToken("the end of the filter")
+	}
+	return f, nil
+}
 
-	if "(" != cql.currentToken {
-		//log.Fatalln("Error, not valid DWITHIN!!")
-		return errors.New("not valid DWITHIN!!")
+func (cql *CqlConverter) unexpectedToken(expecting string) error {
+	if cql.tokenErr != nil {
+		return cql.tokenErr
+	}
+	if cql.currentTokenType == TT_EOF {
+		return errors.New("unexpected end of the filter, expecting " + expecting)
 	}
+	return fmt.Errorf("unexpected %q at position %d, expecting %s", cql.currentToken, cql.currentIndex, expecting)
+}
 
-	//get all tokens for the WITHIN claus, parse all comma separated tokens
-	tokens := cql.GetParenthesisedTokens()
-	//log.Println((tokens))
+// isToken checks the current token is the (case insensitive) keyword or symbol
+func (cql *CqlConverter) isToken(tokenType int, token string) bool {
+	return cql.currentTokenType == tokenType && strings.EqualFold(cql.currentToken, token)
+}
 
-	sql.WriteString("ST_DWithin(")
-	sql.WriteString(tokens[0])
-	sql.WriteString("::Geography, ST_GeomFromText('")
+func (cql *CqlConverter) parseOr() (filterNode, error) {
+	return cql.parseLogic("or", cql.parseAnd)
+}
 
-	openParenthesis := 0
-	closeParenthesis := 0
-	i := 1
-	numeric := 0
-	numParenthesis := 0
-	geom := ""
-	//get the geometry contents
-	for i < len(tokens) {
-		token = tokens[i]
-
-		//log.Println(token)
-		i++
-		if "(" == token {
-			openParenthesis++
+func (cql *CqlConverter) parseAnd() (filterNode, error) {
+	return cql.parseLogic("and", cql.parseNot)
+}
+
+func (cql *CqlConverter) parseLogic(op string, operand func() (filterNode, error)) (filterNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	if !cql.isToken(TT_LOGIC_OPS, op) {
+		return left, nil
+	}
+	f := &logicFilter{op: cql.currentToken, children: []filterNode{left}}
+	for cql.isToken(TT_LOGIC_OPS, op) {
+		cql.NextToken()
+		right, err := operand()
+		if err != nil {
+			return nil, err
 		}
-		if ")" == token {
-			closeParenthesis++
+		f.children = append(f.children, right)
+	}
+	return f, nil
+}
+
+func (cql *CqlConverter) parseNot() (filterNode, error) {
+	if cql.isToken(TT_LOGIC_OPS, "not") {
+		cql.NextToken()
+		child, err := cql.parseNot()
+		if err != nil {
+			return nil, err
 		}
-		//log.Println("token3 " + token)
-		if "POLYGON" == strings.ToUpper(token) || "POLYLINE" == strings.ToUpper(token) || "POINT" == strings.ToUpper(token) {
-			geom = token
-			if "POLYGON" == strings.ToUpper(token) || "POLYLINE" == strings.ToUpper(token) {
-				sql.WriteString(token)
-				sql.WriteString("((")
-				numParenthesis = 2
-			} else if "POINT" == strings.ToUpper(token) {
-				sql.WriteString("POINT(")
-				numParenthesis = 1
+		return &notFilter{child: child}, nil
+	}
+	return cql.parsePrimary()
+}
+
+func (cql *CqlConverter) parsePrimary() (filterNode, error) {
+	var (
+		f   filterNode
+		err error
+	)
+	switch cql.currentTokenType {
+	case TT_PARENTHESIS:
+		if "(" != cql.currentToken {
+			return nil, cql.unexpectedToken("a filter")
+		}
+		//either a nested filter or an expression, (depth * 1000) > 5000
+		state := cql.saveState()
+		cql.NextToken()
+		if f, err = cql.parseOr(); err == nil && !cql.isToken(TT_PARENTHESIS, ")") {
+			err = cql.unexpectedToken("')'")
+		}
+		if err != nil {
+			filterState := cql.saveState()
+			cql.restoreState(state)
+			if f, exprErr := cql.parsePredicate(); exprErr == nil {
+				return f, nil
 			}
-			numeric = 0
-		}
-		//get the coordinates
-		if openParenthesis == numParenthesis && closeParenthesis == 0 {
-			if PatternMatch("-?[.\\d]+", token) { //numeric
-				numeric++
-				if numeric > 1 {
-					if numeric%2 == 0 {
-						sql.WriteString(" ")
-					} else {
-						sql.WriteString(",")
-					}
-				}
-				sql.WriteString(token)
+			cql.restoreState(filterState)
+			return nil, err
+		}
+	case TT_BBOX:
+		f, err = cql.parseBBox()
+	case TT_SPATIAL:
+		if cql.cql2 {
+			f, err = cql.parseCql2Spatial()
+		} else {
+			f, err = cql.parseSpatial()
+		}
+	case TT_TEMPORAL:
+		if !cql.cql2 {
+			return cql.parsePredicate()
+		}
+		f, err = cql.parseCql2Temporal()
+	case TT_WITHIN:
+		f, err = cql.parseSpatial()
+	case TT_DWITHIN, TT_BEYOND:
+		f, err = cql.parseDistance()
+	default:
+		return cql.parsePredicate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cql.NextToken() //past the close parenthesis
+	return f, nil
+}
+
+// the comparison operators, CQL == is the same as =
+var relationOps = map[string]string{
+	"=":  "=",
+	"==": "=",
+	"<>": "<>",
+	"!=": "<>",
+	"<":  "<",
+	">":  ">",
+	"<=": "<=",
+	">=": ">=",
+}
+
+func (cql *CqlConverter) parsePredicate() (filterNode, error) {
+	left, err := cql.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	not := false
+	if cql.isToken(TT_LOGIC_OPS, "not") {
+		not = true
+		cql.NextToken()
+		if cql.currentTokenType != TT_COMPARE_OPS || cql.isToken(TT_COMPARE_OPS, "is") {
+			return nil, cql.unexpectedToken("BETWEEN, IN, LIKE or ILIKE after NOT")
+		}
+	}
+
+	if cql.currentTokenType == TT_RELATION_OPS {
+		op := cql.currentToken
+		if relationOps[op] == "" {
+			return nil, errors.New("invalid comparison operator " + op)
+		}
+		cql.NextToken()
+		right, err := cql.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		//keep != as written
+		if op == "==" {
+			op = "="
+		}
+		return &comparisonFilter{op: op, left: left, right: right}, nil
+	}
+
+	if cql.currentTokenType == TT_TEMPORAL && !not {
+		return cql.parseTemporal(left)
+	}
+
+	if cql.currentTokenType != TT_COMPARE_OPS {
+		return nil, cql.unexpectedToken("a comparison")
+	}
+	keyword := strings.ToLower(cql.currentToken)
+	cql.NextToken()
+	switch keyword {
+	case "between":
+		lower, err := cql.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if !cql.isToken(TT_LOGIC_OPS, "and") {
+			return nil, cql.unexpectedToken("AND in BETWEEN")
+		}
+		cql.NextToken()
+		upper, err := cql.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return &betweenFilter{expr: left, lower: lower, upper: upper, not: not}, nil
+	case "in":
+		if !cql.isToken(TT_PARENTHESIS, "(") {
+			return nil, cql.unexpectedToken("'(' after IN")
+		}
+		f := &inFilter{expr: left, not: not}
+		for {
+			cql.NextToken()
+			value, err := cql.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			f.values = append(f.values, value)
+			if cql.currentTokenType != TT_COMMA {
+				break
 			}
 		}
-		//fmt.Printf("openParenthesis %d closeParenthesis %d", openParenthesis, closeParenthesis)
-		if openParenthesis == closeParenthesis && closeParenthesis > 0 {
-			break
+		if !cql.isToken(TT_PARENTHESIS, ")") {
+			return nil, cql.unexpectedToken("',' or ')' in the IN list")
+		}
+		cql.NextToken()
+		return f, nil
+	case "like", "ilike":
+		pattern, err := cql.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return &likeFilter{expr: left, pattern: pattern, caseInsensitive: keyword == "ilike", not: not}, nil
+	default: //is [not] null
+		isNot := false
+		if cql.isToken(TT_LOGIC_OPS, "not") {
+			isNot = true
+			cql.NextToken()
+		}
+		if !cql.isToken(TT_WORD, "null") {
+			return nil, cql.unexpectedToken("NULL after IS")
 		}
+		cql.NextToken()
+		return &nullFilter{expr: left, not: isNot}, nil
 	}
-	if "POLYGON" == strings.ToUpper(geom) || "POLYLINE" == strings.ToUpper(geom) {
-		sql.WriteString("))', 4326)::Geography")
-	} else if "POINT" == strings.ToUpper(geom) {
-		sql.WriteString(")', 4326)::Geography")
-	} else {
-		return errors.New("No valid geometry for function DWITHIN!!")
+}
+
+// parseExpression parses arithmetic on property names, literal values and function calls
+func (cql *CqlConverter) parseExpression() (filterNode, error) {
+	left, err := cql.parseTerm()
+	if err != nil {
+		return nil, err
 	}
-	//get the distance
-	if i < len(tokens) {
-		token = tokens[i]
-		//log.Println("## distance " + token)
-		if PatternMatch("[.\\d]+", token) {
-			distance, err := strconv.ParseFloat(token, 64)
+	for cql.isToken(TT_ARITH_OPS, "+") || cql.isToken(TT_ARITH_OPS, "-") {
+		op := cql.currentToken
+		cql.NextToken()
+		right, err := cql.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = newArithmeticExpr(op, left, right); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (cql *CqlConverter) parseTerm() (filterNode, error) {
+	left, err := cql.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for cql.isToken(TT_ARITH_OPS, "*") || cql.isToken(TT_ARITH_OPS, "/") {
+		op := cql.currentToken
+		cql.NextToken()
+		right, err := cql.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = newArithmeticExpr(op, left, right); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (cql *CqlConverter) parseUnary() (filterNode, error) {
+	if cql.isToken(TT_ARITH_OPS, "-") || cql.isToken(TT_ARITH_OPS, "+") {
+		op := cql.currentToken
+		cql.NextToken()
+		e, err := cql.parseUnary()
+		if err != nil || op == "+" {
+			return e, err
+		}
+		return newNegateExpr(e), nil
+	}
+	return cql.parseFactor()
+}
+
+func (cql *CqlConverter) parseFactor() (filterNode, error) {
+	var e filterNode
+	switch cql.currentTokenType {
+	case TT_PARENTHESIS:
+		if "(" != cql.currentToken {
+			return nil, cql.unexpectedToken("a property name or a value")
+		}
+		cql.NextToken()
+		inner, err := cql.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if !cql.isToken(TT_PARENTHESIS, ")") {
+			return nil, cql.unexpectedToken("')'")
+		}
+		e = inner
+	case TT_STRING:
+		e = &literalExpr{value: cql.currentToken}
+	case TT_TIMESTRING:
+		e = &timeExpr{value: cql.currentToken}
+	case TT_WORD:
+		token := cql.currentToken
+		lval := strings.ToLower(token)
+		if i, err := strconv.ParseInt(token, 10, 64); err == nil {
+			e = &literalExpr{value: i}
+		} else if f, err := strconv.ParseFloat(token, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			e = &literalExpr{value: f}
+		} else if lval == "true" || lval == "false" {
+			e = &literalExpr{value: lval == "true"}
+		} else if lval == "null" {
+			return nil, cql.unexpectedToken("a value, use IS NULL to compare with NULL")
+		} else if lval == "now" {
+			return cql.parseNow()
+		} else if cql.cql2 && (lval == "timestamp" || lval == "date") && cql.isFunctionCall() {
+			return cql.parseCql2Instant(lval)
+		} else if cql.isFunctionCall() {
+			return cql.parseFunction(token)
+		} else {
+			p, err := newPropertyExpr(token)
 			if err != nil {
-				//log.Fatalln("error parsing distance!!")
-				distance = -1
-				return errors.New("error parsing distance!!")
+				return nil, err
 			}
-			i++
-			if i < len(tokens) { //get unit
-				token = strings.ToLower(tokens[i])
-				//log.Println("## unit " + token)
-				if "meters" == token {
-				} else if "feet" == token {
-					//log.Println("## change feets to meeters " + token)
-					distance = 0.3048 * distance
-				} else {
-					//log.Fatalln("wrong unit for distance, should be in [meters, feet]!!")
-					return errors.New("wrong unit for distance, should be in [meters, feet]!!")
-				}
+			e = p
+		}
+	default:
+		return nil, cql.unexpectedToken("a property name or a value")
+	}
+	cql.NextToken()
+	return e, nil
+}
+
+// isFunctionCall checks the current word is followed by '(', moving to it if so
+func (cql *CqlConverter) isFunctionCall() bool {
+	state := cql.saveState()
+	cql.NextToken()
+	if cql.isToken(TT_PARENTHESIS, "(") {
+		return true
+	}
+	cql.restoreState(state)
+	return false
+}
+
+// parseFunction parses the arguments of a whitelisted function call, strToLowerCase(magnitudetype)
+func (cql *CqlConverter) parseFunction(name string) (filterNode, error) {
+	args := make([]filterNode, 0)
+	cql.NextToken()
+	if !cql.isToken(TT_PARENTHESIS, ")") {
+		for {
+			arg, err := cql.parseExpression()
+			if err != nil {
+				return nil, err
 			}
-			sql.WriteString(", ")
-			sql.WriteString(strconv.FormatFloat(distance, 'f', -1, 64))
+			args = append(args, arg)
+			if cql.currentTokenType != TT_COMMA {
+				break
+			}
+			cql.NextToken()
+		}
+		if !cql.isToken(TT_PARENTHESIS, ")") {
+			return nil, cql.unexpectedToken("',' or ')' in the arguments of " + name)
 		}
 	}
-	sql.WriteString(")")
+	f, err := newFunctionExpr(name, args)
+	if err != nil {
+		return nil, err
+	}
+	cql.NextToken()
+	return f, nil
+}
 
-	return nil
+/**
+ * temporal predicates, the time property is compared with an instant or a period:
+ *
+ * origintime BEFORE 2016-01-01T00:00:00Z
+ * origintime AFTER NOW() - P7D
+ * origintime DURING 2016-01-01/P1M
+ * origintime DURING 2016-01-01T00:00:00Z/2016-02-01T00:00:00Z
+ * origintime BEFORE OR DURING P1D/2016-01-01
+ * origintime DURING OR AFTER 2016-01-01/2016-02-01
+ * origintime TEQUALS 2016-01-01T10:00:00Z
+ */
+func (cql *CqlConverter) parseTemporal(left filterNode) (filterNode, error) {
+	op := strings.ToUpper(cql.currentToken)
+	cql.NextToken()
+	if (op == "BEFORE" || op == "DURING") && cql.isToken(TT_LOGIC_OPS, "or") {
+		cql.NextToken()
+		second := "AFTER"
+		if op == "BEFORE" {
+			second = "DURING"
+		}
+		if !cql.isToken(TT_TEMPORAL, second) {
+			return nil, cql.unexpectedToken(second + " after " + op + " OR")
+		}
+		op += " OR " + second
+		cql.NextToken()
+	}
+	start, end, err := cql.parseTemporalOperand()
+	if err != nil {
+		return nil, err
+	}
+	return newTemporalFilter(op, left, start, end)
 }
 
 /**
-*   convert cql to sql
+ * parse an instant (end is nil) or a period: start/end, start/duration or duration/end.
+ * an instant is an ISO 8601 date time or NOW() optionally plus or minus a duration.
  */
-func (cql *CqlConverter) ToSQL() (string, error) {
+func (cql *CqlConverter) parseTemporalOperand() (filterNode, filterNode, error) {
+	if cql.currentTokenType == TT_STRING && SearchStringInString(cql.currentToken, "/") {
+		//a quoted period, '2016-01-01/P1M'
+		parts := strings.Split(cql.currentToken, "/")
+		if len(parts) != 2 {
+			return nil, nil, errors.New("invalid time period " + cql.currentToken)
+		}
+		cql.NextToken()
+		return newPeriod(parts[0], parts[1])
+	}
+
 	var (
-		sql bytes.Buffer
-		err error
+		start    filterNode
+		duration string
+		err      error
 	)
-	err = nil
-	//go through the CQL string and convert
-	for cql.currentTokenType != TT_EOF {
+	if cql.currentTokenType == TT_WORD && isDuration(cql.currentToken) {
+		duration = strings.ToUpper(cql.currentToken)
+		cql.NextToken()
+	} else if start, err = cql.parseInstant(); err != nil {
+		return nil, nil, err
+	}
+	if !cql.isToken(TT_ARITH_OPS, "/") {
+		if start == nil {
+			return nil, nil, cql.unexpectedToken("'/' after the duration " + duration)
+		}
+		return start, nil, nil
+	}
+	cql.NextToken()
+
+	if start != nil && cql.currentTokenType == TT_WORD && isDuration(cql.currentToken) {
+		//start/duration
+		duration = strings.ToUpper(cql.currentToken)
 		cql.NextToken()
-		//1. leading space
-		if cql.currentTokenType == TT_RELATION_OPS || cql.currentTokenType == TT_LOGIC_OPS {
-			sql.WriteString(" ")
-		}
-		//2. do content
-		if cql.currentTokenType == TT_TIMESTRING {
-			sql.WriteString(cql.currentToken)
-			sql.WriteString("::timestamptz") //DB column type
-		} else if cql.currentTokenType == TT_RELATION_OPS && cql.currentToken == "==" { //convert to =
-			sql.WriteString("=")
-		} else if cql.currentTokenType == TT_BBOX {
-			err = cql.ToBBoxSql(&sql)
-		} else if cql.currentTokenType == TT_WITHIN {
-			err = cql.ToWithinSql(&sql)
-		} else if cql.currentTokenType == TT_DWITHIN {
-			err = cql.ToDWithinSql(&sql)
-		} else { //just the token
-			sql.WriteString(cql.currentToken)
-		}
-		//3. end space
-		if cql.currentTokenType == TT_RELATION_OPS || cql.currentTokenType == TT_LOGIC_OPS {
-			sql.WriteString(" ")
-		}
-		//log.Println(cql.Render())
-	}
-	return sql.String(), err
+		return start, &timeOffsetExpr{time: start, sign: "+", duration: duration}, nil
+	}
+	end, err := cql.parseInstant()
+	if err != nil {
+		return nil, nil, err
+	}
+	if start == nil { //duration/end
+		start = &timeOffsetExpr{time: end, sign: "-", duration: duration}
+	}
+	return start, end, nil
+}
 
+func (cql *CqlConverter) parseInstant() (filterNode, error) {
+	if cql.isToken(TT_WORD, "now") {
+		return cql.parseNow()
+	}
+	if cql.currentTokenType != TT_TIMESTRING {
+		return nil, cql.unexpectedToken("an ISO 8601 date time or NOW()")
+	}
+	t := &timeExpr{value: cql.currentToken}
+	cql.NextToken()
+	return t, nil
+}
+
+// parseNow parses NOW() with an optional duration offset, NOW() - P7D
+func (cql *CqlConverter) parseNow() (filterNode, error) {
+	cql.NextToken()
+	if !cql.isToken(TT_PARENTHESIS, "(") {
+		return nil, cql.unexpectedToken("'(' after NOW")
+	}
+	cql.NextToken()
+	if !cql.isToken(TT_PARENTHESIS, ")") {
+		return nil, cql.unexpectedToken("')' after NOW(")
+	}
+	cql.NextToken()
+
+	var now filterNode = &nowExpr{}
+	if !cql.isToken(TT_ARITH_OPS, "-") && !cql.isToken(TT_ARITH_OPS, "+") {
+		return now, nil
+	}
+	//a duration offset, otherwise the sign is arithmetic
+	state := cql.saveState()
+	sign := cql.currentToken
+	cql.NextToken()
+	if cql.currentTokenType != TT_WORD || !PatternMatch("^[Pp]", cql.currentToken) {
+		cql.restoreState(state)
+		return now, nil
+	}
+	duration := cql.currentToken
+	if !isDuration(duration) {
+		return nil, errors.New("invalid ISO 8601 duration " + duration)
+	}
+	cql.NextToken()
+	return &timeOffsetExpr{time: now, sign: sign, duration: strings.ToUpper(duration)}, nil
+}
+
+// isDuration checks s is an ISO 8601 duration with at least one part, P7D
+func isDuration(s string) bool {
+	s = strings.ToUpper(s)
+	return PatternMatch(ISO_DURATION_PATTERN, s) && s != "P" && !strings.HasSuffix(s, "T")
+}
+
+// newPeriod makes the start and end of a period given as text, e.g. 2016-01-01 and P1M
+func newPeriod(first string, second string) (filterNode, filterNode, error) {
+	first, second = strings.TrimSpace(first), strings.TrimSpace(second)
+	switch {
+	case PatternMatch(ISO_TIME_PATTERN, first) && PatternMatch(ISO_TIME_PATTERN, second):
+		return &timeExpr{value: first}, &timeExpr{value: second}, nil
+	case PatternMatch(ISO_TIME_PATTERN, first) && isDuration(second):
+		start := &timeExpr{value: first}
+		return start, &timeOffsetExpr{time: start, sign: "+", duration: strings.ToUpper(second)}, nil
+	case isDuration(first) && PatternMatch(ISO_TIME_PATTERN, second):
+		end := &timeExpr{value: second}
+		return &timeOffsetExpr{time: end, sign: "-", duration: strings.ToUpper(first)}, end, nil
+	}
+	return nil, nil, errors.New("invalid time period " + first + "/" + second)
+}
+
+/**
+*   convert cql to sql, the values are written into the sql
+ */
+func (cql *CqlConverter) ToSQL() (string, error) {
+	w := &sqlWriter{inline: true}
+	if err := cql.writeSql(w); err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
+
+/**
+ * convert cql to sql, the values are bound as query parameters ($1, $2...)
+ * to be passed with the sql to db.Query
+ */
+func (cql *CqlConverter) ToSQLWithArgs() (string, []interface{}, error) {
+	w := &sqlWriter{}
+	if err := cql.writeSql(w); err != nil {
+		return "", nil, err
+	}
+	return w.String(), w.args, nil
+}
+
+func (cql *CqlConverter) writeSql(w *sqlWriter) error {
+	f, err := cql.Parse()
+	if err != nil || f == nil {
+		return err
+	}
+	return f.writeSql(w)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"math"
 	"testing"
 )
 
@@ -71,3 +72,342 @@ func TestToSql(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestToBBoxSqlKermadec(t *testing.T) {
+	//the Kermadec Islands sit either side of 180°
+	cqlString := `BBOX(origin_geom,175,-32,-175,-28)`
+	expected := `(ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(175 -32,180 -28)'::geometry),4326),origin_geom)` +
+		` OR ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(-180 -32,-175 -28)'::geometry),4326),origin_geom))`
+	var sql bytes.Buffer
+	cql := NewCqlConverter(cqlString)
+	cql.NextToken()
+	err := cql.ToBBoxSql(&sql)
+	t.Log(sql.String())
+
+	if err != nil || sql.String() != expected {
+		t.Fail()
+	}
+	if cql.BBOX != "175,-32,-175,-28" {
+		t.Errorf("unexpected bbox %s", cql.BBOX)
+	}
+}
+
+func TestToBBoxSql360(t *testing.T) {
+	//the same box in the 0-360 convention
+	cqlString := `BBOX(origin_geom,175,-32,185,-28)`
+	expected := `(ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(175 -32,180 -28)'::geometry),4326),origin_geom)` +
+		` OR ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(-180 -32,-175 -28)'::geometry),4326),origin_geom))`
+	var sql bytes.Buffer
+	cql := NewCqlConverter(cqlString)
+	cql.NextToken()
+	err := cql.ToBBoxSql(&sql)
+	t.Log(sql.String())
+
+	if err != nil || sql.String() != expected {
+		t.Fail()
+	}
+}
+
+func TestToBBoxSqlInvalid(t *testing.T) {
+	for _, cqlString := range []string{`BBOX(origin_geom,175,-32,-175)`, `BBOX(origin_geom,175,-32,east,-28)`, `BBOX(origin_geom,175,-32`,
+		`BBOX(origin_geom,1e20,-32,1e20,-28)`, `BBOX(origin_geom,-1e16,-32,175,-28)`, `BBOX(origin_geom,175,-32,Inf,-28)`} {
+		var sql bytes.Buffer
+		cql := NewCqlConverter(cqlString)
+		cql.NextToken()
+		if err := cql.ToBBoxSql(&sql); err == nil {
+			t.Errorf("expected error for %s", cqlString)
+		}
+	}
+}
+
+func TestNormaliseLongitude(t *testing.T) {
+	tests := map[float64]float64{
+		175:   175,
+		-180:  -180,
+		180:   180,
+		185:   -175,
+		360:   0,
+		540:   180,
+		-185:  175,
+		-540:  -180,
+		725.5: 5.5,
+	}
+	for lon, expected := range tests {
+		if got := normaliseLongitude(lon); got != expected {
+			t.Errorf("%v: expected %v got %v", lon, expected, got)
+		}
+	}
+	//huge longitudes don't take a step of 360° at a time
+	for _, lon := range []float64{1e16, -1e16, 1e20, -1e20} {
+		if got := normaliseLongitude(lon); got < -180 || got > 180 {
+			t.Errorf("%v: expected a longitude in -180..180 got %v", lon, got)
+		}
+	}
+	if got := normaliseLongitude(math.Inf(1)); !math.IsNaN(got) {
+		t.Errorf("+Inf: expected NaN got %v", got)
+	}
+}
+
+func TestToWithinSqlKermadec(t *testing.T) {
+	cqlString := `WITHIN(origin_geom,POLYGON((177 -32,-178 -32,-178 -28,177 -28,177 -32)))`
+	expected := `ST_Within(ST_ShiftLongitude(origin_geom), ST_GeomFromText('POLYGON((177 -32,182 -32,182 -28,177 -28,177 -32))', 4326))`
+	var sql bytes.Buffer
+	cql := NewCqlConverter(cqlString)
+	cql.NextToken()
+	err := cql.ToWithinSql(&sql)
+	t.Log(sql.String())
+
+	if err != nil || sql.String() != expected {
+		t.Fail()
+	}
+}
+
+func TestToWithinSql360(t *testing.T) {
+	//0-360 longitudes are normalised, the polygon still crosses 180°
+	cqlString := `WITHIN(origin_geom,POLYGON((177 -32,182 -32,182 -28,177 -28,177 -32)))`
+	expected := `ST_Within(ST_ShiftLongitude(origin_geom), ST_GeomFromText('POLYGON((177 -32,182 -32,182 -28,177 -28,177 -32))', 4326))`
+	var sql bytes.Buffer
+	cql := NewCqlConverter(cqlString)
+	cql.NextToken()
+	err := cql.ToWithinSql(&sql)
+	t.Log(sql.String())
+
+	if err != nil || sql.String() != expected {
+		t.Fail()
+	}
+}
+
+func TestToDWithinSqlKermadec(t *testing.T) {
+	cqlString := `DWITHIN(origin_geom,Point(182.1 -29.3),50000,meters)`
+	expected := `ST_DWithin(origin_geom::Geography, ST_GeomFromText('POINT(-177.9 -29.3)', 4326)::Geography, 50000)`
+	var sql bytes.Buffer
+	cql := NewCqlConverter(cqlString)
+	cql.NextToken()
+	err := cql.ToDWithinSql(&sql)
+	t.Log(sql.String())
+
+	if err != nil || sql.String() != expected {
+		t.Fail()
+	}
+}
+
+func TestToSpatialSql(t *testing.T) {
+	tests := map[string]string{
+		`INTERSECTS(origin_geom,LINESTRING(172 -40,176 -38))`:                                              `ST_Intersects(origin_geom, ST_GeomFromText('LINESTRING(172 -40,176 -38)', 4326))`,
+		`CONTAINS(POLYGON((170 -40,178 -40,178 -46,170 -40)),origin_geom)`:                                 `ST_Contains(ST_GeomFromText('POLYGON((170 -40,178 -40,178 -46,170 -40))', 4326), origin_geom)`,
+		`DISJOINT(origin_geom,MULTIPOINT(175 -41,176 -39))`:                                                `ST_Disjoint(origin_geom, ST_GeomFromText('MULTIPOINT((175 -41),(176 -39))', 4326))`,
+		`WITHIN(origin_geom,POLYGON((170 -40,178 -40,178 -46,170 -40),(172 -42,174 -42,174 -44,172 -42)))`: `ST_Within(origin_geom, ST_GeomFromText('POLYGON((170 -40,178 -40,178 -46,170 -40),(172 -42,174 -42,174 -44,172 -42))', 4326))`,
+		`RELATE(origin_geom,POINT(175 -41),'t*f**f***')`:                                                   `ST_Relate(origin_geom, ST_GeomFromText('POINT(175 -41)', 4326), 'T*F**F***')`,
+		`CROSSES(origin_geom,LINESTRING(177 -30,-178 -30))`:                                                `ST_Crosses(ST_ShiftLongitude(origin_geom), ST_GeomFromText('LINESTRING(177 -30,182 -30)', 4326))`,
+	}
+	for cqlString, expected := range tests {
+		var sql bytes.Buffer
+		cql := NewCqlConverter(cqlString)
+		cql.NextToken()
+		err := cql.ToSpatialSql(&sql)
+		if err != nil || sql.String() != expected {
+			t.Errorf("%s: got %s %v", cqlString, sql.String(), err)
+		}
+	}
+}
+
+func TestToBeyondSql(t *testing.T) {
+	cqlString := `BEYOND(origin_geom,POINT(175 -41),50,kilometers)`
+	expected := `NOT ST_DWithin(origin_geom::Geography, ST_GeomFromText('POINT(175 -41)', 4326)::Geography, 50000)`
+	var sql bytes.Buffer
+	cql := NewCqlConverter(cqlString)
+	cql.NextToken()
+	err := cql.ToDWithinSql(&sql)
+	if err != nil || sql.String() != expected {
+		t.Errorf("got %s %v", sql.String(), err)
+	}
+}
+
+func TestToSqlSpatialErrors(t *testing.T) {
+	for _, cqlString := range []string{
+		`magnitude > 3 AND INTERSECTS(origin_geom,POLYGON((170 -40,178 -40,178 -46,170 -46)))`,
+		`TOUCHES(origin_geom,POINT(175))`,
+		`OVERLAPS(origin_geom;drop table x,POINT(175 -41))`,
+		`RELATE(origin_geom,POINT(175 -41),'TTT')`,
+		`DWITHIN(origin_geom,POINT(175 -41),5,furlongs)`,
+		`EQUALS(origin_geom,POINT(175 -41)`,
+		`INTERSECTS(origin_geom,POINT(1e20 -41))`,
+		`DWITHIN(origin_geom,POINT(-1e16 -41),5,kilometers)`,
+	} {
+		cql := NewCqlConverter(cqlString)
+		if _, err := cql.ToSQL(); err == nil {
+			t.Errorf("expected error for %s", cqlString)
+		}
+	}
+}
+
+func TestToSqlComparisons(t *testing.T) {
+	tests := map[string]string{
+		`magnitude BETWEEN 4 AND 6`:                              `magnitude BETWEEN 4 AND 6`,
+		`magnitude NOT BETWEEN 4.5 AND 6`:                        `magnitude NOT BETWEEN 4.5 AND 6`,
+		`eventtype IN ('earthquake','quarry blast')`:             `eventtype IN ('earthquake', 'quarry blast')`,
+		`eventtype not in ('earthquake')`:                        `eventtype NOT IN ('earthquake')`,
+		`magnitudetype ILIKE 'ml%'`:                              `magnitudetype ILIKE 'ml%'`,
+		`magnitudetype NOT LIKE 'M_'`:                            `magnitudetype NOT LIKE 'M_'`,
+		`depth IS NULL`:                                          `depth IS NULL`,
+		`depth is not null AND magnitude>=4`:                     `depth IS NOT NULL AND magnitude >= 4`,
+		`NOT (magnitude < 3 OR depth > 100)`:                     `NOT (magnitude < 3 OR depth > 100)`,
+		`eventtype = 'o''reilly''s quake'`:                       `eventtype = 'o''reilly''s quake'`,
+		`"magnitude" == 5 and origintime > 2016-01-01T00:00:00Z`: `magnitude = 5 and origintime > '2016-01-01T00:00:00Z'::timestamptz`,
+		`depth=-9`: `depth = -9`,
+	}
+	for cqlString, expected := range tests {
+		cql := NewCqlConverter(cqlString)
+		sql, err := cql.ToSQL()
+		if err != nil || sql != expected {
+			t.Errorf("%s: expected %s got %s %v", cqlString, expected, sql, err)
+		}
+	}
+}
+
+func TestToSQLWithArgs(t *testing.T) {
+	cqlString := `eventtype IN ('earthquake','quarry blast') AND magnitude BETWEEN 4 AND 6.5 AND origintime>='2016-01-01' AND magnitudetype ILIKE 'ml%'`
+	expected := `eventtype IN ($1, $2) AND magnitude BETWEEN $3 AND $4 AND origintime >= $5::timestamptz AND magnitudetype ILIKE $6`
+	cql := NewCqlConverter(cqlString)
+	sql, args, err := cql.ToSQLWithArgs()
+	if err != nil || sql != expected {
+		t.Errorf("got %s %v", sql, err)
+	}
+	expectedArgs := []interface{}{"earthquake", "quarry blast", int64(4), 6.5, "2016-01-01", "ml%"}
+	if len(args) != len(expectedArgs) {
+		t.Fatalf("expected %d args got %v", len(expectedArgs), args)
+	}
+	for i := range args {
+		if args[i] != expectedArgs[i] {
+			t.Errorf("arg %d expected %v got %v", i+1, expectedArgs[i], args[i])
+		}
+	}
+}
+
+func TestToSqlErrors(t *testing.T) {
+	for _, cqlString := range []string{
+		`magnitude BETWEEN 4`,
+		`eventtype IN ('earthquake'`,
+		`eventtype = 'earthquake`,
+		`depth IS 5`,
+		`magnitude > 3 AND`,
+		`(magnitude > 3`,
+		`magnitude > 3)`,
+		`magnitude`,
+		`magnitude = NULL`,
+		`magnitude NOT = 3`,
+		`magnitude;drop table quakes > 3`,
+		`pg_sleep(10) > 0`,
+		`magnitude =< 3`,
+		`depth LIKE '1%'`,
+		`origintime ILIKE '2016%'`,
+		`eventtype LIKE 5`,
+	} {
+		cql := NewCqlConverter(cqlString)
+		if sql, err := cql.ToSQL(); err == nil {
+			t.Errorf("expected error for %s, got %s", cqlString, sql)
+		}
+	}
+}
+
+func TestToSqlTemporal(t *testing.T) {
+	tests := map[string]string{
+		`origintime BEFORE 2016-01-01T00:00:00Z`:                             `origintime < '2016-01-01T00:00:00Z'::timestamptz`,
+		`origintime AFTER NOW() - P7D`:                                       `origintime > (now() - 'P7D'::interval)`,
+		`origintime AFTER NOW()-PT12H`:                                       `origintime > (now() - 'PT12H'::interval)`,
+		`origintime > now() - p1m`:                                           `origintime > (now() - 'P1M'::interval)`,
+		`origintime TEQUALS '2016-01-01T10:00:00Z'`:                          `origintime = '2016-01-01T10:00:00Z'::timestamptz`,
+		`origintime DURING 2016-01-01/P1M`:                                   `origintime > '2016-01-01'::timestamptz AND origintime < ('2016-01-01'::timestamptz + 'P1M'::interval)`,
+		`origintime DURING '2016-01-01/2016-02-01'`:                          `origintime > '2016-01-01'::timestamptz AND origintime < '2016-02-01'::timestamptz`,
+		`origintime DURING P1D/2016-01-01T00:00:00Z`:                         `origintime > ('2016-01-01T00:00:00Z'::timestamptz - 'P1D'::interval) AND origintime < '2016-01-01T00:00:00Z'::timestamptz`,
+		`origintime BEFORE OR DURING 2016-01-01/2016-02-01 or magnitude > 6`: `origintime < '2016-02-01'::timestamptz or magnitude > 6`,
+		`magnitude > 6 OR origintime DURING OR AFTER 2016-01-01/2016-02-01`:  `magnitude > 6 OR origintime > '2016-01-01'::timestamptz`,
+		`magnitude > 6 OR origintime DURING NOW() - P7D/NOW()`:               `magnitude > 6 OR (origintime > (now() - 'P7D'::interval) AND origintime < now())`,
+	}
+	for cqlString, expected := range tests {
+		cql := NewCqlConverter(cqlString)
+		sql, err := cql.ToSQL()
+		if err != nil || sql != expected {
+			t.Errorf("%s: expected %s got %s %v", cqlString, expected, sql, err)
+		}
+	}
+
+	for _, cqlString := range []string{
+		`origintime DURING 2016-01-01`,
+		`origintime TEQUALS 2016-01-01/P1M`,
+		`origintime AFTER NOW() - 7 days`,
+		`origintime AFTER NOW() - P`,
+		`origintime BEFORE OR AFTER 2016-01-01`,
+		`origintime DURING P1M/P1D`,
+		`origintime AFTER 'yesterday'`,
+	} {
+		cql := NewCqlConverter(cqlString)
+		if sql, err := cql.ToSQL(); err == nil {
+			t.Errorf("expected error for %s, got %s", cqlString, sql)
+		}
+	}
+}
+
+func TestToSqlArithmetic(t *testing.T) {
+	tests := map[string]string{
+		`depth * 1000 > 5000`:                                    `(depth * 1000) > 5000`,
+		`depth*1000>5000 AND magnitude-1>=2`:                     `(depth * 1000) > 5000 AND (magnitude - 1) >= 2`,
+		`(depth + 5) * 2 > 10`:                                   `((depth + 5) * 2) > 10`,
+		`depth + 5 * 2 > 10`:                                     `(depth + 10) > 10`,
+		`magnitude > -depth / 10`:                                `magnitude > ((-depth) / NULLIF(10, 0))`,
+		`abs(latitude) < 40`:                                     `abs(latitude) < 40`,
+		`ABS(latitude - 1.5) < 40`:                               `abs((latitude - 1.5)) < 40`,
+		`strToLowerCase(magnitudetype) = 'ml'`:                   `lower(magnitudetype) = 'ml'`,
+		`year(origintime) = 2016 and month(origintime) IN (1,2)`: `extract(year from origintime at time zone 'UTC') = 2016 and extract(month from origintime at time zone 'UTC') IN (1, 2)`,
+		`strStartsWith(publicid, '2016') = true`:                 `(left(publicid, length('2016'::text)) = '2016'::text) = true`,
+		`pow(magnitude, 2) > 16 OR pi() > depth`:                 `power(magnitude, 2::bigint) > 16 OR pi() > depth`,
+		`(magnitude > 3) AND (depth) < 100`:                      `magnitude > 3 AND depth < 100`,
+		`origintime > NOW() - P7D AND depth > 1e-3`:              `origintime > (now() - 'P7D'::interval) AND depth > 0.001`,
+		`depth > 2 * 3`:                                          `depth > 6`,
+		`magnitude = '5' AND usedphasecount = '12'`:              `magnitude = '5' AND usedphasecount = '12'`,
+		`origintime > '2016-01-01T00:00:00Z'`:                    `origintime > '2016-01-01T00:00:00Z'::timestamptz`,
+		`sqrt(4) > 1 AND log(magnitude) > 1`:                     `sqrt(4::bigint) > 1 AND ln(magnitude) > 1`,
+	}
+	for cqlString, expected := range tests {
+		cql := NewCqlConverter(cqlString)
+		sql, err := cql.ToSQL()
+		if err != nil || sql != expected {
+			t.Errorf("%s: expected %s got %s %v", cqlString, expected, sql, err)
+		}
+	}
+
+	cql := NewCqlConverter(`strToUpperCase(magnitudetype) = 'ML' AND abs(latitude) < 40`)
+	sql, args, err := cql.ToSQLWithArgs()
+	if err != nil || sql != `upper(magnitudetype) = $1 AND abs(latitude) < $2` || len(args) != 2 {
+		t.Errorf("got %s %v %v", sql, args, err)
+	}
+
+	for _, cqlString := range []string{
+		`pg_sleep(10) > 0`,
+		`abs(latitude, 2) < 40`,
+		`depth / 0 > 1`,
+		`sqrt(-1) > 0`,
+		`asin(2) > 0`,
+		`pow(0, -1) > 0`,
+		`exp(1000) > 0`,
+		`abs('abc') > 0`,
+		`year(magnitude) = 2016`,
+		`strLength(depth) > 2`,
+		`magnitude + 'abc' > 1`,
+		`magnitude = 'abc'`,
+		`usedphasecount = 1.5e`,
+		`usedphasecount IN (1, 'x')`,
+		`magnitudetype = 5`,
+		`origintime > 5`,
+		`origintime > '2016-02-30'`,
+		`depth BETWEEN 'a' AND 10`,
+		`depth * > 1`,
+		`abs(latitude < 40`,
+		`(depth + 1 > 2`,
+	} {
+		cql := NewCqlConverter(cqlString)
+		if sql, err := cql.ToSQL(); err == nil {
+			t.Errorf("expected error for %s, got %s", cqlString, sql)
+		}
+	}
+}
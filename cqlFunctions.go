@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * The functions that can be used in CQL expressions, e.g. abs(latitude) < 40,
+ * strToLowerCase(magnitudetype) = 'ml', year(origintime) = 2016.
+ * Names follow the GeoServer (GeoTools) filter functions.  Only the functions
+ * listed here are translated, any other function call is rejected.
+ *
+ * params are the types of the arguments, n a number, s a string and t a time,
+ * sql is the template for the call, {0}, {1}... are replaced by the arguments.
+ */
+type cqlFunction struct {
+	params string
+	sql    string
+}
+
+// the attribute types of the function parameter types
+var cqlParamTypes = map[byte][]string{
+	'n': {ATTRIBUTE_DOUBLE, ATTRIBUTE_INTEGER},
+	's': {ATTRIBUTE_STRING},
+	't': {ATTRIBUTE_TIMESTAMP},
+}
+
+// the domains of the math functions on numbers, postgres errors outside them
+var cqlFunctionDomains = map[string]func(x []float64) bool{
+	"sqrt":  func(x []float64) bool { return x[0] >= 0 },
+	"exp":   func(x []float64) bool { return !math.IsInf(math.Exp(x[0]), 0) },
+	"log":   func(x []float64) bool { return x[0] > 0 },
+	"log10": func(x []float64) bool { return x[0] > 0 },
+	"asin":  func(x []float64) bool { return math.Abs(x[0]) <= 1 },
+	"acos":  func(x []float64) bool { return math.Abs(x[0]) <= 1 },
+	"pow": func(x []float64) bool {
+		p := math.Pow(x[0], x[1])
+		return !math.IsNaN(p) && !math.IsInf(p, 0)
+	},
+}
+
+var cqlFunctions = map[string]cqlFunction{
+	//math
+	"abs":       {"n", "abs({0})"},
+	"ceil":      {"n", "ceil({0})"},
+	"floor":     {"n", "floor({0})"},
+	"round":     {"n", "round({0})"},
+	"rint":      {"n", "round({0})"},
+	"sqrt":      {"n", "sqrt({0})"},
+	"exp":       {"n", "exp({0})"},
+	"log":       {"n", "ln({0})"},
+	"log10":     {"n", "log({0})"},
+	"pow":       {"nn", "power({0}, {1})"},
+	"sin":       {"n", "sin({0})"},
+	"cos":       {"n", "cos({0})"},
+	"tan":       {"n", "tan({0})"},
+	"asin":      {"n", "asin({0})"},
+	"acos":      {"n", "acos({0})"},
+	"atan":      {"n", "atan({0})"},
+	"atan2":     {"nn", "atan2({0}, {1})"},
+	"min":       {"nn", "least({0}, {1})"},
+	"max":       {"nn", "greatest({0}, {1})"},
+	"todegrees": {"n", "degrees({0})"},
+	"toradians": {"n", "radians({0})"},
+	"pi":        {"", "pi()"},
+	//string, the GeoTools substring positions are zero based
+	"strtolowercase":    {"s", "lower({0})"},
+	"strtouppercase":    {"s", "upper({0})"},
+	"strlength":         {"s", "length({0})"},
+	"strtrim":           {"s", "trim({0})"},
+	"strconcat":         {"ss", "({0} || {1})"},
+	"strsubstring":      {"snn", "substr({0}, {1} + 1, {2} - {1})"},
+	"strsubstringstart": {"sn", "substr({0}, {1} + 1)"},
+	"strindexof":        {"ss", "(strpos({0}, {1}) - 1)"},
+	"strstartswith":     {"ss", "(left({0}, length({1})) = {1})"},
+	"strendswith":       {"ss", "(right({0}, length({1})) = {1})"},
+	//CQL2 case insensitive comparison, CASEI(magnitudetype) = CASEI('ml')
+	"casei": {"s", "lower({0})"},
+	//date parts, in UTC
+	"year":      {"t", "extract(year from {0} at time zone 'UTC')"},
+	"month":     {"t", "extract(month from {0} at time zone 'UTC')"},
+	"day":       {"t", "extract(day from {0} at time zone 'UTC')"},
+	"hour":      {"t", "extract(hour from {0} at time zone 'UTC')"},
+	"minute":    {"t", "extract(minute from {0} at time zone 'UTC')"},
+	"second":    {"t", "extract(second from {0} at time zone 'UTC')"},
+	"dayofyear": {"t", "extract(doy from {0} at time zone 'UTC')"},
+	"dayofweek": {"t", "extract(dow from {0} at time zone 'UTC')"},
+}
+
+// functionExpr is a call to one of the cqlFunctions
+type functionExpr struct {
+	name     string
+	function cqlFunction
+	args     []filterNode
+}
+
+func newFunctionExpr(name string, args []filterNode) (*functionExpr, error) {
+	function, ok := cqlFunctions[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(cqlFunctions))
+		for n := range cqlFunctions {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.New("unknown function " + name + ", the supported functions are: " + strings.Join(names, ", "))
+	}
+	if len(args) != len(function.params) {
+		return nil, errors.New("function " + name + " takes " + strconv.Itoa(len(function.params)) + " arguments")
+	}
+	//postgres errors on the wrong type or a number out of the domain
+	for i, arg := range args {
+		if t := exprType(arg, propertyType); t != "" && !isOneOf(t, cqlParamTypes[function.params[i]]) {
+			return nil, errors.New("function " + name + " doesn't take a " + t + " argument " + strconv.Itoa(i+1))
+		}
+	}
+	if domain, ok := cqlFunctionDomains[strings.ToLower(name)]; ok {
+		x := make([]float64, len(args))
+		numbers := true
+		for i, arg := range args {
+			x[i], ok = numericValue(arg)
+			numbers = numbers && ok
+		}
+		if numbers && !domain(x) {
+			return nil, errors.New("function " + name + " is undefined for " + strings.Trim(fmt.Sprint(x), "[]"))
+		}
+	}
+	return &functionExpr{name: name, function: function, args: args}, nil
+}
+
+/**
+ * exprType is the attribute type of a literal, time or property expression, "" when it isn't known.
+ * propertyType is the type of an attribute.
+ */
+func exprType(e filterNode, propertyType func(name string) string) string {
+	switch v := e.(type) {
+	case *literalExpr:
+		switch v.value.(type) {
+		case string:
+			return ATTRIBUTE_STRING
+		case int64:
+			return ATTRIBUTE_INTEGER
+		case float64:
+			return ATTRIBUTE_DOUBLE
+		}
+	case *timeExpr, *nowExpr, *timeOffsetExpr:
+		return ATTRIBUTE_TIMESTAMP
+	case *propertyExpr:
+		return propertyType(v.name)
+	}
+	return ""
+}
+
+func isOneOf(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *functionExpr) writeSql(w *sqlWriter) error {
+	tmpl := e.function.sql
+	for len(tmpl) > 0 {
+		i := strings.Index(tmpl, "{")
+		if i < 0 {
+			w.WriteString(tmpl)
+			break
+		}
+		w.WriteString(tmpl[:i])
+		j := strings.Index(tmpl[i:], "}") + i
+		n, _ := strconv.Atoi(tmpl[i+1 : j])
+		if err := writeTypedSql(w, e.args[n]); err != nil {
+			return err
+		}
+		tmpl = tmpl[j+1:]
+	}
+	return nil
+}
+
+/**
+ * writeTypedSql casts literal values, postgres can't choose between
+ * overloaded functions for an untyped parameter, e.g. abs($1).
+ */
+func writeTypedSql(w *sqlWriter, e filterNode) error {
+	if err := e.writeSql(w); err != nil {
+		return err
+	}
+	if l, ok := e.(*literalExpr); ok {
+		switch l.value.(type) {
+		case string:
+			w.WriteString("::text")
+		case int64:
+			w.WriteString("::bigint")
+		case float64:
+			w.WriteString("::float8")
+		case bool:
+			w.WriteString("::boolean")
+		}
+	}
+	return nil
+}
+
+// arithmeticExpr: depth * 1000, division by zero gives NULL rather than an error
+type arithmeticExpr struct {
+	op    string
+	left  filterNode
+	right filterNode
+}
+
+/**
+ * newArithmeticExpr folds operations on two numbers into a number,
+ * that leaves postgres a column type to work out the parameter types from.
+ */
+func newArithmeticExpr(op string, left filterNode, right filterNode) (filterNode, error) {
+	l, lok := numericValue(left)
+	r, rok := numericValue(right)
+	if op == "/" && rok && r == 0 {
+		return nil, errors.New("division by zero")
+	}
+	for _, e := range []filterNode{left, right} {
+		if t := exprType(e, propertyType); t == ATTRIBUTE_STRING || t == ATTRIBUTE_TIMESTAMP {
+			return nil, errors.New("arithmetic " + op + " on a " + t)
+		}
+	}
+	if !lok || !rok {
+		return &arithmeticExpr{op: op, left: left, right: right}, nil
+	}
+	var val float64
+	switch op {
+	case "+":
+		val = l + r
+	case "-":
+		val = l - r
+	case "*":
+		val = l * r
+	case "/":
+		val = l / r
+	}
+	if val == float64(int64(val)) && isInteger(left) && isInteger(right) && op != "/" {
+		return &literalExpr{value: int64(val)}, nil
+	}
+	return &literalExpr{value: val}, nil
+}
+
+func numericValue(e filterNode) (float64, bool) {
+	if l, ok := e.(*literalExpr); ok {
+		switch v := l.value.(type) {
+		case int64:
+			return float64(v), true
+		case float64:
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func isInteger(e filterNode) bool {
+	l, ok := e.(*literalExpr)
+	if ok {
+		_, ok = l.value.(int64)
+	}
+	return ok
+}
+
+func (e *arithmeticExpr) writeSql(w *sqlWriter) error {
+	w.WriteString("(")
+	if err := e.left.writeSql(w); err != nil {
+		return err
+	}
+	w.WriteString(" " + e.op + " ")
+	if e.op == "/" {
+		w.WriteString("NULLIF(")
+	}
+	if err := e.right.writeSql(w); err != nil {
+		return err
+	}
+	if e.op == "/" {
+		w.WriteString(", 0)")
+	}
+	w.WriteString(")")
+	return nil
+}
+
+// negateExpr: -depth
+type negateExpr struct {
+	expr filterNode
+}
+
+func newNegateExpr(e filterNode) filterNode {
+	if l, ok := e.(*literalExpr); ok {
+		switch v := l.value.(type) {
+		case int64:
+			return &literalExpr{value: -v}
+		case float64:
+			return &literalExpr{value: -v}
+		}
+	}
+	return &negateExpr{expr: e}
+}
+
+func (e *negateExpr) writeSql(w *sqlWriter) error {
+	w.WriteString("(-")
+	if err := e.expr.writeSql(w); err != nil {
+		return err
+	}
+	w.WriteString(")")
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * The coordinate reference systems of srsName and crs. origin_geom is stored in EPSG:4326,
+ * features are reprojected into EPSG:2193 (NZTM) or EPSG:3857 (Web Mercator) with ST_Transform,
+ * and bboxes and filter geometries given in those are transformed back to EPSG:4326.
+ */
+
+const (
+	SRID_WGS84        = 4326
+	SRID_NZTM         = 2193
+	SRID_WEB_MERCATOR = 3857
+	CRS_URI_PREFIX    = "http://www.opengis.net/def/crs/EPSG/0/"
+	// projected bboxes are segmented into 10 km edges before they are transformed, so they keep their shape
+	CRS_SEGMENT_LENGTH = 10000
+)
+
+var supportedSrids = map[int]string{
+	SRID_WGS84:        "WGS 84",
+	SRID_NZTM:         "NZGD2000 / New Zealand Transverse Mercator 2000",
+	SRID_WEB_MERCATOR: "WGS 84 / Pseudo-Mercator",
+}
+
+/**
+ * The forms of an EPSG srsName. The urn and http forms follow the EPSG axis order, latitude, longitude
+ * for EPSG:4326 and northing, easting for EPSG:2193, the others are always x, y.
+ */
+var crsPrefixes = []struct {
+	prefix   string
+	epsgAxes bool
+}{
+	{"epsg:", false},
+	{"http://www.opengis.net/gml/srs/epsg.xml#", false},
+	{"urn:ogc:def:crs:epsg::", true},
+	{"urn:ogc:def:crs:epsg:6.6:", true},
+	{"urn:x-ogc:def:crs:epsg:", true},
+	{"http://www.opengis.net/def/crs/epsg/0/", true},
+}
+
+var crs84Names = map[string]bool{
+	"crs:84":                        true,
+	"urn:ogc:def:crs:ogc:1.3:crs84": true,
+	"http://www.opengis.net/def/crs/ogc/1.3/crs84": true,
+}
+
+// EPSG codes with northing (latitude) as their first axis
+var northingFirstSrids = map[int]bool{
+	SRID_WGS84: true,
+	SRID_NZTM:  true,
+}
+
+/**
+ * parseCrs reads the EPSG code of a srsName (empty is EPSG:4326), and whether its coordinates
+ * are in latitude, longitude (northing, easting) order.
+ */
+func parseCrs(srsName string) (int, bool, error) {
+	srs := strings.ToLower(strings.TrimSpace(srsName))
+	if srs == "" || crs84Names[srs] {
+		return SRID_WGS84, false, nil
+	}
+	for _, p := range crsPrefixes {
+		if !strings.HasPrefix(srs, p.prefix) {
+			continue
+		}
+		srid, err := strconv.Atoi(srs[len(p.prefix):])
+		if err != nil {
+			break
+		}
+		if srid == 900913 { //the old Google code of Web Mercator
+			srid = SRID_WEB_MERCATOR
+		}
+		if supportedSrids[srid] == "" {
+			break
+		}
+		return srid, p.epsgAxes && northingFirstSrids[srid], nil
+	}
+	return 0, false, errors.New("unsupported srsName " + srsName + ", use EPSG:4326, EPSG:2193 or EPSG:3857")
+}
+
+// isUrnCrs checks whether srsName is one of the urn or http forms, which follow the EPSG axis order
+func isUrnCrs(srsName string) bool {
+	srs := strings.ToLower(strings.TrimSpace(srsName))
+	for _, p := range crsPrefixes {
+		if p.epsgAxes && strings.HasPrefix(srs, p.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// crsUri is the http URI of an EPSG code, e.g. for the Content-Crs header
+func crsUri(srid int) string {
+	return CRS_URI_PREFIX + strconv.Itoa(srid)
+}
+
+// crsName is the short EPSG:n name of an EPSG code
+func crsName(srid int) string {
+	return "EPSG:" + strconv.Itoa(srid)
+}
+
+// isWgs84 checks whether an EPSG code (0 for the default) is the EPSG:4326 of the stored geometries
+func isWgs84(srid int) bool {
+	return srid == 0 || srid == SRID_WGS84
+}
+
+// transformSql reprojects the EPSG:4326 geometry sql into srid
+func transformSql(geom string, srid int) string {
+	if isWgs84(srid) {
+		return geom
+	}
+	return fmt.Sprintf("ST_Transform(%s, %d)", geom, srid)
+}
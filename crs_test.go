@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCrs(t *testing.T) {
+	tests := []struct {
+		srsName string
+		srid    int
+		latLon  bool
+	}{
+		{"", SRID_WGS84, false},
+		{"EPSG:4326", SRID_WGS84, false},
+		{"urn:ogc:def:crs:EPSG::4326", SRID_WGS84, true},
+		{"http://www.opengis.net/def/crs/OGC/1.3/CRS84", SRID_WGS84, false},
+		{"EPSG:2193", SRID_NZTM, false},
+		{"urn:ogc:def:crs:EPSG::2193", SRID_NZTM, true},
+		{"http://www.opengis.net/gml/srs/epsg.xml#3857", SRID_WEB_MERCATOR, false},
+		{"EPSG:900913", SRID_WEB_MERCATOR, false},
+		{"http://www.opengis.net/def/crs/EPSG/0/3857", SRID_WEB_MERCATOR, false},
+	}
+	for _, test := range tests {
+		srid, latLon, err := parseCrs(test.srsName)
+		if err != nil || srid != test.srid || latLon != test.latLon {
+			t.Errorf("%s: expected %d %v got %d %v %v", test.srsName, test.srid, test.latLon, srid, latLon, err)
+		}
+	}
+	for _, srsName := range []string{"EPSG:27200", "EPSG:", "urn:ogc:def:crs:EPSG::abc", "WGS84"} {
+		if _, _, err := parseCrs(srsName); err == nil {
+			t.Errorf("expected error for %s", srsName)
+		}
+	}
+}
+
+func TestSrsNameParams(t *testing.T) {
+	params, err := getQueryParams(map[string][]string{
+		"outputFormat": {"csv"},
+		"srsName":      {"EPSG:2193"},
+		"propertyName": {"publicid,origin_geom"},
+		"cql_filter":   {"BBOX(origin_geom,1500000,5300000,1600000,5400000,'EPSG:2193')"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlPre, header := getCsvSelect(params)
+	if header != "publicid,origin_geom" ||
+		sqlPre != "select format('%s,%s', publicid::text, ST_AsText(ST_Transform(origin_geom, 2193))) as csv from wfs.quake_search_v1" {
+		t.Errorf("got %s %s", sqlPre, header)
+	}
+	f, err := getQueryFilter(params)
+	if err != nil || cql2Sql(f) != "ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(1500000, 5300000, 1600000, 5400000, 2193), 10000), 4326), origin_geom)" {
+		t.Errorf("got %v %v", f, err)
+	}
+	if params.bbox != "" {
+		t.Errorf("expected no EPSG:4326 bounds, got %s", params.bbox)
+	}
+	if crs := params.geoJsonCrs(); crs == nil || crs.Properties["name"] != "urn:ogc:def:crs:EPSG::2193" {
+		t.Errorf("got %v", crs)
+	}
+	if params.gmlSrsName() != "http://www.opengis.net/gml/srs/epsg.xml#2193" {
+		t.Errorf("got %s", params.gmlSrsName())
+	}
+	//the GML bounds stay in EPSG:4326
+	if bounds := params.wgs84(); bounds.gmlSrsName() != "http://www.opengis.net/gml/srs/epsg.xml#4326" || bounds.gmlPos("164", "-49", " ") != "164 -49" {
+		t.Errorf("got %s", bounds.gmlSrsName())
+	}
+	params.urnCrs = true
+	if bounds := params.wgs84(); bounds.gmlSrsName() != "urn:ogc:def:crs:EPSG::4326" || bounds.gmlPos("164", "-49", " ") != "-49 164" {
+		t.Errorf("got %s", bounds.gmlSrsName())
+	}
+
+	if _, err := getQueryParams(map[string][]string{"srsName": {"EPSG:27200"}}); err == nil {
+		t.Error("expected error for EPSG:27200")
+	}
+}
+
+func TestAxisOrder(t *testing.T) {
+	params, err := getQueryParams(map[string][]string{
+		"version":    {"2.0.0"},
+		"srsName":    {"urn:ogc:def:crs:EPSG::4326"},
+		"cql_filter": {"BBOX(origin_geom,-42,174,-41,175,'urn:ogc:def:crs:EPSG::4326')"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !params.latLon || params.gmlSrsName() != "urn:ogc:def:crs:EPSG::4326" ||
+		params.gmlSql(3, "origin_geom") != "ST_AsGML(3, ST_FlipCoordinates(origin_geom), 15, 1)" ||
+		params.gmlPos("174", "-41", " ") != "-41 174" {
+		t.Errorf("expected latitude, longitude, got %s %s", params.gmlSrsName(), params.gmlSql(3, "origin_geom"))
+	}
+	f, err := getQueryFilter(params)
+	if err != nil || cql2Sql(f) != `ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)` {
+		t.Errorf("got %v %v", f, err)
+	}
+	if swapGmlCoordinates(GML_BBOX_NZ) != "-49,164 -32,-176" {
+		t.Errorf("got %s", swapGmlCoordinates(GML_BBOX_NZ))
+	}
+
+	//WFS 1.0.0 and the EPSG:4326 short form are longitude, latitude
+	for _, v := range []map[string][]string{
+		{"version": {"1.0.0"}, "srsName": {"urn:ogc:def:crs:EPSG::4326"}},
+		{"version": {"2.0.0"}, "srsName": {"EPSG:4326"}},
+	} {
+		params, _ := getQueryParams(v)
+		if params.latLon || params.gmlSrsName() != "http://www.opengis.net/gml/srs/epsg.xml#4326" ||
+			params.gmlSql(3, "origin_geom") != "ST_AsGML(3, origin_geom, 15, 0)" {
+			t.Errorf("%v: expected longitude, latitude", v)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Declustering of the filtered quakes into mainshocks, foreshocks and aftershocks.
+ * /decluster?method=reasenberg&cql_filter=origintime>='2010-01-01'&outputFormat=csv
+ * GetFeature takes declustered=true (Gardner-Knopoff), declustered=gardner-knopoff or declustered=reasenberg
+ * and returns the mainshocks only. The quakes are declustered after the other filters.
+ *
+ * Gardner and Knopoff (1974): from the largest quake down, the quakes within the distance and time windows
+ * of a quake not yet in a cluster are its cluster.
+ * Reasenberg (1985): in time order, a quake joins the cluster of an earlier quake within its interaction
+ * distance and look-ahead time, with the standard parameters of ZMAP.
+ * The largest quake of a cluster is its mainshock, the quakes before it are foreshocks and after it aftershocks.
+ * The quakes that are not in a cluster are mainshocks of cluster 0.
+ */
+const (
+	DECLUSTER_GARDNER_KNOPOFF = "gardner-knopoff"
+	DECLUSTER_REASENBERG      = "reasenberg"
+	DECLUSTER_MAX_QUAKES      = 200000
+
+	LABEL_MAINSHOCK  = "mainshock"
+	LABEL_FORESHOCK  = "foreshock"
+	LABEL_AFTERSHOCK = "aftershock"
+
+	// the Reasenberg parameters of ZMAP
+	REASENBERG_TAU_MIN = 1.0  // days
+	REASENBERG_TAU_MAX = 10.0 // days
+	REASENBERG_P       = 0.95 // confidence of the look-ahead time
+	REASENBERG_XK      = 0.5  // increase of the lower cutoff magnitude during clusters
+	REASENBERG_XMEFF   = 1.5  // effective lower cutoff magnitude
+	REASENBERG_RFACT   = 10.0 // interaction distances of the crack radius
+
+	SECONDS_PER_DAY = 86400
+)
+
+var declusterParams = []string{
+	"typeName",
+	"method", //gardner-knopoff (default) or reasenberg
+	"cql_filter",
+	"filter",
+	"filter-lang",
+	"bbox",
+	"outputFormat", //json (default) or csv
+}
+
+// declusterEvent is a quake of the catalogue, in time order
+type declusterEvent struct {
+	Publicid   string   `json:"publicid"`
+	Origintime string   `json:"origintime"`
+	Longitude  float64  `json:"longitude"`
+	Latitude   float64  `json:"latitude"`
+	Depth      *float64 `json:"depth"`
+	Magnitude  *float64 `json:"magnitude"`
+	Cluster    int      `json:"cluster"`
+	Label      string   `json:"label"`
+	time       float64  // days
+}
+
+func (e *declusterEvent) magnitude() float64 {
+	if e.Magnitude == nil {
+		return 0
+	}
+	return *e.Magnitude
+}
+
+func (e *declusterEvent) depth() float64 {
+	if e.Depth == nil {
+		return 0
+	}
+	return *e.Depth
+}
+
+// epicentralDistance is in km
+func (e *declusterEvent) epicentralDistance(o *declusterEvent) float64 {
+	return greatCircleDistance(Coord{e.Longitude, e.Latitude}, Coord{o.Longitude, o.Latitude})
+}
+
+// hypocentralDistance is in km
+func (e *declusterEvent) hypocentralDistance(o *declusterEvent) float64 {
+	return math.Hypot(e.epicentralDistance(o), e.depth()-o.depth())
+}
+
+// parseDeclusterMethod reads a method, true is DECLUSTER_GARDNER_KNOPOFF
+func parseDeclusterMethod(method string) (string, error) {
+	switch m := strings.ToLower(method); m {
+	case "", "true", DECLUSTER_GARDNER_KNOPOFF:
+		return DECLUSTER_GARDNER_KNOPOFF, nil
+	case DECLUSTER_REASENBERG:
+		return m, nil
+	}
+	return "", errors.New("unknown declustering method " + method + ", use " + DECLUSTER_GARDNER_KNOPOFF + " or " + DECLUSTER_REASENBERG)
+}
+
+// gardnerKnopoffWindow is the distance (km) and time (days) window of a magnitude
+func gardnerKnopoffWindow(magnitude float64) (float64, float64) {
+	distance := math.Pow(10, 0.1238*magnitude+0.983)
+	if magnitude >= 6.5 {
+		return distance, math.Pow(10, 0.032*magnitude+2.7389)
+	}
+	return distance, math.Pow(10, 0.5409*magnitude-0.547)
+}
+
+// declusterGardnerKnopoff labels the events, in time order
+func declusterGardnerKnopoff(events []*declusterEvent) {
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return events[order[a]].magnitude() > events[order[b]].magnitude() })
+
+	clusters := make([]int, len(events))
+	next := 1
+	for _, i := range order {
+		e := events[i]
+		if clusters[i] != 0 || e.Magnitude == nil {
+			continue
+		}
+		distance, days := gardnerKnopoffWindow(*e.Magnitude)
+		members := make([]int, 0)
+		for j := i - 1; j >= 0 && e.time-events[j].time <= days; j-- {
+			if clusters[j] == 0 && e.epicentralDistance(events[j]) <= distance {
+				members = append(members, j)
+			}
+		}
+		for j := i + 1; j < len(events) && events[j].time-e.time <= days; j++ {
+			if clusters[j] == 0 && e.epicentralDistance(events[j]) <= distance {
+				members = append(members, j)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		clusters[i] = next
+		for _, j := range members {
+			clusters[j] = next
+		}
+		next++
+	}
+	labelClusters(events, clusters)
+}
+
+// reasenbergTau is the look-ahead time (days) of a quake days after the largest quake of its cluster
+func reasenbergTau(largest float64, days float64) float64 {
+	deltaM := math.Max(0, (1-REASENBERG_XK)*largest-REASENBERG_XMEFF)
+	tau := -math.Log(1-REASENBERG_P) * days / math.Pow(10, (deltaM-1)*2/3)
+	return math.Max(REASENBERG_TAU_MIN, math.Min(REASENBERG_TAU_MAX, tau))
+}
+
+// reasenbergRadius is the interaction distance (km) of a magnitude, RFACT crack radii
+func reasenbergRadius(magnitude float64) float64 {
+	return REASENBERG_RFACT * 0.011 * math.Pow(10, 0.4*magnitude)
+}
+
+// declusterReasenberg labels the events, in time order
+func declusterReasenberg(events []*declusterEvent) {
+	clusters := make([]int, len(events))
+	largest := make(map[int]int) // the largest event of a cluster
+	next := 1
+	join := func(i int, c int) {
+		clusters[i] = c
+		if k, ok := largest[c]; !ok || events[i].magnitude() > events[k].magnitude() {
+			largest[c] = i
+		}
+	}
+	for i, e := range events {
+		tau, magnitude := REASENBERG_TAU_MIN, e.magnitude()
+		if c := clusters[i]; c != 0 {
+			k := largest[c]
+			magnitude = math.Max(magnitude, events[k].magnitude())
+			tau = reasenbergTau(events[k].magnitude(), e.time-events[k].time)
+		}
+		radius := reasenbergRadius(magnitude)
+		for j := i + 1; j < len(events) && events[j].time-e.time <= tau; j++ {
+			if e.hypocentralDistance(events[j]) > radius {
+				continue
+			}
+			ci, cj := clusters[i], clusters[j]
+			switch {
+			case ci == 0 && cj == 0:
+				join(i, next)
+				join(j, next)
+				next++
+			case cj == 0:
+				join(j, ci)
+			case ci == 0:
+				join(i, cj)
+			case ci != cj: //merge the later cluster
+				for k := range clusters {
+					if clusters[k] == cj {
+						join(k, ci)
+					}
+				}
+				delete(largest, cj)
+			}
+		}
+	}
+	labelClusters(events, clusters)
+}
+
+/**
+ * labelClusters sets the cluster and label of the events, the clusters numbered in the time order
+ * of their first events, the largest (the first of equals) the mainshock.
+ */
+func labelClusters(events []*declusterEvent, clusters []int) {
+	mainshocks := make(map[int]int)
+	numbers := make(map[int]int)
+	for i, c := range clusters {
+		if c == 0 {
+			continue
+		}
+		if _, ok := numbers[c]; !ok {
+			numbers[c] = len(numbers) + 1
+		}
+		if k, ok := mainshocks[c]; !ok || events[i].magnitude() > events[k].magnitude() {
+			mainshocks[c] = i
+		}
+	}
+	for i, e := range events {
+		c := clusters[i]
+		e.Cluster, e.Label = numbers[c], LABEL_MAINSHOCK
+		if c == 0 {
+			continue
+		}
+		if k := mainshocks[c]; i < k {
+			e.Label = LABEL_FORESHOCK
+		} else if i > k {
+			e.Label = LABEL_AFTERSHOCK
+		}
+	}
+}
+
+// getDeclusteredQuakes reads the quakes of params in time order and declusters them
+func getDeclusteredQuakes(params *QueryParams, method string) ([]*declusterEvent, *result) {
+	sqlPre := `select publicid, to_char(origintime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"'), extract(epoch from origintime),
+     longitude, latitude, depth, magnitude from ` + params.layer.Table
+	all := params.unpaged()
+	all.sortBy, all.maxFeatures = "origintime", DECLUSTER_MAX_QUAKES+1
+	sqlString, args, err := getSqlQueryString(sqlPre, all)
+	if err != nil {
+		return nil, badRequest(err.Error())
+	}
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+	defer rows.Close()
+
+	events := make([]*declusterEvent, 0)
+	for rows.Next() {
+		var (
+			e                declusterEvent
+			seconds          float64
+			depth, magnitude sql.NullFloat64
+		)
+		if err := rows.Scan(&e.Publicid, &e.Origintime, &seconds, &e.Longitude, &e.Latitude, &depth, &magnitude); err != nil {
+			return nil, internalServerError(err)
+		}
+		e.time = seconds / SECONDS_PER_DAY
+		if depth.Valid {
+			e.Depth = &depth.Float64
+		}
+		if magnitude.Valid {
+			e.Magnitude = &magnitude.Float64
+		}
+		events = append(events, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, internalServerError(err)
+	}
+	if len(events) > DECLUSTER_MAX_QUAKES {
+		return nil, badRequest(fmt.Sprintf("more than %d quakes to decluster, please filter them", DECLUSTER_MAX_QUAKES))
+	}
+
+	if method == DECLUSTER_REASENBERG {
+		declusterReasenberg(events)
+	} else {
+		declusterGardnerKnopoff(events)
+	}
+	return events, nil
+}
+
+/**
+ * getDecluster labels the filtered quakes as JSON or CSV.
+ * /decluster?method=gardner-knopoff&cql_filter=origintime>='2016-11-13'+AND+origintime<'2016-12-13'
+ */
+func getDecluster(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{}, declusterParams); !res.ok {
+		return res
+	}
+	v := r.URL.Query()
+	params, err := getQueryParams(v)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	if !params.layer.isQuake() {
+		return badRequest("declustering is for quakes only")
+	}
+	switch params.outputFormat {
+	case "", "JSON", "CSV":
+	default:
+		return badRequest("unsupported outputFormat " + params.outputFormat + ", use json or csv")
+	}
+	method, err := parseDeclusterMethod(v.Get("method"))
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	events, res := getDeclusteredQuakes(params, method)
+	if res != nil {
+		return res
+	}
+
+	if params.outputFormat == "CSV" {
+		b.WriteString("publicid,origintime,longitude,latitude,depth,magnitude,cluster,label\n")
+		for _, e := range events {
+			b.WriteString(strings.Join([]string{e.Publicid, e.Origintime, formatCoord(e.Longitude), formatCoord(e.Latitude),
+				formatOptional(e.Depth), formatOptional(e.Magnitude), strconv.Itoa(e.Cluster), e.Label}, ",") + "\n")
+		}
+		h.Set("Content-Disposition", `attachment; filename="decluster.csv"`)
+		h.Set("Content-Type", V1CSV)
+		return &statusOK
+	}
+	return writeJson(h, b, "application/json", map[string]interface{}{"method": method, "quakes": events})
+}
+
+/**
+ * idListFilter matches (or excludes) a list of ids of any length with a single bound parameter,
+ * column = ANY(string_to_array($1, ',')), the ids have no commas.
+ */
+type idListFilter struct {
+	column  string
+	ids     []string
+	exclude bool
+}
+
+func (f *idListFilter) writeSql(w *sqlWriter) error {
+	if f.exclude {
+		w.WriteString("NOT ")
+	}
+	w.WriteString("(" + f.column + " = ANY(string_to_array(")
+	w.bind(strings.Join(f.ids, ","))
+	w.WriteString(", ',')))")
+	return nil
+}
+
+/**
+ * setDeclustered adds the filter of the mainshocks of the declustered parameter to params,
+ * excluding the foreshocks and aftershocks of the quakes of params.
+ */
+func setDeclustered(params *QueryParams, declustered string) *result {
+	if declustered == "" || strings.EqualFold(declustered, "false") {
+		return nil
+	}
+	method, err := parseDeclusterMethod(declustered)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	events, res := getDeclusteredQuakes(params, method)
+	if res != nil {
+		return res
+	}
+	dependent := make([]string, 0)
+	for _, e := range events {
+		if e.Label != LABEL_MAINSHOCK {
+			dependent = append(dependent, e.Publicid)
+		}
+	}
+	if len(dependent) > 0 {
+		params.filters = append(params.filters, &idListFilter{column: params.layer.IdColumn, ids: dependent, exclude: true})
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func newDeclusterEvent(id string, days, longitude, latitude, depth, magnitude float64) *declusterEvent {
+	return &declusterEvent{Publicid: id, time: days, Longitude: longitude, Latitude: latitude, Depth: &depth, Magnitude: &magnitude}
+}
+
+// a magnitude 6 sequence near Kaikoura, with a quake far away and one a long time later
+func declusterSequence() []*declusterEvent {
+	return []*declusterEvent{
+		newDeclusterEvent("far", 99, 176, -38, 10, 4),
+		newDeclusterEvent("foreshock", 99.5, 173.5, -42.45, 14, 4.5),
+		newDeclusterEvent("mainshock", 100, 173.5, -42.5, 15, 6),
+		newDeclusterEvent("aftershock1", 100.1, 173.55, -42.45, 10, 4.8),
+		newDeclusterEvent("aftershock2", 100.5, 173.6, -42.5, 8, 4.2),
+		newDeclusterEvent("aftershock3", 101.2, 173.5, -42.55, 9, 3.9),
+		newDeclusterEvent("later", 2000, 173.5, -42.5, 10, 4),
+	}
+}
+
+func TestGardnerKnopoffWindow(t *testing.T) {
+	distance, days := gardnerKnopoffWindow(5)
+	if math.Abs(distance-39.99) > 0.1 || math.Abs(days-143.7) > 0.1 {
+		t.Errorf("got %v %v", distance, days)
+	}
+	if _, days = gardnerKnopoffWindow(7); math.Abs(days-918.1) > 0.1 {
+		t.Errorf("got %v", days)
+	}
+}
+
+func TestDecluster(t *testing.T) {
+	expected := map[string]struct {
+		cluster int
+		label   string
+	}{
+		"far":         {0, LABEL_MAINSHOCK},
+		"foreshock":   {1, LABEL_FORESHOCK},
+		"mainshock":   {1, LABEL_MAINSHOCK},
+		"aftershock1": {1, LABEL_AFTERSHOCK},
+		"aftershock2": {1, LABEL_AFTERSHOCK},
+		"aftershock3": {1, LABEL_AFTERSHOCK},
+		"later":       {0, LABEL_MAINSHOCK},
+	}
+	for method, decluster := range map[string]func([]*declusterEvent){
+		DECLUSTER_GARDNER_KNOPOFF: declusterGardnerKnopoff,
+		DECLUSTER_REASENBERG:      declusterReasenberg,
+	} {
+		events := declusterSequence()
+		decluster(events)
+		for _, e := range events {
+			if x := expected[e.Publicid]; e.Cluster != x.cluster || e.Label != x.label {
+				t.Errorf("%s %s: expected %d %s got %d %s", method, e.Publicid, x.cluster, x.label, e.Cluster, e.Label)
+			}
+		}
+	}
+}
+
+func TestReasenbergTau(t *testing.T) {
+	if tau := reasenbergTau(6, 0.1); tau != REASENBERG_TAU_MIN {
+		t.Errorf("expected the minimum look-ahead, got %v", tau)
+	}
+	if tau := reasenbergTau(3, 100); tau != REASENBERG_TAU_MAX {
+		t.Errorf("expected the maximum look-ahead, got %v", tau)
+	}
+	if tau := reasenbergTau(4, 0.5); math.Abs(tau-0.5*-math.Log(0.05)/math.Pow(10, -1.0/3)) > 1e-9 {
+		t.Errorf("got %v", tau)
+	}
+}
+
+func TestParseDeclusterMethod(t *testing.T) {
+	tests := map[string]string{"true": DECLUSTER_GARDNER_KNOPOFF, "": DECLUSTER_GARDNER_KNOPOFF,
+		"Reasenberg": DECLUSTER_REASENBERG, "gardner-knopoff": DECLUSTER_GARDNER_KNOPOFF}
+	for s, expected := range tests {
+		if method, err := parseDeclusterMethod(s); err != nil || method != expected {
+			t.Errorf("%s: expected %s got %s %v", s, expected, method, err)
+		}
+	}
+	if _, err := parseDeclusterMethod("zaliapin"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestIdListFilter(t *testing.T) {
+	f := &idListFilter{column: "publicid", ids: []string{"2016p858000", "2016p858021"}, exclude: true}
+	if s := cql2Sql(f); s != "NOT (publicid = ANY(string_to_array('2016p858000,2016p858021', ',')))" {
+		t.Errorf("got %s", s)
+	}
+	w := &sqlWriter{}
+	if err := f.writeSql(w); err != nil || w.String() != "NOT (publicid = ANY(string_to_array($1, ',')))" || len(w.args) != 1 {
+		t.Errorf("got %s %v", w.String(), w.args)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * GeoJSON, CSV and GML of the layers without the quake schema, written from their configured attributes.
+ */
+
+/**
+ * the features in the outputFormat of params, nil for an unknown outputFormat
+ */
+func getFeaturesOutput(r *http.Request, h http.Header, b *bytes.Buffer, params *QueryParams) *result {
+	switch {
+	case params.outputFormat == "JSON":
+		return getFeaturesGeoJson(h, b, params)
+	case params.outputFormat == "CSV":
+		return getFeaturesCsv(h, b, params)
+	case params.outputFormat == "GML2":
+		return getFeaturesGml(h, b, params, 2)
+	case params.outputFormat == "TEXT/XML" && params.subType == "GML/3.2":
+		return getFeaturesGml(h, b, params, 3)
+	}
+	return nil
+}
+
+type featureRow struct {
+	id       string
+	values   []sql.NullString //of the layer attributes, as text
+	geometry sql.NullString
+}
+
+/**
+ * queryFeatures selects the id, the attributes as text and the geometry (written by geometrySql, e.g. ST_AsGeoJSON(%s))
+ * of the features matching params and calls f for each of them
+ */
+func queryFeatures(params *QueryParams, geometrySql string, f func(row *featureRow) error) *result {
+	l := params.layer
+	columns := []string{l.IdColumn + "::text"}
+	for i := range l.Attributes {
+		columns = append(columns, l.Attributes[i].textColumn())
+	}
+	columns = append(columns, fmt.Sprintf(geometrySql, params.geometrySql(l.Geometry)))
+	sqlPre := "select " + strings.Join(columns, ", ") + " from " + l.Table
+
+	sqlString, args, err := getSqlQueryString(sqlPre, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := &featureRow{values: make([]sql.NullString, len(l.Attributes))}
+		dest := []interface{}{&row.id}
+		for i := range row.values {
+			dest = append(dest, &row.values[i])
+		}
+		dest = append(dest, &row.geometry)
+		if err := rows.Scan(dest...); err != nil {
+			return internalServerError(err)
+		}
+		if err := f(row); err != nil {
+			return internalServerError(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+	return &statusOK
+}
+
+func getFeaturesGeoJson(h http.Header, b *bytes.Buffer, params *QueryParams) *result {
+	features, res := getLayerFeatures(params)
+	if !res.ok {
+		return res
+	}
+
+	jsonBytes, err := json.Marshal(GeoJsonFeatureCollection{Type: "FeatureCollection", Features: features, Crs: params.geoJsonCrs()})
+	if err != nil {
+		return internalServerError(err)
+	}
+	b.Write(jsonBytes)
+	h.Set("Content-Type", V1GeoJSON)
+	return &statusOK
+}
+
+// getGeoJsonFeatures queries the features of any layer matching params
+func getGeoJsonFeatures(params *QueryParams) ([]Feature, *result) {
+	if params.layer.isQuake() {
+		return getQuakeFeatures(params)
+	}
+	return getLayerFeatures(params)
+}
+
+// getLayerFeatures queries the features matching params as GeoJSON features
+func getLayerFeatures(params *QueryParams) ([]Feature, *result) {
+	l := params.layer
+	features := make([]Feature, 0)
+	res := queryFeatures(params, "ST_AsGeoJSON(%s)", func(row *featureRow) error {
+		properties := make(map[string]interface{})
+		for i, a := range l.Attributes {
+			if !row.values[i].Valid || !params.hasProperty(a.Name) {
+				continue
+			}
+			value, err := a.jsonValue(row.values[i].String)
+			if err != nil {
+				return err
+			}
+			properties[a.Name] = value
+		}
+		feature := Feature{Type: "Feature", Id: l.IdPrefix + "." + row.id, Properties: properties}
+		if row.geometry.Valid {
+			feature.Geometry = json.RawMessage(row.geometry.String)
+		}
+		features = append(features, feature)
+		return nil
+	})
+	return features, res
+}
+
+// jsonValue types the text value of an attribute
+func (a *layerAttribute) jsonValue(s string) (interface{}, error) {
+	switch a.Type {
+	case ATTRIBUTE_DOUBLE:
+		return strconv.ParseFloat(s, 64)
+	case ATTRIBUTE_INTEGER:
+		return strconv.ParseInt(s, 10, 64)
+	}
+	return s, nil
+}
+
+func getFeaturesCsv(h http.Header, b *bytes.Buffer, params *QueryParams) *result {
+	sqlPre, header := getCsvSelect(params)
+	sqlString, args, err := getSqlQueryString(sqlPre, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+
+	b.WriteString(header + "\n")
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return internalServerError(err)
+		}
+		b.WriteString(line + "\n")
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+	h.Set("Content-Disposition", `attachment; filename="`+params.layer.Name+`.csv"`)
+	h.Set("Content-Type", V1CSV)
+	return &statusOK
+}
+
+func getFeaturesGml(h http.Header, b *bytes.Buffer, params *QueryParams, gmlVersion int) *result {
+	l := params.layer
+	member, idAttr := "gml:featureMember", "fid"
+	if gmlVersion == 3 {
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<wfs:FeatureCollection xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:gml="http://www.opengis.net/gml/3.2"
+   xmlns:geonet="http://geonet.org.nz" timeStamp="` + time.Now().Format(RFC3339_FORMAT) + `">` + "\n")
+		member, idAttr = "wfs:member", "gml:id"
+	} else {
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<wfs:FeatureCollection xmlns:wfs="http://www.opengis.net/wfs" xmlns:gml="http://www.opengis.net/gml"
+   xmlns:geonet="http://geonet.org.nz">` + "\n")
+	}
+
+	options := 0
+	if params.urnCrs {
+		options = 1
+	}
+	res := queryFeatures(params, fmt.Sprintf("ST_AsGML(%d, %%s, 15, %d)", gmlVersion, options), func(row *featureRow) error {
+		b.WriteString(fmt.Sprintf("<%s>\n<geonet:%s %s=\"%s.", member, l.Name, idAttr, l.IdPrefix))
+		xml.EscapeText(b, []byte(row.id))
+		b.WriteString("\">\n")
+		for i, a := range l.Attributes {
+			if !row.values[i].Valid || !params.hasProperty(a.Name) {
+				continue
+			}
+			b.WriteString("<geonet:" + a.Name + ">")
+			xml.EscapeText(b, []byte(row.values[i].String))
+			b.WriteString("</geonet:" + a.Name + ">\n")
+		}
+		if row.geometry.Valid && params.hasProperty(l.Geometry) {
+			b.WriteString(fmt.Sprintf("<geonet:%s>%s</geonet:%s>\n", l.Geometry, row.geometry.String, l.Geometry))
+		}
+		b.WriteString(fmt.Sprintf("</geonet:%s></%s>\n", l.Name, member))
+		return nil
+	})
+	if !res.ok {
+		return res
+	}
+	b.WriteString("</wfs:FeatureCollection>")
+	h.Set("Content-Type", CONTENT_TYPE_XML)
+	return &statusOK
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+ * OGC Filter Encoding (FES 1.1 ogc:Filter and FES 2.0 fes:Filter) documents, sent in the filter parameter.
+ * Elements are matched by local name so both versions and any namespace prefix work, e.g.
+ *
+ * <fes:Filter><fes:And>
+ *   <fes:PropertyIsGreaterThanOrEqualTo><fes:ValueReference>magnitude</fes:ValueReference><fes:Literal>4</fes:Literal></fes:PropertyIsGreaterThanOrEqualTo>
+ *   <fes:Within><fes:ValueReference>origin_geom</fes:ValueReference><gml:Polygon>...</gml:Polygon></fes:Within>
+ * </fes:And></fes:Filter>
+ */
+const (
+	FES_DEFAULT_GEOMETRY = "origin_geom" //the geometry of a BBOX without a property
+)
+
+// the FES comparison operators
+var fesComparisonOps = map[string]string{
+	"PropertyIsEqualTo":              "=",
+	"PropertyIsNotEqualTo":           "<>",
+	"PropertyIsLessThan":             "<",
+	"PropertyIsGreaterThan":          ">",
+	"PropertyIsLessThanOrEqualTo":    "<=",
+	"PropertyIsGreaterThanOrEqualTo": ">=",
+}
+
+// the FES arithmetic operators (FES 1.1)
+var fesArithmeticOps = map[string]string{
+	"Add": "+",
+	"Sub": "-",
+	"Mul": "*",
+	"Div": "/",
+}
+
+// xmlElement is a generic XML element, for documents matched by local name
+type xmlElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Children []xmlElement `xml:",any"`
+	Text     string       `xml:",chardata"`
+}
+
+func parseXmlElement(doc string) (*xmlElement, error) {
+	e := &xmlElement{}
+	if err := xml.Unmarshal([]byte(doc), e); err != nil {
+		return nil, errors.New("invalid XML, " + err.Error())
+	}
+	return e, nil
+}
+
+func (e *xmlElement) name() string {
+	return e.XMLName.Local
+}
+
+// attr returns the value of the attribute with the local name, or ""
+func (e *xmlElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element with the local name, or nil
+func (e *xmlElement) child(name string) *xmlElement {
+	for i := range e.Children {
+		if e.Children[i].name() == name {
+			return &e.Children[i]
+		}
+	}
+	return nil
+}
+
+func (e *xmlElement) text() string {
+	return strings.TrimSpace(e.Text)
+}
+
+// String writes the element back as XML by local names, without the namespace declarations
+func (e *xmlElement) String() string {
+	var b bytes.Buffer
+	e.write(&b)
+	return b.String()
+}
+
+func (e *xmlElement) write(b *bytes.Buffer) {
+	b.WriteString("<" + e.name())
+	for _, a := range e.Attrs {
+		if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+			continue
+		}
+		b.WriteString(" " + a.Name.Local + `="`)
+		xml.EscapeText(b, []byte(a.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	xml.EscapeText(b, []byte(e.Text))
+	for i := range e.Children {
+		e.Children[i].write(b)
+	}
+	b.WriteString("</" + e.name() + ">")
+}
+
+// ParseFesFilter parses an ogc:Filter or fes:Filter document of layer l
+func ParseFesFilter(doc string, l *featureLayer) (filterNode, error) {
+	root, err := parseXmlElement(doc)
+	if err != nil {
+		return nil, err
+	}
+	return parseFesFilterElement(root, l)
+}
+
+func parseFesFilterElement(root *xmlElement, l *featureLayer) (filterNode, error) {
+	if root.name() != "Filter" {
+		return nil, errors.New("invalid filter, expecting a Filter element but found " + root.name())
+	}
+	if len(root.Children) == 0 {
+		return nil, errors.New("invalid filter, the Filter is empty")
+	}
+	if isFesId(&root.Children[0]) {
+		return parseFesIds(root.Children, l)
+	}
+	if len(root.Children) != 1 {
+		return nil, errors.New("invalid filter, a Filter has one operator, use And or Or to combine them")
+	}
+	return parseFesOperator(&root.Children[0])
+}
+
+func isFesId(e *xmlElement) bool {
+	switch e.name() {
+	case "ResourceId", "FeatureId", "GmlObjectId":
+		return true
+	}
+	return false
+}
+
+// parseFesIds parses <fes:ResourceId rid="quake.2016p123456"/> and <ogc:FeatureId fid="..."/> of layer l
+func parseFesIds(elements []xmlElement, l *featureLayer) (filterNode, error) {
+	ids := make([]string, 0, len(elements))
+	for i := range elements {
+		e := &elements[i]
+		if !isFesId(e) {
+			return nil, errors.New("invalid filter, " + e.name() + " can't be mixed with feature ids")
+		}
+		id := e.attr("rid")
+		if id == "" {
+			id = e.attr("fid")
+		}
+		if id == "" {
+			id = e.attr("id")
+		}
+		ids = append(ids, id)
+	}
+	return newLayerFeatureIdFilter(l, ids)
+}
+
+func parseFesOperator(e *xmlElement) (filterNode, error) {
+	name := e.name()
+	if op, ok := fesComparisonOps[name]; ok {
+		exprs, err := parseFesExpressions(e, 2)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(e.attr("matchCase"), "false") && isTextComparison(exprs) {
+			for i := range exprs {
+				if exprs[i], err = newFunctionExpr("casei", []filterNode{exprs[i]}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return &comparisonFilter{op: op, left: exprs[0], right: exprs[1]}, nil
+	}
+	if function, ok := spatialFunctions[strings.ToLower(name)]; ok && function != "ST_Relate" {
+		return parseFesSpatial(e, strings.ToUpper(name))
+	}
+
+	switch name {
+	case "And", "Or":
+		if len(e.Children) < 2 {
+			return nil, errors.New("invalid filter, " + name + " needs at least two operators")
+		}
+		f := &logicFilter{op: strings.ToUpper(name)}
+		for i := range e.Children {
+			child, err := parseFesOperator(&e.Children[i])
+			if err != nil {
+				return nil, err
+			}
+			f.children = append(f.children, child)
+		}
+		return f, nil
+	case "Not":
+		if len(e.Children) != 1 {
+			return nil, errors.New("invalid filter, Not needs one operator")
+		}
+		child, err := parseFesOperator(&e.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{child: child}, nil
+	case "PropertyIsNull", "PropertyIsNil":
+		exprs, err := parseFesExpressions(e, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &nullFilter{expr: exprs[0]}, nil
+	case "PropertyIsBetween":
+		return parseFesBetween(e)
+	case "PropertyIsLike":
+		return parseFesLike(e)
+	case "BBOX":
+		return parseFesBBox(e)
+	case "DWithin", "Beyond":
+		return parseFesDistance(e)
+	}
+	return nil, errors.New("invalid filter, unsupported operator " + name)
+}
+
+/**
+ * isTextComparison is true when matchCase="false" applies: one side is a string literal or string attribute
+ * and neither is a number, time or attribute of another type. Functions and arithmetic are of unknown type.
+ */
+func isTextComparison(exprs []filterNode) bool {
+	text := false
+	for _, expr := range exprs {
+		switch e := expr.(type) {
+		case *literalExpr:
+			if _, ok := e.value.(string); !ok {
+				return false
+			}
+			text = true
+		case *timeExpr:
+			return false
+		case *propertyExpr:
+			switch propertyType(e.name) {
+			case ATTRIBUTE_STRING:
+				text = true
+			case "":
+			default:
+				return false
+			}
+		}
+	}
+	return text
+}
+
+func parseFesExpressions(e *xmlElement, count int) ([]filterNode, error) {
+	if len(e.Children) != count {
+		return nil, errors.New("invalid filter, " + e.name() + " takes " + strconv.Itoa(count) + " expressions")
+	}
+	exprs := make([]filterNode, count)
+	for i := range e.Children {
+		expr, err := parseFesExpression(&e.Children[i])
+		if err != nil {
+			return nil, err
+		}
+		exprs[i] = expr
+	}
+	return exprs, nil
+}
+
+// parseFesExpression parses a ValueReference (PropertyName), Literal, Function or arithmetic operator
+func parseFesExpression(e *xmlElement) (filterNode, error) {
+	switch e.name() {
+	case "ValueReference", "PropertyName":
+		return newPropertyExpr(fesPropertyName(e.text()))
+	case "Literal":
+		return newLiteralFromText(e.text()), nil
+	case "Function":
+		args := make([]filterNode, 0, len(e.Children))
+		for i := range e.Children {
+			arg, err := parseFesExpression(&e.Children[i])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return newFunctionExpr(e.attr("name"), args)
+	}
+	if op, ok := fesArithmeticOps[e.name()]; ok {
+		exprs, err := parseFesExpressions(e, 2)
+		if err != nil {
+			return nil, err
+		}
+		return newArithmeticExpr(op, exprs[0], exprs[1])
+	}
+	return nil, errors.New("invalid filter, expecting a ValueReference, Literal or Function but found " + e.name())
+}
+
+// fesPropertyName strips the namespace prefix and path, geonet:quake_search_v1/geonet:magnitude is magnitude
+func fesPropertyName(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// newLiteralFromText types a literal written as text: a number, a date time or a string
+func newLiteralFromText(s string) filterNode {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return &literalExpr{value: i}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return &literalExpr{value: f}
+	}
+	if PatternMatch(ISO_TIME_PATTERN, s) {
+		return &timeExpr{value: s}
+	}
+	return &literalExpr{value: s}
+}
+
+func parseFesBetween(e *xmlElement) (filterNode, error) {
+	if len(e.Children) != 3 {
+		return nil, errors.New("invalid filter, PropertyIsBetween takes an expression, LowerBoundary and UpperBoundary")
+	}
+	expr, err := parseFesExpression(&e.Children[0])
+	if err != nil {
+		return nil, err
+	}
+	bounds := make([]filterNode, 2)
+	for i, name := range []string{"LowerBoundary", "UpperBoundary"} {
+		b := e.child(name)
+		if b == nil || len(b.Children) != 1 {
+			return nil, errors.New("invalid filter, PropertyIsBetween needs a " + name + " with one expression")
+		}
+		if bounds[i], err = parseFesExpression(&b.Children[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &betweenFilter{expr: expr, lower: bounds[0], upper: bounds[1]}, nil
+}
+
+/**
+ * <PropertyIsLike wildCard="*" singleChar="." escapeChar="!"> the pattern is converted to
+ * a LIKE pattern, matchCase="false" is ILIKE.
+ */
+func parseFesLike(e *xmlElement) (filterNode, error) {
+	if len(e.Children) != 2 || e.Children[1].name() != "Literal" {
+		return nil, errors.New("invalid filter, PropertyIsLike takes an expression and a Literal pattern")
+	}
+	expr, err := parseFesExpression(&e.Children[0])
+	if err != nil {
+		return nil, err
+	}
+	wildCard, singleChar, escapeChar := e.attr("wildCard"), e.attr("singleChar"), e.attr("escapeChar")
+	if escapeChar == "" {
+		escapeChar = e.attr("escape") //FES 1.1
+	}
+	if wildCard == "" {
+		wildCard = "*"
+	}
+	if singleChar == "" {
+		singleChar = "."
+	}
+	if escapeChar == "" {
+		escapeChar = "!"
+	}
+
+	var pattern []rune
+	escaped := false
+	for _, c := range e.Children[1].Text {
+		s := string(c)
+		switch {
+		case escaped:
+			escaped = false
+			if strings.ContainsRune("%_\\", c) {
+				pattern = append(pattern, '\\')
+			}
+			pattern = append(pattern, c)
+		case s == escapeChar:
+			escaped = true
+		case s == wildCard:
+			pattern = append(pattern, '%')
+		case s == singleChar:
+			pattern = append(pattern, '_')
+		case strings.ContainsRune("%_\\", c):
+			pattern = append(pattern, '\\', c)
+		default:
+			pattern = append(pattern, c)
+		}
+	}
+	return &likeFilter{
+		expr:            expr,
+		pattern:         &literalExpr{value: string(pattern)},
+		caseInsensitive: strings.EqualFold(e.attr("matchCase"), "false"),
+	}, nil
+}
+
+// fesGeometryArgs returns the property and the geometry element of a spatial operator, the property is optional
+func fesGeometryArgs(e *xmlElement) (string, *xmlElement, error) {
+	property := FES_DEFAULT_GEOMETRY
+	var geometry *xmlElement
+	for i := range e.Children {
+		c := &e.Children[i]
+		switch c.name() {
+		case "ValueReference", "PropertyName":
+			property = fesPropertyName(c.text())
+		case "Distance":
+		default:
+			if geometry != nil {
+				return "", nil, errors.New("invalid filter, " + e.name() + " takes one geometry")
+			}
+			geometry = c
+		}
+	}
+	if geometry == nil {
+		return "", nil, errors.New("invalid filter, " + e.name() + " needs a GML geometry")
+	}
+	if !IsPropertyName(property) {
+		return "", nil, errors.New("invalid property name " + property)
+	}
+	return property, geometry, nil
+}
+
+func parseFesSpatial(e *xmlElement, op string) (filterNode, error) {
+	property, g, err := fesGeometryArgs(e)
+	if err != nil {
+		return nil, err
+	}
+	geom, srid, err := parseGmlGeometry(g)
+	if err != nil {
+		return nil, err
+	}
+	if !isWgs84(srid) {
+		return &spatialFilter{op: op, property: property, geometry: geom, srid: srid}, nil
+	}
+	return newSpatialFilter(op, property, geom), nil
+}
+
+// BBOX with a gml:Envelope (GML 3) or gml:Box (GML 2)
+func parseFesBBox(e *xmlElement) (filterNode, error) {
+	property, g, err := fesGeometryArgs(e)
+	if err != nil {
+		return nil, err
+	}
+	if g.name() != "Envelope" && g.name() != "Box" {
+		return nil, errors.New("invalid filter, BBOX needs a gml:Envelope or gml:Box")
+	}
+	geom, srid, err := parseGmlGeometry(g)
+	if err != nil {
+		return nil, err
+	}
+	ring := geom.Rings[0]
+	minx, miny, maxx, maxy := ring[0].X, ring[0].Y, ring[2].X, ring[2].Y
+	if isWgs84(srid) {
+		srid = 0
+	}
+	return &bboxFilter{property: property, minx: minx, miny: miny, maxx: maxx, maxy: maxy, srid: srid}, nil
+}
+
+// DWithin and Beyond with a <Distance units="km"> (FES 1.1) or <Distance uom="km"> (FES 2.0)
+func parseFesDistance(e *xmlElement) (filterNode, error) {
+	f, err := parseFesSpatial(e, strings.ToUpper(e.name()))
+	if err != nil {
+		return nil, err
+	}
+	d := e.child("Distance")
+	if d == nil {
+		return nil, errors.New("invalid filter, " + e.name() + " needs a Distance")
+	}
+	distance, err := strconv.ParseFloat(d.text(), 64)
+	if err != nil || distance < 0 || math.IsNaN(distance) || math.IsInf(distance, 0) {
+		return nil, errors.New("invalid filter, " + e.name() + " distance " + d.text())
+	}
+	units := d.attr("uom")
+	if units == "" {
+		units = d.attr("units")
+	}
+	unit, ok := distanceUnits[fesUnitName(units)]
+	if !ok {
+		return nil, errors.New("wrong unit for distance, should be in [meters, kilometers, feet, statute miles, nautical miles]!!")
+	}
+	sf := f.(*spatialFilter)
+	sf.distance = unit * distance
+	return sf, nil
+}
+
+// fesUnitName maps units like "urn:ogc:def:uom:EPSG::9001", "#km" and "meter" to the distanceUnits names
+func fesUnitName(units string) string {
+	units = strings.ToLower(strings.TrimSpace(units))
+	if i := strings.LastIndexAny(units, "#:"); i >= 0 {
+		units = units[i+1:]
+	}
+	switch units {
+	case "9001", "meter", "metre", "metres":
+		return "meters"
+	case "9036", "kilometer", "kilometre", "kilometres":
+		return "kilometers"
+	case "9002", "ft", "foot":
+		return "feet"
+	case "mi":
+		return "statute miles"
+	case "nm", "9030":
+		return "nautical miles"
+	}
+	return units
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFesFilter(t *testing.T) {
+	tests := map[string]string{
+		`<ogc:Filter xmlns:ogc="http://www.opengis.net/ogc"><ogc:PropertyIsEqualTo><ogc:PropertyName>geonet:magnitudetype</ogc:PropertyName><ogc:Literal>ML</ogc:Literal></ogc:PropertyIsEqualTo></ogc:Filter>`:                                                                                                                                                                                                    `magnitudetype = 'ML'`,
+		`<fes:Filter xmlns:fes="http://www.opengis.net/fes/2.0"><fes:PropertyIsEqualTo matchCase="false"><fes:ValueReference>magnitudetype</fes:ValueReference><fes:Literal>ml</fes:Literal></fes:PropertyIsEqualTo></fes:Filter>`:                                                                                                                                                                                 `lower(magnitudetype) = lower('ml'::text)`,
+		`<Filter><And><PropertyIsLessThan><PropertyName>depth</PropertyName><Literal>40.5</Literal></PropertyIsLessThan><PropertyIsGreaterThanOrEqualTo><PropertyName>origintime</PropertyName><Literal>2016-01-01T00:00:00Z</Literal></PropertyIsGreaterThanOrEqualTo></And></Filter>`:                                                                                                                            `depth < 40.5 AND origintime >= '2016-01-01T00:00:00Z'::timestamptz`,
+		`<Filter><PropertyIsEqualTo matchCase="false"><PropertyName>magnitude</PropertyName><Literal>5</Literal></PropertyIsEqualTo></Filter>`:                                                                                                                                                                                                                                                                     `magnitude = 5`,
+		`<Filter><PropertyIsBetween><PropertyName>magnitude</PropertyName><LowerBoundary><Literal>4</Literal></LowerBoundary><UpperBoundary><Literal>6</Literal></UpperBoundary></PropertyIsBetween></Filter>`:                                                                                                                                                                                                     `magnitude BETWEEN 4 AND 6`,
+		`<Filter><PropertyIsLike wildCard="*" singleChar="." escape="!" matchCase="false"><PropertyName>publicid</PropertyName><Literal>2016p*_!*.</Literal></PropertyIsLike></Filter>`:                                                                                                                                                                                                                            `publicid ILIKE '2016p%\_*_'`,
+		`<Filter><Not><PropertyIsNull><PropertyName>depth</PropertyName></PropertyIsNull></Not></Filter>`:                                                                                                                                                                                                                                                                                                          `NOT (depth IS NULL)`,
+		`<Filter><PropertyIsGreaterThan><Mul><PropertyName>depth</PropertyName><Literal>1000</Literal></Mul><Literal>5000</Literal></PropertyIsGreaterThan></Filter>`:                                                                                                                                                                                                                                              `(depth * 1000) > 5000`,
+		`<Filter><PropertyIsLessThan><Function name="abs"><PropertyName>latitude</PropertyName></Function><Literal>40</Literal></PropertyIsLessThan></Filter>`:                                                                                                                                                                                                                                                     `abs(latitude) < 40`,
+		`<fes:Filter xmlns:fes="http://www.opengis.net/fes/2.0"><fes:ResourceId rid="quake.2016p123456"/><fes:ResourceId rid="quake.2016p654321"/></fes:Filter>`:                                                                                                                                                                                                                                                   `publicid IN ('2016p123456', '2016p654321')`,
+		`<ogc:Filter xmlns:ogc="http://www.opengis.net/ogc"><ogc:FeatureId fid="quake.2016p123456"/></ogc:Filter>`:                                                                                                                                                                                                                                                                                                 `publicid = '2016p123456'`,
+		`<Filter><BBOX><PropertyName>origin_geom</PropertyName><gml:Envelope xmlns:gml="http://www.opengis.net/gml" srsName="EPSG:4326"><gml:lowerCorner>174 -42</gml:lowerCorner><gml:upperCorner>175 -41</gml:upperCorner></gml:Envelope></BBOX></Filter>`:                                                                                                                                                       `ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)`,
+		`<Filter><BBOX><gml:Envelope xmlns:gml="http://www.opengis.net/gml" srsName="urn:ogc:def:crs:EPSG::4326"><gml:lowerCorner>-42 174</gml:lowerCorner><gml:upperCorner>-41 175</gml:upperCorner></gml:Envelope></BBOX></Filter>`:                                                                                                                                                                              `ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)`,
+		`<Filter><BBOX><PropertyName>origin_geom</PropertyName><gml:Box xmlns:gml="http://www.opengis.net/gml"><gml:coordinates>174,-42 175,-41</gml:coordinates></gml:Box></BBOX></Filter>`:                                                                                                                                                                                                                       `ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:Polygon xmlns:gml="http://www.opengis.net/gml"><gml:exterior><gml:LinearRing><gml:posList>172 -41 175 -41 175 -44 172 -41</gml:posList></gml:LinearRing></gml:exterior></gml:Polygon></Within></Filter>`:                                                                                                                                     `ST_Within(origin_geom, ST_GeomFromText('POLYGON((172 -41,175 -41,175 -44,172 -41))', 4326))`,
+		`<Filter><Intersects><PropertyName>origin_geom</PropertyName><gml:MultiPoint xmlns:gml="http://www.opengis.net/gml"><gml:pointMember><gml:Point><gml:pos>175 -41</gml:pos></gml:Point></gml:pointMember><gml:pointMember><gml:Point><gml:coord><gml:X>176</gml:X><gml:Y>-40</gml:Y></gml:coord></gml:Point></gml:pointMember></gml:MultiPoint></Intersects></Filter>`:                                      `ST_Intersects(origin_geom, ST_GeomFromText('MULTIPOINT((175 -41),(176 -40))', 4326))`,
+		`<Filter><DWithin><PropertyName>origin_geom</PropertyName><gml:Point xmlns:gml="http://www.opengis.net/gml"><gml:coordinates>175,-41</gml:coordinates></gml:Point><Distance units="km">50</Distance></DWithin></Filter>`:                                                                                                                                                                                   `ST_DWithin(origin_geom::Geography, ST_GeomFromText('POINT(175 -41)', 4326)::Geography, 50000)`,
+		`<Filter><Beyond><ValueReference>origin_geom</ValueReference><gml:Point xmlns:gml="http://www.opengis.net/gml"><gml:pos>175 -41</gml:pos></gml:Point><Distance uom="urn:ogc:def:uom:EPSG::9001">500</Distance></Beyond></Filter>`:                                                                                                                                                                          `NOT ST_DWithin(origin_geom::Geography, ST_GeomFromText('POINT(175 -41)', 4326)::Geography, 500)`,
+		`<Filter><Intersects><PropertyName>origin_geom</PropertyName><gml:Point xmlns:gml="http://www.opengis.net/gml" srsName="EPSG:2193"><gml:pos>1600000 5400000</gml:pos></gml:Point></Intersects></Filter>`:                                                                                                                                                                                                   `ST_Intersects(origin_geom, ST_Transform(ST_GeomFromText('POINT(1600000 5400000)', 2193), 4326))`,
+		`<Filter><BBOX><PropertyName>origin_geom</PropertyName><gml:Envelope xmlns:gml="http://www.opengis.net/gml" srsName="urn:ogc:def:crs:EPSG::3857"><gml:lowerCorner>19300000 -5100000</gml:lowerCorner><gml:upperCorner>19500000 -5000000</gml:upperCorner></gml:Envelope></BBOX></Filter>`:                                                                                                                  `ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(19300000, -5100000, 19500000, -5000000, 3857), 10000), 4326), origin_geom)`,
+		`<Filter><PropertyIsNil><PropertyName>depth</PropertyName></PropertyIsNil></Filter>`:                                                                                                                                                                                                                                                                                                                       `depth IS NULL`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:Polygon xmlns:gml="http://www.opengis.net/gml/3.2"><gml:exterior><gml:LinearRing><gml:posList srsDimension="2">172 -41 175 -41 175 -44 172 -41</gml:posList></gml:LinearRing></gml:exterior></gml:Polygon></Within></Filter>`:                                                                                                                `ST_Within(origin_geom, ST_GeomFromText('POLYGON((172 -41,175 -41,175 -44,172 -41))', 4326))`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:Polygon xmlns:gml="http://www.opengis.net/gml/3.2"><gml:interior><gml:LinearRing><gml:posList>173 -42 174 -42 174 -43 173 -42</gml:posList></gml:LinearRing></gml:interior><gml:exterior><gml:LinearRing><gml:posList>172 -41 176 -41 176 -45 172 -45 172 -41</gml:posList></gml:LinearRing></gml:exterior></gml:Polygon></Within></Filter>`: `ST_Within(origin_geom, ST_GeomFromText('POLYGON((172 -41,176 -41,176 -45,172 -45,172 -41),(173 -42,174 -42,174 -43,173 -42))', 4326))`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:MultiSurface xmlns:gml="http://www.opengis.net/gml/3.2"><gml:surfaceMember><gml:Polygon><gml:exterior><gml:LinearRing><gml:posList>172 -41 175 -41 175 -44 172 -41</gml:posList></gml:LinearRing></gml:exterior></gml:Polygon></gml:surfaceMember></gml:MultiSurface></Within></Filter>`:                                                     `ST_Within(origin_geom, ST_GeomFromText('MULTIPOLYGON(((172 -41,175 -41,175 -44,172 -41)))', 4326))`,
+	}
+	for filter, expected := range tests {
+		f, err := parseFilterLang(filter, "", featureLayers[0])
+		if err != nil {
+			t.Errorf("%s: %v", filter, err)
+			continue
+		}
+		if sql := cql2Sql(f); sql != expected {
+			t.Errorf("%s: expected %s got %s", filter, expected, sql)
+		}
+	}
+
+	for _, filter := range []string{
+		`<Filter><PropertyIsEqualTo><PropertyName>magnitude</PropertyName></PropertyIsEqualTo></Filter>`,
+		`<Filter><PropertyIsEqualTo><PropertyName>magnitude;drop table x</PropertyName><Literal>1</Literal></PropertyIsEqualTo></Filter>`,
+		`<Filter><PropertyIsEqualTo><Function name="pg_sleep"><Literal>10</Literal></Function><Literal>1</Literal></PropertyIsEqualTo></Filter>`,
+		`<Filter><Intersects><PropertyName>origin_geom</PropertyName><gml:Point xmlns:gml="http://www.opengis.net/gml" srsName="EPSG:27200"><gml:pos>2600000 6000000</gml:pos></gml:Point></Intersects></Filter>`,
+		`<Filter><DWithin><PropertyName>origin_geom</PropertyName><gml:Point xmlns:gml="http://www.opengis.net/gml"><gml:pos>175 -41</gml:pos></gml:Point><Distance units="parsecs">1</Distance></DWithin></Filter>`,
+		`<Filter><PropertyIsEqualTo><PropertyName>magnitude</PropertyName><Literal>1</Literal></PropertyIsEqualTo><PropertyIsEqualTo><PropertyName>depth</PropertyName><Literal>1</Literal></PropertyIsEqualTo></Filter>`,
+		`<Filter><PropertyIsEqualTo>`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:Polygon xmlns:gml="http://www.opengis.net/gml/3.2"><gml:exterior><gml:LinearRing><gml:posList srsDimension="3">172 -41 0 175 -41 0 175 -44 0 172 -41 0</gml:posList></gml:LinearRing></gml:exterior></gml:Polygon></Within></Filter>`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:Polygon xmlns:gml="http://www.opengis.net/gml/3.2"><gml:interior><gml:LinearRing><gml:posList>173 -42 174 -42 174 -43 173 -42</gml:posList></gml:LinearRing></gml:interior></gml:Polygon></Within></Filter>`,
+		`<Filter><Intersects><PropertyName>origin_geom</PropertyName><gml:MultiPoint xmlns:gml="http://www.opengis.net/gml/3.2"><gml:pointMember><gml:LineString><gml:posList>175 -41 176 -40</gml:posList></gml:LineString></gml:pointMember></gml:MultiPoint></Intersects></Filter>`,
+		`<Filter><Within><PropertyName>origin_geom</PropertyName><gml:MultiSurface xmlns:gml="http://www.opengis.net/gml/3.2"><gml:surfaceMember><gml:Point><gml:pos>175 -41</gml:pos></gml:Point></gml:surfaceMember></gml:MultiSurface></Within></Filter>`,
+		`<Query/>`,
+	} {
+		if f, err := parseFilterLang(filter, "", featureLayers[0]); err == nil {
+			t.Errorf("expected error for %s, got %s", filter, cql2Sql(f))
+		}
+	}
+
+	//the feature ids of another layer
+	layers, err := parseLayers([]byte(`[` + testStationLayer + `]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := parseFilterLang(`<Filter><FeatureId fid="station.WEL"/></Filter>`, "", layers[0]); err != nil || cql2Sql(f) != `code = 'WEL'` {
+		t.Errorf("got %v %v", f, err)
+	}
+	if f, err := parseFilterLang(`<Filter><ResourceId rid="quake.2016p123456"/></Filter>`, "", layers[0]); err == nil {
+		t.Errorf("expected error for a quake id of the station layer, got %s", cql2Sql(f))
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * The filter model that query filters (CQL) are parsed into before being
+ * written out as the WHERE clause of the SQL query.
+ * Literal values are bound as query parameters ($1, $2...) unless the sqlWriter is inline.
+ */
+type filterNode interface {
+	writeSql(w *sqlWriter) error
+}
+
+type sqlWriter struct {
+	bytes.Buffer
+	args   []interface{} // bound parameter values
+	inline bool          // write literal values into the sql instead of binding them
+	layer  *featureLayer // the properties must be of the layer, nil for no check
+}
+
+// propertyType is the type of an attribute of the layer of w, or of any layer without one
+func (w *sqlWriter) propertyType(name string) string {
+	if w.layer != nil {
+		if a := w.layer.attribute(name); a != nil {
+			return a.Type
+		}
+		return ""
+	}
+	return propertyType(name)
+}
+
+/**
+ * checkComparable is an error for values postgres can't compare, e.g. magnitude = 'abc' or origintime > 5,
+ * a string compared with a number or time must be one.
+ */
+func (w *sqlWriter) checkComparable(a, b filterNode) error {
+	ta, tb := exprType(a, w.propertyType), exprType(b, w.propertyType)
+	if ta == "" || tb == "" || ta == tb {
+		return nil
+	}
+	numbers := []string{ATTRIBUTE_DOUBLE, ATTRIBUTE_INTEGER}
+	if isOneOf(ta, numbers) && isOneOf(tb, numbers) {
+		return nil
+	}
+	if tb == ATTRIBUTE_STRING {
+		a, b, ta = b, a, tb
+		tb = exprType(b, w.propertyType)
+	}
+	if l, ok := a.(*literalExpr); ok && ta == ATTRIBUTE_STRING {
+		s := l.value.(string)
+		switch tb {
+		case ATTRIBUTE_DOUBLE:
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				return nil
+			}
+		case ATTRIBUTE_INTEGER:
+			if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return nil
+			}
+		case ATTRIBUTE_TIMESTAMP:
+			if isTimeText(s) {
+				return nil
+			}
+		}
+		return errors.New("invalid " + tb + " " + quoteLiteral(s))
+	}
+	return errors.New("can't compare " + ta + " and " + tb)
+}
+
+// isTimeText is true for an ISO 8601 date time with a valid date, e.g. 2016-01-01T00:00:00Z
+func isTimeText(s string) bool {
+	if !PatternMatch(ISO_TIME_PATTERN, s) {
+		return false
+	}
+	date := strings.FieldsFunc(s, func(r rune) bool { return r == 'T' || r == ' ' })[0]
+	_, err := time.Parse("2006-1-2", date)
+	return err == nil
+}
+
+// checkProperty is an error for a property that isn't an attribute or the geometry of the layer of w
+func (w *sqlWriter) checkProperty(name string) error {
+	if w.layer != nil && !w.layer.hasProperty(name) {
+		return errors.New("unknown property " + name + " of " + w.layer.typeName())
+	}
+	return nil
+}
+
+// bind writes a placeholder for value, or the quoted value itself for an inline writer.
+func (w *sqlWriter) bind(value interface{}) {
+	if w.inline {
+		w.WriteString(quoteLiteral(value))
+		return
+	}
+	w.args = append(w.args, value)
+	w.WriteString("$" + strconv.Itoa(len(w.args)))
+}
+
+func quoteLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'"
+	case float64:
+		return formatCoord(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return "NULL"
+}
+
+// logicFilter joins two or more filters with AND or OR, op keeps the case it was written in
+type logicFilter struct {
+	op       string
+	children []filterNode
+}
+
+func (f *logicFilter) writeSql(w *sqlWriter) error {
+	for i, child := range f.children {
+		if i > 0 {
+			w.WriteString(" " + f.op + " ")
+		}
+		//nested AND/OR of the other kind keeps its parenthesis
+		nested, ok := child.(*logicFilter)
+		group := ok && !strings.EqualFold(nested.op, f.op)
+		if group {
+			w.WriteString("(")
+		}
+		if err := child.writeSql(w); err != nil {
+			return err
+		}
+		if group {
+			w.WriteString(")")
+		}
+	}
+	return nil
+}
+
+type notFilter struct {
+	child filterNode
+}
+
+func (f *notFilter) writeSql(w *sqlWriter) error {
+	w.WriteString("NOT (")
+	if err := f.child.writeSql(w); err != nil {
+		return err
+	}
+	w.WriteString(")")
+	return nil
+}
+
+// comparisonFilter is a binary comparison: =, <>, !=, <, >, <=, >=
+type comparisonFilter struct {
+	op    string
+	left  filterNode
+	right filterNode
+}
+
+func (f *comparisonFilter) writeSql(w *sqlWriter) error {
+	if err := w.checkComparable(f.left, f.right); err != nil {
+		return err
+	}
+	if err := f.left.writeSql(w); err != nil {
+		return err
+	}
+	w.WriteString(" " + f.op + " ")
+	return f.right.writeSql(w)
+}
+
+// betweenFilter: magnitude BETWEEN 4 AND 6
+type betweenFilter struct {
+	expr  filterNode
+	lower filterNode
+	upper filterNode
+	not   bool
+}
+
+func (f *betweenFilter) writeSql(w *sqlWriter) error {
+	for _, bound := range []filterNode{f.lower, f.upper} {
+		if err := w.checkComparable(f.expr, bound); err != nil {
+			return err
+		}
+	}
+	if err := f.expr.writeSql(w); err != nil {
+		return err
+	}
+	if f.not {
+		w.WriteString(" NOT")
+	}
+	w.WriteString(" BETWEEN ")
+	if err := f.lower.writeSql(w); err != nil {
+		return err
+	}
+	w.WriteString(" AND ")
+	return f.upper.writeSql(w)
+}
+
+// inFilter: eventtype IN ('earthquake','quarry blast')
+type inFilter struct {
+	expr   filterNode
+	values []filterNode
+	not    bool
+}
+
+func (f *inFilter) writeSql(w *sqlWriter) error {
+	for _, value := range f.values {
+		if err := w.checkComparable(f.expr, value); err != nil {
+			return err
+		}
+	}
+	if err := f.expr.writeSql(w); err != nil {
+		return err
+	}
+	if f.not {
+		w.WriteString(" NOT")
+	}
+	w.WriteString(" IN (")
+	for i, value := range f.values {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		if err := value.writeSql(w); err != nil {
+			return err
+		}
+	}
+	w.WriteString(")")
+	return nil
+}
+
+// likeFilter: magnitudetype ILIKE 'ml%', % matches any characters and _ a single character
+type likeFilter struct {
+	expr            filterNode
+	pattern         filterNode
+	caseInsensitive bool
+	not             bool
+}
+
+func (f *likeFilter) writeSql(w *sqlWriter) error {
+	//LIKE is for text, e.g. not depth LIKE '1%'
+	for _, e := range []filterNode{f.expr, f.pattern} {
+		if t := exprType(e, w.propertyType); t != "" && t != ATTRIBUTE_STRING {
+			return errors.New("LIKE is for strings, not " + t)
+		}
+	}
+	if err := f.expr.writeSql(w); err != nil {
+		return err
+	}
+	if f.not {
+		w.WriteString(" NOT")
+	}
+	if f.caseInsensitive {
+		w.WriteString(" ILIKE ")
+	} else {
+		w.WriteString(" LIKE ")
+	}
+	return f.pattern.writeSql(w)
+}
+
+// nullFilter: depth IS NULL, depth IS NOT NULL
+type nullFilter struct {
+	expr filterNode
+	not  bool
+}
+
+func (f *nullFilter) writeSql(w *sqlWriter) error {
+	if err := f.expr.writeSql(w); err != nil {
+		return err
+	}
+	if f.not {
+		w.WriteString(" IS NOT NULL")
+	} else {
+		w.WriteString(" IS NULL")
+	}
+	return nil
+}
+
+// propertyExpr is a column of the queried table or view
+type propertyExpr struct {
+	name string
+}
+
+func newPropertyExpr(name string) (*propertyExpr, error) {
+	if !IsPropertyName(name) {
+		return nil, errors.New("invalid property name " + name)
+	}
+	return &propertyExpr{name: name}, nil
+}
+
+func (e *propertyExpr) writeSql(w *sqlWriter) error {
+	if err := w.checkProperty(e.name); err != nil {
+		return err
+	}
+	w.WriteString(e.name)
+	return nil
+}
+
+// literalExpr is a string, number or boolean value
+type literalExpr struct {
+	value interface{}
+}
+
+func (e *literalExpr) writeSql(w *sqlWriter) error {
+	w.bind(e.value)
+	return nil
+}
+
+// timeExpr is an ISO 8601 date or date time, compared as timestamptz (the DB column type)
+type timeExpr struct {
+	value string
+}
+
+func (e *timeExpr) writeSql(w *sqlWriter) error {
+	if !isTimeText(e.value) {
+		return errors.New("invalid date time " + e.value)
+	}
+	w.bind(e.value)
+	w.WriteString("::timestamptz")
+	return nil
+}
+
+// nowExpr is the current time, NOW()
+type nowExpr struct{}
+
+func (e *nowExpr) writeSql(w *sqlWriter) error {
+	w.WriteString("now()")
+	return nil
+}
+
+// timeOffsetExpr is a time plus or minus an ISO 8601 duration, NOW() - P7D
+type timeOffsetExpr struct {
+	time     filterNode
+	sign     string // + or -
+	duration string // P7D
+}
+
+func (e *timeOffsetExpr) writeSql(w *sqlWriter) error {
+	w.WriteString("(")
+	if err := e.time.writeSql(w); err != nil {
+		return err
+	}
+	w.WriteString(" " + e.sign + " ")
+	w.bind(e.duration)
+	w.WriteString("::interval)")
+	return nil
+}
+
+/**
+ * newTemporalFilter compares a time property with an instant (end is nil) or a period (start, end).
+ * BEFORE, AFTER, DURING, BEFORE OR DURING, DURING OR AFTER and TEQUALS, periods are exclusive.
+ */
+func newTemporalFilter(op string, expr filterNode, start filterNode, end filterNode) (filterNode, error) {
+	if end == nil {
+		switch op {
+		case "BEFORE":
+			return &comparisonFilter{op: "<", left: expr, right: start}, nil
+		case "AFTER":
+			return &comparisonFilter{op: ">", left: expr, right: start}, nil
+		case "TEQUALS":
+			return &comparisonFilter{op: "=", left: expr, right: start}, nil
+		}
+		return nil, errors.New(op + " needs a time period, e.g. 2016-01-01/P1M")
+	}
+	switch op {
+	case "BEFORE":
+		return &comparisonFilter{op: "<", left: expr, right: start}, nil
+	case "AFTER":
+		return &comparisonFilter{op: ">", left: expr, right: end}, nil
+	case "DURING":
+		return &logicFilter{op: "AND", children: []filterNode{
+			&comparisonFilter{op: ">", left: expr, right: start},
+			&comparisonFilter{op: "<", left: expr, right: end},
+		}}, nil
+	case "BEFORE OR DURING":
+		return &comparisonFilter{op: "<", left: expr, right: end}, nil
+	case "DURING OR AFTER":
+		return &comparisonFilter{op: ">", left: expr, right: start}, nil
+	}
+	return nil, errors.New(op + " needs a time instant, e.g. 2016-01-01T00:00:00Z")
+}
+
+// newLayerFeatureIdFilter matches the feature ids <idPrefix>.<idColumn> of a layer, a bare id is accepted too
+func newLayerFeatureIdFilter(l *featureLayer, ids []string) (filterNode, error) {
+	return newIdFilter(l.IdPrefix, l.IdColumn, ids)
+}
+
+func newIdFilter(idPrefix string, idColumn string, ids []string) (filterNode, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("no feature ids")
+	}
+	values := make([]filterNode, 0, len(ids))
+	for _, id := range ids {
+		value := strings.TrimSpace(id)
+		if i := strings.LastIndex(value, "."); i >= 0 {
+			if value[:i] != idPrefix {
+				return nil, errors.New("unknown feature id " + id + ", expecting " + idPrefix + ".<" + idColumn + ">")
+			}
+			value = value[i+1:]
+		}
+		if value == "" {
+			return nil, errors.New("empty feature id")
+		}
+		values = append(values, &literalExpr{value: value})
+	}
+	property := &propertyExpr{name: idColumn}
+	if len(values) == 1 {
+		return &comparisonFilter{op: "=", left: property, right: values[0]}, nil
+	}
+	return &inFilter{expr: property, values: values}, nil
+}
+
+/**
+ * bboxFilter: BBOX(origin_geom,174,-41,175,-42), longitudes are normalised into -180..180.
+ * A bbox in another CRS (srid) is transformed into EPSG:4326.
+ */
+type bboxFilter struct {
+	property               string
+	minx, miny, maxx, maxy float64
+	srid                   int // 0 for EPSG:4326
+}
+
+func (f *bboxFilter) writeSql(w *sqlWriter) error {
+	if err := w.checkProperty(f.property); err != nil {
+		return err
+	}
+	if isWgs84(f.srid) {
+		writeBBoxSql(&w.Buffer, f.property, f.minx, f.miny, f.maxx, f.maxy)
+		return nil
+	}
+	w.WriteString(fmt.Sprintf("ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(%s, %s, %s, %s, %d), %d), 4326), %s)",
+		formatCoord(f.minx), formatCoord(f.miny), formatCoord(f.maxx), formatCoord(f.maxy), f.srid, CRS_SEGMENT_LENGTH, f.property))
+	return nil
+}
+
+/**
+ * spatialFilter compares a geometry property with a WKT geometry:
+ * INTERSECTS, CONTAINS, DISJOINT, CROSSES, OVERLAPS, TOUCHES, EQUALS, WITHIN, RELATE, DWITHIN and BEYOND.
+ */
+type spatialFilter struct {
+	op            string    // upper case ECQL predicate name
+	property      string    // the geometry column, e.g. origin_geom
+	geometry      *Geometry // with normalised longitudes
+	geometryFirst bool      // CONTAINS(POLYGON(...),origin_geom)
+	distance      float64   // meters, for DWITHIN and BEYOND
+	pattern       string    // DE-9IM pattern for RELATE
+	srid          int       // of the geometry, 0 for EPSG:4326
+}
+
+func newSpatialFilter(op string, property string, geometry *Geometry) *spatialFilter {
+	geometry.NormaliseLongitudes()
+	return &spatialFilter{op: op, property: property, geometry: geometry}
+}
+
+func (f *spatialFilter) writeSql(w *sqlWriter) error {
+	if err := w.checkProperty(f.property); err != nil {
+		return err
+	}
+	var property, geomSql string
+	switch f.op {
+	case "DWITHIN", "BEYOND":
+		//geography distances are fine over the antimeridian
+		property = f.property + "::Geography"
+		geomSql = f.geometrySql(f.geometry.String()) + "::Geography"
+		if f.op == "BEYOND" {
+			w.WriteString("NOT ")
+		}
+		w.WriteString("ST_DWithin(" + property + ", " + geomSql + ", " + formatCoord(f.distance) + ")")
+		return nil
+	}
+
+	function := spatialFunctions[strings.ToLower(f.op)]
+	if function == "" {
+		return errors.New("unknown spatial predicate " + f.op)
+	}
+	property = f.property
+	wkt := f.geometry.String()
+	if isWgs84(f.srid) && f.geometry.CrossesAntimeridian() {
+		//compare both sides in the 0-360 convention
+		shifted, _ := ParseWkt(wkt)
+		shifted.ShiftLongitudes()
+		wkt = shifted.String()
+		property = "ST_ShiftLongitude(" + property + ")"
+	}
+	geomSql = f.geometrySql(wkt)
+
+	w.WriteString(function + "(")
+	if f.geometryFirst {
+		w.WriteString(geomSql + ", " + property)
+	} else {
+		w.WriteString(property + ", " + geomSql)
+	}
+	if f.pattern != "" {
+		w.WriteString(", '" + f.pattern + "'")
+	}
+	w.WriteString(")")
+	return nil
+}
+
+// geometrySql is the EPSG:4326 geometry of wkt, transformed from the CRS of the filter
+func (f *spatialFilter) geometrySql(wkt string) string {
+	if isWgs84(f.srid) {
+		return "ST_GeomFromText('" + wkt + "', 4326)"
+	}
+	return fmt.Sprintf("ST_Transform(ST_GeomFromText('%s', %d), 4326)", wkt, f.srid)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+/**
+ * Where a quake is relative to people, from a gazetteer of NZ towns and localities bundled with the service.
+ * locality=true adds the nearest locality of each quake, the distance, direction and bearing from it and
+ * a description as in the GeoNet quake pages, e.g. "20 km north-east of Seddon", to the GeoJSON and KML.
+ * distanceFrom=POINT(lon lat) adds distance_km, the great circle distance of the quake from the point,
+ * to the GeoJSON, CSV and KML, and sortBy=distance_km sorts by it.
+ */
+const (
+	DISTANCE_PROPERTY       = "distance_km"
+	LOCALITY_NEAR_DISTANCE  = 5 // km, "within 5 km of"
+	LOCALITY_DISTANCE_ROUND = 5 // km, the description distances are to the nearest 5 km
+)
+
+// the properties added by locality=true
+var localityProperties = []string{"locality", "locality_distance_km", "locality_direction", "locality_bearing", "location"}
+
+type locality struct {
+	name      string
+	longitude float64
+	latitude  float64
+}
+
+// nzLocalities are the towns and localities of the descriptions, the GeoNet felt report places
+var nzLocalities = []locality{
+	//Northland, Auckland, Coromandel
+	{"Kaitaia", 173.27, -35.11},
+	{"Kerikeri", 173.95, -35.23},
+	{"Whangarei", 174.32, -35.73},
+	{"Dargaville", 173.87, -35.94},
+	{"Warkworth", 174.66, -36.40},
+	{"Auckland", 174.76, -36.85},
+	{"Pukekohe", 174.90, -37.20},
+	{"Coromandel", 175.50, -36.76},
+	{"Whitianga", 175.70, -36.83},
+	{"Thames", 175.54, -37.14},
+	{"Waihi", 175.84, -37.39},
+	//Waikato, Bay of Plenty
+	{"Huntly", 175.16, -37.56},
+	{"Raglan", 174.87, -37.80},
+	{"Hamilton", 175.28, -37.79},
+	{"Morrinsville", 175.53, -37.65},
+	{"Matamata", 175.77, -37.81},
+	{"Te Awamutu", 175.32, -38.01},
+	{"Otorohanga", 175.21, -38.19},
+	{"Te Kuiti", 175.16, -38.34},
+	{"Tokoroa", 175.87, -38.22},
+	{"Tauranga", 176.17, -37.69},
+	{"Te Puke", 176.32, -37.78},
+	{"Rotorua", 176.25, -38.14},
+	{"Kawerau", 176.70, -38.10},
+	{"Whakatane", 176.99, -37.95},
+	{"Opotiki", 177.29, -38.01},
+	{"White Island", 177.18, -37.52},
+	//central North Island
+	{"Taupo", 176.07, -38.69},
+	{"Turangi", 175.81, -38.99},
+	{"Taumarunui", 175.26, -38.88},
+	{"National Park", 175.39, -39.18},
+	{"Ohakune", 175.42, -39.42},
+	{"Waiouru", 175.67, -39.48},
+	{"Taihape", 175.80, -39.68},
+	//East Cape, Hawke's Bay
+	{"Ruatoria", 178.32, -37.89},
+	{"Tokomaru Bay", 178.31, -38.13},
+	{"Tolaga Bay", 178.30, -38.37},
+	{"Gisborne", 178.02, -38.66},
+	{"Wairoa", 177.42, -39.04},
+	{"Napier", 176.91, -39.49},
+	{"Hastings", 176.84, -39.64},
+	{"Waipukurau", 176.56, -40.00},
+	{"Porangahau", 176.61, -40.30},
+	{"Dannevirke", 176.10, -40.21},
+	//Taranaki, Manawatu, Whanganui
+	{"New Plymouth", 174.08, -39.06},
+	{"Stratford", 174.28, -39.34},
+	{"Opunake", 173.86, -39.46},
+	{"Hawera", 174.28, -39.59},
+	{"Patea", 174.48, -39.76},
+	{"Whanganui", 175.05, -39.93},
+	{"Marton", 175.38, -40.07},
+	{"Feilding", 175.57, -40.23},
+	{"Palmerston North", 175.61, -40.35},
+	{"Woodville", 175.87, -40.34},
+	{"Pahiatua", 175.84, -40.45},
+	{"Levin", 175.28, -40.62},
+	//Wairarapa, Wellington
+	{"Eketahuna", 175.70, -40.65},
+	{"Castlepoint", 176.22, -40.90},
+	{"Masterton", 175.66, -40.95},
+	{"Martinborough", 175.46, -41.22},
+	{"Otaki", 175.15, -40.76},
+	{"Paraparaumu", 175.01, -40.91},
+	{"Upper Hutt", 175.07, -41.12},
+	{"Porirua", 174.84, -41.13},
+	{"Lower Hutt", 174.91, -41.21},
+	{"Wellington", 174.78, -41.29},
+	//Nelson, Marlborough
+	{"Collingwood", 172.68, -40.68},
+	{"Takaka", 172.81, -40.86},
+	{"Motueka", 173.01, -41.12},
+	{"Nelson", 173.28, -41.27},
+	{"Richmond", 173.18, -41.34},
+	{"St Arnaud", 172.85, -41.80},
+	{"Murchison", 172.33, -41.80},
+	{"Picton", 174.00, -41.29},
+	{"Blenheim", 173.96, -41.51},
+	{"Seddon", 174.07, -41.67},
+	{"Ward", 174.13, -41.83},
+	//West Coast
+	{"Karamea", 172.11, -41.25},
+	{"Westport", 171.60, -41.75},
+	{"Reefton", 171.86, -42.12},
+	{"Springs Junction", 172.18, -42.33},
+	{"Greymouth", 171.21, -42.45},
+	{"Hokitika", 170.97, -42.72},
+	{"Arthur's Pass", 171.56, -42.94},
+	{"Franz Josef", 170.18, -43.39},
+	{"Fox Glacier", 170.02, -43.46},
+	{"Haast", 169.04, -43.88},
+	//Canterbury
+	{"Hanmer Springs", 172.83, -42.52},
+	{"Kaikoura", 173.68, -42.40},
+	{"Waiau", 173.04, -42.66},
+	{"Culverden", 172.85, -42.77},
+	{"Cheviot", 173.27, -42.81},
+	{"Amberley", 172.73, -43.16},
+	{"Rangiora", 172.60, -43.30},
+	{"Kaiapoi", 172.66, -43.38},
+	{"Christchurch", 172.64, -43.53},
+	{"Lyttelton", 172.72, -43.60},
+	{"Akaroa", 172.97, -43.80},
+	{"Darfield", 172.11, -43.49},
+	{"Methven", 171.65, -43.63},
+	{"Ashburton", 171.75, -43.90},
+	{"Geraldine", 171.24, -44.09},
+	{"Fairlie", 170.83, -44.10},
+	{"Timaru", 171.25, -44.40},
+	{"Waimate", 171.05, -44.73},
+	{"Aoraki/Mount Cook", 170.10, -43.73},
+	{"Twizel", 170.10, -44.26},
+	//Otago, Southland
+	{"Oamaru", 170.97, -45.10},
+	{"Ranfurly", 170.10, -45.13},
+	{"Palmerston", 170.72, -45.48},
+	{"Dunedin", 170.50, -45.87},
+	{"Mosgiel", 170.35, -45.88},
+	{"Balclutha", 169.74, -46.23},
+	{"Wanaka", 169.13, -44.70},
+	{"Cromwell", 169.20, -45.04},
+	{"Alexandra", 169.38, -45.25},
+	{"Queenstown", 168.66, -45.03},
+	{"Milford Sound", 167.93, -44.67},
+	{"Te Anau", 167.72, -45.41},
+	{"Tuatapere", 167.69, -46.13},
+	{"Gore", 168.94, -46.10},
+	{"Riverton", 168.02, -46.36},
+	{"Invercargill", 168.35, -46.41},
+	{"Bluff", 168.33, -46.60},
+	{"Oban", 168.13, -46.90},
+	//offshore islands
+	{"Waitangi, Chatham Islands", -176.56, -43.95},
+	{"Raoul Island", -177.92, -29.27},
+}
+
+// the eight compass points from north, clockwise
+var compassPoints = []string{"north", "north-east", "east", "south-east", "south", "south-west", "west", "north-west"}
+
+// nearLocality is the nearest locality of a quake, the distance in km and the bearing and direction from the locality
+type nearLocality struct {
+	locality
+	distance  float64
+	bearing   float64
+	direction string
+}
+
+// nearestLocality finds the locality of nzLocalities nearest lon,lat
+func nearestLocality(lon, lat float64) nearLocality {
+	quake := Coord{X: lon, Y: lat}
+	nearest := nearLocality{distance: math.Inf(1)}
+	for _, l := range nzLocalities {
+		if d := greatCircleDistance(Coord{X: l.longitude, Y: l.latitude}, quake); d < nearest.distance {
+			nearest.locality, nearest.distance = l, d
+		}
+	}
+	from := Coord{X: nearest.longitude, Y: nearest.latitude}
+	nearest.bearing = bearing(from, quake)
+	nearest.direction = compassPoint(nearest.bearing)
+	return nearest
+}
+
+// bearing is the initial bearing in degrees clockwise from north, of the great circle from a to b
+func bearing(a, b Coord) float64 {
+	lat1, lat2 := a.Y*math.Pi/180, b.Y*math.Pi/180
+	dLon := (b.X - a.X) * math.Pi / 180
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// compassPoint is the nearest of the eight compass points of a bearing
+func compassPoint(bearing float64) string {
+	return compassPoints[int(math.Floor(math.Mod(bearing+22.5, 360)/45))]
+}
+
+// description is as in the GeoNet quake pages, "20 km north-east of Seddon" or "Within 5 km of Seddon"
+func (n nearLocality) description() string {
+	d := math.Round(n.distance/LOCALITY_DISTANCE_ROUND) * LOCALITY_DISTANCE_ROUND
+	if d <= LOCALITY_NEAR_DISTANCE {
+		return fmt.Sprintf("Within %d km of %s", LOCALITY_NEAR_DISTANCE, n.name)
+	}
+	return fmt.Sprintf("%.0f km %s of %s", d, n.direction, n.name)
+}
+
+// parseDistanceFrom reads the POINT(lon lat) of distanceFrom, nil for none
+func parseDistanceFrom(distanceFrom string) (*Coord, error) {
+	if strings.TrimSpace(distanceFrom) == "" {
+		return nil, nil
+	}
+	g, err := ParseWkt(strings.TrimSpace(distanceFrom))
+	if err != nil {
+		return nil, errors.New("invalid distanceFrom " + distanceFrom + ", " + err.Error())
+	}
+	if g.Type != WKT_POINT {
+		return nil, errors.New("invalid distanceFrom " + distanceFrom + ", expecting POINT(lon lat)")
+	}
+	c := g.Rings[0][0]
+	if math.IsNaN(c.X) || math.IsInf(c.X, 0) || !(c.Y >= -90 && c.Y <= 90) {
+		return nil, errors.New("invalid distanceFrom " + distanceFrom + ", expecting a longitude and a latitude of -90 to 90")
+	}
+	g.NormaliseLongitudes()
+	return &g.Rings[0][0], nil
+}
+
+// distanceSql is the distance in km of the quakes from distanceFrom, null without it
+func (params *QueryParams) distanceSql() string {
+	if params.distanceFrom == nil {
+		return "NULL::double precision"
+	}
+	return fmt.Sprintf("ST_Distance(%s::geography, ST_SetSRID(ST_MakePoint(%g, %g), 4326)::geography) / 1000",
+		params.layer.Geometry, params.distanceFrom.X, params.distanceFrom.Y)
+}
+
+// computedColumns are the sql of the computed properties that can be sorted by
+func (params *QueryParams) computedColumns() map[string]string {
+	columns := make(map[string]string)
+	if params.distanceFrom != nil {
+		columns[DISTANCE_PROPERTY] = params.distanceSql()
+	}
+	return columns
+}
+
+// isComputedProperty is true for the properties added by distanceFrom and locality
+func (params *QueryParams) isComputedProperty(name string) bool {
+	if name == DISTANCE_PROPERTY {
+		return params.distanceFrom != nil
+	}
+	if params.locality {
+		for _, p := range localityProperties {
+			if name == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setComputedProperties adds the distanceFrom and locality properties of the quake at lon,lat
+func (params *QueryParams) setComputedProperties(q *QuakeProperties, lon, lat float64, distance *float64) {
+	if params.distanceFrom != nil && distance != nil {
+		d := math.Round(*distance*100) / 100
+		q.DistanceKm = &d
+	}
+	if params.locality {
+		n := nearestLocality(lon, lat)
+		d, b := math.Round(n.distance*10)/10, math.Round(n.bearing)
+		if b == 360 {
+			b = 0
+		}
+		q.Locality, q.LocalityDistanceKm, q.LocalityDirection, q.LocalityBearing = n.name, &d, n.direction, &b
+		q.Location = n.description()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNearestLocality(t *testing.T) {
+	tests := []struct {
+		lon, lat    float64
+		name        string
+		direction   string
+		description string
+	}{
+		{174.07, -41.67, "Seddon", "north", "Within 5 km of Seddon"},
+		{174.24, -41.543, "Seddon", "north-east", "20 km north-east of Seddon"},
+		{172.64, -43.75, "Lyttelton", "south", "20 km south of Lyttelton"},
+		{-176.9, -43.95, "Waitangi, Chatham Islands", "west", "25 km west of Waitangi, Chatham Islands"},
+	}
+	for _, test := range tests {
+		n := nearestLocality(test.lon, test.lat)
+		if n.name != test.name || n.direction != test.direction || n.description() != test.description {
+			t.Errorf("%v %v: got %s %s %s %v", test.lon, test.lat, n.name, n.direction, n.description(), n.distance)
+		}
+	}
+}
+
+func TestCompassPoint(t *testing.T) {
+	tests := []struct {
+		bearing float64
+		point   string
+	}{
+		{0, "north"},
+		{22.4, "north"},
+		{22.5, "north-east"},
+		{135, "south-east"},
+		{200, "south"},
+		{270, "west"},
+		{337.4, "north-west"},
+		{350, "north"},
+	}
+	for _, test := range tests {
+		if p := compassPoint(test.bearing); p != test.point {
+			t.Errorf("%v: expected %s got %s", test.bearing, test.point, p)
+		}
+	}
+	if b := bearing(Coord{X: 174, Y: -41}, Coord{X: 174, Y: -40}); b != 0 {
+		t.Errorf("expected north, got %v", b)
+	}
+	if b := bearing(Coord{X: 174, Y: -41}, Coord{X: 173, Y: -41}); b < 269 || b > 271 {
+		t.Errorf("expected west, got %v", b)
+	}
+}
+
+func TestDistanceFrom(t *testing.T) {
+	v, _ := url.ParseQuery("typeName=geonet:quake_search_v1&outputFormat=json&distanceFrom=POINT(-185.22 -41.29)&sortBy=distance_km D,magnitude&propertyName=magnitude")
+	params, err := getQueryParams(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.distanceFrom == nil || params.distanceFrom.X != 174.78 || params.distanceFrom.Y != -41.29 {
+		t.Fatalf("got %v", params.distanceFrom)
+	}
+	distance := "ST_Distance(origin_geom::geography, ST_SetSRID(ST_MakePoint(174.78, -41.29), 4326)::geography) / 1000"
+	if s := params.distanceSql(); s != distance {
+		t.Errorf("got %s", s)
+	}
+	sql, _, err := getSqlQueryString("select publicid from quake_search_v1", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(sql, " ORDER BY ("+distance+") DESC, magnitude ASC") {
+		t.Errorf("got %s", sql)
+	}
+	if _, header := getCsvSelect(params); header != "magnitude,distance_km" {
+		t.Errorf("got %s", header)
+	}
+
+	d := 12.345
+	q := QuakeProperties{Publicid: "2016p858000", Magnitude: 7.8}
+	params.setComputedProperties(&q, 174.07, -41.67, &d)
+	props, err := params.selectProperties(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(props); string(b) != `{"distance_km":12.35,"magnitude":7.8}` {
+		t.Errorf("got %s", b)
+	}
+
+	for _, query := range []string{
+		"distanceFrom=LINESTRING(174 -41,175 -41)",
+		"distanceFrom=POINT(174)",
+		"distanceFrom=POINT(175 -95)",
+		"distanceFrom=POINT(NaN -41)",
+		"distanceFrom=POINT(Inf -41)",
+		"sortBy=distance_km",
+		"propertyName=distance_km",
+	} {
+		v, _ := url.ParseQuery("typeName=geonet:quake_search_v1&outputFormat=json&" + query)
+		params, err := getQueryParams(v)
+		if err == nil {
+			_, _, err = getSqlQueryString("select publicid from quake_search_v1", params)
+		}
+		if err == nil {
+			t.Errorf("expected error for %s", query)
+		}
+	}
+}
+
+func TestLocalityProperties(t *testing.T) {
+	v, _ := url.ParseQuery("typeName=geonet:quake_search_v1&outputFormat=json&locality=true&propertyName=magnitude,location")
+	params, err := getQueryParams(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := params.checkPropertyNames(); err != nil {
+		t.Error(err)
+	}
+	q := QuakeProperties{Publicid: "2016p858000", Magnitude: 7.8}
+	params.setComputedProperties(&q, 174.24, -41.543, nil)
+	if q.DistanceKm != nil || q.Locality != "Seddon" || q.LocalityDirection != "north-east" || q.LocalityDistanceKm == nil ||
+		q.LocalityBearing == nil || *q.LocalityBearing < 22.5 || *q.LocalityBearing >= 67.5 {
+		t.Errorf("got %+v", q)
+	}
+	props, err := params.selectProperties(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(props)
+	for _, s := range []string{`"location":"20 km north-east of Seddon"`, `"locality":"Seddon"`, `"locality_direction":"north-east"`, `"locality_bearing":`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("expected %s in %s", s, b)
+		}
+	}
+	if strings.Contains(string(b), "publicid") {
+		t.Errorf("expected the propertyName only, got %s", b)
+	}
+}
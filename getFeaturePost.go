@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/**
+ * GetFeature by POST, the body is read into the query parameters of the GET request so both take the same path:
+ * 1. form encoded parameters (application/x-www-form-urlencoded), as in the query string
+ * 2. a CQL2-JSON filter (application/json), as filter with filter-lang=cql2-json
+ * 3. a wfs:GetFeature document (WFS 1.1 or 2.0) with a Query or a StoredQuery, or a ListStoredQueries
+ * or DescribeStoredQueries document, e.g.
+ *
+ * <wfs:GetFeature service="WFS" version="2.0.0" outputFormat="json" count="100">
+ *   <wfs:Query typeNames="geonet:quake_search_v1">
+ *     <wfs:PropertyName>magnitude</wfs:PropertyName>
+ *     <fes:Filter>...</fes:Filter>
+ *     <fes:SortBy><fes:SortProperty><fes:ValueReference>magnitude</fes:ValueReference><fes:SortOrder>DESC</fes:SortOrder></fes:SortProperty></fes:SortBy>
+ *   </wfs:Query>
+ * </wfs:GetFeature>
+ */
+const (
+	MAX_POST_BODY     = 1 << 20
+	CONTENT_TYPE_FORM = "application/x-www-form-urlencoded"
+	CONTENT_TYPE_JSON = "application/json"
+)
+
+// readPostQuery reads the body of a POST request into its query parameters
+func readPostQuery(r *http.Request) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MAX_POST_BODY))
+	if err != nil {
+		return errors.New("unable to read the request body, " + err.Error())
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var post url.Values
+	switch {
+	case contentType == CONTENT_TYPE_FORM:
+		if post, err = url.ParseQuery(string(body)); err != nil {
+			return errors.New("invalid form parameters, " + err.Error())
+		}
+	case contentType == CONTENT_TYPE_JSON || strings.HasSuffix(contentType, "+json"):
+		post = url.Values{}
+		post.Set("filter", string(body))
+		post.Set("filter-lang", FILTER_LANG_CQL2_JSON)
+	case len(strings.TrimSpace(string(body))) == 0:
+		post = url.Values{}
+	default: //text/xml or application/xml
+		if post, err = getFeatureParams(string(body)); err != nil {
+			return err
+		}
+	}
+
+	v := r.URL.Query()
+	for k, values := range post {
+		v[k] = values
+	}
+	r.URL.RawQuery = v.Encode()
+	return nil
+}
+
+// getFeatureParams reads a WFS request document into the parameters of the GET request
+func getFeatureParams(doc string) (url.Values, error) {
+	root, err := parseXmlElement(doc)
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("request", root.name())
+	for _, name := range []string{"service", "version"} {
+		if val := root.attr(name); val != "" {
+			v.Set(name, val)
+		}
+	}
+	switch root.name() {
+	case "GetFeature":
+	case "ListStoredQueries":
+		return v, nil
+	case "DescribeStoredQueries":
+		ids := make([]string, 0)
+		for i := range root.Children {
+			if root.Children[i].name() == "StoredQueryId" {
+				ids = append(ids, root.Children[i].text())
+			}
+		}
+		if len(ids) > 0 {
+			v.Set("storedQuery_id", strings.Join(ids, ","))
+		}
+		return v, nil
+	default:
+		return nil, errors.New("unsupported request " + root.name())
+	}
+	//text/xml; subtype=gml/3.2
+	if outputFormat := root.attr("outputFormat"); outputFormat != "" {
+		parts := strings.Split(outputFormat, ";")
+		v.Set("outputFormat", strings.TrimSpace(parts[0]))
+		for _, part := range parts[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "subtype") {
+				v.Set("subtype", kv[1])
+			}
+		}
+	}
+	//maxFeatures for WFS 1.x, count for 2.0
+	if count := firstAttr(root, "maxFeatures", "count"); count != "" {
+		v.Set("maxFeatures", count)
+	}
+	if startIndex := root.attr("startIndex"); startIndex != "" {
+		v.Set("startIndex", startIndex)
+	}
+	//the number of features (hits) isn't supported
+	if resultType := root.attr("resultType"); resultType != "" && resultType != "results" {
+		return nil, errors.New("unsupported resultType " + resultType + ", only results")
+	}
+
+	var query *xmlElement
+	for i := range root.Children {
+		if name := root.Children[i].name(); name == "Query" || name == "StoredQuery" {
+			if query != nil {
+				return nil, errors.New("only one Query or StoredQuery is supported in a GetFeature")
+			}
+			query = &root.Children[i]
+		}
+	}
+	if query == nil {
+		return nil, errors.New("a GetFeature needs a Query or a StoredQuery")
+	}
+	//<wfs:StoredQuery id="RecentQuakes"><wfs:Parameter name="minMagnitude">5</wfs:Parameter></wfs:StoredQuery>
+	if query.name() == "StoredQuery" {
+		v.Set("storedQuery_id", query.attr("id"))
+		for i := range query.Children {
+			c := &query.Children[i]
+			if c.name() != "Parameter" || c.attr("name") == "" {
+				return nil, errors.New("unsupported element " + c.name() + " in a StoredQuery")
+			}
+			v.Set(c.attr("name"), c.text())
+		}
+		return v, nil
+	}
+	if typeName := firstAttr(query, "typeName", "typeNames"); typeName != "" {
+		v.Set("typeName", typeName)
+	}
+	if srsName := query.attr("srsName"); srsName != "" {
+		if _, _, err := parseCrs(srsName); err != nil {
+			return nil, err
+		}
+		v.Set("srsName", srsName)
+	}
+
+	propertyNames := make([]string, 0)
+	for i := range query.Children {
+		c := &query.Children[i]
+		switch c.name() {
+		case "PropertyName":
+			propertyNames = append(propertyNames, c.text())
+		case "Filter":
+			v.Set("filter", c.String())
+		case "SortBy":
+			sortBy, err := getFeatureSortBy(c)
+			if err != nil {
+				return nil, err
+			}
+			v.Set("sortBy", sortBy)
+		default:
+			return nil, errors.New("unsupported element " + c.name() + " in a Query")
+		}
+	}
+	if len(propertyNames) > 0 {
+		v.Set("propertyName", strings.Join(propertyNames, ","))
+	}
+	return v, nil
+}
+
+// firstAttr is the first of the attributes of e that is set, for the WFS 1.x and 2.0 names of a parameter
+func firstAttr(e *xmlElement, names ...string) string {
+	for _, name := range names {
+		if val := e.attr(name); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// getFeatureSortBy writes a SortBy as the sortBy parameter, e.g. "magnitude DESC,origintime ASC"
+func getFeatureSortBy(e *xmlElement) (string, error) {
+	sortProperties := make([]string, 0)
+	for i := range e.Children {
+		c := &e.Children[i]
+		property := c.child("ValueReference")
+		if property == nil {
+			property = c.child("PropertyName")
+		}
+		if c.name() != "SortProperty" || property == nil {
+			return "", errors.New("invalid SortBy, expecting a SortProperty with a ValueReference or PropertyName")
+		}
+		sortProperty := property.text()
+		if order := c.child("SortOrder"); order != nil {
+			sortProperty += " " + order.text()
+		}
+		sortProperties = append(sortProperties, sortProperty)
+	}
+	if len(sortProperties) == 0 {
+		return "", errors.New("invalid SortBy, no SortProperty")
+	}
+	return strings.Join(sortProperties, ","), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetFeatureParams(t *testing.T) {
+	doc := `<wfs:GetFeature service="WFS" version="2.0.0" outputFormat="text/xml; subtype=gml/3.2" count="10" startIndex="20" resultType="results"
+   xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:fes="http://www.opengis.net/fes/2.0" xmlns:gml="http://www.opengis.net/gml/3.2">
+  <wfs:Query typeNames="geonet:quake_search_v1" srsName="urn:ogc:def:crs:EPSG::4326">
+    <wfs:PropertyName>geonet:magnitude</wfs:PropertyName>
+    <wfs:PropertyName>depth</wfs:PropertyName>
+    <fes:Filter>
+      <fes:And>
+        <fes:PropertyIsGreaterThanOrEqualTo><fes:ValueReference>magnitude</fes:ValueReference><fes:Literal>4</fes:Literal></fes:PropertyIsGreaterThanOrEqualTo>
+        <fes:BBOX><gml:Envelope srsName="EPSG:4326"><gml:lowerCorner>174 -42</gml:lowerCorner><gml:upperCorner>175 -41</gml:upperCorner></gml:Envelope></fes:BBOX>
+      </fes:And>
+    </fes:Filter>
+    <fes:SortBy>
+      <fes:SortProperty><fes:ValueReference>magnitude</fes:ValueReference><fes:SortOrder>DESC</fes:SortOrder></fes:SortProperty>
+      <fes:SortProperty><fes:ValueReference>origintime</fes:ValueReference></fes:SortProperty>
+    </fes:SortBy>
+  </wfs:Query>
+</wfs:GetFeature>`
+
+	v, err := getFeatureParams(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"service":      "WFS",
+		"version":      "2.0.0",
+		"request":      "GetFeature",
+		"outputFormat": "text/xml",
+		"subtype":      "gml/3.2",
+		"maxFeatures":  "10",
+		"startIndex":   "20",
+		"typeName":     "geonet:quake_search_v1",
+		"propertyName": "geonet:magnitude,depth",
+		"sortBy":       "magnitude DESC,origintime",
+		"srsName":      "urn:ogc:def:crs:EPSG::4326",
+	}
+	for k, val := range expected {
+		if v.Get(k) != val {
+			t.Errorf("%s: expected %s got %s", k, val, v.Get(k))
+		}
+	}
+
+	f, err := parseFilterLang(v.Get("filter"), "", featureLayers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql := cql2Sql(f); sql != `magnitude >= 4 AND ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom)` {
+		t.Errorf("got %s", sql)
+	}
+
+	//both the WFS 1.x and 2.0 names, the first is taken
+	v, err = getFeatureParams(`<GetFeature maxFeatures="5" count="7"><Query typeName="geonet:quake_search_v1" typeNames="geonet:quake_search_v1"/></GetFeature>`)
+	if err != nil || v.Get("maxFeatures") != "5" || v.Get("typeName") != "geonet:quake_search_v1" {
+		t.Errorf("got %v %v", v, err)
+	}
+
+	for _, doc := range []string{
+		`<wfs:GetCapabilities/>`,
+		`<GetFeature resultType="hits"><Query typeNames="geonet:quake_search_v1"/></GetFeature>`,
+		`<GetFeature outputFormat="json"/>`,
+		`<GetFeature><Query typeName="geonet:quake_search_v1"/><Query typeName="geonet:quake_search_v1"/></GetFeature>`,
+		`<GetFeature><Query typeName="geonet:quake_search_v1" srsName="EPSG:27200"/></GetFeature>`,
+		`<GetFeature><Query><SortBy><SortProperty><SortOrder>DESC</SortOrder></SortProperty></SortBy></Query></GetFeature>`,
+		`<GetFeature><Query><Function name="abs"/></Query></GetFeature>`,
+		`<GetFeature>`,
+	} {
+		if _, err := getFeatureParams(doc); err == nil {
+			t.Errorf("expected error for %s", doc)
+		}
+	}
+}
+
+func TestReadPostQuery(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		expected    string
+	}{
+		{CONTENT_TYPE_FORM, "outputFormat=json&cql_filter=magnitude%3E4&maxFeatures=5",
+			"cql_filter=magnitude%3E4&maxFeatures=5&outputFormat=json&service=WFS"},
+		{CONTENT_TYPE_JSON, `{"op":">","args":[{"property":"magnitude"},4]}`,
+			"filter=%7B%22op%22%3A%22%3E%22%2C%22args%22%3A%5B%7B%22property%22%3A%22magnitude%22%7D%2C4%5D%7D&filter-lang=cql2-json&service=WFS"},
+		{"text/xml", `<GetFeature outputFormat="csv"><Query typeName="geonet:quake_search_v1"/></GetFeature>`,
+			"outputFormat=csv&request=GetFeature&service=WFS&typeName=geonet%3Aquake_search_v1"},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("POST", "/ows?service=WFS", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", test.contentType)
+		if err := readPostQuery(r); err != nil {
+			t.Errorf("%s: %v", test.body, err)
+			continue
+		}
+		if r.URL.RawQuery != test.expected {
+			t.Errorf("%s: expected %s got %s", test.body, test.expected, r.URL.RawQuery)
+		}
+	}
+}
+
+func TestSortByPropertyName(t *testing.T) {
+	params, _ := getQueryParams(map[string][]string{
+		"outputFormat": {"csv"},
+		"sortBy":       {"geonet:magnitude D,origintime ASC"},
+		"propertyName": {"publicid,magnitude"},
+	})
+	sql, _, err := getSqlQueryString("select publicid from wfs.quake_search_v1", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "select publicid from wfs.quake_search_v1 ORDER BY magnitude DESC, origintime ASC" {
+		t.Errorf("got %s", sql)
+	}
+	if !params.hasProperty("magnitude") || params.hasProperty("depth") {
+		t.Error("expected only publicid and magnitude")
+	}
+	if sqlPre, header := getCsvSelect(params); header != "publicid,magnitude" ||
+		sqlPre != "select format('%s,%s', publicid::text, magnitude::text) as csv from wfs.quake_search_v1" {
+		t.Errorf("got %s %s", sqlPre, header)
+	}
+
+	for _, v := range []map[string][]string{
+		{"sortBy": {"magnitude;drop table x"}},
+		{"sortBy": {"origin_geom"}},
+		{"sortBy": {"magnitude DOWN"}},
+		{"sortBy": {"magnitude,"}},
+		{"propertyName": {"magnitude,password"}},
+	} {
+		params, _ := getQueryParams(v)
+		if _, _, err := getSqlQueryString("", params); err == nil {
+			t.Errorf("expected error for %v", v)
+		}
+	}
+}
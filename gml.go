@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/**
+ * GML 2 and GML 3 geometries in filters, read into a Geometry:
+ * Point, LineString, Polygon, Envelope, Box and the Multi* geometries (MultiCurve, MultiSurface too).
+ * Coordinates are gml:pos, gml:posList, gml:coordinates or gml:coord.
+ */
+
+// parseGmlGeometry reads a GML geometry and the EPSG code of its srsName
+func parseGmlGeometry(e *xmlElement) (*Geometry, int, error) {
+	srid, latLon, err := parseCrs(e.attr("srsName"))
+	if err != nil {
+		return nil, 0, err
+	}
+	g, err := readGmlGeometry(e, srid, latLon)
+	if err != nil {
+		return nil, 0, err
+	}
+	//validate the rings and coordinate counts
+	if isWgs84(srid) {
+		g, err = ParseWkt(g.String())
+	} else {
+		g, err = parseProjectedWkt(g.String())
+	}
+	return g, srid, err
+}
+
+func readGmlGeometry(e *xmlElement, srid int, latLon bool) (*Geometry, error) {
+	if srs := e.attr("srsName"); srs != "" {
+		s, l, err := parseCrs(srs)
+		if err != nil {
+			return nil, err
+		}
+		if s != srid {
+			return nil, errors.New("invalid geometry, the parts of a geometry must have the same srsName")
+		}
+		latLon = l
+	}
+
+	switch e.name() {
+	case "Point", "LineString", "LinearRing":
+		coords, err := readGmlCoords(e, latLon)
+		if err != nil {
+			return nil, err
+		}
+		if e.name() == "Point" {
+			return &Geometry{Type: WKT_POINT, Rings: [][]Coord{coords}}, nil
+		}
+		return &Geometry{Type: WKT_LINESTRING, Rings: [][]Coord{coords}}, nil
+	case "Polygon":
+		g := &Geometry{Type: WKT_POLYGON}
+		exteriors := 0
+		for i := range e.Children {
+			c := &e.Children[i]
+			switch c.name() {
+			case "exterior", "outerBoundaryIs", "interior", "innerBoundaryIs":
+			default:
+				continue
+			}
+			if len(c.Children) != 1 {
+				return nil, errors.New("invalid GML, " + c.name() + " needs a LinearRing")
+			}
+			coords, err := readGmlCoords(&c.Children[0], latLon)
+			if err != nil {
+				return nil, err
+			}
+			if c.name() == "exterior" || c.name() == "outerBoundaryIs" {
+				g.Rings = append([][]Coord{coords}, g.Rings...)
+				exteriors++
+			} else {
+				g.Rings = append(g.Rings, coords)
+			}
+		}
+		if exteriors != 1 {
+			return nil, errors.New("invalid GML, a Polygon needs one exterior ring")
+		}
+		return g, nil
+	case "Envelope", "Box":
+		var coords []Coord
+		var err error
+		if e.name() == "Envelope" {
+			lower, upper := e.child("lowerCorner"), e.child("upperCorner")
+			if lower == nil || upper == nil {
+				return nil, errors.New("invalid GML, an Envelope needs a lowerCorner and an upperCorner")
+			}
+			coords, err = parseGmlPosList(lower.text()+" "+upper.text(), 2, latLon)
+		} else {
+			coords, err = readGmlCoords(e, latLon)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(coords) != 2 {
+			return nil, errors.New("invalid GML, an " + e.name() + " has two corners")
+		}
+		if !isWgs84(srid) {
+			return newEnvelopeGeometry(coords[0].X, coords[0].Y, coords[1].X, coords[1].Y), nil
+		}
+		return newBBoxGeometry([]float64{coords[0].X, coords[0].Y, coords[1].X, coords[1].Y})
+	case "MultiPoint", "MultiLineString", "MultiCurve", "MultiPolygon", "MultiSurface":
+		types := map[string]string{
+			"MultiPoint":      WKT_MULTIPOINT,
+			"MultiLineString": WKT_MULTILINESTRING,
+			"MultiCurve":      WKT_MULTILINESTRING,
+			"MultiPolygon":    WKT_MULTIPOLYGON,
+			"MultiSurface":    WKT_MULTIPOLYGON,
+		}
+		partTypes := map[string]string{
+			WKT_MULTIPOINT:      WKT_POINT,
+			WKT_MULTILINESTRING: WKT_LINESTRING,
+			WKT_MULTIPOLYGON:    WKT_POLYGON,
+		}
+		g := &Geometry{Type: types[e.name()]}
+		//pointMember, pointMembers, curveMember, lineStringMember, surfaceMember, polygonMember...
+		for i := range e.Children {
+			member := &e.Children[i]
+			for j := range member.Children {
+				part, err := readGmlGeometry(&member.Children[j], srid, latLon)
+				if err != nil {
+					return nil, err
+				}
+				if part.Type != partTypes[g.Type] {
+					return nil, errors.New("invalid GML, a " + e.name() + " can't have a " + member.Children[j].name())
+				}
+				g.Parts = append(g.Parts, part)
+			}
+		}
+		if len(g.Parts) == 0 {
+			return nil, errors.New("invalid GML, empty " + e.name())
+		}
+		return g, nil
+	}
+	return nil, errors.New("invalid filter, unsupported geometry " + e.name())
+}
+
+// readGmlCoords reads the coordinates of a Point, LineString, LinearRing or Box
+func readGmlCoords(e *xmlElement, latLon bool) ([]Coord, error) {
+	if posList := e.child("posList"); posList != nil {
+		dim := 2
+		if d := posList.attr("srsDimension"); d != "" {
+			dim, _ = strconv.Atoi(d)
+		}
+		return parseGmlPosList(posList.text(), dim, latLon)
+	}
+	if coordinates := e.child("coordinates"); coordinates != nil {
+		return parseGmlCoordinates(coordinates, latLon)
+	}
+	coords := make([]Coord, 0)
+	for i := range e.Children {
+		c := &e.Children[i]
+		var (
+			list []Coord
+			err  error
+		)
+		switch c.name() {
+		case "pos":
+			list, err = parseGmlPosList(c.text(), 2, latLon)
+		case "coord":
+			x, y := c.child("X"), c.child("Y")
+			if x == nil || y == nil {
+				return nil, errors.New("invalid GML, a coord needs an X and a Y")
+			}
+			list, err = parseGmlPosList(x.text()+" "+y.text(), 2, latLon)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		coords = append(coords, list...)
+	}
+	if len(coords) == 0 {
+		return nil, errors.New("invalid GML, " + e.name() + " has no coordinates")
+	}
+	return coords, nil
+}
+
+// parseGmlPosList parses "x y x y ...", only 2D
+func parseGmlPosList(s string, dim int, latLon bool) ([]Coord, error) {
+	if dim != 2 {
+		return nil, errors.New("invalid GML, only 2D coordinates are supported")
+	}
+	values, err := parseCoordinates(strings.Fields(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, errors.New("invalid GML, only 2D coordinates are supported: " + s)
+	}
+	coords := make([]Coord, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		if latLon {
+			coords = append(coords, Coord{values[i+1], values[i]})
+		} else {
+			coords = append(coords, Coord{values[i], values[i+1]})
+		}
+	}
+	return coords, nil
+}
+
+// parseGmlCoordinates parses GML 2 <gml:coordinates cs="," ts=" " decimal=".">x,y x,y</gml:coordinates>
+func parseGmlCoordinates(e *xmlElement, latLon bool) ([]Coord, error) {
+	cs, ts, decimal := e.attr("cs"), e.attr("ts"), e.attr("decimal")
+	if cs == "" {
+		cs = ","
+	}
+	if decimal == "" {
+		decimal = "."
+	}
+	var tuples []string
+	if ts == "" || strings.TrimSpace(ts) == "" {
+		tuples = strings.Fields(e.text())
+	} else {
+		tuples = strings.Split(e.text(), ts)
+	}
+	values := make([]string, 0, 2*len(tuples))
+	for _, tuple := range tuples {
+		if decimal != "." {
+			tuple = strings.Replace(tuple, decimal, ".", -1)
+		}
+		parts := strings.Split(strings.TrimSpace(tuple), cs)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid GML, only 2D coordinates are supported: " + tuple)
+		}
+		values = append(values, parts...)
+	}
+	return parseGmlPosList(strings.Join(values, " "), 2, latLon)
+}
@@ -389,12 +389,17 @@ func (pm *Placemark) render() string {
 
 //###
 func getKmlStyleUrl(dep float64) string {
+	return "#" + QUAKE_STYLE_DEPTHS[getQuakeDepthIndex(dep)]
+}
+
+// the index of a depth in QUAKE_STYLE_DEPTHS
+func getQuakeDepthIndex(dep float64) int {
 	for index, depth := range QUAKE_DEPTH4COLORS {
 		if dep < float64(depth) {
-			return "#" + QUAKE_STYLE_DEPTHS[index]
+			return index
 		}
 	}
-	return "#" + QUAKE_STYLE_DEPTHS[len(QUAKE_DEPTH4COLORS)]
+	return len(QUAKE_DEPTH4COLORS)
 }
 
 func getQuakeMagClassIndex(mag float64) int {
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+/**
+ * The feature types (layers), configured in layers.json or the file named by LAYERS_CONFIG.
+ * Each names its source table or view, attribute columns and geometry column, e.g.
+ *
+ * {"name": "station_v1", "title": "Seismic stations", "table": "wfs.station_v1",
+ *  "idPrefix": "station", "idColumn": "code", "geometry": "location",
+ *  "attributes": [{"name": "code", "type": "string"}, {"name": "opened", "type": "timestamp"}]}
+ *
+ * Layers with "schema": "quake" have the columns of quake_search_v1 and the quake outputs (KML, stored queries),
+ * the other layers are written from their attributes.
+ */
+const (
+	LAYER_SCHEMA_QUAKE = "quake"
+	LAYER_NAMESPACE    = "geonet"
+	DEFAULT_LAYERS     = "layers.json"
+
+	ATTRIBUTE_STRING    = "string"
+	ATTRIBUTE_DOUBLE    = "double"
+	ATTRIBUTE_INTEGER   = "integer"
+	ATTRIBUTE_TIMESTAMP = "timestamp"
+)
+
+var (
+	featureLayers []*featureLayer //the first is the default layer
+	tableRegexp   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+)
+
+type featureLayer struct {
+	Name       string           `json:"name"` //the typeName without the geonet: prefix
+	Title      string           `json:"title"`
+	Table      string           `json:"table"`  //table or view
+	Schema     string           `json:"schema"` //quake, or empty
+	IdPrefix   string           `json:"idPrefix"`
+	IdColumn   string           `json:"idColumn"` //feature ids are <idPrefix>.<idColumn>
+	Geometry   string           `json:"geometry"` //in EPSG:4326
+	Time       string           `json:"time"`     //the time column, optional
+	Attributes []layerAttribute `json:"attributes"`
+}
+
+type layerAttribute struct {
+	Name string `json:"name"`
+	Type string `json:"type"` //string, double, integer or timestamp
+}
+
+func init() {
+	file := os.Getenv("LAYERS_CONFIG")
+	if file == "" {
+		file = DEFAULT_LAYERS
+	}
+	layers, err := loadLayers(file)
+	if err != nil {
+		log.Fatalf("Problem with the layers config %s: %s\n", file, err)
+	}
+	featureLayers = layers
+}
+
+func loadLayers(file string) ([]*featureLayer, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseLayers(b)
+}
+
+func parseLayers(b []byte) ([]*featureLayer, error) {
+	var layers []*featureLayer
+	if err := json.Unmarshal(b, &layers); err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return nil, errors.New("no layers")
+	}
+	names := make(map[string]bool)
+	for _, l := range layers {
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+		if names[l.Name] {
+			return nil, errors.New("duplicate layer " + l.Name)
+		}
+		names[l.Name] = true
+	}
+	return layers, nil
+}
+
+// validate checks the names that are written into the sql
+func (l *featureLayer) validate() error {
+	if !IsPropertyName(l.Name) || !tableRegexp.MatchString(l.Table) {
+		return errors.New("invalid layer name or table " + l.Name + " " + l.Table)
+	}
+	if l.Schema != "" && l.Schema != LAYER_SCHEMA_QUAKE {
+		return errors.New("unknown schema " + l.Schema + " of layer " + l.Name)
+	}
+	if l.IdPrefix == "" || !IsPropertyName(l.Geometry) || (l.Time != "" && l.attribute(l.Time) == nil) {
+		return errors.New("layer " + l.Name + " needs an idPrefix, a geometry and a time attribute if any")
+	}
+	if l.attribute(l.IdColumn) == nil {
+		return errors.New("the idColumn of layer " + l.Name + " must be an attribute")
+	}
+	for _, a := range l.Attributes {
+		if !IsPropertyName(a.Name) || a.Name == l.Geometry {
+			return errors.New("invalid attribute " + a.Name + " of layer " + l.Name)
+		}
+		switch a.Type {
+		case ATTRIBUTE_STRING, ATTRIBUTE_DOUBLE, ATTRIBUTE_INTEGER, ATTRIBUTE_TIMESTAMP:
+		default:
+			return errors.New("unknown type " + a.Type + " of attribute " + a.Name)
+		}
+	}
+	return nil
+}
+
+/**
+ * getLayer resolves a typeName, typeNames or layers parameter, e.g. geonet:quake_search_v1,
+ * the default layer when it is empty.
+ */
+func getLayer(typeName string) (*featureLayer, error) {
+	typeName = strings.TrimSpace(typeName)
+	if typeName == "" {
+		return featureLayers[0], nil
+	}
+	if strings.Contains(typeName, ",") {
+		return nil, errors.New("only one typeName is supported")
+	}
+	name := typeName
+	if i := strings.Index(name, ":"); i >= 0 {
+		if name[:i] != LAYER_NAMESPACE {
+			return nil, errors.New("unknown typeName " + typeName)
+		}
+		name = name[i+1:]
+	}
+	for _, l := range featureLayers {
+		if l.Name == name {
+			return l, nil
+		}
+	}
+	return nil, errors.New("unknown typeName " + typeName)
+}
+
+func (l *featureLayer) typeName() string {
+	return LAYER_NAMESPACE + ":" + l.Name
+}
+
+func (l *featureLayer) isQuake() bool {
+	return l.Schema == LAYER_SCHEMA_QUAKE
+}
+
+// propertyType is the type of the attribute name of the first layer that has it, "" for none
+func propertyType(name string) string {
+	for _, l := range featureLayers {
+		if a := l.attribute(name); a != nil {
+			return a.Type
+		}
+	}
+	return ""
+}
+
+func (l *featureLayer) attribute(name string) *layerAttribute {
+	for i := range l.Attributes {
+		if l.Attributes[i].Name == name {
+			return &l.Attributes[i]
+		}
+	}
+	return nil
+}
+
+// hasProperty is true for an attribute or the geometry
+func (l *featureLayer) hasProperty(name string) bool {
+	return name == l.Geometry || l.attribute(name) != nil
+}
+
+// textColumn is the sql of an attribute as text, RFC3339 for timestamps
+func (a *layerAttribute) textColumn() string {
+	if a.Type == ATTRIBUTE_TIMESTAMP {
+		return `to_char(` + a.Name + `, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"')`
+	}
+	return a.Name + "::text"
+}
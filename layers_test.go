@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+var testStationLayer = `{"name": "station_v1", "title": "Seismic stations", "table": "wfs.station_v1",
+  "idPrefix": "station", "idColumn": "code", "geometry": "location",
+  "attributes": [{"name": "code", "type": "string"}, {"name": "height", "type": "double"}, {"name": "opened", "type": "timestamp"}]}`
+
+func TestGetLayer(t *testing.T) {
+	for _, typeName := range []string{"", "geonet:quake_search_v1", "quake_search_v1"} {
+		l, err := getLayer(typeName)
+		if err != nil || l.Name != "quake_search_v1" || !l.isQuake() || l.Table != "wfs.quake_search_v1" {
+			t.Errorf("%s: got %v %v", typeName, l, err)
+		}
+	}
+	for _, typeName := range []string{"geonet:quake_search_v9", "topp:quake_search_v1", "geonet:quake_search_v1,geonet:quake_search_v1"} {
+		if _, err := getLayer(typeName); err == nil {
+			t.Errorf("expected error for %s", typeName)
+		}
+	}
+}
+
+func TestLayerConfig(t *testing.T) {
+	layers, err := parseLayers([]byte(`[` + testStationLayer + `]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := &QueryParams{layer: layers[0], properties: parsePropertyNames("code,opened,location")}
+	sqlPre, header := getCsvSelect(params)
+	if header != "code,opened,location" ||
+		sqlPre != `select format('%s,%s,%s', code::text, to_char(opened, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"'), ST_AsText(location)) as csv from wfs.station_v1` {
+		t.Errorf("got %s %s", sqlPre, header)
+	}
+	params.featureIds = "station.WEL"
+	f, err := getQueryFilter(params)
+	if err != nil || cql2Sql(f) != `code = 'WEL'` {
+		t.Errorf("got %v %v", f, err)
+	}
+
+	for _, config := range []string{
+		`[]`,
+		`[{"name": "station_v1", "table": "wfs.station_v1; drop table x", "idPrefix": "station", "idColumn": "code", "geometry": "location", "attributes": [{"name": "code", "type": "string"}]}]`,
+		`[{"name": "station_v1", "table": "wfs.station_v1", "idPrefix": "station", "idColumn": "id", "geometry": "location", "attributes": [{"name": "code", "type": "string"}]}]`,
+		`[{"name": "station_v1", "table": "wfs.station_v1", "idPrefix": "station", "idColumn": "code", "geometry": "location", "attributes": [{"name": "code", "type": "text"}]}]`,
+		`[{"name": "station_v1", "table": "wfs.station_v1", "schema": "station", "idPrefix": "station", "idColumn": "code", "geometry": "location", "attributes": [{"name": "code", "type": "string"}]}]`,
+		`[` + testStationLayer + `,` + testStationLayer + `]`,
+	} {
+		if _, err := parseLayers([]byte(config)); err == nil {
+			t.Errorf("expected error for %s", config)
+		}
+	}
+}
+
+func TestFilterProperties(t *testing.T) {
+	layers, err := parseLayers([]byte(`[` + testStationLayer + `]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	station := layers[0]
+	tests := []struct {
+		layer *featureLayer
+		query string
+		ok    bool
+	}{
+		{featureLayers[0], "cql_filter=magnitude > 1 AND INTERSECTS(origin_geom, POINT(175 -41))", true},
+		{featureLayers[0], "cql_filter=foo > 1", false},
+		{featureLayers[0], "cql_filter=abs(foo) > 1", false},
+		{featureLayers[0], "cql_filter=BBOX(location,174,-42,175,-41)", false},
+		{featureLayers[0], "filter=foo IS NULL", false},
+		{featureLayers[0], "filter=<Filter><PropertyIsEqualTo><PropertyName>foo</PropertyName><Literal>1</Literal></PropertyIsEqualTo></Filter>", false},
+		{station, "cql_filter=height > 100 AND BBOX(location,174,-42,175,-41)", true},
+		{station, "cql_filter=magnitude > 1", false},
+		{station, "cql_filter=WITHIN(origin_geom, POLYGON((174 -41,175 -41,175 -42,174 -41)))", false},
+	}
+	for _, test := range tests {
+		v, _ := url.ParseQuery(test.query)
+		params := &QueryParams{layer: test.layer, maxFeatures: empty_param_value, cqlFilter: v.Get("cql_filter"), filter: v.Get("filter")}
+		_, _, err := getSqlQueryString("select * from "+test.layer.Table, params)
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s: got %v", test.layer.Name, test.query, err)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * OGC API - Features Part 1 (Core) and the CQL2 filter of Part 3, on the layers of the WFS:
+ * /conformance
+ * /collections
+ * /collections/{id}
+ * /collections/{id}/items?bbox=174,-42,175,-41&datetime=2016-01-01T00:00:00Z/..&limit=100&offset=100&filter=magnitude>4
+ * /collections/{id}/items/{featureId}
+ */
+const (
+	OGC_API_LIMIT         = 10
+	OGC_API_MAX_LIMIT     = 10000
+	CONTENT_TYPE_GEO_JSON = "application/geo+json"
+	CRS84                 = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+)
+
+var (
+	ogcApiConformance = []string{
+		"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+		"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+		"http://www.opengis.net/spec/ogcapi-features-3/1.0/conf/filter",
+		"http://www.opengis.net/spec/ogcapi-features-3/1.0/conf/features-filter",
+		"http://www.opengis.net/spec/cql2/1.0/conf/cql2-text",
+		"http://www.opengis.net/spec/cql2/1.0/conf/cql2-json",
+		"http://www.opengis.net/spec/cql2/1.0/conf/basic-cql2",
+		"http://www.opengis.net/spec/ogcapi-features-2/1.0/conf/crs",
+	}
+	ogcApiItemsParams = []string{"bbox", "bbox-crs", "datetime", "limit", "offset", "filter", "filter-lang", "f", "crs"}
+	// the crs and bbox-crs of the items, CRS84 is the default
+	ogcApiCrs = []string{CRS84, crsUri(SRID_WGS84), crsUri(SRID_NZTM), crsUri(SRID_WEB_MERCATOR)}
+)
+
+type ogcLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type ogcCollection struct {
+	Id         string    `json:"id"`
+	Title      string    `json:"title,omitempty"`
+	ItemType   string    `json:"itemType"`
+	Crs        []string  `json:"crs"`
+	StorageCrs string    `json:"storageCrs,omitempty"`
+	Links      []ogcLink `json:"links"`
+}
+
+type ogcCollections struct {
+	Links       []ogcLink       `json:"links"`
+	Collections []ogcCollection `json:"collections"`
+}
+
+type ogcFeatureCollection struct {
+	Type           string    `json:"type"`
+	Features       []Feature `json:"features"`
+	Links          []ogcLink `json:"links"`
+	TimeStamp      string    `json:"timeStamp"`
+	NumberReturned int       `json:"numberReturned"`
+}
+
+type ogcFeature struct {
+	Feature
+	Links []ogcLink `json:"links"`
+}
+
+func ogcApi(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if r.URL.Path == "/conformance" {
+		if res := checkQuery(r, []string{}, []string{"f"}); !res.ok {
+			return res
+		}
+		return writeJson(h, b, "application/json", map[string][]string{"conformsTo": ogcApiConformance})
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 {
+		return getCollections(r, h, b)
+	}
+	l, err := getLayer(parts[1])
+	if err != nil || strings.Contains(parts[1], ":") {
+		return notFoundError("unknown collection " + parts[1])
+	}
+	switch {
+	case len(parts) == 2:
+		if res := checkQuery(r, []string{}, []string{"f"}); !res.ok {
+			return res
+		}
+		return writeJson(h, b, "application/json", getCollection(r, l))
+	case len(parts) == 3 && parts[2] == "items":
+		return getItems(r, h, b, l)
+	case len(parts) == 4 && parts[2] == "items":
+		return getItem(r, h, b, l, parts[3])
+	}
+	return &notFound
+}
+
+func getCollections(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{}, []string{"f"}); !res.ok {
+		return res
+	}
+	collections := ogcCollections{
+		Links:       []ogcLink{{Href: baseUrl(r) + "/collections", Rel: "self", Type: "application/json"}},
+		Collections: make([]ogcCollection, 0),
+	}
+	for _, l := range featureLayers {
+		collections.Collections = append(collections.Collections, getCollection(r, l))
+	}
+	return writeJson(h, b, "application/json", collections)
+}
+
+func getCollection(r *http.Request, l *featureLayer) ogcCollection {
+	href := baseUrl(r) + "/collections/" + l.Name
+	return ogcCollection{
+		Id:         l.Name,
+		Title:      l.Title,
+		ItemType:   "feature",
+		Crs:        ogcApiCrs,
+		StorageCrs: CRS84,
+		Links: []ogcLink{
+			{Href: href, Rel: "self", Type: "application/json"},
+			{Href: href + "/items", Rel: "items", Type: CONTENT_TYPE_GEO_JSON},
+		},
+	}
+}
+
+func getItems(r *http.Request, h http.Header, b *bytes.Buffer, l *featureLayer) *result {
+	if res := checkQuery(r, []string{}, ogcApiItemsParams); !res.ok {
+		return res
+	}
+	v := r.URL.Query()
+	params, err := getOgcApiParams(v, l)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+
+	features, res := getGeoJsonFeatures(params)
+	if !res.ok {
+		return res
+	}
+	params.setContentCrs(h)
+
+	self := baseUrl(r) + r.URL.Path
+	collection := ogcFeatureCollection{
+		Type:           "FeatureCollection",
+		Features:       features,
+		TimeStamp:      time.Now().UTC().Format(time.RFC3339),
+		NumberReturned: len(features),
+		Links: []ogcLink{
+			{Href: self + "?" + v.Encode(), Rel: "self", Type: CONTENT_TYPE_GEO_JSON},
+			{Href: baseUrl(r) + "/collections/" + l.Name, Rel: "collection", Type: "application/json"},
+		},
+	}
+	//paging
+	if len(features) == params.maxFeatures {
+		v.Set("offset", strconv.Itoa(params.startIndex+params.maxFeatures))
+		collection.Links = append(collection.Links, ogcLink{Href: self + "?" + v.Encode(), Rel: "next", Type: CONTENT_TYPE_GEO_JSON})
+	}
+	if params.startIndex > 0 {
+		prev := params.startIndex - params.maxFeatures
+		if prev < 0 {
+			prev = 0
+		}
+		v.Set("offset", strconv.Itoa(prev))
+		collection.Links = append(collection.Links, ogcLink{Href: self + "?" + v.Encode(), Rel: "prev", Type: CONTENT_TYPE_GEO_JSON})
+	}
+	return writeJson(h, b, CONTENT_TYPE_GEO_JSON, collection)
+}
+
+func getItem(r *http.Request, h http.Header, b *bytes.Buffer, l *featureLayer, featureId string) *result {
+	if res := checkQuery(r, []string{}, []string{"f", "crs"}); !res.ok {
+		return res
+	}
+	srid, latLon, err := parseOgcApiCrs(r.URL.Query().Get("crs"))
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	params := &QueryParams{layer: l, maxFeatures: empty_param_value, featureIds: featureId, srid: srid, latLon: latLon}
+	if strings.Contains(featureId, ",") {
+		return notFoundError("unknown feature " + featureId)
+	}
+	features, res := getGeoJsonFeatures(params)
+	if !res.ok {
+		return res
+	}
+	if len(features) == 0 {
+		return notFoundError("unknown feature " + featureId)
+	}
+	params.setContentCrs(h)
+	collection := baseUrl(r) + "/collections/" + l.Name
+	return writeJson(h, b, CONTENT_TYPE_GEO_JSON, ogcFeature{
+		Feature: features[0],
+		Links: []ogcLink{
+			{Href: baseUrl(r) + r.URL.Path, Rel: "self", Type: CONTENT_TYPE_GEO_JSON},
+			{Href: collection, Rel: "collection", Type: "application/json"},
+		},
+	})
+}
+
+// getOgcApiParams reads the parameters of /items into the query params of the WFS
+func getOgcApiParams(v url.Values, l *featureLayer) (*QueryParams, error) {
+	if f := v.Get("f"); f != "" && f != "json" && f != "geojson" {
+		return nil, errors.New("unsupported f " + f + ", only json")
+	}
+	params := &QueryParams{
+		layer:        l,
+		outputFormat: "JSON",
+		maxFeatures:  OGC_API_LIMIT,
+		filter:       v.Get("filter"),
+		filterLang:   v.Get("filter-lang"),
+		sortBy:       l.IdColumn, //a stable order for paging, the latest first when there is a time
+	}
+	if l.Time != "" {
+		params.sortBy = l.Time + " DESC," + l.IdColumn
+	}
+	var err error
+	if params.srid, params.latLon, err = parseOgcApiCrs(v.Get("crs")); err != nil {
+		return nil, err
+	}
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, errors.New("invalid limit " + limit)
+		}
+		if n > OGC_API_MAX_LIMIT {
+			n = OGC_API_MAX_LIMIT
+		}
+		params.maxFeatures = n
+	}
+	if offset := v.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid offset " + offset)
+		}
+		params.startIndex = n
+	}
+	if bbox := v.Get("bbox"); bbox != "" {
+		srid, latLon, err := parseOgcApiCrs(v.Get("bbox-crs"))
+		if err != nil {
+			return nil, errors.New("invalid bbox-crs, " + err.Error())
+		}
+		f, err := newOgcApiBBoxFilter(l, bbox, srid, latLon)
+		if err != nil {
+			return nil, err
+		}
+		params.filters = append(params.filters, f)
+	} else if v.Get("bbox-crs") != "" {
+		return nil, errors.New("bbox-crs needs a bbox")
+	}
+	if datetime := v.Get("datetime"); datetime != "" {
+		f, err := newDatetimeFilter(l, datetime)
+		if err != nil {
+			return nil, err
+		}
+		params.filters = append(params.filters, f)
+	}
+	return params, nil
+}
+
+/**
+ * newOgcApiBBoxFilter: bbox=minx,miny,maxx,maxy or minx,miny,minz,maxx,maxy,maxz in CRS84 or the CRS of bbox-crs,
+ * latitude (northing) first when that is the axis order of the CRS
+ */
+func newOgcApiBBoxFilter(l *featureLayer, bbox string, srid int, latLon bool) (filterNode, error) {
+	coords, err := parseCoordinates(strings.Split(bbox, ","))
+	if err != nil {
+		return nil, errors.New("invalid bbox " + bbox)
+	}
+	switch len(coords) {
+	case 4:
+	case 6:
+		coords = []float64{coords[0], coords[1], coords[3], coords[4]}
+	default:
+		return nil, errors.New("invalid bbox " + bbox + ", expecting 4 or 6 numbers")
+	}
+	if latLon {
+		coords = []float64{coords[1], coords[0], coords[3], coords[2]}
+	}
+	if coords[1] > coords[3] {
+		return nil, errors.New("invalid bbox " + bbox + ", the minimum latitude is greater than the maximum")
+	}
+	if !isWgs84(srid) {
+		return &bboxFilter{property: l.Geometry, minx: coords[0], miny: coords[1], maxx: coords[2], maxy: coords[3], srid: srid}, nil
+	}
+	if err := checkLongitudes(coords[0], coords[2]); err != nil {
+		return nil, errors.New("invalid bbox " + bbox + ", " + err.Error())
+	}
+	minx, miny, maxx, maxy := normaliseBBox(coords[0], coords[1], coords[2], coords[3])
+	return &bboxFilter{property: l.Geometry, minx: minx, miny: miny, maxx: maxx, maxy: maxy}, nil
+}
+
+/**
+ * newDatetimeFilter: an instant or a closed or half bounded interval,
+ * datetime=2016-01-01T00:00:00Z, 2016-01-01T00:00:00Z/2016-02-01T00:00:00Z, ../2016-02-01T00:00:00Z, 2016-01-01T00:00:00Z/..
+ */
+func newDatetimeFilter(l *featureLayer, datetime string) (filterNode, error) {
+	if l.Time == "" {
+		return nil, errors.New("collection " + l.Name + " has no time")
+	}
+	property := &propertyExpr{name: l.Time}
+	parts := strings.Split(datetime, "/")
+	if len(parts) == 1 {
+		t, err := newDatetimeExpr(parts[0])
+		if err != nil || t == nil {
+			return nil, errors.New("invalid datetime " + datetime)
+		}
+		return &comparisonFilter{op: "=", left: property, right: t}, nil
+	}
+	if len(parts) != 2 {
+		return nil, errors.New("invalid datetime " + datetime)
+	}
+	start, err1 := newDatetimeExpr(parts[0])
+	end, err2 := newDatetimeExpr(parts[1])
+	if err1 != nil || err2 != nil || (start == nil && end == nil) {
+		return nil, errors.New("invalid datetime " + datetime)
+	}
+	filters := make([]filterNode, 0, 2)
+	if start != nil {
+		filters = append(filters, &comparisonFilter{op: ">=", left: property, right: start})
+	}
+	if end != nil {
+		filters = append(filters, &comparisonFilter{op: "<=", left: property, right: end})
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return &logicFilter{op: "AND", children: filters}, nil
+}
+
+// newDatetimeExpr parses an RFC 3339 date time or date, nil for an open end ("" or "..")
+func newDatetimeExpr(s string) (filterNode, error) {
+	if s == "" || s == CQL2_OPEN_END {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if _, err := time.Parse(layout, s); err == nil {
+			return &timeExpr{value: s}, nil
+		}
+	}
+	return nil, errors.New("invalid date time " + s)
+}
+
+/**
+ * baseUrl is the public url of the service for links, the service is behind a proxy with a path prefix (/geonet)
+ * so this is WEBSERVER_PUBLIC_URL, or the scheme and host of the request when it isn't set.
+ */
+func baseUrl(r *http.Request) string {
+	if webServerPublicUrl != "" {
+		return webServerPublicUrl
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeJson(h http.Header, b *bytes.Buffer, contentType string, v interface{}) *result {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return internalServerError(err)
+	}
+	b.Write(out)
+	h.Set("Content-Type", contentType)
+	return &statusOK
+}
+
+// parseOgcApiCrs reads a crs or bbox-crs URI, one of ogcApiCrs, CRS84 when it is empty, and its axis order
+func parseOgcApiCrs(crs string) (int, bool, error) {
+	if crs == "" {
+		return SRID_WGS84, false, nil
+	}
+	for _, c := range ogcApiCrs {
+		if c == crs {
+			return parseCrs(crs)
+		}
+	}
+	return 0, false, errors.New("unsupported crs " + crs + ", use one of " + strings.Join(ogcApiCrs, ", "))
+}
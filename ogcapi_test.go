@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOgcApiParams(t *testing.T) {
+	l, _ := getLayer("quake_search_v1")
+	tests := map[string]string{
+		"": `select publicid from wfs.quake_search_v1 ORDER BY origintime DESC, publicid ASC limit 10`,
+		"bbox=174,-42,175,-41&limit=100&offset=200":                                     `select publicid from wfs.quake_search_v1 WHERE ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom) ORDER BY origintime DESC, publicid ASC limit 100 offset 200`,
+		"datetime=2016-01-01T00:00:00Z/..&filter=magnitude>4":                           `select publicid from wfs.quake_search_v1 WHERE magnitude > $1 AND origintime >= $2::timestamptz ORDER BY origintime DESC, publicid ASC limit 10`,
+		"datetime=../2016-02-01&limit=20000":                                            `select publicid from wfs.quake_search_v1 WHERE origintime <= $1::timestamptz ORDER BY origintime DESC, publicid ASC limit 10000`,
+		"datetime=2016-01-01T00:00:00Z/2016-02-01T00:00:00Z&bbox=174,-42,0,175,-41,100": `select publicid from wfs.quake_search_v1 WHERE ST_Contains(ST_SetSRID(ST_Envelope('LINESTRING(174 -42,175 -41)'::geometry),4326),origin_geom) AND origintime >= $1::timestamptz AND origintime <= $2::timestamptz ORDER BY origintime DESC, publicid ASC limit 10`,
+		"bbox=5300000,1500000,5400000,1600000&bbox-crs=http://www.opengis.net/def/crs/EPSG/0/2193&crs=http://www.opengis.net/def/crs/EPSG/0/3857": `select publicid from wfs.quake_search_v1 WHERE ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(1500000, 5300000, 1600000, 5400000, 2193), 10000), 4326), origin_geom) ORDER BY origintime DESC, publicid ASC limit 10`,
+	}
+	for query, expected := range tests {
+		v, _ := url.ParseQuery(query)
+		params, err := getOgcApiParams(v, l)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		sql, _, err := getSqlQueryString("select publicid from wfs.quake_search_v1", params)
+		if err != nil || sql != expected {
+			t.Errorf("%s: expected %s got %s %v", query, expected, sql, err)
+		}
+	}
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=ten",
+		"offset=-1",
+		"bbox=174,-42,175",
+		"bbox=174,-41,175,-42",
+		"bbox=1e20,-42,1e20,-41",
+		"bbox=-1e16,-42,175,-41",
+		"datetime=yesterday",
+		"datetime=../..",
+		"datetime=2016-01-01/2016-02-01/2016-03-01",
+		"f=html",
+		"crs=EPSG:2193",
+		"bbox-crs=http://www.opengis.net/def/crs/EPSG/0/2193",
+	} {
+		v, _ := url.ParseQuery(query)
+		if _, err := getOgcApiParams(v, l); err == nil {
+			t.Errorf("expected error for %s", query)
+		}
+	}
+}
+
+func TestOgcApiRoutes(t *testing.T) {
+	tests := map[string]string{
+		"/conformance":                 `"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core"`,
+		"/collections":                 `"href":"http://wfs.geonet.org.nz/collections/quake_search_v1/items","rel":"items"`,
+		"/collections/quake_search_v1": `"id":"quake_search_v1"`,
+	}
+	for path, expected := range tests {
+		r, _ := http.NewRequest("GET", "http://wfs.geonet.org.nz"+path, nil)
+		var b bytes.Buffer
+		if res := ogcApi(r, http.Header{}, &b); !res.ok || !strings.Contains(b.String(), expected) {
+			t.Errorf("%s: expected %s got %s %s", path, expected, res.msg, b.String())
+		}
+	}
+
+	//the links keep the path prefix of the proxy
+	webServerPublicUrl = "http://wfs.geonet.org.nz/geonet"
+	defer func() { webServerPublicUrl = "" }()
+	r, _ := http.NewRequest("GET", "http://localhost:8081/collections/quake_search_v1", nil)
+	var b bytes.Buffer
+	if res := ogcApi(r, http.Header{}, &b); !res.ok || !strings.Contains(b.String(), `"href":"http://wfs.geonet.org.nz/geonet/collections/quake_search_v1/items","rel":"items"`) {
+		t.Errorf("got %s %s", res.msg, b.String())
+	}
+
+	for path, code := range map[string]int{
+		"/collections/quake_search_v9":                      http.StatusNotFound,
+		"/collections/geonet:quake_search_v1":               http.StatusNotFound,
+		"/collections/quake_search_v1/queryables/x":         http.StatusNotFound,
+		"/collections/quake_search_v1/items?limit=0":        http.StatusBadRequest,
+		"/collections/quake_search_v1/items?maxFeatures=10": http.StatusBadRequest,
+	} {
+		r, _ := http.NewRequest("GET", "http://wfs.geonet.org.nz"+path, nil)
+		var b bytes.Buffer
+		if res := ogcApi(r, http.Header{}, &b); res.code != code {
+			t.Errorf("%s: expected %d got %d", path, code, res.code)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * A cross section of the quakes along a line, for the depth profiles of subduction.
+ * /profile?line=LINESTRING(174 -38,178 -40)&width=50km&cql_filter=magnitude>3&outputFormat=svg
+ * The quakes within half the width either side of the line are projected onto it,
+ * with their distance along the line, their offset from it (positive on the right, looking along the line)
+ * and their depth, as JSON (the default), CSV or an SVG plot of depth by distance.
+ */
+const (
+	PROFILE_DEFAULT_WIDTH = 50   // km
+	PROFILE_MAX_WIDTH     = 1000 // km
+	EARTH_RADIUS          = 6371.0088
+
+	PROFILE_SVG_WIDTH  = 800
+	PROFILE_SVG_HEIGHT = 400
+	PROFILE_SVG_MARGIN = 50
+	CONTENT_TYPE_SVG   = "image/svg+xml"
+)
+
+var profileParams = []string{
+	"typeName",
+	"line", //LINESTRING in EPSG:4326
+	"width",
+	"cql_filter",
+	"filter",
+	"filter-lang",
+	"bbox",
+	"outputFormat", //json (default), csv or svg
+}
+
+// profileQuake is a quake of a profile, distance and offset in km
+type profileQuake struct {
+	Publicid   string   `json:"publicid"`
+	Origintime string   `json:"origintime"`
+	Longitude  float64  `json:"longitude"`
+	Latitude   float64  `json:"latitude"`
+	Depth      *float64 `json:"depth"`
+	Magnitude  *float64 `json:"magnitude"`
+	Distance   float64  `json:"distance"`
+	Offset     float64  `json:"offset"`
+}
+
+type profile struct {
+	Line   string         `json:"line"`
+	Width  float64        `json:"width"`  //km
+	Length float64        `json:"length"` //km
+	Quakes []profileQuake `json:"quakes"`
+	line   *Geometry
+}
+
+// newProfile reads the line and width parameters
+func newProfile(line string, width string) (*profile, error) {
+	g, err := ParseWkt(strings.TrimSpace(line))
+	if err != nil {
+		return nil, errors.New("invalid line " + line + ", " + err.Error())
+	}
+	if g.Type != WKT_LINESTRING || len(g.Rings[0]) < 2 {
+		return nil, errors.New("invalid line " + line + ", expecting a LINESTRING of two or more points")
+	}
+	g.NormaliseLongitudes()
+	if g.CrossesAntimeridian() {
+		return nil, errors.New("a line crossing the antimeridian is not supported")
+	}
+	p := &profile{Line: g.String(), Width: PROFILE_DEFAULT_WIDTH, line: g, Quakes: make([]profileQuake, 0)}
+	if width != "" {
+		if p.Width, err = parseProfileWidth(width); err != nil {
+			return nil, err
+		}
+	}
+	coords := g.Rings[0]
+	for i := 1; i < len(coords); i++ {
+		p.Length += greatCircleDistance(coords[i-1], coords[i])
+	}
+	return p, nil
+}
+
+// parseProfileWidth reads a width in km, e.g. 50km, 50000m or 50
+func parseProfileWidth(width string) (float64, error) {
+	s, scale := strings.ToLower(strings.TrimSpace(width)), 1.0
+	switch {
+	case strings.HasSuffix(s, "km"):
+		s = strings.TrimSuffix(s, "km")
+	case strings.HasSuffix(s, "m"):
+		s, scale = strings.TrimSuffix(s, "m"), 0.001
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || w*scale <= 0 || w*scale > PROFILE_MAX_WIDTH {
+		return 0, fmt.Errorf("invalid width %s, expecting up to %dkm, e.g. 50km", width, PROFILE_MAX_WIDTH)
+	}
+	return w * scale, nil
+}
+
+// greatCircleDistance is the haversine distance in km
+func greatCircleDistance(a, b Coord) float64 {
+	lat1, lat2 := a.Y*math.Pi/180, b.Y*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.X-a.X)*math.Pi/180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// swathFilter selects the quakes within half the width of the line
+func (p *profile) swathFilter(l *featureLayer) filterNode {
+	return &spatialFilter{op: "DWITHIN", property: l.Geometry, geometry: p.line, distance: p.Width / 2 * 1000}
+}
+
+/**
+ * side is 1 when x,y is on the right of the nearest segment of the line, looking along it, otherwise -1.
+ * The longitudes are scaled by the cosine of the latitude, close enough for the side.
+ */
+func (p *profile) side(x, y float64) float64 {
+	coords := p.line.Rings[0]
+	scale := math.Cos(y * math.Pi / 180)
+	nearest, cross := math.Inf(1), 0.0
+	for i := 1; i < len(coords); i++ {
+		ax, ay := coords[i-1].X*scale, coords[i-1].Y
+		dx, dy := coords[i].X*scale-ax, coords[i].Y-ay
+		px, py := x*scale-ax, y-ay
+		t := 0.0
+		if length := dx*dx + dy*dy; length > 0 {
+			t = math.Max(0, math.Min(1, (px*dx+py*dy)/length))
+		}
+		if d := math.Hypot(px-t*dx, py-t*dy); d < nearest {
+			nearest, cross = d, dx*py-dy*px
+		}
+	}
+	if cross > 0 {
+		return -1
+	}
+	return 1
+}
+
+func getProfile(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{"line"}, profileParams); !res.ok {
+		return res
+	}
+	v := r.URL.Query()
+	params, err := getQueryParams(v)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	if !params.layer.isQuake() {
+		return badRequest("profiles are for quakes only")
+	}
+	switch params.outputFormat {
+	case "", "JSON", "CSV", "SVG":
+	default:
+		return badRequest("unsupported outputFormat " + params.outputFormat + ", use json, csv or svg")
+	}
+	p, err := newProfile(v.Get("line"), v.Get("width"))
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	params = params.unpaged()
+	params.filters = append(params.filters, p.swathFilter(params.layer))
+
+	g := params.layer.Geometry
+	sqlPre := `select publicid, to_char(origintime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') as origintime, longitude, latitude,
+     depth, magnitude, ` + g + ` from ` + params.layer.Table
+	filtered, args, err := getSqlQueryString(sqlPre, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	line := "ST_GeomFromText('" + p.Line + "', 4326)"
+	sqlString := fmt.Sprintf(`select publicid, origintime, longitude, latitude, depth, magnitude,
+     ST_Length(ST_LineSubstring(%[1]s, 0, ST_LineLocatePoint(%[1]s, %[2]s))::geography) / 1000 as distance,
+     ST_Distance(%[1]s::geography, %[2]s::geography) / 1000 from (%[3]s) q order by distance`, line, g, filtered)
+
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			q                profileQuake
+			depth, magnitude sql.NullFloat64
+		)
+		if err := rows.Scan(&q.Publicid, &q.Origintime, &q.Longitude, &q.Latitude, &depth, &magnitude, &q.Distance, &q.Offset); err != nil {
+			return internalServerError(err)
+		}
+		if depth.Valid {
+			q.Depth = &depth.Float64
+		}
+		if magnitude.Valid {
+			q.Magnitude = &magnitude.Float64
+		}
+		q.Offset *= p.side(q.Longitude, q.Latitude)
+		p.Quakes = append(p.Quakes, q)
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+
+	switch params.outputFormat {
+	case "CSV":
+		p.writeCsv(b)
+		h.Set("Content-Disposition", `attachment; filename="profile.csv"`)
+		h.Set("Content-Type", V1CSV)
+	case "SVG":
+		p.writeSvg(b)
+		h.Set("Content-Type", CONTENT_TYPE_SVG)
+	default:
+		return writeJson(h, b, "application/json", p)
+	}
+	return &statusOK
+}
+
+func (p *profile) writeCsv(b *bytes.Buffer) {
+	b.WriteString("publicid,origintime,longitude,latitude,depth,magnitude,distance,offset\n")
+	for _, q := range p.Quakes {
+		b.WriteString(strings.Join([]string{q.Publicid, q.Origintime, formatCoord(q.Longitude), formatCoord(q.Latitude),
+			formatOptional(q.Depth), formatOptional(q.Magnitude), strconv.FormatFloat(q.Distance, 'f', 3, 64),
+			strconv.FormatFloat(q.Offset, 'f', 3, 64)}, ",") + "\n")
+	}
+}
+
+// profileTick is the step of about five ticks of an axis from 0 to max, 1, 2 or 5 times a power of 10
+func profileTick(max float64) float64 {
+	if max <= 0 {
+		return 1
+	}
+	step := math.Pow(10, math.Floor(math.Log10(max/5)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if max/(step*m) <= 7 {
+			return step * m
+		}
+	}
+	return step * 10
+}
+
+/**
+ * writeSvg plots depth (down) by distance along the line, the quakes coloured by depth
+ * and sized by magnitude, half the size of the WMS circles.
+ */
+func (p *profile) writeSvg(b *bytes.Buffer) {
+	maxDepth := 50.0
+	for _, q := range p.Quakes {
+		if q.Depth != nil && *q.Depth > maxDepth {
+			maxDepth = *q.Depth
+		}
+	}
+	depthTick := profileTick(maxDepth)
+	maxDepth = math.Ceil(maxDepth/depthTick) * depthTick
+	length := math.Max(p.Length, 1)
+	plotWidth, plotHeight := float64(PROFILE_SVG_WIDTH-2*PROFILE_SVG_MARGIN), float64(PROFILE_SVG_HEIGHT-2*PROFILE_SVG_MARGIN)
+	px := func(distance float64) float64 { return PROFILE_SVG_MARGIN + distance/length*plotWidth }
+	py := func(depth float64) float64 { return PROFILE_SVG_MARGIN + depth/maxDepth*plotHeight }
+
+	b.WriteString(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %[1]d %[2]d" font-family="sans-serif" font-size="11">`+"\n",
+		PROFILE_SVG_WIDTH, PROFILE_SVG_HEIGHT))
+	b.WriteString(fmt.Sprintf(`<title>%d quakes within %gkm of %s</title>`+"\n", len(p.Quakes), p.Width/2, p.Line))
+	b.WriteString(fmt.Sprintf(`<rect x="%d" y="%d" width="%g" height="%g" fill="none" stroke="#333"/>`+"\n",
+		PROFILE_SVG_MARGIN, PROFILE_SVG_MARGIN, plotWidth, plotHeight))
+	distanceTick := profileTick(length)
+	for d := 0.0; d <= length+1e-9; d += distanceTick {
+		b.WriteString(fmt.Sprintf(`<text x="%.1f" y="%d" text-anchor="middle">%g</text>`+"\n", px(d), PROFILE_SVG_MARGIN-6, d))
+	}
+	for d := 0.0; d <= maxDepth+1e-9; d += depthTick {
+		b.WriteString(fmt.Sprintf(`<text x="%d" y="%.1f" text-anchor="end">%g</text>`+"\n", PROFILE_SVG_MARGIN-6, py(d)+4, d))
+	}
+	b.WriteString(fmt.Sprintf(`<text x="%d" y="%d" text-anchor="middle">Distance along the line (km)</text>`+"\n",
+		PROFILE_SVG_WIDTH/2, PROFILE_SVG_MARGIN-24))
+	b.WriteString(fmt.Sprintf(`<text x="14" y="%d" text-anchor="middle" transform="rotate(-90 14 %[1]d)">Depth (km)</text>`+"\n",
+		PROFILE_SVG_HEIGHT/2))
+
+	for _, q := range p.Quakes {
+		if q.Depth == nil {
+			continue
+		}
+		magnitude := 0.0
+		if q.Magnitude != nil {
+			magnitude = *q.Magnitude
+		}
+		c := WMS_DEPTH_COLORS[getQuakeDepthIndex(*q.Depth)]
+		b.WriteString(fmt.Sprintf(`<circle cx="%.1f" cy="%.1f" r="%.1f" fill="#%02x%02x%02x" fill-opacity="%.2f" stroke="#333" stroke-width="0.5"><title>%s M%s %gkm</title></circle>`+"\n",
+			px(q.Distance), py(*q.Depth), quakeRadius(magnitude)/2, c.R, c.G, c.B, float64(c.A)/0xff, html.EscapeString(q.Publicid), formatOptional(q.Magnitude), *q.Depth))
+	}
+	b.WriteString("</svg>\n")
+}
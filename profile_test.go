@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestNewProfile(t *testing.T) {
+	p, err := newProfile("LINESTRING(175 -38, 175 -39)", "50km")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Line != "LINESTRING(175 -38,175 -39)" || p.Width != 50 || math.Abs(p.Length-111.195) > 0.01 {
+		t.Errorf("got %s %v %v", p.Line, p.Width, p.Length)
+	}
+	if s := cql2Sql(p.swathFilter(featureLayers[0])); s != "ST_DWithin(origin_geom::Geography, ST_GeomFromText('LINESTRING(175 -38,175 -39)', 4326)::Geography, 25000)" {
+		t.Errorf("got %s", s)
+	}
+	//looking south, the west is on the right
+	if p.side(174.9, -38.5) != 1 || p.side(175.1, -38.5) != -1 {
+		t.Errorf("expected the west on the right")
+	}
+
+	for _, test := range []struct {
+		line, width string
+	}{
+		{"POINT(175 -38)", ""},
+		{"LINESTRING(175 -38)", ""},
+		{"LINESTRING(175 -38,", ""},
+		{"LINESTRING(179 -38,-179 -39)", ""},
+		{"LINESTRING(175 -38,176 -39)", "0km"},
+		{"LINESTRING(175 -38,176 -39)", "2000km"},
+		{"LINESTRING(175 -38,176 -39)", "wide"},
+	} {
+		if _, err := newProfile(test.line, test.width); err == nil {
+			t.Errorf("expected error for %s %s", test.line, test.width)
+		}
+	}
+}
+
+func TestParseProfileWidth(t *testing.T) {
+	tests := map[string]float64{"50km": 50, "50 km": 50, "25000m": 25, "10": 10, "0.5KM": 0.5}
+	for s, expected := range tests {
+		if w, err := parseProfileWidth(s); err != nil || w != expected {
+			t.Errorf("%s: expected %v got %v %v", s, expected, w, err)
+		}
+	}
+}
+
+func TestProfileTick(t *testing.T) {
+	tests := map[float64]float64{50: 10, 111.2: 20, 300: 50, 700: 100, 1: 0.2}
+	for max, expected := range tests {
+		if tick := profileTick(max); math.Abs(tick-expected) > 1e-9 {
+			t.Errorf("%v: expected %v got %v", max, expected, tick)
+		}
+	}
+}
+
+func TestProfileOutput(t *testing.T) {
+	p, err := newProfile("LINESTRING(175 -38,175 -39)", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth, magnitude := 120.0, 5.1
+	p.Quakes = append(p.Quakes, profileQuake{Publicid: "2016p858000", Origintime: "2016-11-13T11:02:56.346Z",
+		Longitude: 174.9, Latitude: -38.5, Depth: &depth, Magnitude: &magnitude, Distance: 55.6, Offset: 8.7})
+
+	b := &bytes.Buffer{}
+	p.writeCsv(b)
+	if b.String() != "publicid,origintime,longitude,latitude,depth,magnitude,distance,offset\n"+
+		"2016p858000,2016-11-13T11:02:56.346Z,174.9,-38.5,120,5.1,55.600,8.700\n" {
+		t.Errorf("got %s", b.String())
+	}
+
+	b.Reset()
+	p.writeSvg(b)
+	for _, s := range []string{`<svg xmlns="http://www.w3.org/2000/svg" width="800" height="400"`, `<circle cx="400.0" cy="350.0"`,
+		`fill="#33a02c"`, "<title>2016p858000 M5.1 120km</title>", ">Depth (km)</text>"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %s in %s", s, b.String())
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -42,11 +43,31 @@ var (
 	optionalParams = []string{"service",
 		"version",
 		"request",
-		"typeName", //for wfs
-		"layers",   //for kml
+		"typeName",  //for wfs
+		"typeNames", //for wfs 2.0
+		"layers",    //for kml
 		"maxFeatures",
+		"count",      //WFS 2.0 maxFeatures
+		"startIndex", //WFS 2.0 paging
 		"cql_filter",
+		"filter",       //CQL2 or FES XML
+		"filter-lang",  //cql2-text or cql2-json
+		"featureID",    //WFS 1.x, quake.<publicid>,...
+		"resourceId",   //WFS 2.0, quake.<publicid>,...
+		"sortBy",       //e.g. magnitude DESC,origintime
+		"propertyName", //the properties to return, e.g. magnitude,depth
+		"srsName",      //EPSG:4326 (default), EPSG:2193 or EPSG:3857
+		"crs",          //as srsName, for the JSON formats
+		"bbox",         //minx,miny,maxx,maxy[,crs]
+		"region",       //a named region of /regions, e.g. canterbury
 		"subtype",
+		"aggregate",    //grid:<size> or hex:<size>, the quakes binned into GeoJSON polygons
+		"declustered",  //true, gardner-knopoff or reasenberg, the mainshocks only
+		"locality",     //true, the nearest NZ locality and the distance and direction from it
+		"distanceFrom", //POINT(lon lat), adds distance_km
+		//GeoServer vendor parameters that clients send, accepted and ignored: there are no format options or SQL views here
+		"format_options",
+		"viewparams",
 	}
 )
 
@@ -62,13 +83,81 @@ func init() {
 }
 
 func getQuakesWfs(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	normaliseQuery(r, append([]string{"storedQuery_id"}, optionalParams...))
+	v := r.URL.Query()
+	switch strings.ToUpper(v.Get("request")) {
+	case "LISTSTOREDQUERIES":
+		return listStoredQueries(r, h, b)
+	case "DESCRIBESTOREDQUERIES":
+		return describeStoredQueries(r, h, b)
+	}
+
+	//a stored query takes its own parameters
+	optional := optionalParams
+	var storedQuery *storedQuery
+	if id := v.Get("storedQuery_id"); id != "" {
+		if storedQuery = getStoredQuery(id); storedQuery == nil {
+			return badRequest("unknown storedQuery_id " + id)
+		}
+		optional = append([]string{"storedQuery_id"}, optionalParams...)
+		optional = append(optional, storedQuery.parameterNames()...)
+	}
+
 	//1. check query parameters
-	if res := checkQuery(r, requiredParams, optionalParams); !res.ok {
+	if res := checkQuery(r, requiredParams, optional); !res.ok {
 		return res
 	}
-	v := r.URL.Query()
-	params := getQueryParams(v)
+	v = r.URL.Query()
+	query := v
+	if storedQuery != nil {
+		query = storedQuery.withoutParameters(v)
+	}
+	params, err := getQueryParams(query)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	params.setContentCrs(h)
+	if storedQuery != nil {
+		if !params.layer.isQuake() && !storedQuery.anyLayer {
+			return badRequest("the stored query " + storedQuery.id + " is for quakes only")
+		}
+		f, err := storedQuery.getFilter(params.layer, v)
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		params.filters = append(params.filters, f)
+		if storedQuery.id == GET_FEATURE_BY_ID_QUERY {
+			if res := checkFeatureFound(params, v.Get("ID")); res != nil {
+				return res
+			}
+		}
+	}
+	if !params.layer.isQuake() {
+		if params.aggregate != nil || v.Get("declustered") != "" || params.locality || params.distanceFrom != nil {
+			return badRequest("aggregate, declustered, locality and distanceFrom are for quakes only")
+		}
+		if res := getFeaturesOutput(r, h, b, params); res != nil {
+			return res
+		}
+		return &statusOK
+	}
+	if res := setDeclustered(params, v.Get("declustered")); res != nil {
+		return res
+	}
+	if res := getQuakesOutput(r, h, b, params); res != nil {
+		return res
+	}
+	return &statusOK
+}
+
+/**
+ * the quakes in the outputFormat of params, nil for an unknown outputFormat
+ */
+func getQuakesOutput(r *http.Request, h http.Header, b *bytes.Buffer, params *QueryParams) *result {
 	log.Println("##outputFormat|", params.outputFormat, "| sub type", params.subType)
+	if params.aggregate != nil {
+		return getQuakesAggregate(h, b, params)
+	}
 	if params.outputFormat == "JSON" {
 		return getQuakesGeoJson(r, h, b, params)
 	} else if params.outputFormat == "CSV" {
@@ -80,7 +169,128 @@ func getQuakesWfs(r *http.Request, h http.Header, b *bytes.Buffer) *result {
 		log.Println("##2 outputFormat", params.outputFormat, " sub type", params.subType)
 		return getQuakesGml3(r, h, b, params)
 	}
-	return &statusOK
+	return nil
+}
+
+/**
+ * a single quake by its publicid, /quake/2016p123456?outputFormat=csv
+ * the outputFormat is GeoJSON by default.
+ */
+func getQuake(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{}, []string{"outputFormat", "subtype", "srsName", "crs"}); !res.ok {
+		return res
+	}
+	publicid := strings.TrimPrefix(r.URL.Path, "/quake/")
+	if publicid == "" || strings.Contains(publicid, "/") {
+		return badRequest("invalid publicid " + publicid)
+	}
+
+	params, err := getQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	var count int
+	if err := db.QueryRow("select count(*) from "+params.layer.Table+" where publicid = $1", publicid).Scan(&count); err != nil {
+		return internalServerError(err)
+	}
+	if count == 0 {
+		return notFoundError("quake " + publicid + " not found")
+	}
+	params.featureIds = publicid
+	params.setContentCrs(h)
+	if params.outputFormat == "" {
+		params.outputFormat = "JSON"
+	}
+	if res := getQuakesOutput(r, h, b, params); res != nil {
+		return res
+	}
+	return badRequest("unsupported outputFormat " + r.URL.Query().Get("outputFormat"))
+}
+
+/**
+ * The columns of the KML placemarks, scanned by kmlQuake.fields.
+ */
+const QUAKE_KML_COLUMNS = `publicid, eventtype, to_char(origintime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS origintime,
+     latitude, longitude, depth, depthtype, magnitude, magnitudetype, evaluationmethod, evaluationstatus,
+     evaluationmode, earthmodel, usedphasecount,usedstationcount, minimumdistance, azimuthalgap, magnitudeuncertainty,
+     originerror, magnitudestationcount, to_char(modificationtime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS modificationtime`
+
+// kmlQuake is a row of QUAKE_KML_COLUMNS, note the null values
+type kmlQuake struct {
+	publicid              string
+	origintime            string
+	modificationtime      sql.NullString
+	eventtype             sql.NullString
+	latitude              float64
+	longitude             float64
+	depth                 sql.NullFloat64
+	depthtype             sql.NullString
+	magnitude             sql.NullFloat64
+	magnitudetype         sql.NullString
+	evaluationmethod      sql.NullString
+	evaluationstatus      sql.NullString
+	evaluationmode        sql.NullString
+	earthmodel            sql.NullString
+	usedphasecount        sql.NullInt64
+	usedstationcount      sql.NullInt64
+	minimumdistance       sql.NullFloat64
+	azimuthalgap          sql.NullFloat64
+	magnitudeuncertainty  sql.NullFloat64
+	originerror           sql.NullFloat64
+	magnitudestationcount sql.NullInt64
+}
+
+// fields are the scan destinations of QUAKE_KML_COLUMNS
+func (q *kmlQuake) fields() []interface{} {
+	return []interface{}{&q.publicid, &q.eventtype, &q.origintime, &q.latitude, &q.longitude, &q.depth, &q.depthtype,
+		&q.magnitude, &q.magnitudetype, &q.evaluationmethod, &q.evaluationstatus,
+		&q.evaluationmode, &q.earthmodel, &q.usedphasecount, &q.usedstationcount,
+		&q.minimumdistance, &q.azimuthalgap, &q.magnitudeuncertainty, &q.originerror, &q.magnitudestationcount,
+		&q.modificationtime}
+}
+
+// quakeAttribute is a name (as in GeoJSON and GML), title (as in the KML ExtendedData) and value of a quake
+type quakeAttribute struct {
+	name  string
+	title string
+	value interface{}
+}
+
+/**
+ * attributes are the KML ExtendedData of a quake, also the attributes of WMS GetFeatureInfo.
+ * The null values are left out.
+ */
+func (q *kmlQuake) attributes() ([]quakeAttribute, error) {
+	t, err := time.Parse(RFC3339_FORMAT, q.origintime)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []quakeAttribute{
+		{"publicid", "Public Id", q.publicid},
+		{"utctime", "Universal Time", t.In(time.UTC).Format(UTC_KML_TIME_FORMAT)},
+		{"nztime", "NZ Standard Time", t.In(NZTzLocation).Format(NZ_KML_TIME_FORMAT)},
+	}
+	add := func(name, title string, valid bool, value interface{}) {
+		if valid {
+			attributes = append(attributes, quakeAttribute{name, title, value})
+		}
+	}
+	add("depth", "Focal Depth (km)", q.depth.Valid, q.depth.Float64)
+	add("magnitude", "Magnitude", q.magnitude.Valid, q.magnitude.Float64)
+	add("magnitudetype", "Magnitude Type", q.magnitudetype.Valid, q.magnitudetype.String)
+	add("depthtype", "Depth Type", q.depthtype.Valid, q.depthtype.String)
+	add("evaluationmethod", "Evaluation Method", q.evaluationmethod.Valid, q.evaluationmethod.String)
+	add("evaluationstatus", "Evaluation Status", q.evaluationstatus.Valid, q.evaluationstatus.String)
+	add("evaluationmode", "Evaluation Mode", q.evaluationmode.Valid, q.evaluationmode.String)
+	add("earthmodel", "Earth Model", q.earthmodel.Valid, q.earthmodel.String)
+	add("usedphasecount", "Used Face Count", q.usedphasecount.Valid, q.usedphasecount.Int64)
+	add("usedstationcount", "Used station Count", q.usedstationcount.Valid, q.usedstationcount.Int64)
+	add("magnitudestationcount", "Magnitude station Count", q.magnitudestationcount.Valid, q.magnitudestationcount.Int64)
+	add("minimumdistance", "Minimum Distance", q.minimumdistance.Valid, q.minimumdistance.Float64)
+	add("azimuthalgap", "Azimuthal Gap", q.azimuthalgap.Valid, q.azimuthalgap.Float64)
+	add("originerror", "Origin Error", q.originerror.Valid, q.originerror.Float64)
+	add("magnitudeuncertainty", "Magnitude Uncertainty", q.magnitudeuncertainty.Valid, q.magnitudeuncertainty.Float64)
+	return attributes, nil
 }
 
 /**
@@ -95,20 +305,27 @@ func getQuakesKml(r *http.Request, h http.Header, b *bytes.Buffer) *result {
 	}
 
 	v := r.URL.Query()
-	sqlPre := `select publicid, eventtype, to_char(origintime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS origintime,
-     latitude, longitude, depth, depthtype, magnitude, magnitudetype, evaluationmethod, evaluationstatus,
-     evaluationmode, earthmodel, usedphasecount,usedstationcount, minimumdistance, azimuthalgap, magnitudeuncertainty,
-     originerror, magnitudestationcount, to_char(modificationtime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS modificationtime
-     from wfs.quake_search_v1 `
-
-	params := getQueryParams(v)
+	params, err := getQueryParams(v)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	if !params.layer.isQuake() {
+		return badRequest("KML is for quakes only")
+	}
+	if !isWgs84(params.srid) {
+		return badRequest("KML is in EPSG:4326 only")
+	}
+	if res := setDeclustered(params, v.Get("declustered")); res != nil {
+		return res
+	}
+	sqlPre := "select " + QUAKE_KML_COLUMNS + ", " + params.distanceSql() + " from " + params.layer.Table + " "
 
-	sqlString, err1 := getSqlQueryString(sqlPre, params)
+	sqlString, args, err1 := getSqlQueryString(sqlPre, params)
 	if err1 != nil {
 		return badRequest(err1.Error())
 	}
 
-	rows, err := db.Query(sqlString)
+	rows, err := db.Query(sqlString, args...)
 
 	if err != nil {
 		return internalServerError(err)
@@ -119,132 +336,43 @@ func getQuakesKml(r *http.Request, h http.Header, b *bytes.Buffer) *result {
 	allQuakeFolders := make(map[string]*Folder)
 
 	for rows.Next() { //21 fields
-		var ( //note the null values
-			publicid              string
-			origintime            string
-			modificationtime      sql.NullString
-			eventtype             sql.NullString
-			latitude              float64
-			longitude             float64
-			depth                 sql.NullFloat64
-			depthtype             sql.NullString
-			magnitude             sql.NullFloat64
-			magnitudetype         sql.NullString
-			evaluationmethod      sql.NullString
-			evaluationstatus      sql.NullString
-			evaluationmode        sql.NullString
-			earthmodel            sql.NullString
-			usedphasecount        sql.NullInt64
-			usedstationcount      sql.NullInt64
-			minimumdistance       sql.NullFloat64
-			azimuthalgap          sql.NullFloat64
-			magnitudeuncertainty  sql.NullFloat64
-			originerror           sql.NullFloat64
-			magnitudestationcount sql.NullInt64
-		)
-
-		err := rows.Scan(&publicid, &eventtype, &origintime, &latitude, &longitude, &depth, &depthtype,
-			&magnitude, &magnitudetype, &evaluationmethod, &evaluationstatus,
-			&evaluationmode, &earthmodel, &usedphasecount, &usedstationcount,
-			&minimumdistance, &azimuthalgap, &magnitudeuncertainty, &originerror, &magnitudestationcount,
-			&modificationtime,
-		)
-		if err != nil {
+		q := &kmlQuake{}
+		var distance sql.NullFloat64
+		if err := rows.Scan(append(q.fields(), &distance)...); err != nil {
 			return internalServerError(err)
 		}
 		count++
+		magnitude := q.magnitude
 
 		mag := 0.0
 		if magnitude.Valid {
 			mag = magnitude.Float64
 		}
 		dep := 0.0
-		if depth.Valid {
-			dep = depth.Float64
+		if q.depth.Valid {
+			dep = q.depth.Float64
 		}
 
 		iconSt := NewIconStyle(getKmlIconSize(mag), 0.0)
 		style := NewStyle("", iconSt, nil)
-		quakePm := NewPlacemark("quake."+publicid, origintime, NewPoint(latitude, longitude))
+		quakePm := NewPlacemark("quake."+q.publicid, q.origintime, NewPoint(q.latitude, q.longitude))
 		quakePm.SetStyleUrl(getKmlStyleUrl(dep))
 		quakePm.SetStyle(style)
 
-		exData := NewExtendedData()
-		exData.AddData(NewData("Public Id", publicid))
-
-		t, err := time.Parse(RFC3339_FORMAT, origintime)
+		attributes, err := q.attributes()
 		if err != nil {
 			log.Panic("time format error", err)
 			return internalServerError(err)
 		}
-
-		tu := t.In(time.UTC)
-		utcTime := tu.Format(UTC_KML_TIME_FORMAT)
-		exData.AddData(NewData("Universal Time", utcTime))
-
-		tnz := t.In(NZTzLocation)
-		nzTime := tnz.Format(NZ_KML_TIME_FORMAT)
-
-		exData.AddData(NewData("NZ Standard Time", nzTime))
-
-		if depth.Valid {
-			exData.AddData(NewData("Focal Depth (km)", fmt.Sprintf("%g", depth.Float64)))
-		}
-
-		if magnitude.Valid {
-			exData.AddData(NewData("Magnitude", fmt.Sprintf("%g", magnitude.Float64)))
-		}
-
-		if magnitudetype.Valid {
-			exData.AddData(NewData("Magnitude Type", magnitudetype.String))
-		}
-
-		if depthtype.Valid {
-			exData.AddData(NewData("Depth Type", depthtype.String))
-		}
-
-		if evaluationmethod.Valid {
-			exData.AddData(NewData("Evaluation Method", evaluationmethod.String))
-		}
-
-		if evaluationstatus.Valid {
-			exData.AddData(NewData("Evaluation Status", evaluationstatus.String))
-		}
-
-		if evaluationmode.Valid {
-			exData.AddData(NewData("Evaluation Mode", evaluationmode.String))
-		}
-
-		if earthmodel.Valid {
-			exData.AddData(NewData("Earth Model", earthmodel.String))
-		}
-
-		if usedphasecount.Valid {
-			exData.AddData(NewData("Used Face Count", fmt.Sprintf("%d", usedphasecount.Int64)))
-		}
-
-		if usedstationcount.Valid {
-			exData.AddData(NewData("Used station Count", fmt.Sprintf("%d", usedstationcount.Int64)))
-		}
-
-		if magnitudestationcount.Valid {
-			exData.AddData(NewData("Magnitude station Count", fmt.Sprintf("%d", magnitudestationcount.Int64)))
+		exData := NewExtendedData()
+		for _, a := range attributes {
+			exData.AddData(NewData(a.title, fmt.Sprint(a.value)))
 		}
-
-		if minimumdistance.Valid {
-			exData.AddData(NewData("Minimum Distance", fmt.Sprintf("%g", minimumdistance.Float64)))
+		if distance.Valid {
+			exData.AddData(NewData("Distance (km)", fmt.Sprintf("%.2f", distance.Float64)))
 		}
-
-		if azimuthalgap.Valid {
-			exData.AddData(NewData("Azimuthal Gap", fmt.Sprintf("%g", azimuthalgap.Float64)))
-		}
-
-		if originerror.Valid {
-			exData.AddData(NewData("Origin Error", fmt.Sprintf("%g", originerror.Float64)))
-		}
-
-		if magnitudeuncertainty.Valid {
-			exData.AddData(NewData("Magnitude Uncertainty", fmt.Sprintf("%g", magnitudeuncertainty.Float64)))
+		if params.locality {
+			exData.AddData(NewData("Location", nearestLocality(q.longitude, q.latitude).description()))
 		}
 
 		quakePm.SetExtendedData(exData)
@@ -310,14 +438,14 @@ func getQuakesGml3(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
            latitude, longitude, depth, depthtype, magnitude,  magnitudetype, evaluationmethod, evaluationstatus,
            evaluationmode, earthmodel, usedphasecount,usedstationcount, minimumdistance, azimuthalgap, magnitudeuncertainty,
            originerror, magnitudestationcount, to_char(modificationtime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS modificationtime,
-           ST_AsGML(3,origin_geom) as gml from wfs.quake_search_v1 `
+           ` + params.gmlSql(3, "origin_geom") + ` as gml, ` + params.xySql("origin_geom") + ` from ` + params.layer.Table + " "
 
-	sqlString, err1 := getSqlQueryString(sqlPre, params)
+	sqlString, args, err1 := getSqlQueryString(sqlPre, params)
 	if err1 != nil {
 		return badRequest(err1.Error())
 	}
 
-	rows, err := db.Query(sqlString)
+	rows, err := db.Query(sqlString, args...)
 
 	if err != nil {
 		return internalServerError(err)
@@ -331,19 +459,23 @@ func getQuakesGml3(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 		boundLower string
 		boundUpper string
 	)
+	//the bounds are in EPSG:4326 whatever the CRS of the features
+	bounds := params.wgs84()
 	if params.bbox != "" {
 		bboxarray := BBox2Array(params.bbox)
 		if len(bboxarray) == 4 {
-			boundLower = bboxarray[0] + " " + bboxarray[1]
-			boundUpper = bboxarray[2] + " " + bboxarray[3]
+			boundLower = bounds.gmlPos(bboxarray[0], bboxarray[1], " ")
+			boundUpper = bounds.gmlPos(bboxarray[2], bboxarray[3], " ")
 		}
 	}
 
 	if boundLower == "" {
-		boundLower = GML3_BOUND_LOWER_NZ
+		lower := strings.Fields(GML3_BOUND_LOWER_NZ)
+		boundLower = bounds.gmlPos(lower[0], lower[1], " ")
 	}
 	if boundUpper == "" {
-		boundUpper = GML3_BOUND_UPPER_NZ
+		upper := strings.Fields(GML3_BOUND_UPPER_NZ)
+		boundUpper = bounds.gmlPos(upper[0], upper[1], " ")
 	}
 
 	t := time.Now()
@@ -359,7 +491,7 @@ func getQuakesGml3(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
        http://www.opengis.net/gml/3.2 http://wfs.geonet.org.nz/schemas/gml/3.2.1/gml.xsd
        http://www.opengis.net/wfs/2.0 http://wfs.geonet.org.nz/schemas/wfs/2.0/wfs.xsd">
      <wfs:boundedBy>
-        <gml:Envelope srsDimension="2" srsName="http://www.opengis.net/gml/srs/epsg.xml#4326">
+        <gml:Envelope srsDimension="2" srsName="` + bounds.gmlSrsName() + `">
           <gml:lowerCorner>` + boundLower + `</gml:lowerCorner>
            <gml:upperCorner>` + boundUpper + `</gml:upperCorner>
        </gml:Envelope>
@@ -391,13 +523,14 @@ func getQuakesGml3(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 			originerror           sql.NullFloat64
 			magnitudestationcount sql.NullInt64
 			gml                   string
+			x, y                  float64
 		)
 
 		err := rows.Scan(&publicid, &eventtype, &origintime, &latitude, &longitude, &depth, &depthtype,
 			&magnitude, &magnitudetype, &evaluationmethod, &evaluationstatus,
 			&evaluationmode, &earthmodel, &usedphasecount, &usedstationcount,
 			&minimumdistance, &azimuthalgap, &magnitudeuncertainty, &originerror, &magnitudestationcount,
-			&modificationtime, &gml,
+			&modificationtime, &gml, &x, &y,
 		)
 		if err != nil {
 			return internalServerError(err)
@@ -405,68 +538,79 @@ func getQuakesGml3(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 		b.Write([]byte("<wfs:member>\n"))
 		b.Write([]byte(fmt.Sprintf("<geonet:quake gml:id=\"quake.%s\">\n", publicid)))
 		//
-		b.Write([]byte("<gml:boundedBy>\n<gml:Envelope srsDimension=\"2\" srsName=\"http://www.opengis.net/gml/srs/epsg.xml#4326\">\n"))
-		b.Write([]byte(fmt.Sprintf("<gml:lowerCorner>%g %g</gml:lowerCorner>\n", longitude, latitude)))
-		b.Write([]byte(fmt.Sprintf("<gml:upperCorner>%g %g</gml:upperCorner>\n", longitude, latitude)))
+		b.Write([]byte("<gml:boundedBy>\n<gml:Envelope srsDimension=\"2\" srsName=\"" + params.gmlSrsName() + "\">\n"))
+		pos := params.gmlPos(fmt.Sprintf("%g", x), fmt.Sprintf("%g", y), " ")
+		b.Write([]byte("<gml:lowerCorner>" + pos + "</gml:lowerCorner>\n"))
+		b.Write([]byte("<gml:upperCorner>" + pos + "</gml:upperCorner>\n"))
 		b.Write([]byte("</gml:Envelope>\n</gml:boundedBy>\n"))
 
-		b.Write([]byte(fmt.Sprintf("<geonet:publicid>%s</geonet:publicid>\n", publicid)))
-		b.Write([]byte(fmt.Sprintf("<geonet:origintime>%s</geonet:origintime>\n", origintime)))
-		b.Write([]byte(fmt.Sprintf("<geonet:latitude>%g</geonet:latitude>\n", latitude)))
-		b.Write([]byte(fmt.Sprintf("<geonet:longitude>%g</geonet:longitude>\n", longitude)))
-		if eventtype.Valid {
+		if params.hasProperty("publicid") {
+			b.Write([]byte(fmt.Sprintf("<geonet:publicid>%s</geonet:publicid>\n", publicid)))
+		}
+		if params.hasProperty("origintime") {
+			b.Write([]byte(fmt.Sprintf("<geonet:origintime>%s</geonet:origintime>\n", origintime)))
+		}
+		if params.hasProperty("latitude") {
+			b.Write([]byte(fmt.Sprintf("<geonet:latitude>%g</geonet:latitude>\n", latitude)))
+		}
+		if params.hasProperty("longitude") {
+			b.Write([]byte(fmt.Sprintf("<geonet:longitude>%g</geonet:longitude>\n", longitude)))
+		}
+		if eventtype.Valid && params.hasProperty("eventtype") {
 			b.Write([]byte(fmt.Sprintf("<geonet:eventtype>%s</geonet:eventtype>\n", eventtype.String)))
 		}
-		if modificationtime.Valid {
+		if modificationtime.Valid && params.hasProperty("modificationtime") {
 			b.Write([]byte(fmt.Sprintf("<geonet:modificationtime>%s</geonet:modificationtime>\n", modificationtime.String)))
 		}
-		if depth.Valid {
+		if depth.Valid && params.hasProperty("depth") {
 			b.Write([]byte(fmt.Sprintf("<geonet:depth>%g</geonet:depth>\n", depth.Float64)))
 		}
-		if depthtype.Valid {
+		if depthtype.Valid && params.hasProperty("depthtype") {
 			b.Write([]byte(fmt.Sprintf("<geonet:depthtype>%s</geonet:depthtype>\n", depthtype.String)))
 		}
-		if magnitude.Valid {
+		if magnitude.Valid && params.hasProperty("magnitude") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitude>%g</geonet:magnitude>\n", magnitude.Float64)))
 		}
-		if magnitudetype.Valid {
+		if magnitudetype.Valid && params.hasProperty("magnitudetype") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitudetype>%s</geonet:magnitudetype>\n", magnitudetype.String)))
 		}
-		if evaluationmethod.Valid {
+		if evaluationmethod.Valid && params.hasProperty("evaluationmethod") {
 			b.Write([]byte(fmt.Sprintf("<geonet:evaluationmethod>%s</geonet:evaluationmethod>\n", evaluationmethod.String)))
 		}
-		if evaluationstatus.Valid {
+		if evaluationstatus.Valid && params.hasProperty("evaluationstatus") {
 			b.Write([]byte(fmt.Sprintf("<geonet:evaluationstatus>%s</geonet:evaluationstatus>\n", evaluationstatus.String)))
 		}
-		if evaluationmode.Valid {
+		if evaluationmode.Valid && params.hasProperty("evaluationmode") {
 			b.Write([]byte(fmt.Sprintf("<geonet:evaluationmode>%s</geonet:evaluationmode>\n", evaluationmode.String)))
 		}
-		if earthmodel.Valid {
+		if earthmodel.Valid && params.hasProperty("earthmodel") {
 			b.Write([]byte(fmt.Sprintf("<geonet:earthmodel>%s</geonet:earthmodel>\n", earthmodel.String)))
 		}
-		if usedphasecount.Valid {
+		if usedphasecount.Valid && params.hasProperty("usedphasecount") {
 			b.Write([]byte(fmt.Sprintf("<geonet:usedphasecount>%d</geonet:usedphasecount>\n", usedphasecount.Int64)))
 		}
-		if usedstationcount.Valid {
+		if usedstationcount.Valid && params.hasProperty("usedstationcount") {
 			b.Write([]byte(fmt.Sprintf("<geonet:usedstationcount>%d</geonet:usedstationcount>\n", usedstationcount.Int64)))
 		}
-		if minimumdistance.Valid {
+		if minimumdistance.Valid && params.hasProperty("minimumdistance") {
 			b.Write([]byte(fmt.Sprintf("<geonet:minimumdistance>%g</geonet:minimumdistance>\n", minimumdistance.Float64)))
 		}
-		if azimuthalgap.Valid {
+		if azimuthalgap.Valid && params.hasProperty("azimuthalgap") {
 			b.Write([]byte(fmt.Sprintf("<geonet:azimuthalgap>%g</geonet:azimuthalgap>\n", azimuthalgap.Float64)))
 		}
-		if magnitudeuncertainty.Valid {
+		if magnitudeuncertainty.Valid && params.hasProperty("magnitudeuncertainty") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitudeuncertainty>%g</geonet:magnitudeuncertainty>\n", magnitudeuncertainty.Float64)))
 		}
-		if originerror.Valid {
+		if originerror.Valid && params.hasProperty("originerror") {
 			b.Write([]byte(fmt.Sprintf("<geonet:originerror>%g</geonet:originerror>\n", originerror.Float64)))
 		}
-		if magnitudestationcount.Valid {
+		if magnitudestationcount.Valid && params.hasProperty("magnitudestationcount") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitudestationcount>%d</geonet:magnitudestationcount>\n", magnitudestationcount.Int64)))
 		}
 		//geonet:origin_geom
-		b.Write([]byte(fmt.Sprintf("<geonet:origin_geom>%s</geonet:origin_geom>\n", gml)))
+		if params.hasProperty("origin_geom") {
+			b.Write([]byte(fmt.Sprintf("<geonet:origin_geom>%s</geonet:origin_geom>\n", gml)))
+		}
 		b.Write([]byte("</geonet:quake></wfs:member>\n"))
 	}
 
@@ -483,14 +627,14 @@ func getQuakesGml2(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
            latitude, longitude, depth, depthtype, magnitude,  magnitudetype, evaluationmethod, evaluationstatus,
            evaluationmode, earthmodel, usedphasecount,usedstationcount, minimumdistance, azimuthalgap, magnitudeuncertainty,
            originerror, magnitudestationcount, to_char(modificationtime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS modificationtime,
-           ST_AsGML(origin_geom) as gml from wfs.quake_search_v1 `
+           ` + params.gmlSql(2, "origin_geom") + ` as gml, ` + params.xySql("origin_geom") + ` from ` + params.layer.Table + " "
 
-	sqlString, err1 := getSqlQueryString(sqlPre, params)
+	sqlString, args, err1 := getSqlQueryString(sqlPre, params)
 	if err1 != nil {
 		return badRequest(err1.Error())
 	}
 
-	rows, err := db.Query(sqlString)
+	rows, err := db.Query(sqlString, args...)
 
 	if err != nil {
 		return internalServerError(err)
@@ -504,17 +648,23 @@ func getQuakesGml2(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 	if bbox1 == "" {
 		bbox1 = GML_BBOX_NZ
 	}
+	//the bounds are in EPSG:4326 whatever the CRS of the features
+	bounds := params.wgs84()
+	if bounds.latLon {
+		bbox1 = swapGmlCoordinates(bbox1)
+	}
+	gml2Bounds := `
+       <gml:Box srsName="` + bounds.gmlSrsName() + `">
+          <gml:coordinates decimal="." cs="," ts=" ">` + bbox1 + `</gml:coordinates>
+       </gml:Box>
+     `
 	b.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
     <wfs:FeatureCollection xmlns:wfs="http://www.opengis.net/wfs"
      xmlns:gml="http://www.opengis.net/gml"
      xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
      xmlns:geonet="http://geonet.org.nz"
      xsi:schemaLocation="http://geonet.org.nz http://geonet.org.nz/quakes http://www.opengis.net/wfs http://schemas.opengis.net/wfs/1.0.0/WFS-basic.xsd">
-     <gml:boundedBy>
-       <gml:Box srsName="http://www.opengis.net/gml/srs/epsg.xml#4326">
-          <gml:coordinates decimal="." cs="," ts=" ">` + bbox1 + `</gml:coordinates>
-       </gml:Box>
-     </gml:boundedBy>`))
+     <gml:boundedBy>` + gml2Bounds + `</gml:boundedBy>`))
 	b.Write(eol)
 
 	for rows.Next() {
@@ -541,13 +691,14 @@ func getQuakesGml2(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 			originerror           sql.NullFloat64
 			magnitudestationcount sql.NullInt64
 			gml                   string
+			x, y                  float64
 		)
 
 		err := rows.Scan(&publicid, &eventtype, &origintime, &latitude, &longitude, &depth, &depthtype,
 			&magnitude, &magnitudetype, &evaluationmethod, &evaluationstatus,
 			&evaluationmode, &earthmodel, &usedphasecount, &usedstationcount,
 			&minimumdistance, &azimuthalgap, &magnitudeuncertainty, &originerror, &magnitudestationcount,
-			&modificationtime, &gml,
+			&modificationtime, &gml, &x, &y,
 		)
 		if err != nil {
 			return internalServerError(err)
@@ -555,67 +706,78 @@ func getQuakesGml2(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 		b.Write([]byte("<gml:featureMember>\n"))
 		b.Write([]byte(fmt.Sprintf("<geonet:quake fid=\"quake.%s\">\n", publicid)))
 		//
-		b.Write([]byte("<gml:boundedBy>\n<gml:Box srsName=\"http://www.opengis.net/gml/srs/epsg.xml#4326\">\n"))
-		b.Write([]byte(fmt.Sprintf("<gml:coordinates decimal=\".\" cs=\",\" ts=\" \">%g,%g %g,%g</gml:coordinates>\n", longitude, latitude, longitude, latitude)))
+		b.Write([]byte("<gml:boundedBy>\n<gml:Box srsName=\"" + params.gmlSrsName() + "\">\n"))
+		coord := params.gmlPos(fmt.Sprintf("%g", x), fmt.Sprintf("%g", y), ",")
+		b.Write([]byte("<gml:coordinates decimal=\".\" cs=\",\" ts=\" \">" + coord + " " + coord + "</gml:coordinates>\n"))
 		b.Write([]byte("</gml:Box>\n</gml:boundedBy>\n"))
 
-		b.Write([]byte(fmt.Sprintf("<geonet:publicid>%s</geonet:publicid>\n", publicid)))
-		b.Write([]byte(fmt.Sprintf("<geonet:origintime>%s</geonet:origintime>\n", origintime)))
-		b.Write([]byte(fmt.Sprintf("<geonet:latitude>%g</geonet:latitude>\n", latitude)))
-		b.Write([]byte(fmt.Sprintf("<geonet:longitude>%g</geonet:longitude>\n", longitude)))
-		if eventtype.Valid {
+		if params.hasProperty("publicid") {
+			b.Write([]byte(fmt.Sprintf("<geonet:publicid>%s</geonet:publicid>\n", publicid)))
+		}
+		if params.hasProperty("origintime") {
+			b.Write([]byte(fmt.Sprintf("<geonet:origintime>%s</geonet:origintime>\n", origintime)))
+		}
+		if params.hasProperty("latitude") {
+			b.Write([]byte(fmt.Sprintf("<geonet:latitude>%g</geonet:latitude>\n", latitude)))
+		}
+		if params.hasProperty("longitude") {
+			b.Write([]byte(fmt.Sprintf("<geonet:longitude>%g</geonet:longitude>\n", longitude)))
+		}
+		if eventtype.Valid && params.hasProperty("eventtype") {
 			b.Write([]byte(fmt.Sprintf("<geonet:eventtype>%s</geonet:eventtype>\n", eventtype.String)))
 		}
-		if modificationtime.Valid {
+		if modificationtime.Valid && params.hasProperty("modificationtime") {
 			b.Write([]byte(fmt.Sprintf("<geonet:modificationtime>%s</geonet:modificationtime>\n", modificationtime.String)))
 		}
-		if depth.Valid {
+		if depth.Valid && params.hasProperty("depth") {
 			b.Write([]byte(fmt.Sprintf("<geonet:depth>%g</geonet:depth>\n", depth.Float64)))
 		}
-		if depthtype.Valid {
+		if depthtype.Valid && params.hasProperty("depthtype") {
 			b.Write([]byte(fmt.Sprintf("<geonet:depthtype>%s</geonet:depthtype>\n", depthtype.String)))
 		}
-		if magnitude.Valid {
+		if magnitude.Valid && params.hasProperty("magnitude") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitude>%g</geonet:magnitude>\n", magnitude.Float64)))
 		}
-		if magnitudetype.Valid {
+		if magnitudetype.Valid && params.hasProperty("magnitudetype") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitudetype>%s</geonet:magnitudetype>\n", magnitudetype.String)))
 		}
-		if evaluationmethod.Valid {
+		if evaluationmethod.Valid && params.hasProperty("evaluationmethod") {
 			b.Write([]byte(fmt.Sprintf("<geonet:evaluationmethod>%s</geonet:evaluationmethod>\n", evaluationmethod.String)))
 		}
-		if evaluationstatus.Valid {
+		if evaluationstatus.Valid && params.hasProperty("evaluationstatus") {
 			b.Write([]byte(fmt.Sprintf("<geonet:evaluationstatus>%s</geonet:evaluationstatus>\n", evaluationstatus.String)))
 		}
-		if evaluationmode.Valid {
+		if evaluationmode.Valid && params.hasProperty("evaluationmode") {
 			b.Write([]byte(fmt.Sprintf("<geonet:evaluationmode>%s</geonet:evaluationmode>\n", evaluationmode.String)))
 		}
-		if earthmodel.Valid {
+		if earthmodel.Valid && params.hasProperty("earthmodel") {
 			b.Write([]byte(fmt.Sprintf("<geonet:earthmodel>%s</geonet:earthmodel>\n", earthmodel.String)))
 		}
-		if usedphasecount.Valid {
+		if usedphasecount.Valid && params.hasProperty("usedphasecount") {
 			b.Write([]byte(fmt.Sprintf("<geonet:usedphasecount>%d</geonet:usedphasecount>\n", usedphasecount.Int64)))
 		}
-		if usedstationcount.Valid {
+		if usedstationcount.Valid && params.hasProperty("usedstationcount") {
 			b.Write([]byte(fmt.Sprintf("<geonet:usedstationcount>%d</geonet:usedstationcount>\n", usedstationcount.Int64)))
 		}
-		if minimumdistance.Valid {
+		if minimumdistance.Valid && params.hasProperty("minimumdistance") {
 			b.Write([]byte(fmt.Sprintf("<geonet:minimumdistance>%g</geonet:minimumdistance>\n", minimumdistance.Float64)))
 		}
-		if azimuthalgap.Valid {
+		if azimuthalgap.Valid && params.hasProperty("azimuthalgap") {
 			b.Write([]byte(fmt.Sprintf("<geonet:azimuthalgap>%g</geonet:azimuthalgap>\n", azimuthalgap.Float64)))
 		}
-		if magnitudeuncertainty.Valid {
+		if magnitudeuncertainty.Valid && params.hasProperty("magnitudeuncertainty") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitudeuncertainty>%g</geonet:magnitudeuncertainty>\n", magnitudeuncertainty.Float64)))
 		}
-		if originerror.Valid {
+		if originerror.Valid && params.hasProperty("originerror") {
 			b.Write([]byte(fmt.Sprintf("<geonet:originerror>%g</geonet:originerror>\n", originerror.Float64)))
 		}
-		if magnitudestationcount.Valid {
+		if magnitudestationcount.Valid && params.hasProperty("magnitudestationcount") {
 			b.Write([]byte(fmt.Sprintf("<geonet:magnitudestationcount>%d</geonet:magnitudestationcount>\n", magnitudestationcount.Int64)))
 		}
 		//geonet:origin_geom
-		b.Write([]byte(fmt.Sprintf("<geonet:origin_geom>%s</geonet:origin_geom>\n", gml)))
+		if params.hasProperty("origin_geom") {
+			b.Write([]byte(fmt.Sprintf("<geonet:origin_geom>%s</geonet:origin_geom>\n", gml)))
+		}
 		b.Write([]byte("</geonet:quake></gml:featureMember>\n"))
 	}
 
@@ -629,19 +791,40 @@ func getQuakesGml2(r *http.Request, h http.Header, b *bytes.Buffer, params *Quer
 
 func getQuakesCsv(r *http.Request, h http.Header, b *bytes.Buffer, params *QueryParams) *result {
 	//21  fields
-	sqlPre := `select format('%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s',
+	//the x,y of the reprojected origin_geom follow the 21 fields in another CRS
+	xyFormat, xyColumns := "", ""
+	if !isWgs84(params.srid) {
+		xyFormat, xyColumns = ",%s,%s", ", "+params.xySql("origin_geom")
+	}
+	//then the distance_km of distanceFrom
+	if params.distanceFrom != nil {
+		xyFormat, xyColumns = xyFormat+",%s", xyColumns+", round(("+params.distanceSql()+")::numeric, 2)"
+	}
+	sqlPre := `select format('%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s` + xyFormat + `',
                publicid,eventtype,to_char(origintime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"'),
                to_char(modificationtime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"'),longitude, latitude, magnitude,
                depth,magnitudetype, depthtype, evaluationmethod, evaluationstatus, evaluationmode, earthmodel, usedphasecount,
                usedstationcount,magnitudestationcount, minimumdistance,
-               azimuthalgap,originerror,magnitudeuncertainty) as csv from wfs.quake_search_v1`
+               azimuthalgap,originerror,magnitudeuncertainty` + xyColumns + `) as csv from ` + params.layer.Table
+	header := "publicid,eventtype,origintime,modificationtime,longitude, latitude, magnitude, depth,magnitudetype,depthtype," +
+		"evaluationmethod,evaluationstatus,evaluationmode,earthmodel,usedphasecount,usedstationcount,magnitudestationcount,minimumdistance," +
+		"azimuthalgap,originerror,magnitudeuncertainty"
+	if !isWgs84(params.srid) {
+		header += ",x,y"
+	}
+	if params.distanceFrom != nil {
+		header += "," + DISTANCE_PROPERTY
+	}
+	if params.properties != nil {
+		sqlPre, header = getCsvSelect(params)
+	}
 
-	sqlString, err1 := getSqlQueryString(sqlPre, params)
+	sqlString, args, err1 := getSqlQueryString(sqlPre, params)
 	if err1 != nil {
 		return badRequest(err1.Error())
 	}
 
-	rows, err := db.Query(sqlString)
+	rows, err := db.Query(sqlString, args...)
 
 	if err != nil {
 		return internalServerError(err)
@@ -655,9 +838,7 @@ func getQuakesCsv(r *http.Request, h http.Header, b *bytes.Buffer, params *Query
 	)
 	eol := []byte("\n")
 
-	b.Write([]byte("publicid,eventtype,origintime,modificationtime,longitude, latitude, magnitude, depth,magnitudetype,depthtype," +
-		"evaluationmethod,evaluationstatus,evaluationmode,earthmodel,usedphasecount,usedstationcount,magnitudestationcount,minimumdistance," +
-		"azimuthalgap,originerror,magnitudeuncertainty"))
+	b.Write([]byte(header))
 	b.Write(eol)
 	for rows.Next() {
 		err := rows.Scan(&d)
@@ -675,24 +856,51 @@ func getQuakesCsv(r *http.Request, h http.Header, b *bytes.Buffer, params *Query
 	return &statusOK
 }
 
-//http://hutl14681.gns.cri.nz:8081/geojson?limit=100&bbox=163.60840,-49.18170,182.98828,-32.28713&startdate=2015-6-27T22:00:00&enddate=2015-7-27T23:00:00
-//(r *http.Request, h http.Header, b *bytes.Buffer) *result
-func getQuakesGeoJson(r *http.Request, h http.Header, b *bytes.Buffer, params *QueryParams) *result {
+/**
+ * the select and header of the csv of the layer attributes and geometry (as WKT),
+ * only the properties of propertyName when it is given
+ */
+func getCsvSelect(params *QueryParams) (string, string) {
+	l := params.layer
+	names := make([]string, 0)
+	columns := make([]string, 0)
+	for i := range l.Attributes {
+		if a := &l.Attributes[i]; params.hasProperty(a.Name) {
+			names = append(names, a.Name)
+			columns = append(columns, a.textColumn())
+		}
+	}
+	if params.hasProperty(l.Geometry) {
+		names = append(names, l.Geometry)
+		columns = append(columns, "ST_AsText("+params.geometrySql(l.Geometry)+")")
+	}
+	if params.distanceFrom != nil {
+		names = append(names, DISTANCE_PROPERTY)
+		columns = append(columns, "round(("+params.distanceSql()+")::numeric, 2)")
+	}
+	format := strings.TrimSuffix(strings.Repeat("%s,", len(names)), ",")
+	return fmt.Sprintf("select format('%s', %s) as csv from %s", format, strings.Join(columns, ", "), l.Table),
+		strings.Join(names, ",")
+}
+
+// getQuakeFeatures queries the quakes matching params as GeoJSON features
+func getQuakeFeatures(params *QueryParams) ([]Feature, *result) {
 	sqlPre := `select publicid, eventtype, to_char(origintime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS origintime,
               depth, depthtype, magnitude, magnitudetype, evaluationmethod, evaluationstatus,
               evaluationmode, earthmodel, usedphasecount,usedstationcount, minimumdistance, azimuthalgap, magnitudeuncertainty,
               originerror, magnitudestationcount, to_char(modificationtime, 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS modificationtime,
-              ST_AsGeoJSON(origin_geom) as geojson from wfs.quake_search_v1`
+              ST_AsGeoJSON(` + params.geometrySql("origin_geom") + `) as geojson, longitude, latitude,
+              ` + params.distanceSql() + ` as distance_km from ` + params.layer.Table
 
-	sqlString, err1 := getSqlQueryString(sqlPre, params)
+	sqlString, args, err1 := getSqlQueryString(sqlPre, params)
 	if err1 != nil {
-		return badRequest(err1.Error())
+		return nil, badRequest(err1.Error())
 	}
 
-	rows, err := db.Query(sqlString)
+	rows, err := db.Query(sqlString, args...)
 
 	if err != nil {
-		return internalServerError(err)
+		return nil, internalServerError(err)
 	}
 	defer rows.Close()
 	allFeatures := make([]Feature, 0)
@@ -719,24 +927,26 @@ func getQuakesGeoJson(r *http.Request, h http.Header, b *bytes.Buffer, params *Q
 			originerror           sql.NullFloat64
 			magnitudestationcount sql.NullInt64
 			geojson               string
+			longitude, latitude   float64
+			distance              sql.NullFloat64
 		)
 
 		err := rows.Scan(&publicid, &eventtype, &origintime, &depth, &depthtype,
 			&magnitude, &magnitudetype, &evaluationmethod, &evaluationstatus,
 			&evaluationmode, &earthmodel, &usedphasecount, &usedstationcount,
 			&minimumdistance, &azimuthalgap, &magnitudeuncertainty, &originerror, &magnitudestationcount,
-			&modificationtime, &geojson,
+			&modificationtime, &geojson, &longitude, &latitude, &distance,
 		)
 		if err != nil {
-			return internalServerError(err)
+			return nil, internalServerError(err)
 		}
-		quakeFeature := Feature{Type: "Feature"}
+		quakeFeature := Feature{Type: "Feature", Id: "quake." + publicid}
 		//get geometry
 		var featureGeo FeatureGeometry
 		err = json.Unmarshal([]byte(geojson), &featureGeo)
 		if err != nil {
 			log.Panic("error", err)
-			return internalServerError(err)
+			return nil, internalServerError(err)
 		}
 		quakeFeature.Geometry = featureGeo
 		//get properties
@@ -795,15 +1005,34 @@ func getQuakesGeoJson(r *http.Request, h http.Header, b *bytes.Buffer, params *Q
 		if magnitudestationcount.Valid {
 			quakeProp.Magnitudestationcount = magnitudestationcount.Int64
 		}
+		var d *float64
+		if distance.Valid {
+			d = &distance.Float64
+		}
+		params.setComputedProperties(&quakeProp, longitude, latitude, d)
 
-		quakeFeature.Properties = quakeProp
+		quakeFeature.Properties, err = params.selectProperties(quakeProp)
+		if err != nil {
+			return nil, internalServerError(err)
+		}
 		allFeatures = append(allFeatures, quakeFeature)
 	}
 	rows.Close()
+	return allFeatures, &statusOK
+}
+
+// http://hutl14681.gns.cri.nz:8081/geojson?limit=100&bbox=163.60840,-49.18170,182.98828,-32.28713&startdate=2015-6-27T22:00:00&enddate=2015-7-27T23:00:00
+// (r *http.Request, h http.Header, b *bytes.Buffer) *result
+func getQuakesGeoJson(r *http.Request, h http.Header, b *bytes.Buffer, params *QueryParams) *result {
+	allFeatures, res := getQuakeFeatures(params)
+	if !res.ok {
+		return res
+	}
 
 	outputJson := GeoJsonFeatureCollection{
 		Type:     "FeatureCollection",
 		Features: allFeatures,
+		Crs:      params.geoJsonCrs(),
 	}
 
 	// send result response
@@ -819,13 +1048,192 @@ func getQuakesGeoJson(r *http.Request, h http.Header, b *bytes.Buffer, params *Q
 	return &statusOK
 }
 
-func getQueryParams(v url.Values) *QueryParams {
-	return &QueryParams{
+func getQueryParams(v url.Values) (*QueryParams, error) {
+	v = normaliseParams(v, append(append([]string{}, requiredParams...), optionalParams...))
+	//typeName for WFS 1.x, typeNames for 2.0, layers for KML
+	typeName := v.Get("typeName")
+	for _, k := range []string{"typeNames", "layers"} {
+		if typeName == "" {
+			typeName = v.Get(k)
+		}
+	}
+	layer, err := getLayer(typeName)
+	if err != nil {
+		return nil, err
+	}
+	srsName := v.Get("srsName")
+	if srsName == "" {
+		srsName = v.Get("crs")
+	}
+	srid, latLon, err := parseCrs(srsName)
+	if err != nil {
+		return nil, err
+	}
+	//WFS 1.0.0 is always x,y, the later versions follow the EPSG axis order of the urn and http forms
+	urnCrs := isUrnCrs(srsName)
+	if v.Get("version") == "1.0.0" {
+		latLon, urnCrs = false, false
+	}
+	maxFeatures := v.Get("maxFeatures")
+	if maxFeatures == "" {
+		maxFeatures = v.Get("count")
+	}
+	params := &QueryParams{
+		layer:        layer,
+		srid:         srid,
+		latLon:       latLon,
+		urnCrs:       urnCrs,
 		outputFormat: strings.ToUpper(v.Get("outputFormat")),
-		maxFeatures:  parseIntVal(v.Get("maxFeatures")),
+		maxFeatures:  parseIntVal(maxFeatures),
+		startIndex:   parseIntVal(v.Get("startIndex")),
 		cqlFilter:    v.Get("cql_filter"),
+		filter:       v.Get("filter"),
+		filterLang:   v.Get("filter-lang"),
+		featureIds:   strings.Trim(v.Get("featureID")+","+v.Get("resourceId"), ","),
+		sortBy:       v.Get("sortBy"),
+		properties:   parsePropertyNames(v.Get("propertyName")),
 		subType:      strings.ToUpper(v.Get("subtype")),
 	}
+
+	if params.aggregate, err = parseAggregate(v.Get("aggregate")); err != nil {
+		return nil, err
+	}
+	if params.distanceFrom, err = parseDistanceFrom(v.Get("distanceFrom")); err != nil {
+		return nil, err
+	}
+	params.locality = strings.EqualFold(v.Get("locality"), "true")
+
+	if region := v.Get("region"); region != "" {
+		f, err := newRegionFilter(layer, region)
+		if err != nil {
+			return nil, err
+		}
+		params.filters = append(params.filters, f)
+	}
+
+	if bbox := v.Get("bbox"); bbox != "" {
+		f, err := newBBoxParamFilter(layer, bbox, v.Get("version"))
+		if err != nil {
+			return nil, err
+		}
+		params.filters = append(params.filters, f)
+		//the bounds of GML are in EPSG:4326
+		if isWgs84(f.srid) {
+			params.bbox = formatCoord(f.minx) + "," + formatCoord(f.miny) + "," + formatCoord(f.maxx) + "," + formatCoord(f.maxy)
+		}
+	}
+	return params, nil
+}
+
+/**
+ * the bbox parameter, minx,miny,maxx,maxy[,crs] in EPSG:4326 by default, ANDed with the other filters.
+ * After WFS 1.0.0 a urn or http crs is in its EPSG axis order.
+ */
+func newBBoxParamFilter(l *featureLayer, bbox string, version string) (*bboxFilter, error) {
+	parts := strings.Split(bbox, ",")
+	srid, latLon := SRID_WGS84, false
+	if len(parts) == 5 {
+		var err error
+		if srid, latLon, err = parseCrs(parts[4]); err != nil {
+			return nil, errors.New("invalid bbox, " + err.Error())
+		}
+		parts = parts[:4]
+	}
+	if len(parts) != 4 {
+		return nil, errors.New("invalid bbox " + bbox + ", expecting minx,miny,maxx,maxy[,crs]")
+	}
+	if version == "1.0.0" {
+		latLon = false
+	}
+	f, err := newOgcApiBBoxFilter(l, strings.Join(parts, ","), srid, latLon)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*bboxFilter), nil
+}
+
+// parsePropertyNames parses a comma separated propertyName, nil for all properties
+func parsePropertyNames(propertyName string) map[string]bool {
+	if strings.TrimSpace(propertyName) == "" {
+		return nil
+	}
+	properties := make(map[string]bool)
+	for _, name := range strings.Split(propertyName, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			properties[fesPropertyName(name)] = true
+		}
+	}
+	return properties
+}
+
+// hasProperty is true when the property is to be returned
+func (params *QueryParams) hasProperty(name string) bool {
+	return params.properties == nil || params.properties[name]
+}
+
+// selectProperties returns the requested properties of a quake, for GeoJSON
+func (params *QueryParams) selectProperties(quakeProp QuakeProperties) (interface{}, error) {
+	if params.properties == nil {
+		return quakeProp, nil
+	}
+	b, err := json.Marshal(quakeProp)
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]interface{})
+	if err := json.Unmarshal(b, &props); err != nil {
+		return nil, err
+	}
+	for name := range props {
+		if !params.properties[name] && !params.isComputedProperty(name) {
+			delete(props, name)
+		}
+	}
+	return props, nil
+}
+
+// checkPropertyNames checks the propertyName are of the layer or computed
+func (params *QueryParams) checkPropertyNames() error {
+	for name := range params.properties {
+		if !params.layer.hasProperty(name) && !params.isComputedProperty(name) {
+			return errors.New("unknown propertyName " + name)
+		}
+	}
+	return nil
+}
+
+/*
+	the ORDER BY of a sortBy, properties with an optional order separated by commas:
+
+WFS 1.1 "magnitude D,origintime A" or WFS 2.0 "magnitude DESC,origintime ASC",
+also the computed properties of the sql of computed, e.g. distance_km
+*/
+func getOrderBy(l *featureLayer, sortBy string, computed map[string]string) (string, error) {
+	orders := make([]string, 0)
+	for _, sortProperty := range strings.Split(sortBy, ",") {
+		fields := strings.Fields(sortProperty)
+		if len(fields) == 0 || len(fields) > 2 {
+			return "", errors.New("invalid sortBy " + sortBy)
+		}
+		name := fesPropertyName(fields[0])
+		if expr, ok := computed[name]; ok {
+			name = "(" + expr + ")"
+		} else if l.attribute(name) == nil {
+			return "", errors.New("can't sort by " + fields[0])
+		}
+		order := "ASC"
+		if len(fields) == 2 {
+			switch strings.ToUpper(fields[1]) {
+			case "A", "ASC":
+			case "D", "DESC":
+				order = "DESC"
+			default:
+				return "", errors.New("invalid sort order " + fields[1])
+			}
+		}
+		orders = append(orders, name+" "+order)
+	}
+	return strings.Join(orders, ", "), nil
 }
 
 func parseIntVal(valstring string) int {
@@ -837,28 +1245,97 @@ func parseIntVal(valstring string) int {
 	return empty_param_value
 }
 
-/* generate sql query string based on query parameters from url*/
-func getSqlQueryString(sqlPre string, params *QueryParams) (string, error) {
+/*
+	generate sql query string based on query parameters from url,
+
+the filter values are returned as args for the sql parameters
+*/
+func getSqlQueryString(sqlPre string, params *QueryParams) (string, []interface{}, error) {
 	sql := sqlPre
-	if params.cqlFilter != "" {
-		cql := NewCqlConverter(params.cqlFilter)
-		cql2Sql, err := cql.ToSQL()
-		params.bbox = cql.BBOX
-		if err == nil {
-			sql += fmt.Sprintf(" WHERE %s", cql2Sql)
-		} else {
-			return "", err
+	var args []interface{}
+	f, err := getQueryFilter(params)
+	if err != nil {
+		return "", nil, err
+	}
+	if f != nil {
+		w := &sqlWriter{layer: params.layer}
+		if err := f.writeSql(w); err != nil {
+			return "", nil, err
+		}
+		sql += fmt.Sprintf(" WHERE %s", w.String())
+		args = w.args
+	}
+	if err := params.checkPropertyNames(); err != nil {
+		return "", nil, err
+	}
+	if params.sortBy != "" {
+		orderBy, err := getOrderBy(params.layer, params.sortBy, params.computedColumns())
+		if err != nil {
+			return "", nil, err
 		}
+		sql += " ORDER BY " + orderBy
 	}
 
 	if params.maxFeatures != empty_param_value {
 		sql += fmt.Sprintf(" limit %d", params.maxFeatures)
 	}
-	log.Println("##sql", sql)
-	return sql, nil
+	if params.startIndex > 0 {
+		sql += fmt.Sprintf(" offset %d", params.startIndex)
+	}
+	log.Println("##sql", sql, args)
+	return sql, args, nil
 
 }
 
+/*
+	the filter of the cql_filter (ECQL), filter (CQL2) and featureID parameters and the filters of params,
+
+all must match when more than one is given, nil for no filter
+*/
+func getQueryFilter(params *QueryParams) (filterNode, error) {
+	filters := make([]filterNode, 0)
+	if params.cqlFilter != "" {
+		cql := NewCqlConverter(params.cqlFilter)
+		f, err := cql.Parse()
+		if err != nil {
+			return nil, err
+		}
+		if params.bbox == "" { //the bbox parameter first
+			params.bbox = cql.BBOX
+		}
+		if f != nil {
+			filters = append(filters, f)
+		}
+	}
+	if params.filter != "" {
+		f, err := parseFilterLang(params.filter, params.filterLang, params.layer)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			filters = append(filters, f)
+		}
+	} else if params.filterLang != "" {
+		return nil, errors.New("filter-lang without a filter")
+	}
+	if params.featureIds != "" {
+		f, err := newLayerFeatureIdFilter(params.layer, strings.Split(params.featureIds, ","))
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	filters = append(filters, params.filters...)
+
+	switch len(filters) {
+	case 0:
+		return nil, nil
+	case 1:
+		return filters[0], nil
+	}
+	return &logicFilter{op: "AND", children: filters}, nil
+}
+
 func BBox2Array(bbox string) []string {
 	bboxarray := strings.Split(bbox, ",")
 	//remove empty
@@ -883,14 +1360,21 @@ func getGmlBbox(bbox string) string {
 }
 
 type GeoJsonFeatureCollection struct {
-	Type     string    `json:"type"`
-	Features []Feature `json:"features"`
+	Type     string      `json:"type"`
+	Features []Feature   `json:"features"`
+	Crs      *GeoJsonCrs `json:"crs,omitempty"` //named crs of GeoJSON 2008, for the projected CRS only
+}
+
+type GeoJsonCrs struct {
+	Type       string            `json:"type"`
+	Properties map[string]string `json:"properties"`
 }
 
 type Feature struct {
-	Type       string          `json:"type"`
-	Geometry   FeatureGeometry `json:"geometry"`
-	Properties QuakeProperties `json:"properties"`
+	Type       string      `json:"type"`
+	Id         string      `json:"id,omitempty"`
+	Geometry   interface{} `json:"geometry"`
+	Properties interface{} `json:"properties"`
 }
 
 type QuakeProperties struct {
@@ -913,6 +1397,13 @@ type QuakeProperties struct {
 	Magnitudeuncertainty  float64 `json:"magnitudeuncertainty,omitempty"`
 	Originerror           float64 `json:"originerror,omitempty"`
 	Magnitudestationcount int64   `json:"magnitudestationcount,omitempty"`
+	//the computed properties of distanceFrom and locality
+	DistanceKm         *float64 `json:"distance_km,omitempty"`
+	Locality           string   `json:"locality,omitempty"`
+	LocalityDistanceKm *float64 `json:"locality_distance_km,omitempty"`
+	LocalityDirection  string   `json:"locality_direction,omitempty"`
+	LocalityBearing    *float64 `json:"locality_bearing,omitempty"`
+	Location           string   `json:"location,omitempty"`
 }
 
 type FeatureGeometry struct {
@@ -921,9 +1412,114 @@ type FeatureGeometry struct {
 }
 
 type QueryParams struct {
+	layer        *featureLayer
 	outputFormat string
 	subType      string //sub type of outputFormat
 	maxFeatures  int
 	cqlFilter    string
+	filter       string //CQL2 text or JSON
+	filterLang   string
+	featureIds   string //quake.<publicid>,...
+	sortBy       string
+	properties   map[string]bool //nil for all properties
+	filters      []filterNode    //of a stored query or the OGC API parameters
+	startIndex   int
 	bbox         string
+	srid         int  //EPSG code of the output geometries
+	latLon       bool //the output geometries are latitude, longitude (northing, easting)
+	urnCrs       bool //the GML srsName is a urn
+	aggregate    *aggregation
+	distanceFrom *Coord //of distance_km
+	locality     bool   //add the nearest locality
+}
+
+// unpaged is a copy of params without maxFeatures, startIndex and sortBy, for all the matching features
+func (params *QueryParams) unpaged() *QueryParams {
+	all := *params
+	all.maxFeatures, all.startIndex, all.sortBy = empty_param_value, 0, ""
+	return &all
+}
+
+// geometrySql reprojects the geometry column into the CRS and axis order of srsName
+func (params *QueryParams) geometrySql(column string) string {
+	g := transformSql(column, params.srid)
+	if params.latLon {
+		return "ST_FlipCoordinates(" + g + ")"
+	}
+	return g
+}
+
+// xySql selects the x (easting) and y (northing) of the reprojected geometry column, whatever the axis order
+func (params *QueryParams) xySql(column string) string {
+	g := transformSql(column, params.srid)
+	return "ST_X(" + g + "), ST_Y(" + g + ")"
+}
+
+// gmlSql writes the geometry column as GML, with a urn srsName when it was asked for
+func (params *QueryParams) gmlSql(gmlVersion int, column string) string {
+	options := 0
+	if params.urnCrs {
+		options = 1
+	}
+	return fmt.Sprintf("ST_AsGML(%d, %s, 15, %d)", gmlVersion, params.geometrySql(column), options)
+}
+
+// gmlSrsName is the srsName of the GML geometries and bounds
+func (params *QueryParams) gmlSrsName() string {
+	if params.urnCrs {
+		return "urn:ogc:def:crs:EPSG::" + strconv.Itoa(params.epsgCode())
+	}
+	return "http://www.opengis.net/gml/srs/epsg.xml#" + strconv.Itoa(params.epsgCode())
+}
+
+// gmlPos joins the x and y of a GML position in the axis order of srsName
+func (params *QueryParams) gmlPos(x, y string, sep string) string {
+	if params.latLon {
+		return y + sep + x
+	}
+	return x + sep + y
+}
+
+// swapGmlCoordinates swaps the x,y tuples of gml:coordinates into y,x
+func swapGmlCoordinates(coordinates string) string {
+	tuples := strings.Fields(strings.Replace(coordinates, ", ", ",", -1))
+	for i, t := range tuples {
+		if xy := strings.Split(t, ","); len(xy) == 2 {
+			tuples[i] = xy[1] + "," + xy[0]
+		}
+	}
+	return strings.Join(tuples, " ")
+}
+
+// geoJsonCrs names a projected or latitude, longitude CRS, GeoJSON is CRS84 without it
+func (params *QueryParams) geoJsonCrs() *GeoJsonCrs {
+	if isWgs84(params.srid) && !params.latLon {
+		return nil
+	}
+	return &GeoJsonCrs{Type: "name", Properties: map[string]string{"name": "urn:ogc:def:crs:EPSG::" + strconv.Itoa(params.epsgCode())}}
+}
+
+// setContentCrs sets the Content-Crs header of the output geometries
+func (params *QueryParams) setContentCrs(h http.Header) {
+	if isWgs84(params.srid) && !params.latLon {
+		h.Set("Content-Crs", "<"+CRS84+">")
+		return
+	}
+	h.Set("Content-Crs", "<"+crsUri(params.epsgCode())+">")
+}
+
+// wgs84 is params for the EPSG:4326 srsName and axis order of the form of the requested srsName, for the bounds of GML
+func (params *QueryParams) wgs84() *QueryParams {
+	if isWgs84(params.srid) {
+		return params
+	}
+	return &QueryParams{srid: SRID_WGS84, urnCrs: params.urnCrs, latLon: params.urnCrs && northingFirstSrids[SRID_WGS84]}
+}
+
+// epsgCode is the EPSG code of the output geometries
+func (params *QueryParams) epsgCode() int {
+	if isWgs84(params.srid) {
+		return SRID_WGS84
+	}
+	return params.srid
 }
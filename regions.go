@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+/**
+ * Named regions, polygons bundled with the service: the GeoNet quake regions and the NZ regional councils.
+ * GetFeature and KML take region=canterbury for the quakes within a region, the CQL takes
+ * WITHIN(origin_geom, REGION('canterbury')) wherever a WKT geometry is expected, and
+ * /regions lists the polygons as GeoJSON, /regions?type=council the regional councils only.
+ * The polygons are simplified outlines of a few vertices, extended offshore, for searching rather than for boundaries.
+ * The regional councils are council:<name>, e.g. council:canterbury.
+ */
+const (
+	REGION_TYPE_GEONET  = "geonet"
+	REGION_TYPE_COUNCIL = "council"
+)
+
+type region struct {
+	id    string
+	title string
+	typ   string // one of the REGION_TYPE_*
+	wkt   string // longitudes east of 180 in the 0-360 convention
+}
+
+var regions = []region{
+	//the GeoNet quake regions
+	{"newzealand", "New Zealand", REGION_TYPE_GEONET,
+		"POLYGON((164 -49,184 -49,184 -32,164 -32,164 -49))"},
+	{"aucklandnorthland", "Auckland and Northland", REGION_TYPE_GEONET,
+		"POLYGON((172.5 -34,175 -34,176.2 -36.2,176.2 -37.3,175.3 -37.6,174.2 -37.6,172.5 -35.5,172.5 -34))"},
+	{"tongagrirobayofplenty", "Tongariro and Bay of Plenty", REGION_TYPE_GEONET,
+		"POLYGON((175.3 -37.6,176.2 -37.3,177.5 -37.2,177.6 -38.3,176.6 -39.4,175.2 -39.4,174.9 -38.6,173.5 -38.6,174.2 -37.6,175.3 -37.6))"},
+	{"gisborne", "Gisborne", REGION_TYPE_GEONET,
+		"POLYGON((177.5 -37.2,179 -37.2,179 -39.2,177.4 -39.2,177.6 -38.3,177.5 -37.2))"},
+	{"hawkesbay", "Hawke's Bay", REGION_TYPE_GEONET,
+		"POLYGON((176.6 -39.4,177.6 -38.3,177.4 -39.2,179 -39.2,178.2 -40.5,175.8 -40.5,176.6 -39.4))"},
+	{"taranaki", "Taranaki", REGION_TYPE_GEONET,
+		"POLYGON((173.5 -38.6,174.9 -38.6,175.2 -39.4,175.6 -40.1,174.5 -40.4,173.5 -40,173.5 -38.6))"},
+	{"wellington", "Wellington", REGION_TYPE_GEONET,
+		"POLYGON((175.6 -40.1,175.2 -39.4,176.6 -39.4,175.8 -40.5,176.5 -40.9,175.5 -41.8,174.5 -41.6,174.5 -40.4,175.6 -40.1))"},
+	{"nelsonwestcoast", "Nelson and West Coast", REGION_TYPE_GEONET,
+		"POLYGON((171.8 -40.3,173.3 -40.3,174.5 -40.9,174.5 -41.5,172.6 -42.2,171.6 -43.2,169.9 -44.1,168.6 -44.1,170.5 -42.6,171.8 -40.3))"},
+	{"canterbury", "Canterbury", REGION_TYPE_GEONET,
+		"POLYGON((174.5 -41.5,174.8 -42.2,173.8 -43.3,173.5 -44.2,171.5 -44.9,170.2 -44.6,169.9 -44.1,171.6 -43.2,172.6 -42.2,174.5 -41.5))"},
+	{"fiordland", "Fiordland", REGION_TYPE_GEONET,
+		"POLYGON((166.5 -44.1,168.6 -44.1,168 -45.2,167.6 -46.2,167.5 -47,165.5 -47,165.5 -45.5,166.5 -44.1))"},
+	{"otagosouthland", "Otago and Southland", REGION_TYPE_GEONET,
+		"POLYGON((169.9 -44.1,170.2 -44.6,171.5 -44.9,171 -46,169.5 -47,168 -47.5,167.5 -47.5,167.5 -47,167.6 -46.2,168 -45.2,168.6 -44.1,169.9 -44.1))"},
+	//the regional councils
+	{"council:northland", "Northland Region", REGION_TYPE_COUNCIL,
+		"POLYGON((172.6 -34.3,173.3 -34.3,174.2 -35,174.9 -35.9,174.6 -36.2,174.3 -36.4,173.6 -35.9,173 -35.3,172.6 -34.3))"},
+	{"council:auckland", "Auckland Region", REGION_TYPE_COUNCIL,
+		"POLYGON((174.3 -36.4,174.6 -36.2,174.9 -35.9,175.6 -36,175.6 -36.4,175.2 -36.6,175.3 -37,175 -37.3,174.6 -37.3,174.3 -36.8,174.3 -36.4))"},
+	{"council:waikato", "Waikato Region", REGION_TYPE_COUNCIL,
+		"POLYGON((174.6 -37.3,175 -37.3,175.3 -37,175.2 -36.6,175.6 -36.4,175.95 -36.9,175.9 -37.5,176 -38,176.5 -38.4,176.6 -39,176 -39.3,175.6 -39.3,175 -39,174.6 -38.6,174.6 -37.3))"},
+	{"council:bayofplenty", "Bay of Plenty Region", REGION_TYPE_COUNCIL,
+		"POLYGON((175.9 -37.5,176.3 -37.2,177.2 -37.3,178 -37.5,177.5 -38.2,177.1 -38.6,176.6 -39,176.5 -38.4,176 -38,175.9 -37.5))"},
+	{"council:gisborne", "Gisborne Region", REGION_TYPE_COUNCIL,
+		"POLYGON((178 -37.5,178.8 -37.6,178.6 -38.7,177.9 -39.1,177.1 -38.6,177.5 -38.2,178 -37.5))"},
+	{"council:hawkesbay", "Hawke's Bay Region", REGION_TYPE_COUNCIL,
+		"POLYGON((176 -39.3,176.6 -39,177.1 -38.6,177.9 -39.1,177 -39.6,176.95 -40.1,176.6 -40.5,176.3 -40.2,176 -39.8,176 -39.3))"},
+	{"council:taranaki", "Taranaki Region", REGION_TYPE_COUNCIL,
+		"POLYGON((173.6 -38.9,174.6 -38.6,175 -39,174.9 -39.4,174.7 -39.9,174.2 -39.7,173.6 -39.4,173.6 -38.9))"},
+	{"council:manawatuwhanganui", "Manawatū-Whanganui Region", REGION_TYPE_COUNCIL,
+		"POLYGON((175 -39,175.6 -39.3,176 -39.3,176 -39.8,176.3 -40.2,176.6 -40.5,175.9 -40.75,175.2 -40.68,175 -40.4,174.7 -39.9,174.9 -39.4,175 -39))"},
+	{"council:wellington", "Wellington Region", REGION_TYPE_COUNCIL,
+		"POLYGON((175.2 -40.68,175.9 -40.75,176.6 -40.5,176.4 -41,175.4 -41.65,174.6 -41.4,174.6 -41.1,175.2 -40.68))"},
+	{"council:tasman", "Tasman Region", REGION_TYPE_COUNCIL,
+		"POLYGON((172 -40.45,172.9 -40.5,173.05 -41.05,173.15 -41.3,173.45 -41.45,173.2 -41.85,172.7 -42.1,172.2 -42,172.45 -41.5,172.15 -41,172 -40.45))"},
+	{"council:nelson", "Nelson Region", REGION_TYPE_COUNCIL,
+		"POLYGON((173.15 -41.3,173.2 -41.15,173.45 -41.05,173.6 -41.2,173.45 -41.45,173.15 -41.3))"},
+	{"council:marlborough", "Marlborough Region", REGION_TYPE_COUNCIL,
+		"POLYGON((173.45 -41.45,173.6 -41.2,173.45 -41.05,173.2 -41.15,173.7 -40.75,174.4 -40.9,174.5 -41.35,174.3 -41.75,173.95 -42.15,173.3 -42.25,172.7 -42.1,173.2 -41.85,173.45 -41.45))"},
+	{"council:westcoast", "West Coast Region", REGION_TYPE_COUNCIL,
+		"POLYGON((172 -40.45,172.15 -41,172.45 -41.5,172.2 -42,172.7 -42.1,172.5 -42.45,171.5 -42.85,171.35 -43.3,170.6 -43.75,169.9 -44.2,169 -44.3,168.1 -44.3,169 -43.7,170.5 -42.9,171.1 -42.1,171.5 -41.4,172 -40.45))"},
+	{"council:canterbury", "Canterbury Region", REGION_TYPE_COUNCIL,
+		"POLYGON((172.7 -42.1,173.3 -42.25,173.95 -42.15,174.1 -42.45,173.4 -43,173.2 -43.9,171.6 -44.55,171.2 -44.95,170.3 -44.6,169.9 -44.2,170.6 -43.75,171.35 -43.3,171.5 -42.85,172.5 -42.45,172.7 -42.1))"},
+	{"council:otago", "Otago Region", REGION_TYPE_COUNCIL,
+		"POLYGON((169.9 -44.2,170.3 -44.6,171.2 -44.95,170.8 -45.6,170.75 -45.95,169.8 -46.45,169.35 -46.65,169.1 -46.2,169 -45.8,168.55 -45.35,168.4 -45,168.35 -44.5,168.1 -44.3,169 -44.3,169.9 -44.2))"},
+	{"council:southland", "Southland Region", REGION_TYPE_COUNCIL,
+		"POLYGON((168.1 -44.3,168.35 -44.5,168.4 -45,168.55 -45.35,169 -45.8,169.1 -46.2,169.35 -46.65,168.5 -47.4,167.4 -47.3,166 -46.2,166.4 -45.3,167.5 -44.5,168.1 -44.3))"},
+}
+
+// regionLiteral is the REGION('canterbury') of a CQL spatial predicate
+var regionLiteral = regexp.MustCompile(`(?i)^REGION\s*\(\s*'([^']*)'\s*\)$`)
+
+// getRegion finds a region by its id, case insensitive
+func getRegion(id string) (*region, error) {
+	for i := range regions {
+		if strings.EqualFold(regions[i].id, strings.TrimSpace(id)) {
+			return &regions[i], nil
+		}
+	}
+	return nil, errors.New("unknown region " + id + ", the regions are listed by /regions")
+}
+
+// geometry is a new copy of the polygon of the region, for the filters to normalise
+func (r *region) geometry() *Geometry {
+	g, err := ParseWkt(r.wkt)
+	if err != nil { //the bundled polygons are checked by the tests
+		panic("invalid region " + r.id + ", " + err.Error())
+	}
+	return g
+}
+
+// isRegionLiteral is true for REGION('name')
+func isRegionLiteral(s string) bool {
+	return regionLiteral.MatchString(strings.TrimSpace(s))
+}
+
+// parseGeometryArg parses the WKT or REGION('name') of a spatial predicate
+func parseGeometryArg(s string) (*Geometry, error) {
+	if m := regionLiteral.FindStringSubmatch(strings.TrimSpace(s)); m != nil {
+		r, err := getRegion(m[1])
+		if err != nil {
+			return nil, err
+		}
+		return r.geometry(), nil
+	}
+	return ParseWkt(s)
+}
+
+// newRegionFilter is the filter of the quakes within the region of the region parameter
+func newRegionFilter(l *featureLayer, id string) (filterNode, error) {
+	r, err := getRegion(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(l.Geometry), nil
+}
+
+/**
+ * filter is WITHIN the region, a region over the antimeridian (newzealand) is split into
+ * the polygons either side of it, as the bbox filter is, so the index of the geometry is used
+ * rather than comparing ST_ShiftLongitude of every quake.
+ */
+func (r *region) filter(property string) filterNode {
+	g := r.geometry()
+	west, east := g.clipLongitude(180, -1), g.clipLongitude(180, 1)
+	if west == nil || east == nil {
+		return newSpatialFilter("WITHIN", property, g)
+	}
+	east.eachRing(func(ring []Coord) {
+		for i := range ring {
+			ring[i].X -= 360
+		}
+	})
+	return &logicFilter{op: "OR", children: []filterNode{
+		newSpatialFilter("WITHIN", property, west),
+		newSpatialFilter("WITHIN", property, east),
+	}}
+}
+
+/**
+ * clipLongitude is the part of a polygon west (side -1) or east (side 1) of the longitude lon,
+ * by Sutherland-Hodgman clipping of the rings, nil when there's none.
+ */
+func (g *Geometry) clipLongitude(lon float64, side float64) *Geometry {
+	inside := func(c Coord) bool { return (c.X-lon)*side >= 0 }
+	clipped := &Geometry{Type: g.Type}
+	for _, ring := range g.Rings {
+		out := make([]Coord, 0, len(ring)+2)
+		for i := 0; i < len(ring)-1; i++ {
+			a, b := ring[i], ring[i+1]
+			if inside(a) {
+				out = append(out, a)
+			}
+			if inside(a) != inside(b) && a.X != lon && b.X != lon {
+				out = append(out, Coord{X: lon, Y: a.Y + (b.Y-a.Y)*(lon-a.X)/(b.X-a.X)})
+			}
+		}
+		if len(out) < 3 {
+			continue
+		}
+		clipped.Rings = append(clipped.Rings, append(out, out[0]))
+	}
+	if len(clipped.Rings) == 0 || len(clipped.Rings) < len(g.Rings) {
+		return nil
+	}
+	return clipped
+}
+
+type regionProperties struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+}
+
+/**
+ * getRegions lists the regions as a GeoJSON FeatureCollection in EPSG:4326,
+ * the polygons east of 180 in the 0-360 convention.
+ * /regions?type=geonet or /regions?type=council for one type of region.
+ */
+func getRegions(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{}, []string{"type"}); !res.ok {
+		return res
+	}
+	typ := strings.ToLower(r.URL.Query().Get("type"))
+	if typ != "" && typ != REGION_TYPE_GEONET && typ != REGION_TYPE_COUNCIL {
+		return badRequest("invalid type " + typ + ", expecting geonet or council")
+	}
+
+	features := make([]Feature, 0, len(regions))
+	for i := range regions {
+		reg := &regions[i]
+		if typ != "" && reg.typ != typ {
+			continue
+		}
+		rings := make([][][]float64, 0)
+		for _, ring := range reg.geometry().Rings {
+			coordinates := make([][]float64, 0, len(ring))
+			for _, c := range ring {
+				coordinates = append(coordinates, []float64{c.X, c.Y})
+			}
+			rings = append(rings, coordinates)
+		}
+		features = append(features, Feature{Type: "Feature", Id: reg.id,
+			Geometry:   PolygonGeometry{Type: "Polygon", Coordinates: rings},
+			Properties: regionProperties{Name: reg.id, Title: reg.title, Type: reg.typ}})
+	}
+
+	jsonBytes, err := json.Marshal(GeoJsonFeatureCollection{Type: "FeatureCollection", Features: features})
+	if err != nil {
+		return internalServerError(err)
+	}
+	b.Write(jsonBytes)
+	h.Set("Content-Type", V1GeoJSON)
+	return &statusOK
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// inRing is a ray casting point in polygon test of the exterior ring
+func inRing(ring []Coord, lon, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Y > lat) != (b.Y > lat) && lon < (b.X-a.X)*(lat-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func TestRegionPolygons(t *testing.T) {
+	ids := make(map[string]bool)
+	for i := range regions {
+		r := &regions[i]
+		if ids[r.id] {
+			t.Errorf("duplicate region %s", r.id)
+		}
+		ids[r.id] = true
+		g, err := ParseWkt(r.wkt)
+		if err != nil {
+			t.Errorf("%s: %s", r.id, err)
+			continue
+		}
+		ring := g.Rings[0]
+		if g.Type != WKT_POLYGON || len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			t.Errorf("%s: expecting a closed polygon, got %s", r.id, r.wkt)
+		}
+	}
+
+	//a town is in one GeoNet quake region and one regional council
+	tests := []struct {
+		lon, lat        float64
+		geonet, council string
+	}{
+		{174.32, -35.73, "aucklandnorthland", "council:northland"},
+		{174.76, -36.85, "aucklandnorthland", "council:auckland"},
+		{175.28, -37.79, "tongagrirobayofplenty", "council:waikato"},
+		{176.07, -38.69, "tongagrirobayofplenty", "council:waikato"},
+		{176.25, -38.14, "tongagrirobayofplenty", "council:bayofplenty"},
+		{178.02, -38.66, "gisborne", "council:gisborne"},
+		{176.91, -39.49, "hawkesbay", "council:hawkesbay"},
+		{174.08, -39.06, "taranaki", "council:taranaki"},
+		{175.61, -40.35, "wellington", "council:manawatuwhanganui"},
+		{174.78, -41.29, "wellington", "council:wellington"},
+		{173.18, -41.34, "nelsonwestcoast", "council:tasman"},
+		{173.28, -41.27, "nelsonwestcoast", "council:nelson"},
+		{173.96, -41.51, "nelsonwestcoast", "council:marlborough"},
+		{171.21, -42.45, "nelsonwestcoast", "council:westcoast"},
+		{172.64, -43.53, "canterbury", "council:canterbury"},
+		{173.68, -42.40, "canterbury", "council:canterbury"},
+		{170.50, -45.87, "otagosouthland", "council:otago"},
+		{168.66, -45.03, "otagosouthland", "council:otago"},
+		{167.72, -45.41, "fiordland", "council:southland"},
+		{168.35, -46.41, "otagosouthland", "council:southland"},
+	}
+	for _, test := range tests {
+		in := make([]string, 0)
+		for i := range regions {
+			r := &regions[i]
+			if r.id != "newzealand" && inRing(r.geometry().Rings[0], test.lon, test.lat) {
+				in = append(in, r.id)
+			}
+		}
+		if len(in) != 2 || in[0] != test.geonet || in[1] != test.council {
+			t.Errorf("%v %v: expected %s and %s, got %v", test.lon, test.lat, test.geonet, test.council, in)
+		}
+	}
+}
+
+func TestRegionFilters(t *testing.T) {
+	tests := map[string]string{
+		`WITHIN(origin_geom, REGION('Council:Nelson')) AND magnitude > 3`: `ST_Within(origin_geom, ST_GeomFromText('POLYGON((173.15 -41.3,173.2 -41.15,173.45 -41.05,173.6 -41.2,173.45 -41.45,173.15 -41.3))', 4326)) AND magnitude > 3`,
+		`CONTAINS(REGION('fiordland'), origin_geom)`:                      `ST_Contains(ST_GeomFromText('POLYGON((166.5 -44.1,168.6 -44.1,168 -45.2,167.6 -46.2,167.5 -47,165.5 -47,165.5 -45.5,166.5 -44.1))', 4326), origin_geom)`,
+	}
+	for cql, expected := range tests {
+		if s, err := NewCqlConverter(cql).ToSQL(); err != nil || s != expected {
+			t.Errorf("%s: got %s %v", cql, s, err)
+		}
+	}
+	if _, err := NewCqlConverter(`WITHIN(origin_geom, REGION('atlantis'))`).ToSQL(); err == nil {
+		t.Error("expected error for an unknown region")
+	}
+
+	v, _ := url.ParseQuery("typeName=geonet:quake_search_v1&outputFormat=json&region=newzealand")
+	params, err := getQueryParams(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _, err := getSqlQueryString("select publicid from quake_search_v1", params); err != nil ||
+		s != "select publicid from quake_search_v1 WHERE ST_Within(origin_geom, ST_GeomFromText('POLYGON((164 -49,180 -49,180 -32,164 -32,164 -49))', 4326)) OR ST_Within(origin_geom, ST_GeomFromText('POLYGON((-180 -49,-176 -49,-176 -32,-180 -32,-180 -49))', 4326))" {
+		t.Errorf("got %s %v", s, err)
+	}
+	g, _ := ParseWkt("POLYGON((170 -40,190 -40,180 -30,170 -40))")
+	if west, east := g.clipLongitude(180, -1), g.clipLongitude(180, 1); west == nil || east == nil ||
+		west.String() != "POLYGON((170 -40,180 -40,180 -30,170 -40))" || east.String() != "POLYGON((180 -40,190 -40,180 -30,180 -40))" {
+		t.Errorf("got %v %v", west, east)
+	}
+	if g.clipLongitude(200, 1) != nil {
+		t.Error("expected no part east of 200")
+	}
+
+	v, _ = url.ParseQuery("typeName=geonet:quake_search_v1&outputFormat=json&region=atlantis")
+	if _, err := getQueryParams(v); err == nil {
+		t.Error("expected error for an unknown region")
+	}
+}
+
+func TestGetRegions(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://wfs.geonet.org.nz/geonet/regions?type=council", nil)
+	b := &bytes.Buffer{}
+	if res := getRegions(r, http.Header{}, b); !res.ok {
+		t.Fatal(res.msg)
+	}
+	var fc struct {
+		Features []struct {
+			Id         string `json:"id"`
+			Properties regionProperties
+			Geometry   struct {
+				Type        string        `json:"type"`
+				Coordinates [][][]float64 `json:"coordinates"`
+			}
+		}
+	}
+	if err := json.Unmarshal(b.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 16 || fc.Features[0].Id != "council:northland" || fc.Features[0].Properties.Title != "Northland Region" ||
+		fc.Features[0].Geometry.Type != "Polygon" || fc.Features[0].Geometry.Coordinates[0][0][0] != 172.6 {
+		t.Errorf("got %s", b.String())
+	}
+
+	r, _ = http.NewRequest("GET", "http://wfs.geonet.org.nz/geonet/regions?type=suburb", nil)
+	if res := getRegions(r, http.Header{}, &bytes.Buffer{}); res.ok {
+		t.Error("expected an invalid type")
+	}
+}
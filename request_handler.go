@@ -5,6 +5,7 @@ import (
 	_ "github.com/GeoNet/log/logentries"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -42,13 +43,15 @@ func notFoundError(message string) *result {
 /*
 checkQuery inspects r and makes sure all required query parameters
 are present and that no more than the required and optional parameters
-are present.
+are present.  Parameter names are case-insensitive, they are renamed to the
+required and optional names in r.URL.
 */
 func checkQuery(r *http.Request, required, optional []string) *result {
 	if strings.Contains(r.URL.Path, ";") {
 		return badRequest("cache buster")
 	}
 
+	normaliseQuery(r, append(append([]string{}, required...), optional...))
 	v := r.URL.Query()
 
 	if len(required) == 0 && len(optional) == 0 {
@@ -88,6 +91,30 @@ func checkQuery(r *http.Request, required, optional []string) *result {
 	return &statusOK
 }
 
+/*
+normaliseParams renames the parameters that match one of names case-insensitively
+(e.g. OUTPUTFORMAT, typenames) to that name, the others are left as they are.
+*/
+func normaliseParams(v url.Values, names []string) url.Values {
+	canonical := make(map[string]string)
+	for _, name := range names {
+		canonical[strings.ToLower(name)] = name
+	}
+	normalised := make(url.Values)
+	for k, values := range v {
+		if name, ok := canonical[strings.ToLower(k)]; ok {
+			k = name
+		}
+		normalised[k] = append(normalised[k], values...)
+	}
+	return normalised
+}
+
+// normaliseQuery renames the query parameters of r with normaliseParams
+func normaliseQuery(r *http.Request, names []string) {
+	r.URL.RawQuery = normaliseParams(r.URL.Query(), names).Encode()
+}
+
 // copied from request_handler.go from mtr/mtr_api/.  We could unify later.
 func toHandler(f requestHandler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -110,7 +137,14 @@ func toHandler(f requestHandler) func(w http.ResponseWriter, r *http.Request) {
 		// 		http.Error(w, res.msg, res.code)
 		// 	}
 
-		case "GET":
+		case "GET", "POST":
+			//a POST is read into the query parameters and served as a GET
+			if r.Method == "POST" {
+				if err := readPostQuery(r); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
 			var b bytes.Buffer
 			res := f(w, r, &b)
 
@@ -119,7 +153,7 @@ func toHandler(f requestHandler) func(w http.ResponseWriter, r *http.Request) {
 				b.WriteTo(w)
 			case http.StatusInternalServerError:
 				http.Error(w, res.msg, res.code)
-				log.Printf("500 serving GET %s %s", r.URL, res.msg)
+				log.Printf("500 serving %s %s %s", r.Method, r.URL, res.msg)
 			default:
 				http.Error(w, res.msg, res.code)
 			}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckQueryCase(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/geonet/ows?SERVICE=WFS&OUTPUTFORMAT=json&typenames=geonet:quake_search_v1&COUNT=5&Cql_Filter=magnitude>4&format_options=callback:f&viewparams=a:1", nil)
+	if res := checkQuery(r, requiredParams, optionalParams); !res.ok {
+		t.Fatal(res.msg)
+	}
+	v := r.URL.Query()
+	if v.Get("outputFormat") != "json" || v.Get("typeNames") != "geonet:quake_search_v1" || v.Get("cql_filter") != "magnitude>4" {
+		t.Errorf("expected the canonical names, got %s", r.URL.RawQuery)
+	}
+	params, err := getQueryParams(v)
+	if err != nil || params.maxFeatures != 5 || params.outputFormat != "JSON" || params.cqlFilter != "magnitude>4" {
+		t.Errorf("got %v %v", params, err)
+	}
+
+	r, _ = http.NewRequest("GET", "/geonet/ows?outputformat=json&maxfeatures=5&count=10", nil)
+	params, _ = getQueryParams(r.URL.Query())
+	if params.maxFeatures != 5 {
+		t.Errorf("expected maxFeatures before count, got %d", params.maxFeatures)
+	}
+
+	for _, query := range []string{"/geonet/ows?typeName=geonet:quake_search_v1", "/geonet/ows?outputFormat=json&format=json"} {
+		r, _ := http.NewRequest("GET", query, nil)
+		if res := checkQuery(r, requiredParams, optionalParams); res.ok {
+			t.Errorf("expected bad request for %s", query)
+		}
+	}
+}
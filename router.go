@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"html/template"
 	"net/http"
+	"strings"
 )
 
 var indexTemp *template.Template
@@ -21,6 +22,27 @@ http://wfs.geonet.org.nz/geonet/ows?service=WFS&version=1.0.0&request=GetFeature
 
 2. wms
 http://wfs.geonet.org.nz/geonet/wms/kml?layers=geonet:quake_search_v1&maxFeatures=50
+http://wfs.geonet.org.nz/geonet/wms?service=WMS&version=1.3.0&request=GetMap&layers=geonet:quake_search_v1&styles=
+&crs=EPSG:4326&bbox=-48,165,-34,180&width=600&height=800&format=image/png&transparent=true
+
+3. a single quake
+http://wfs.geonet.org.nz/geonet/quake/2016p123456?outputFormat=csv
+
+4. OGC API - Features
+http://wfs.geonet.org.nz/geonet/collections/quake_search_v1/items?bbox=174,-42,175,-41&limit=100&filter=magnitude>4
+
+5. statistics
+http://wfs.geonet.org.nz/geonet/stats/mfd?cql_filter=origintime>='2010-01-01'&binWidth=0.1&outputFormat=csv
+
+6. a cross section
+http://wfs.geonet.org.nz/geonet/profile?line=LINESTRING(174+-38,178+-40)&width=50km&outputFormat=svg
+
+7. declustering
+http://wfs.geonet.org.nz/geonet/decluster?method=reasenberg&cql_filter=origintime>='2016-11-13'&outputFormat=csv
+
+8. regions
+http://wfs.geonet.org.nz/geonet/regions?type=council
+http://wfs.geonet.org.nz/geonet/ows?service=WFS&version=1.0.0&request=GetFeature&typeName=geonet:quake_search_v1&outputFormat=json&region=canterbury
 */
 func router(w http.ResponseWriter, r *http.Request, b *bytes.Buffer) *result {
 	var res *result
@@ -28,8 +50,22 @@ func router(w http.ResponseWriter, r *http.Request, b *bytes.Buffer) *result {
 	switch {
 	case r.URL.Path == "/wms/kml":
 		res = getQuakesKml(r, w.Header(), b)
+	case r.URL.Path == "/wms":
+		res = wms(r, w.Header(), b)
 	case r.URL.Path == "/ows":
 		res = getQuakesWfs(r, w.Header(), b)
+	case strings.HasPrefix(r.URL.Path, "/quake/"):
+		res = getQuake(r, w.Header(), b)
+	case r.URL.Path == "/decluster":
+		res = getDecluster(r, w.Header(), b)
+	case r.URL.Path == "/regions":
+		res = getRegions(r, w.Header(), b)
+	case r.URL.Path == "/profile":
+		res = getProfile(r, w.Header(), b)
+	case strings.HasPrefix(r.URL.Path, "/stats/"):
+		res = stats(r, w.Header(), b)
+	case r.URL.Path == "/conformance" || r.URL.Path == "/collections" || strings.HasPrefix(r.URL.Path, "/collections/"):
+		res = ogcApi(r, w.Header(), b)
 	default: //index page
 		indexPage(w)
 		res = &statusOK
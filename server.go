@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 )
 
 var (
@@ -18,6 +19,7 @@ var (
 	maxOpenConns, maxIdleConns    int
 	webServerProduction           bool
 	webServerCname, webServerPort string
+	webServerPublicUrl            string // the url of the service behind the proxy, for links
 )
 
 func init() {
@@ -28,6 +30,7 @@ func init() {
 	webServerProduction = os.Getenv("WEBSERVER_PRODUCTION") == "true"
 	webServerCname = os.Getenv("WEBSERVER_CNAME")
 	webServerPort = os.Getenv("WEBSERVER_PORT")
+	webServerPublicUrl = strings.TrimSuffix(os.Getenv("WEBSERVER_PUBLIC_URL"), "/")
 	maxOpenConns = 30
 	maxIdleConns = 20
 
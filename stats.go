@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Statistics of the filtered quakes, taking the filters of GetFeature.
+ * /stats/mfd?cql_filter=origintime>='2010-01-01'&binWidth=0.1&outputFormat=csv
+ * /stats/timeseries?interval=month&cql_filter=magnitude>3
+ * /stats/histogram?property=depth&binWidth=10
+ */
+const (
+	MFD_DEFAULT_BIN_WIDTH = 0.1
+	MFD_MIN_BIN_WIDTH     = 0.01
+	MFD_MAX_BIN_WIDTH     = 1.0
+
+	TIMESERIES_TIME_FORMAT = "2006-01-02T15:04:05Z"
+)
+
+// the intervals of a time series, as date_trunc fields, and the step to the next
+var timeseriesIntervals = map[string]func(time.Time) time.Time{
+	"day":   func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	"week":  func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+	"month": func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+}
+
+// the histogram properties, their default, smallest and largest bin widths
+var histogramProperties = map[string]struct{ binWidth, minBinWidth, maxBinWidth float64 }{
+	"depth":     {10, 1, 1000},
+	"magnitude": {0.5, 0.1, 10},
+}
+
+var statsParams = []string{
+	"typeName",
+	"cql_filter",
+	"filter",
+	"filter-lang",
+	"bbox",
+	"outputFormat", //json (default) or csv
+}
+
+func stats(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	switch r.URL.Path {
+	case "/stats/mfd":
+		return getMfd(r, h, b)
+	case "/stats/timeseries":
+		return getTimeseries(r, h, b)
+	case "/stats/histogram":
+		return getHistogram(r, h, b)
+	}
+	return notFoundError("unknown statistics " + r.URL.Path)
+}
+
+// getStatsParams reads the filters of statistics, of all the quakes that match
+func getStatsParams(r *http.Request, extra ...string) (*QueryParams, *result) {
+	if res := checkQuery(r, []string{}, append(append([]string{}, statsParams...), extra...)); !res.ok {
+		return nil, res
+	}
+	params, err := getQueryParams(r.URL.Query())
+	if err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if !params.layer.isQuake() {
+		return nil, badRequest("statistics are for quakes only")
+	}
+	switch params.outputFormat {
+	case "", "JSON", "CSV":
+	default:
+		return nil, badRequest("unsupported outputFormat " + params.outputFormat + ", use json or csv")
+	}
+	return params.unpaged(), nil
+}
+
+// mfdBin is a magnitude bin of the magnitude-frequency distribution
+type mfdBin struct {
+	Magnitude   float64 `json:"magnitude"`
+	Incremental int64   `json:"incremental"` //the quakes in the bin
+	Cumulative  int64   `json:"cumulative"`  //the quakes in the bin and above
+}
+
+/**
+ * mfd is the magnitude-frequency distribution of the quakes, and its Gutenberg-Richter estimates.
+ * The magnitude of completeness is by maximum curvature (the bin of the most quakes),
+ * the b-value is the maximum likelihood estimate of Aki (1965) with Utsu's correction for the binning,
+ * and its uncertainty b/sqrt(N), of the N quakes at and above the magnitude of completeness.
+ */
+type mfd struct {
+	Count        int64    `json:"count"`
+	BinWidth     float64  `json:"binWidth"`
+	Mc           *float64 `json:"mc"`
+	McCount      int64    `json:"mcCount"`
+	BValue       *float64 `json:"bValue"`
+	BUncertainty *float64 `json:"bUncertainty"`
+	AValue       *float64 `json:"aValue"`
+	Bins         []mfdBin `json:"bins"`
+}
+
+/**
+ * newMfd estimates the distribution of the counts of the bins, by bin index (magnitude / binWidth),
+ * in ascending order.
+ */
+func newMfd(binWidth float64, indexes []int, counts []int64) *mfd {
+	m := &mfd{BinWidth: binWidth, Bins: make([]mfdBin, 0, len(indexes))}
+	for i, index := range indexes {
+		m.Bins = append(m.Bins, mfdBin{Magnitude: binValue(index, binWidth), Incremental: counts[i]})
+		m.Count += counts[i]
+	}
+	cumulative := int64(0)
+	maxBin := -1
+	for i := len(m.Bins) - 1; i >= 0; i-- {
+		cumulative += m.Bins[i].Incremental
+		m.Bins[i].Cumulative = cumulative
+		if maxBin < 0 || m.Bins[i].Incremental >= m.Bins[maxBin].Incremental {
+			maxBin = i
+		}
+	}
+	if maxBin < 0 {
+		return m
+	}
+
+	mc := m.Bins[maxBin].Magnitude
+	m.Mc = &mc
+	sum := 0.0
+	for _, bin := range m.Bins[maxBin:] {
+		m.McCount += bin.Incremental
+		sum += bin.Magnitude * float64(bin.Incremental)
+	}
+	mean := sum / float64(m.McCount)
+	if mean-(mc-binWidth/2) <= 0 {
+		return m
+	}
+	bValue := math.Log10(math.E) / (mean - (mc - binWidth/2))
+	bUncertainty := bValue / math.Sqrt(float64(m.McCount))
+	aValue := math.Log10(float64(m.McCount)) + bValue*mc
+	m.BValue, m.BUncertainty, m.AValue = &bValue, &bUncertainty, &aValue
+	return m
+}
+
+// binValue is index * binWidth, without the floating point noise of the multiplication
+func binValue(index int, binWidth float64) float64 {
+	return math.Round(float64(index)*binWidth*1e6) / 1e6
+}
+
+// parseBinWidth reads the binWidth parameter, MFD_DEFAULT_BIN_WIDTH when it is empty
+func parseBinWidth(s string) (float64, error) {
+	if s == "" {
+		return MFD_DEFAULT_BIN_WIDTH, nil
+	}
+	w, err := strconv.ParseFloat(s, 64)
+	if err != nil || w < MFD_MIN_BIN_WIDTH || w > MFD_MAX_BIN_WIDTH {
+		return 0, fmt.Errorf("invalid binWidth %s, expecting %g to %g", s, MFD_MIN_BIN_WIDTH, MFD_MAX_BIN_WIDTH)
+	}
+	return w, nil
+}
+
+/**
+ * getMfd is the magnitude-frequency distribution of the filtered quakes as JSON or CSV.
+ * /stats/mfd?cql_filter=origintime>='2010-01-01'+AND+depth<40&binWidth=0.1
+ */
+func getMfd(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	params, res := getStatsParams(r, "binWidth")
+	if res != nil {
+		return res
+	}
+	binWidth, err := parseBinWidth(r.URL.Query().Get("binWidth"))
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	filtered, args, err := getSqlQueryString("select magnitude from "+params.layer.Table, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	sqlString := fmt.Sprintf(`select floor(magnitude / %g + 0.5)::int as bin, count(*) from (%s) q
+     where magnitude is not null group by bin order by bin`, binWidth, filtered)
+
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+	var (
+		indexes []int
+		counts  []int64
+	)
+	for rows.Next() {
+		var (
+			index int
+			count int64
+		)
+		if err := rows.Scan(&index, &count); err != nil {
+			return internalServerError(err)
+		}
+		indexes = append(indexes, index)
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+
+	m := newMfd(binWidth, indexes, counts)
+	if params.outputFormat == "CSV" {
+		writeMfdCsv(b, m)
+		h.Set("Content-Disposition", `attachment; filename="mfd.csv"`)
+		h.Set("Content-Type", V1CSV)
+		return &statusOK
+	}
+	return writeJson(h, b, "application/json", m)
+}
+
+// writeMfdCsv writes the bins, after the estimates as # comments
+func writeMfdCsv(b *bytes.Buffer, m *mfd) {
+	estimates := []struct {
+		name  string
+		value *float64
+	}{{"mc", m.Mc}, {"bValue", m.BValue}, {"bUncertainty", m.BUncertainty}, {"aValue", m.AValue}}
+	b.WriteString(fmt.Sprintf("# count=%d binWidth=%g mcCount=%d\n", m.Count, m.BinWidth, m.McCount))
+	for _, e := range estimates {
+		if e.value != nil {
+			b.WriteString(fmt.Sprintf("# %s=%g\n", e.name, *e.value))
+		}
+	}
+	b.WriteString("magnitude,incremental,cumulative\n")
+	for _, bin := range m.Bins {
+		b.WriteString(strings.Join([]string{strconv.FormatFloat(bin.Magnitude, 'g', -1, 64),
+			strconv.FormatInt(bin.Incremental, 10), strconv.FormatInt(bin.Cumulative, 10)}, ",") + "\n")
+	}
+}
+
+// seismicMomentSql is the moment in N m of a magnitude, M0 = 10^(1.5 Mw + 9.1) of Hanks and Kanamori
+const seismicMomentSql = "power(10, 1.5 * magnitude + 9.1)"
+
+// timeseriesBin is an interval of a time series, in UTC
+type timeseriesBin struct {
+	Start            string   `json:"start"`
+	Count            int64    `json:"count"`
+	MaxMagnitude     *float64 `json:"maxMagnitude"`
+	Moment           float64  `json:"moment"`           //N m
+	CumulativeMoment float64  `json:"cumulativeMoment"` //N m, of this and the earlier intervals
+}
+
+type timeseries struct {
+	Interval string          `json:"interval"`
+	Count    int64           `json:"count"`
+	Bins     []timeseriesBin `json:"bins"`
+}
+
+/**
+ * getTimeseries is the count, maximum magnitude and seismic moment of the filtered quakes by interval.
+ * The intervals without quakes between the first and the last are included.
+ * /stats/timeseries?interval=week&cql_filter=origintime>='2016-11-01'
+ */
+func getTimeseries(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	params, res := getStatsParams(r, "interval")
+	if res != nil {
+		return res
+	}
+	interval := strings.ToLower(r.URL.Query().Get("interval"))
+	if interval == "" {
+		interval = "day"
+	}
+	next := timeseriesIntervals[interval]
+	if next == nil {
+		return badRequest("invalid interval " + interval + ", use day, week or month")
+	}
+	filtered, args, err := getSqlQueryString("select origintime, magnitude from "+params.layer.Table, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	sqlString := fmt.Sprintf(`select to_char(date_trunc('%s', origintime at time zone 'UTC'), 'YYYY-MM-DD"T"HH24:MI:SS"Z"') as start,
+     count(*), max(magnitude), coalesce(sum(%s), 0) from (%s) q group by start order by start`, interval, seismicMomentSql, filtered)
+
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+	ts := &timeseries{Interval: interval, Bins: make([]timeseriesBin, 0)}
+	for rows.Next() {
+		var (
+			bin          timeseriesBin
+			maxMagnitude sql.NullFloat64
+		)
+		if err := rows.Scan(&bin.Start, &bin.Count, &maxMagnitude, &bin.Moment); err != nil {
+			return internalServerError(err)
+		}
+		if maxMagnitude.Valid {
+			bin.MaxMagnitude = &maxMagnitude.Float64
+		}
+		if err := ts.add(bin, next); err != nil {
+			return internalServerError(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+
+	if params.outputFormat == "CSV" {
+		b.WriteString("start,count,maxMagnitude,moment,cumulativeMoment\n")
+		for _, bin := range ts.Bins {
+			b.WriteString(strings.Join([]string{bin.Start, strconv.FormatInt(bin.Count, 10), formatOptional(bin.MaxMagnitude),
+				strconv.FormatFloat(bin.Moment, 'g', -1, 64), strconv.FormatFloat(bin.CumulativeMoment, 'g', -1, 64)}, ",") + "\n")
+		}
+		h.Set("Content-Disposition", `attachment; filename="timeseries.csv"`)
+		h.Set("Content-Type", V1CSV)
+		return &statusOK
+	}
+	return writeJson(h, b, "application/json", ts)
+}
+
+// add appends the bin of the next interval with quakes, after the empty intervals before it
+func (ts *timeseries) add(bin timeseriesBin, next func(time.Time) time.Time) error {
+	cumulative := 0.0
+	if n := len(ts.Bins); n > 0 {
+		last := ts.Bins[n-1]
+		cumulative = last.CumulativeMoment
+		start, err := time.Parse(TIMESERIES_TIME_FORMAT, bin.Start)
+		if err != nil {
+			return err
+		}
+		t, err := time.Parse(TIMESERIES_TIME_FORMAT, last.Start)
+		if err != nil {
+			return err
+		}
+		for t = next(t); t.Before(start); t = next(t) {
+			ts.Bins = append(ts.Bins, timeseriesBin{Start: t.Format(TIMESERIES_TIME_FORMAT), CumulativeMoment: cumulative})
+		}
+	}
+	bin.CumulativeMoment = cumulative + bin.Moment
+	ts.Count += bin.Count
+	ts.Bins = append(ts.Bins, bin)
+	return nil
+}
+
+// histogramBin is the quakes from min to less than max
+type histogramBin struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int64   `json:"count"`
+}
+
+type histogram struct {
+	Property string         `json:"property"`
+	BinWidth float64        `json:"binWidth"`
+	Count    int64          `json:"count"`
+	Bins     []histogramBin `json:"bins"`
+}
+
+// newHistogram is the histogram of the counts by bin index (value / binWidth), in ascending order, with the empty bins
+func newHistogram(property string, binWidth float64, indexes []int, counts []int64) *histogram {
+	hist := &histogram{Property: property, BinWidth: binWidth, Bins: make([]histogramBin, 0)}
+	for i, index := range indexes {
+		first := index
+		if i > 0 {
+			first = indexes[i-1] + 1
+		}
+		for j := first; j <= index; j++ {
+			bin := histogramBin{Min: binValue(j, binWidth), Max: binValue(j+1, binWidth)}
+			if j == index {
+				bin.Count = counts[i]
+			}
+			hist.Bins = append(hist.Bins, bin)
+		}
+		hist.Count += counts[i]
+	}
+	return hist
+}
+
+/**
+ * getHistogram is the histogram of the filtered quakes by depth or magnitude.
+ * /stats/histogram?property=depth&binWidth=10&cql_filter=magnitude>4
+ */
+func getHistogram(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	params, res := getStatsParams(r, "property", "binWidth")
+	if res != nil {
+		return res
+	}
+	v := r.URL.Query()
+	property := strings.ToLower(v.Get("property"))
+	widths, ok := histogramProperties[property]
+	if !ok {
+		return badRequest("invalid property " + v.Get("property") + ", use depth or magnitude")
+	}
+	binWidth := widths.binWidth
+	if s := v.Get("binWidth"); s != "" {
+		w, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(w >= widths.minBinWidth && w <= widths.maxBinWidth) {
+			return badRequest(fmt.Sprintf("invalid binWidth %s, expecting %g to %g", s, widths.minBinWidth, widths.maxBinWidth))
+		}
+		binWidth = w
+	}
+	filtered, args, err := getSqlQueryString("select "+property+" from "+params.layer.Table, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	sqlString := fmt.Sprintf(`select floor(%[1]s / %[2]g)::int as bin, count(*) from (%[3]s) q
+     where %[1]s is not null group by bin order by bin`, property, binWidth, filtered)
+
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+	var (
+		indexes []int
+		counts  []int64
+	)
+	for rows.Next() {
+		var (
+			index int
+			count int64
+		)
+		if err := rows.Scan(&index, &count); err != nil {
+			return internalServerError(err)
+		}
+		indexes = append(indexes, index)
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+
+	hist := newHistogram(property, binWidth, indexes, counts)
+	if params.outputFormat == "CSV" {
+		b.WriteString("min,max,count\n")
+		for _, bin := range hist.Bins {
+			b.WriteString(strings.Join([]string{strconv.FormatFloat(bin.Min, 'g', -1, 64), strconv.FormatFloat(bin.Max, 'g', -1, 64),
+				strconv.FormatInt(bin.Count, 10)}, ",") + "\n")
+		}
+		h.Set("Content-Disposition", `attachment; filename="`+property+`.csv"`)
+		h.Set("Content-Type", V1CSV)
+		return &statusOK
+	}
+	return writeJson(h, b, "application/json", hist)
+}
+
+// formatOptional is a CSV value, empty for null
+func formatOptional(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'g', -1, 64)
+}
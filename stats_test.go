@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewMfd(t *testing.T) {
+	//b = 1 above magnitude 2.0, incomplete below
+	indexes := []int{15, 18, 19}
+	counts := []int64{5, 100, 200}
+	for i := 20; i <= 50; i++ {
+		indexes = append(indexes, i)
+		counts = append(counts, int64(math.Round(1e5*(math.Pow(10, -float64(i)/10+0.05)-math.Pow(10, -float64(i)/10-0.05)))))
+	}
+	m := newMfd(0.1, indexes, counts)
+	if m.Mc == nil || *m.Mc != 2 {
+		t.Fatalf("expected mc 2, got %v", m.Mc)
+	}
+	if m.BValue == nil || math.Abs(*m.BValue-1) > 0.02 {
+		t.Errorf("expected a b-value of 1, got %v", *m.BValue)
+	}
+	if *m.BUncertainty != *m.BValue/math.Sqrt(float64(m.McCount)) {
+		t.Errorf("got %v", *m.BUncertainty)
+	}
+	if m.Bins[0].Magnitude != 1.5 || m.Bins[0].Cumulative != m.Count || m.Bins[len(m.Bins)-1].Magnitude != 5 ||
+		m.Bins[len(m.Bins)-1].Cumulative != m.Bins[len(m.Bins)-1].Incremental || m.Count-m.McCount != 305 {
+		t.Errorf("got %+v", m)
+	}
+
+	empty := newMfd(0.1, nil, nil)
+	if empty.Mc != nil || empty.BValue != nil || empty.Count != 0 {
+		t.Errorf("expected no estimates, got %+v", empty)
+	}
+	//a single bin has no spread
+	if one := newMfd(0.1, []int{30}, []int64{3}); one.BValue == nil || one.McCount != 3 {
+		t.Errorf("got %+v", one)
+	}
+}
+
+func TestMfdCsv(t *testing.T) {
+	b := &bytes.Buffer{}
+	writeMfdCsv(b, newMfd(0.5, []int{4, 5, 6}, []int64{10, 4, 1}))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if lines[0] != "# count=15 binWidth=0.5 mcCount=15" || lines[1] != "# mc=2" ||
+		strings.Join(lines[len(lines)-4:], "\n") != "magnitude,incremental,cumulative\n2,10,15\n2.5,4,5\n3,1,1" {
+		t.Errorf("got %s", b.String())
+	}
+}
+
+func TestParseBinWidth(t *testing.T) {
+	if w, err := parseBinWidth(""); err != nil || w != MFD_DEFAULT_BIN_WIDTH {
+		t.Errorf("got %v %v", w, err)
+	}
+	if w, err := parseBinWidth("0.2"); err != nil || w != 0.2 {
+		t.Errorf("got %v %v", w, err)
+	}
+	for _, s := range []string{"0", "2", "abc", "0.001"} {
+		if _, err := parseBinWidth(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestTimeseriesAdd(t *testing.T) {
+	m := 5.0
+	ts := &timeseries{Interval: "month"}
+	for _, bin := range []timeseriesBin{
+		{Start: "2016-10-01T00:00:00Z", Count: 2, Moment: 1e17},
+		{Start: "2017-01-01T00:00:00Z", Count: 1, MaxMagnitude: &m, Moment: 2e17},
+	} {
+		if err := ts.add(bin, timeseriesIntervals["month"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ts.Count != 3 || len(ts.Bins) != 4 || ts.Bins[1].Start != "2016-11-01T00:00:00Z" || ts.Bins[2].Count != 0 ||
+		ts.Bins[2].CumulativeMoment != 1e17 || ts.Bins[3].CumulativeMoment != 3e17 || *ts.Bins[3].MaxMagnitude != 5 {
+		t.Errorf("got %+v", ts)
+	}
+
+	ts = &timeseries{Interval: "week"}
+	for _, start := range []string{"2016-11-07T00:00:00Z", "2016-11-21T00:00:00Z"} {
+		if err := ts.add(timeseriesBin{Start: start, Count: 1}, timeseriesIntervals["week"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ts.Bins) != 3 || ts.Bins[1].Start != "2016-11-14T00:00:00Z" {
+		t.Errorf("got %+v", ts)
+	}
+}
+
+func TestNewHistogram(t *testing.T) {
+	hist := newHistogram("depth", 10, []int{-1, 0, 3}, []int64{2, 50, 7})
+	if hist.Count != 59 || len(hist.Bins) != 5 {
+		t.Fatalf("got %+v", hist)
+	}
+	expected := []histogramBin{{-10, 0, 2}, {0, 10, 50}, {10, 20, 0}, {20, 30, 0}, {30, 40, 7}}
+	for i, bin := range hist.Bins {
+		if bin != expected[i] {
+			t.Errorf("expected %v got %v", expected[i], bin)
+		}
+	}
+	if hist = newHistogram("magnitude", 0.1, []int{23}, []int64{1}); hist.Bins[0].Min != 2.3 || hist.Bins[0].Max != 2.4 {
+		t.Errorf("got %+v", hist)
+	}
+}
+
+func TestHistogramBinWidth(t *testing.T) {
+	for _, query := range []string{"property=depth&binWidth=0.5", "property=depth&binWidth=1e300", "property=magnitude&binWidth=NaN", "property=magnitude&binWidth=20"} {
+		r, _ := http.NewRequest("GET", "/stats/histogram?"+query, nil)
+		if res := getHistogram(r, http.Header{}, &bytes.Buffer{}); res.code != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request got %d", query, res.code)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * WFS 2.0 stored queries: named queries with typed parameters, run by
+ * GetFeature&storedQuery_id=RecentQuakes&minMagnitude=5&days=30&region=canterbury
+ * and listed by ListStoredQueries and DescribeStoredQueries.
+ */
+const (
+	GET_FEATURE_BY_ID_QUERY = "urn:ogc:def:query:OGC-WFS::GetFeatureById"
+	QUAKE_FEATURE_TYPE      = "geonet:quake_search_v1"
+	WFS_QUERY_LANGUAGE      = "urn:ogc:def:queryLanguage:OGC-WFS::WFS_QueryExpression"
+
+	XS_STRING    = "xs:string"
+	XS_DOUBLE    = "xs:double"
+	XS_INTEGER   = "xs:integer"
+	XS_DATE_TIME = "xs:dateTime"
+)
+
+type storedQueryParameter struct {
+	name         string
+	typ          string // one of the XS_* types
+	title        string
+	defaultValue string // for an optional parameter
+	optional     bool
+}
+
+type storedQuery struct {
+	id         string
+	title      string
+	abstract   string
+	parameters []storedQueryParameter
+	anyLayer   bool // of any layer, the others are for quakes
+	// the filter of the parameter values of a layer: string, float64, int64 or a date time string
+	filter func(l *featureLayer, args map[string]interface{}) (filterNode, error)
+}
+
+var storedQueries = []*storedQuery{
+	{
+		id:       GET_FEATURE_BY_ID_QUERY,
+		title:    "Get feature by identifier",
+		abstract: "The feature with the feature id <idPrefix>.<id>, e.g. quake.<publicid>, or the bare id.",
+		parameters: []storedQueryParameter{
+			{name: "ID", typ: XS_STRING, title: "The feature id"},
+		},
+		anyLayer: true,
+		filter: func(l *featureLayer, args map[string]interface{}) (filterNode, error) {
+			return newLayerFeatureIdFilter(l, []string{args["ID"].(string)})
+		},
+	},
+	{
+		id:       "RecentQuakes",
+		title:    "Recent quakes above a magnitude in a region",
+		abstract: "Quakes of the last days at or above the magnitude in a GeoNet quake region.",
+		parameters: []storedQueryParameter{
+			{name: "minMagnitude", typ: XS_DOUBLE, title: "The minimum magnitude", defaultValue: "3"},
+			{name: "days", typ: XS_INTEGER, title: "The number of days back from now", defaultValue: "7"},
+			{name: "region", typ: XS_STRING, title: "The region of /regions, e.g. canterbury", defaultValue: "newzealand"},
+		},
+		filter: func(_ *featureLayer, args map[string]interface{}) (filterNode, error) {
+			days := args["days"].(int64)
+			if days <= 0 {
+				return nil, errors.New("days must be positive")
+			}
+			region, err := newQuakeRegionFilter(args["region"].(string))
+			if err != nil {
+				return nil, err
+			}
+			return &logicFilter{op: "AND", children: []filterNode{
+				&comparisonFilter{op: ">=", left: &propertyExpr{name: "origintime"},
+					right: &timeOffsetExpr{time: &nowExpr{}, sign: "-", duration: fmt.Sprintf("P%dD", days)}},
+				minMagnitudeFilter(args),
+				region,
+			}}, nil
+		},
+	},
+	{
+		id:       "QuakesInTimeRange",
+		title:    "Quakes in a time range",
+		abstract: "Quakes from the start time up to the end time, optionally at or above a magnitude.",
+		parameters: []storedQueryParameter{
+			{name: "startTime", typ: XS_DATE_TIME, title: "The start of the time range"},
+			{name: "endTime", typ: XS_DATE_TIME, title: "The end of the time range"},
+			{name: "minMagnitude", typ: XS_DOUBLE, title: "The minimum magnitude", optional: true},
+		},
+		filter: func(_ *featureLayer, args map[string]interface{}) (filterNode, error) {
+			origintime := &propertyExpr{name: "origintime"}
+			filters := []filterNode{
+				&comparisonFilter{op: ">=", left: origintime, right: &timeExpr{value: args["startTime"].(string)}},
+				&comparisonFilter{op: "<", left: origintime, right: &timeExpr{value: args["endTime"].(string)}},
+			}
+			if _, ok := args["minMagnitude"]; ok {
+				filters = append(filters, minMagnitudeFilter(args))
+			}
+			return &logicFilter{op: "AND", children: filters}, nil
+		},
+	},
+	{
+		id:       "QuakesNearPoint",
+		title:    "Quakes near a point",
+		abstract: "Quakes within a distance of a point, optionally at or above a magnitude.",
+		parameters: []storedQueryParameter{
+			{name: "longitude", typ: XS_DOUBLE, title: "The longitude of the point"},
+			{name: "latitude", typ: XS_DOUBLE, title: "The latitude of the point"},
+			{name: "distance", typ: XS_DOUBLE, title: "The distance in km", defaultValue: "50"},
+			{name: "minMagnitude", typ: XS_DOUBLE, title: "The minimum magnitude", optional: true},
+		},
+		filter: func(_ *featureLayer, args map[string]interface{}) (filterNode, error) {
+			lon, lat, distance := args["longitude"].(float64), args["latitude"].(float64), args["distance"].(float64)
+			//written so that NaN fails too
+			if !(lon >= -MAX_LONGITUDE && lon <= MAX_LONGITUDE) {
+				return nil, errors.New("invalid longitude")
+			}
+			if !(lat >= -90 && lat <= 90) {
+				return nil, errors.New("invalid latitude")
+			}
+			if !(distance > 0) || math.IsInf(distance, 0) {
+				return nil, errors.New("invalid distance, expecting a number of km greater than 0")
+			}
+			point := &Geometry{Type: WKT_POINT, Rings: [][]Coord{{{X: lon, Y: lat}}}}
+			near := newSpatialFilter("DWITHIN", FES_DEFAULT_GEOMETRY, point)
+			near.distance = distance * 1000
+			if _, ok := args["minMagnitude"]; !ok {
+				return near, nil
+			}
+			return &logicFilter{op: "AND", children: []filterNode{near, minMagnitudeFilter(args)}}, nil
+		},
+	},
+}
+
+func minMagnitudeFilter(args map[string]interface{}) filterNode {
+	return &comparisonFilter{op: ">=", left: &propertyExpr{name: "magnitude"}, right: &literalExpr{value: args["minMagnitude"]}}
+}
+
+// newQuakeRegionFilter is the polygon of a region of /regions
+func newQuakeRegionFilter(region string) (filterNode, error) {
+	r, err := getRegion(region)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(FES_DEFAULT_GEOMETRY), nil
+}
+
+func getStoredQuery(id string) *storedQuery {
+	for _, q := range storedQueries {
+		if q.id == id {
+			return q
+		}
+	}
+	return nil
+}
+
+// returnFeatureTypes are the typeNames of all the layers of a stored query of any layer, else the quakes
+func (q *storedQuery) returnFeatureTypes() []string {
+	if !q.anyLayer {
+		return []string{QUAKE_FEATURE_TYPE}
+	}
+	types := make([]string, 0, len(featureLayers))
+	for _, l := range featureLayers {
+		types = append(types, l.typeName())
+	}
+	return types
+}
+
+// withoutParameters is a copy of v without the stored query parameters, e.g. the region of RecentQuakes isn't also the region parameter
+func (q *storedQuery) withoutParameters(v url.Values) url.Values {
+	query := url.Values{}
+	for k, values := range v {
+		query[k] = values
+	}
+	for _, p := range q.parameters {
+		query.Del(p.name)
+	}
+	return query
+}
+
+func (q *storedQuery) parameterNames() []string {
+	names := make([]string, 0, len(q.parameters))
+	for _, p := range q.parameters {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// getFilter types the parameter values of the request and returns the filter of the stored query on layer l
+func (q *storedQuery) getFilter(l *featureLayer, v url.Values) (filterNode, error) {
+	args := make(map[string]interface{})
+	for _, p := range q.parameters {
+		value := strings.TrimSpace(v.Get(p.name))
+		if value == "" {
+			value = p.defaultValue
+		}
+		if value == "" {
+			if p.optional {
+				continue
+			}
+			return nil, errors.New("missing stored query parameter " + p.name)
+		}
+		arg, err := p.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		args[p.name] = arg
+	}
+	return q.filter(l, args)
+}
+
+// checkFeatureFound is a 404 when GetFeatureById matches no feature, as for /quake/{publicid}
+func checkFeatureFound(params *QueryParams, id string) *result {
+	filtered, args, err := getSqlQueryString("select 1 from "+params.layer.Table, params.unpaged())
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	var count int
+	if err := db.QueryRow("select count(*) from ("+filtered+") q", args...).Scan(&count); err != nil {
+		return internalServerError(err)
+	}
+	if count == 0 {
+		return notFoundError("feature " + id + " not found")
+	}
+	return nil
+}
+
+func (p *storedQueryParameter) parse(value string) (interface{}, error) {
+	switch p.typ {
+	case XS_DOUBLE:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f, nil
+		}
+	case XS_INTEGER:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i, nil
+		}
+	case XS_DATE_TIME:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if _, err := time.Parse(layout, value); err == nil {
+				return value, nil
+			}
+		}
+	default:
+		return value, nil
+	}
+	return nil, errors.New("invalid " + p.typ + " value " + value + " for " + p.name)
+}
+
+type wfsListStoredQueriesResponse struct {
+	XMLName       xml.Name         `xml:"wfs:ListStoredQueriesResponse"`
+	Wfs           string           `xml:"xmlns:wfs,attr"`
+	Geonet        string           `xml:"xmlns:geonet,attr"`
+	StoredQueries []wfsStoredQuery `xml:"wfs:StoredQuery"`
+}
+
+type wfsStoredQuery struct {
+	Id                 string   `xml:"id,attr"`
+	Title              string   `xml:"wfs:Title"`
+	ReturnFeatureTypes []string `xml:"wfs:ReturnFeatureType"`
+}
+
+type wfsDescribeStoredQueriesResponse struct {
+	XMLName      xml.Name                    `xml:"wfs:DescribeStoredQueriesResponse"`
+	Wfs          string                      `xml:"xmlns:wfs,attr"`
+	Xs           string                      `xml:"xmlns:xs,attr"`
+	Geonet       string                      `xml:"xmlns:geonet,attr"`
+	Descriptions []wfsStoredQueryDescription `xml:"wfs:StoredQueryDescription"`
+}
+
+type wfsStoredQueryDescription struct {
+	Id                  string                 `xml:"id,attr"`
+	Title               string                 `xml:"wfs:Title"`
+	Abstract            string                 `xml:"wfs:Abstract"`
+	Parameters          []wfsParameter         `xml:"wfs:Parameter"`
+	QueryExpressionText wfsQueryExpressionText `xml:"wfs:QueryExpressionText"`
+}
+
+type wfsParameter struct {
+	Name     string `xml:"name,attr"`
+	Type     string `xml:"type,attr"`
+	Title    string `xml:"wfs:Title"`
+	Abstract string `xml:"wfs:Abstract,omitempty"`
+}
+
+type wfsQueryExpressionText struct {
+	ReturnFeatureTypes string `xml:"returnFeatureTypes,attr"`
+	Language           string `xml:"language,attr"`
+	IsPrivate          bool   `xml:"isPrivate,attr"`
+}
+
+func listStoredQueries(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{}, []string{"service", "version", "request"}); !res.ok {
+		return res
+	}
+	response := wfsListStoredQueriesResponse{Wfs: "http://www.opengis.net/wfs/2.0", Geonet: "http://geonet.org.nz"}
+	for _, q := range storedQueries {
+		response.StoredQueries = append(response.StoredQueries, wfsStoredQuery{Id: q.id, Title: q.title, ReturnFeatureTypes: q.returnFeatureTypes()})
+	}
+	return writeXml(h, b, response)
+}
+
+func describeStoredQueries(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{}, []string{"service", "version", "request", "storedQuery_id"}); !res.ok {
+		return res
+	}
+	queries := storedQueries
+	if ids := r.URL.Query().Get("storedQuery_id"); ids != "" {
+		queries = make([]*storedQuery, 0)
+		for _, id := range strings.Split(ids, ",") {
+			q := getStoredQuery(strings.TrimSpace(id))
+			if q == nil {
+				return badRequest("unknown storedQuery_id " + id)
+			}
+			queries = append(queries, q)
+		}
+	}
+
+	response := wfsDescribeStoredQueriesResponse{Wfs: "http://www.opengis.net/wfs/2.0",
+		Xs: "http://www.w3.org/2001/XMLSchema", Geonet: "http://geonet.org.nz"}
+	for _, q := range queries {
+		d := wfsStoredQueryDescription{Id: q.id, Title: q.title, Abstract: q.abstract,
+			QueryExpressionText: wfsQueryExpressionText{ReturnFeatureTypes: strings.Join(q.returnFeatureTypes(), " "), Language: WFS_QUERY_LANGUAGE, IsPrivate: true}}
+		for _, p := range q.parameters {
+			param := wfsParameter{Name: p.name, Type: p.typ, Title: p.title}
+			if p.defaultValue != "" {
+				param.Abstract = "optional, default " + p.defaultValue
+			} else if p.optional {
+				param.Abstract = "optional"
+			}
+			d.Parameters = append(d.Parameters, param)
+		}
+		response.Descriptions = append(response.Descriptions, d)
+	}
+	return writeXml(h, b, response)
+}
+
+func writeXml(h http.Header, b *bytes.Buffer, v interface{}) *result {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return internalServerError(err)
+	}
+	b.WriteString(xml.Header)
+	b.Write(out)
+	h.Set("Content-Type", CONTENT_TYPE_XML)
+	return &statusOK
+}
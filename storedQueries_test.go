@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStoredQueries(t *testing.T) {
+	tests := []struct {
+		id       string
+		query    string
+		expected string
+	}{
+		{GET_FEATURE_BY_ID_QUERY, "ID=quake.2016p123456", `publicid = '2016p123456'`},
+		{"RecentQuakes", "minMagnitude=5&days=30&region=Canterbury",
+			`origintime >= (now() - 'P30D'::interval) AND magnitude >= 5 AND ST_Within(origin_geom, ST_GeomFromText('POLYGON((174.5 -41.5,174.8 -42.2,173.8 -43.3,173.5 -44.2,171.5 -44.9,170.2 -44.6,169.9 -44.1,171.6 -43.2,172.6 -42.2,174.5 -41.5))', 4326))`},
+		{"RecentQuakes", "",
+			`origintime >= (now() - 'P7D'::interval) AND magnitude >= 3 AND (ST_Within(origin_geom, ST_GeomFromText('POLYGON((164 -49,180 -49,180 -32,164 -32,164 -49))', 4326)) OR ST_Within(origin_geom, ST_GeomFromText('POLYGON((-180 -49,-176 -49,-176 -32,-180 -32,-180 -49))', 4326)))`},
+		{"QuakesInTimeRange", "startTime=2016-01-01&endTime=2016-02-01T00:00:00Z",
+			`origintime >= '2016-01-01'::timestamptz AND origintime < '2016-02-01T00:00:00Z'::timestamptz`},
+		{"QuakesNearPoint", "longitude=175&latitude=-41&minMagnitude=4.5",
+			`ST_DWithin(origin_geom::Geography, ST_GeomFromText('POINT(175 -41)', 4326)::Geography, 50000) AND magnitude >= 4.5`},
+	}
+	for _, test := range tests {
+		v, _ := url.ParseQuery(test.query)
+		f, err := getStoredQuery(test.id).getFilter(featureLayers[0], v)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.id, test.query, err)
+			continue
+		}
+		if sql := cql2Sql(f); sql != test.expected {
+			t.Errorf("%s %s: expected %s got %s", test.id, test.query, test.expected, sql)
+		}
+	}
+
+	for _, test := range []struct{ id, query string }{
+		{GET_FEATURE_BY_ID_QUERY, ""},
+		{"RecentQuakes", "minMagnitude=big"},
+		{"QuakesInTimeRange", "startTime=yesterday&endTime=2016-02-01"},
+		{"QuakesNearPoint", "longitude=175&latitude=-100"},
+		{"QuakesNearPoint", "longitude=175&latitude=NaN"},
+		{"QuakesNearPoint", "longitude=NaN&latitude=-41"},
+		{"QuakesNearPoint", "longitude=Inf&latitude=-41"},
+		{"QuakesNearPoint", "longitude=1e20&latitude=-41"},
+		{"QuakesNearPoint", "longitude=175&latitude=-41&distance=0"},
+		{"QuakesNearPoint", "longitude=175&latitude=-41&distance=-5"},
+		{"QuakesNearPoint", "longitude=175&latitude=-41&distance=NaN"},
+		{"QuakesNearPoint", "longitude=175&latitude=-41&distance=Inf"},
+	} {
+		v, _ := url.ParseQuery(test.query)
+		if _, err := getStoredQuery(test.id).getFilter(featureLayers[0], v); err == nil {
+			t.Errorf("expected error for %s %s", test.id, test.query)
+		}
+	}
+	layers, err := parseLayers([]byte(`[` + testStationLayer + `]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := url.ParseQuery("ID=station.WEL")
+	if f, err := getStoredQuery(GET_FEATURE_BY_ID_QUERY).getFilter(layers[0], v); err != nil || cql2Sql(f) != `code = 'WEL'` {
+		t.Errorf("got %v %v", f, err)
+	}
+	//the region is the stored query parameter only
+	v, _ = url.ParseQuery("typeName=geonet:quake_search_v1&storedQuery_id=RecentQuakes&region=canterbury")
+	params, err := getQueryParams(getStoredQuery("RecentQuakes").withoutParameters(v))
+	if err != nil || len(params.filters) != 0 || v.Get("region") != "canterbury" {
+		t.Errorf("got %v %v", params, err)
+	}
+
+	v, _ = url.ParseQuery("region=atlantis")
+	if _, err := getStoredQuery("RecentQuakes").getFilter(featureLayers[0], v); err == nil {
+		t.Error("expected error for an unknown region")
+	}
+}
+
+func TestDescribeStoredQueries(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/ows?service=WFS&version=2.0.0&request=DescribeStoredQueries&storedQuery_id=RecentQuakes", nil)
+	var b bytes.Buffer
+	if res := getQuakesWfs(r, http.Header{}, &b); !res.ok {
+		t.Fatal(res.msg)
+	}
+	for _, s := range []string{`<wfs:StoredQueryDescription id="RecentQuakes">`, `<wfs:Parameter name="minMagnitude" type="xs:double">`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %s in %s", s, b.String())
+		}
+	}
+
+	r, _ = http.NewRequest("GET", "/ows?request=ListStoredQueries", nil)
+	b.Reset()
+	if res := getQuakesWfs(r, http.Header{}, &b); !res.ok || !strings.Contains(b.String(), `<wfs:StoredQuery id="`+GET_FEATURE_BY_ID_QUERY+`">`) {
+		t.Errorf("got %s %s", res.msg, b.String())
+	}
+
+	r, _ = http.NewRequest("GET", "/ows?request=DescribeStoredQueries&storedQuery_id=DropTables", nil)
+	if res := getQuakesWfs(r, http.Header{}, &b); res.ok {
+		t.Error("expected error for an unknown stored query")
+	}
+}
+
+func TestStoredQueryPost(t *testing.T) {
+	v, err := getFeatureParams(`<wfs:GetFeature xmlns:wfs="http://www.opengis.net/wfs/2.0" service="WFS" version="2.0.0" outputFormat="json">
+  <wfs:StoredQuery id="RecentQuakes"><wfs:Parameter name="minMagnitude">5</wfs:Parameter></wfs:StoredQuery>
+</wfs:GetFeature>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Get("storedQuery_id") != "RecentQuakes" || v.Get("minMagnitude") != "5" || v.Get("outputFormat") != "json" {
+		t.Errorf("got %v", v)
+	}
+}
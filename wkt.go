@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/**
+ * Well-known text (WKT) geometries used in CQL spatial predicates.
+ * Supports POINT, LINESTRING, POLYGON (with holes) and the MULTI* variants, 2D only.
+ */
+const (
+	WKT_POINT           = "POINT"
+	WKT_LINESTRING      = "LINESTRING"
+	WKT_POLYGON         = "POLYGON"
+	WKT_MULTIPOINT      = "MULTIPOINT"
+	WKT_MULTILINESTRING = "MULTILINESTRING"
+	WKT_MULTIPOLYGON    = "MULTIPOLYGON"
+)
+
+type Coord struct {
+	X float64 // longitude
+	Y float64 // latitude
+}
+
+type Geometry struct {
+	Type  string      // one of the WKT_* types
+	Rings [][]Coord   // one list for a POINT or LINESTRING, the exterior ring then holes for a POLYGON
+	Parts []*Geometry // members of a MULTI* geometry
+}
+
+type wktParser struct {
+	wkt       []rune
+	pos       int
+	projected bool // the x are eastings of a projected CRS, not longitudes
+}
+
+// ParseWkt parses and validates a WKT geometry string of longitudes and latitudes.
+func ParseWkt(wkt string) (*Geometry, error) {
+	return parseWkt(wkt, false)
+}
+
+// parseProjectedWkt parses and validates a WKT geometry string in a projected CRS.
+func parseProjectedWkt(wkt string) (*Geometry, error) {
+	return parseWkt(wkt, true)
+}
+
+func parseWkt(wkt string, projected bool) (*Geometry, error) {
+	p := &wktParser{wkt: []rune(wkt), projected: projected}
+	g, err := p.parseGeometry()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.wkt) {
+		return nil, p.errorf("unexpected text %q after geometry", string(p.wkt[p.pos:]))
+	}
+	return g, nil
+}
+
+// IsWkt checks whether s starts with a supported WKT geometry type.
+func IsWkt(s string) bool {
+	p := &wktParser{wkt: []rune(s)}
+	switch p.readWord() {
+	case WKT_POINT, WKT_LINESTRING, WKT_POLYGON, WKT_MULTIPOINT, WKT_MULTILINESTRING, WKT_MULTIPOLYGON:
+		return true
+	}
+	return false
+}
+
+func (p *wktParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("invalid WKT at position %d: %s", p.pos+1, fmt.Sprintf(format, a...))
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.wkt) && unicode.IsSpace(p.wkt[p.pos]) {
+		p.pos++
+	}
+}
+
+// readWord reads the next alphabetic word in upper case
+func (p *wktParser) readWord() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.wkt) && unicode.IsLetter(p.wkt[p.pos]) {
+		p.pos++
+	}
+	return strings.ToUpper(string(p.wkt[start:p.pos]))
+}
+
+func (p *wktParser) peek() rune {
+	p.skipSpace()
+	if p.pos < len(p.wkt) {
+		return p.wkt[p.pos]
+	}
+	return 0
+}
+
+func (p *wktParser) expect(r rune) error {
+	if p.peek() != r {
+		if p.pos >= len(p.wkt) {
+			return p.errorf("expected '%c' but the geometry ended", r)
+		}
+		return p.errorf("expected '%c' but found '%c'", r, p.wkt[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+func (p *wktParser) parseGeometry() (*Geometry, error) {
+	typ := p.readWord()
+	if typ == "" {
+		return nil, p.errorf("expected a geometry type")
+	}
+	if dim := p.readWord(); dim != "" {
+		if dim == "EMPTY" {
+			return nil, p.errorf("empty %s is not supported", typ)
+		}
+		return nil, p.errorf("only 2D geometries are supported, found %s %s", typ, dim)
+	}
+	g := &Geometry{Type: typ}
+	var err error
+	switch typ {
+	case WKT_POINT:
+		var ring []Coord
+		ring, err = p.parseCoordList()
+		if err == nil && len(ring) != 1 {
+			err = p.errorf("a POINT has exactly one coordinate")
+		}
+		g.Rings = [][]Coord{ring}
+	case WKT_LINESTRING:
+		var line []Coord
+		line, err = p.parseLineString()
+		g.Rings = [][]Coord{line}
+	case WKT_POLYGON:
+		g.Rings, err = p.parsePolygon()
+	case WKT_MULTIPOINT:
+		err = p.parseMultiPoint(g)
+	case WKT_MULTILINESTRING:
+		err = p.parseMulti(g, WKT_LINESTRING)
+	case WKT_MULTIPOLYGON:
+		err = p.parseMulti(g, WKT_POLYGON)
+	default:
+		return nil, p.errorf("unsupported geometry type %s", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// parseCoordList parses "(x y, x y, ...)"
+func (p *wktParser) parseCoordList() ([]Coord, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	coords := make([]Coord, 0)
+	for {
+		c, err := p.parseCoord()
+		if err != nil {
+			return nil, err
+		}
+		coords = append(coords, c)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return coords, nil
+}
+
+func (p *wktParser) parseCoord() (Coord, error) {
+	x, err := p.parseNumber()
+	if err != nil {
+		return Coord{}, err
+	}
+	if !p.projected && (x < -MAX_LONGITUDE || x > MAX_LONGITUDE) {
+		return Coord{}, p.errorf("longitude %s is out of range", formatCoord(x))
+	}
+	y, err := p.parseNumber()
+	if err != nil {
+		return Coord{}, err
+	}
+	if r := p.peek(); strings.ContainsRune("+-.0123456789", r) {
+		return Coord{}, p.errorf("only 2D coordinates are supported")
+	}
+	return Coord{x, y}, nil
+}
+
+func (p *wktParser) parseNumber() (float64, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.wkt) && strings.ContainsRune("+-.0123456789eE", p.wkt[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos >= len(p.wkt) {
+			return 0, p.errorf("expected a number but the geometry ended")
+		}
+		return 0, p.errorf("expected a number but found '%c'", p.wkt[p.pos])
+	}
+	text := string(p.wkt[start:p.pos])
+	val, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+		p.pos = start
+		return 0, p.errorf("invalid number %q", text)
+	}
+	return val, nil
+}
+
+func (p *wktParser) parseLineString() ([]Coord, error) {
+	line, err := p.parseCoordList()
+	if err == nil && len(line) < 2 {
+		err = p.errorf("a LINESTRING needs at least 2 coordinates")
+	}
+	return line, err
+}
+
+func (p *wktParser) parsePolygon() ([][]Coord, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	rings := make([][]Coord, 0)
+	for {
+		ring, err := p.parseCoordList()
+		if err != nil {
+			return nil, err
+		}
+		if len(ring) < 4 {
+			return nil, p.errorf("a POLYGON ring needs at least 4 coordinates")
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return nil, p.errorf("a POLYGON ring must be closed, the first and last coordinates differ")
+		}
+		rings = append(rings, ring)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return rings, nil
+}
+
+// parseMultiPoint accepts both MULTIPOINT(1 2, 3 4) and MULTIPOINT((1 2), (3 4))
+func (p *wktParser) parseMultiPoint(g *Geometry) error {
+	if err := p.expect('('); err != nil {
+		return err
+	}
+	for {
+		var (
+			c   Coord
+			err error
+		)
+		if p.peek() == '(' {
+			var ring []Coord
+			ring, err = p.parseCoordList()
+			if err == nil && len(ring) != 1 {
+				err = p.errorf("a MULTIPOINT member has exactly one coordinate")
+			}
+			if err == nil {
+				c = ring[0]
+			}
+		} else {
+			c, err = p.parseCoord()
+		}
+		if err != nil {
+			return err
+		}
+		g.Parts = append(g.Parts, &Geometry{Type: WKT_POINT, Rings: [][]Coord{{c}}})
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	return p.expect(')')
+}
+
+func (p *wktParser) parseMulti(g *Geometry, partType string) error {
+	if err := p.expect('('); err != nil {
+		return err
+	}
+	for {
+		part := &Geometry{Type: partType}
+		if partType == WKT_LINESTRING {
+			line, err := p.parseLineString()
+			if err != nil {
+				return err
+			}
+			part.Rings = [][]Coord{line}
+		} else {
+			rings, err := p.parsePolygon()
+			if err != nil {
+				return err
+			}
+			part.Rings = rings
+		}
+		g.Parts = append(g.Parts, part)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	return p.expect(')')
+}
+
+// eachRing calls f for every coordinate list of the geometry, including those of MULTI* members.
+func (g *Geometry) eachRing(f func(ring []Coord)) {
+	for _, ring := range g.Rings {
+		f(ring)
+	}
+	for _, part := range g.Parts {
+		part.eachRing(f)
+	}
+}
+
+// NormaliseLongitudes maps longitudes in the 0–360 convention back into -180..180.
+func (g *Geometry) NormaliseLongitudes() {
+	g.eachRing(func(ring []Coord) {
+		for i := range ring {
+			ring[i].X = normaliseLongitude(ring[i].X)
+		}
+	})
+}
+
+/**
+ * CrossesAntimeridian checks whether any line or ring has two consecutive
+ * vertices more than 180° of longitude apart.  Expects normalised longitudes.
+ */
+func (g *Geometry) CrossesAntimeridian() bool {
+	crosses := false
+	g.eachRing(func(ring []Coord) {
+		for i := 1; i < len(ring); i++ {
+			if math.Abs(ring[i].X-ring[i-1].X) > 180 {
+				crosses = true
+			}
+		}
+	})
+	return crosses
+}
+
+// ShiftLongitudes moves negative longitudes into the 0-360 convention, the same as ST_ShiftLongitude.
+func (g *Geometry) ShiftLongitudes() {
+	g.eachRing(func(ring []Coord) {
+		for i := range ring {
+			if ring[i].X < 0 {
+				ring[i].X += 360
+			}
+		}
+	})
+}
+
+// String renders the geometry as WKT, e.g. POLYGON((172.9 -41.7,172 -42.8,169.5 -44.3,172.9 -41.7))
+func (g *Geometry) String() string {
+	var b bytes.Buffer
+	b.WriteString(g.Type)
+	g.writeBody(&b)
+	return b.String()
+}
+
+func (g *Geometry) writeBody(b *bytes.Buffer) {
+	b.WriteString("(")
+	switch g.Type {
+	case WKT_POINT, WKT_LINESTRING:
+		writeCoordList(b, g.Rings[0])
+	case WKT_POLYGON:
+		for i, ring := range g.Rings {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString("(")
+			writeCoordList(b, ring)
+			b.WriteString(")")
+		}
+	default: //MULTI*
+		for i, part := range g.Parts {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			part.writeBody(b)
+		}
+	}
+	b.WriteString(")")
+}
+
+func writeCoordList(b *bytes.Buffer, coords []Coord) {
+	for i, c := range coords {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(formatCoord(c.X))
+		b.WriteString(" ")
+		b.WriteString(formatCoord(c.Y))
+	}
+}
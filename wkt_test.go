@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseWkt(t *testing.T) {
+	tests := map[string]string{
+		"POINT(175 -41)":               "POINT(175 -41)",
+		"Point ( 175.5  -41.25 )":      "POINT(175.5 -41.25)",
+		"LINESTRING(172 -40, 176 -38)": "LINESTRING(172 -40,176 -38)",
+		"POLYGON((170 -40,178 -40,178 -46,170 -46,170 -40),(172 -42,174 -42,174 -44,172 -42))": "POLYGON((170 -40,178 -40,178 -46,170 -46,170 -40),(172 -42,174 -42,174 -44,172 -42))",
+		"MULTIPOINT(175 -41, 176 -39)":                                                          "MULTIPOINT((175 -41),(176 -39))",
+		"MULTIPOINT((175 -41),(176 -39))":                                                       "MULTIPOINT((175 -41),(176 -39))",
+		"MULTILINESTRING((172 -40,176 -38),(170 -44,171 -45))":                                  "MULTILINESTRING((172 -40,176 -38),(170 -44,171 -45))",
+		"MULTIPOLYGON(((170 -40,175 -40,175 -45,170 -40)),((176 -38,178 -38,178 -36,176 -38)))": "MULTIPOLYGON(((170 -40,175 -40,175 -45,170 -40)),((176 -38,178 -38,178 -36,176 -38)))",
+	}
+	for wkt, expected := range tests {
+		g, err := ParseWkt(wkt)
+		if err != nil {
+			t.Errorf("%s: %s", wkt, err)
+			continue
+		}
+		if g.String() != expected {
+			t.Errorf("%s: expected %s got %s", wkt, expected, g.String())
+		}
+	}
+}
+
+func TestParseWktErrors(t *testing.T) {
+	tests := map[string]string{
+		"CIRCLE(175 -41, 5)":   "unsupported geometry type CIRCLE",
+		"POINT(175)":           "expected a number",
+		"POINT(175 -41 10)":    "only 2D",
+		"POINT Z (175 -41 10)": "only 2D",
+		"POINT EMPTY":          "empty POINT",
+		"LINESTRING(175 -41)":  "at least 2 coordinates",
+		"POLYGON((170 -40,178 -40,178 -46,170 -46))": "must be closed",
+		"POLYGON((170 -40,178 -40,170 -40))":         "at least 4 coordinates",
+		"POLYGON((170 -40,178 -40,178 -46,170 -40)":  "expected ')'",
+		"POINT(175 -41) extra":                       "unexpected text",
+		"POINT(175 -4a1)":                            "expected ')'",
+		"POINT(1e20 -41)":                            "out of range",
+		"LINESTRING(175 -41,-541 -40)":               "out of range",
+	}
+	for wkt, expected := range tests {
+		_, err := ParseWkt(wkt)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q got %v", wkt, expected, err)
+		}
+	}
+}
+
+func TestGeometryCrossesAntimeridian(t *testing.T) {
+	g, err := ParseWkt("LINESTRING(178 -30,182 -31)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.NormaliseLongitudes()
+	if !g.CrossesAntimeridian() {
+		t.Error("expected line to cross the antimeridian")
+	}
+	g.ShiftLongitudes()
+	if g.String() != "LINESTRING(178 -30,182 -31)" {
+		t.Errorf("unexpected shifted geometry %s", g.String())
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/**
+ * WMS 1.3.0 GetCapabilities, GetMap and GetFeatureInfo of the quake layers.
+ * /wms?service=WMS&version=1.3.0&request=GetMap&layers=geonet:quake_search_v1&styles=&crs=EPSG:2193
+ *   &bbox=5000000,1000000,6300000,2200000&width=800&height=800&format=image/png&transparent=true&cql_filter=magnitude>4
+ * The quakes are drawn as circles coloured by depth and sized by magnitude, like the KML icons,
+ * the largest last, on a transparent background.
+ * GetFeatureInfo takes the GetMap parameters with query_layers, info_format and the pixel i,j (x,y in WMS 1.1.1),
+ * and finds the quakes nearest the pixel within WMS_INFO_TOLERANCE pixels.
+ */
+const (
+	WMS_VERSION      = "1.3.0"
+	WMS_MAX_SIZE     = 4096  // pixels of WIDTH and HEIGHT
+	WMS_MAX_FEATURES = 50000 // quakes drawn on a map
+	WMS_ICON_SIZE    = 32    // pixel diameter of a quake of KML icon scale 1.0
+	CONTENT_TYPE_PNG = "image/png"
+
+	WMS_INFO_TOLERANCE    = 8  // pixels around the clicked pixel
+	WMS_INFO_MAX_FEATURES = 50 // of feature_count
+	CONTENT_TYPE_HTML     = "text/html"
+	CONTENT_TYPE_GML      = "application/vnd.ogc.gml"
+)
+
+var (
+	// the fill of the KML depth icons, by QUAKE_STYLE_DEPTHS
+	WMS_DEPTH_COLORS = [5]color.NRGBA{
+		{0xe3, 0x1a, 0x1c, 0xdd},
+		{0xff, 0x7f, 0x00, 0xdd},
+		{0xff, 0xd7, 0x00, 0xdd},
+		{0x33, 0xa0, 0x2c, 0xdd},
+		{0x1f, 0x78, 0xb4, 0xdd},
+	}
+	WMS_OUTLINE_COLOR = color.NRGBA{0x33, 0x33, 0x33, 0xcc}
+
+	wmsParams = []string{"service", "version", "request", "layers", "styles", "crs", "srs", "bbox", "width", "height",
+		"format", "transparent", "bgcolor", "exceptions", "cql_filter", "query_layers", "info_format", "feature_count",
+		"i", "j", "x", "y"}
+	wmsCrs = []string{"EPSG:4326", "CRS:84", "EPSG:2193", "EPSG:3857"}
+	// the info_format of GetFeatureInfo, the first is the default
+	wmsInfoFormats = []string{CONTENT_TYPE_HTML, CONTENT_TYPE_JSON, CONTENT_TYPE_GML, "application/gml+xml"}
+)
+
+func wms(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	if res := checkQuery(r, []string{"request"}, wmsParams); !res.ok {
+		return res
+	}
+	v := r.URL.Query()
+	if service := v.Get("service"); service != "" && !strings.EqualFold(service, "WMS") {
+		return badRequest("unsupported service " + service)
+	}
+	switch strings.ToUpper(v.Get("request")) {
+	case "GETCAPABILITIES":
+		return getWmsCapabilities(r, h, b)
+	case "GETMAP":
+		m, err := parseWmsMap(v)
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		return getMap(h, b, m)
+	case "GETFEATUREINFO":
+		m, err := parseWmsMap(v)
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		info, err := parseWmsInfo(v, m)
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		return getFeatureInfo(h, b, info)
+	}
+	return badRequest("unsupported request " + v.Get("request") + ", use GetCapabilities, GetMap or GetFeatureInfo")
+}
+
+// wmsMap is a map of GetMap, or the map around the pixel of GetFeatureInfo
+type wmsMap struct {
+	layer                  *featureLayer
+	srid                   int
+	minx, miny, maxx, maxy float64 // easting, northing whatever the axis order of the CRS
+	width, height          int
+	transparent            bool
+	background             color.NRGBA
+	cqlFilter              string
+}
+
+/**
+ * parseWmsMap reads the map parameters. The bbox of WMS 1.3.0 is in the EPSG axis order of the CRS,
+ * latitude, longitude for EPSG:4326, and x,y for CRS:84 and the SRS of WMS 1.1.1.
+ */
+func parseWmsMap(v url.Values) (*wmsMap, error) {
+	version := v.Get("version")
+	if version != "" && version != WMS_VERSION && version != "1.1.1" {
+		return nil, errors.New("unsupported version " + version + ", use " + WMS_VERSION)
+	}
+	l, err := getLayer(v.Get("layers"))
+	if err != nil {
+		return nil, err
+	}
+	if v.Get("layers") == "" || !l.isQuake() {
+		return nil, errors.New("layers must be one quake layer, e.g. " + QUAKE_FEATURE_TYPE)
+	}
+	if styles := v.Get("styles"); styles != "" && !strings.EqualFold(styles, "default") {
+		return nil, errors.New("unsupported styles " + styles)
+	}
+	if format := v.Get("format"); format != "" && !strings.HasPrefix(format, CONTENT_TYPE_PNG) {
+		return nil, errors.New("unsupported format " + format + ", use " + CONTENT_TYPE_PNG)
+	}
+
+	crs := v.Get("crs")
+	if crs == "" {
+		crs = v.Get("srs")
+	}
+	if crs == "" {
+		return nil, errors.New("missing crs")
+	}
+	srid, _, err := parseCrs(crs)
+	if err != nil {
+		return nil, err
+	}
+	latLon := version != "1.1.1" && !crs84Names[strings.ToLower(crs)] && northingFirstSrids[srid]
+
+	coords, err := parseCoordinates(strings.Split(v.Get("bbox"), ","))
+	if err != nil || len(coords) != 4 {
+		return nil, errors.New("invalid bbox " + v.Get("bbox") + ", expecting minx,miny,maxx,maxy")
+	}
+	if latLon {
+		coords = []float64{coords[1], coords[0], coords[3], coords[2]}
+	}
+	if coords[0] >= coords[2] || coords[1] >= coords[3] {
+		return nil, errors.New("invalid bbox " + v.Get("bbox") + ", the minimum is not less than the maximum")
+	}
+	if isWgs84(srid) {
+		if err := checkLongitudes(coords[0], coords[2]); err != nil {
+			return nil, errors.New("invalid bbox " + v.Get("bbox") + ", " + err.Error())
+		}
+	}
+
+	m := &wmsMap{layer: l, srid: srid, minx: coords[0], miny: coords[1], maxx: coords[2], maxy: coords[3],
+		transparent: strings.EqualFold(v.Get("transparent"), "true"), background: color.NRGBA{0xff, 0xff, 0xff, 0xff},
+		cqlFilter: v.Get("cql_filter")}
+	if m.width, err = parseWmsSize(v.Get("width"), "width"); err != nil {
+		return nil, err
+	}
+	if m.height, err = parseWmsSize(v.Get("height"), "height"); err != nil {
+		return nil, err
+	}
+	if bgcolor := v.Get("bgcolor"); bgcolor != "" {
+		rgb, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(bgcolor), "0x"), 16, 32)
+		if err != nil || rgb > 0xffffff {
+			return nil, errors.New("invalid bgcolor " + bgcolor + ", expecting 0xRRGGBB")
+		}
+		m.background = color.NRGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}
+	}
+	return m, nil
+}
+
+func parseWmsSize(s string, name string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > WMS_MAX_SIZE {
+		return 0, errors.New("invalid " + name + " " + s + ", expecting 1 to " + strconv.Itoa(WMS_MAX_SIZE))
+	}
+	return n, nil
+}
+
+// bboxFilter selects the quakes in the map, a map in EPSG:4326 may cross the antimeridian (e.g. 160 to 190)
+func (m *wmsMap) bboxFilter() *bboxFilter {
+	if !isWgs84(m.srid) {
+		return &bboxFilter{property: m.layer.Geometry, minx: m.minx, miny: m.miny, maxx: m.maxx, maxy: m.maxy, srid: m.srid}
+	}
+	minx, miny, maxx, maxy := normaliseBBox(m.minx, m.miny, m.maxx, m.maxy)
+	return &bboxFilter{property: m.layer.Geometry, minx: minx, miny: miny, maxx: maxx, maxy: maxy}
+}
+
+// pixel is the position in the image of x,y in the CRS of the map
+func (m *wmsMap) pixel(x, y float64) (float64, float64) {
+	if isWgs84(m.srid) && x < m.minx {
+		x += 360
+	}
+	return (x - m.minx) / (m.maxx - m.minx) * float64(m.width), (m.maxy - y) / (m.maxy - m.miny) * float64(m.height)
+}
+
+func getMap(h http.Header, b *bytes.Buffer, m *wmsMap) *result {
+	g := transformSql(m.layer.Geometry, m.srid)
+	sqlPre := "select ST_X(" + g + "), ST_Y(" + g + "), magnitude, depth from " + m.layer.Table
+	//the largest quakes within the limit, drawn from the smallest up so the largest are on top,
+	//quakes without a magnitude would sort first in postgres and take the place of the largest
+	hasMagnitude := &nullFilter{expr: &propertyExpr{name: "magnitude"}, not: true}
+	params := &QueryParams{layer: m.layer, cqlFilter: m.cqlFilter, maxFeatures: WMS_MAX_FEATURES,
+		sortBy: "magnitude DESC", filters: []filterNode{m.bboxFilter(), hasMagnitude}}
+	sqlString, args, err := getSqlQueryString(sqlPre, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, m.width, m.height))
+	if !m.transparent {
+		draw.Draw(img, img.Bounds(), &image.Uniform{m.background}, image.Point{}, draw.Src)
+	}
+	type mapQuake struct {
+		x, y             float64
+		magnitude, depth sql.NullFloat64
+	}
+	quakes := make([]mapQuake, 0)
+	for rows.Next() {
+		var q mapQuake
+		if err := rows.Scan(&q.x, &q.y, &q.magnitude, &q.depth); err != nil {
+			return internalServerError(err)
+		}
+		quakes = append(quakes, q)
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+	for i := len(quakes) - 1; i >= 0; i-- {
+		q := quakes[i]
+		px, py := m.pixel(q.x, q.y)
+		drawQuake(img, px, py, q.magnitude.Float64, q.depth.Float64)
+	}
+
+	if err := png.Encode(b, img); err != nil {
+		return internalServerError(err)
+	}
+	h.Set("Content-Type", CONTENT_TYPE_PNG)
+	return &statusOK
+}
+
+// wmsInfo is a GetFeatureInfo of the map around a pixel
+type wmsInfo struct {
+	*wmsMap
+	x, y      float64 // the centre of the pixel in the CRS of the map
+	tolerance float64 // in the units of the CRS
+	format    string
+	count     int
+}
+
+// parseWmsInfo reads the GetFeatureInfo parameters of the map m
+func parseWmsInfo(v url.Values, m *wmsMap) (*wmsInfo, error) {
+	if queryLayers := v.Get("query_layers"); queryLayers == "" || queryLayers != v.Get("layers") {
+		return nil, errors.New("query_layers must be the layers of the map")
+	}
+	info := &wmsInfo{wmsMap: m, format: wmsInfoFormats[0], count: 1}
+	if format := v.Get("info_format"); format != "" {
+		info.format = ""
+		for _, f := range wmsInfoFormats {
+			if strings.EqualFold(format, f) {
+				info.format = f
+			}
+		}
+		if info.format == "" {
+			return nil, errors.New("unsupported info_format " + format + ", use " + strings.Join(wmsInfoFormats, ", "))
+		}
+	}
+	if count := v.Get("feature_count"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || n > WMS_INFO_MAX_FEATURES {
+			return nil, errors.New("invalid feature_count " + count + ", expecting 1 to " + strconv.Itoa(WMS_INFO_MAX_FEATURES))
+		}
+		info.count = n
+	}
+
+	iName, jName := "i", "j"
+	if v.Get("version") == "1.1.1" {
+		iName, jName = "x", "y"
+	}
+	i, err := strconv.Atoi(v.Get(iName))
+	if err != nil || i < 0 || i >= m.width {
+		return nil, errors.New("invalid " + iName + " " + v.Get(iName) + ", expecting a pixel column of the map")
+	}
+	j, err := strconv.Atoi(v.Get(jName))
+	if err != nil || j < 0 || j >= m.height {
+		return nil, errors.New("invalid " + jName + " " + v.Get(jName) + ", expecting a pixel row of the map")
+	}
+
+	resolution := math.Max((m.maxx-m.minx)/float64(m.width), (m.maxy-m.miny)/float64(m.height))
+	info.x = m.minx + (float64(i)+0.5)*(m.maxx-m.minx)/float64(m.width)
+	info.y = m.maxy - (float64(j)+0.5)*(m.maxy-m.miny)/float64(m.height)
+	info.tolerance = WMS_INFO_TOLERANCE * resolution
+	return info, nil
+}
+
+// bboxFilter selects the quakes within the tolerance of the pixel
+func (info *wmsInfo) bboxFilter() *bboxFilter {
+	m := *info.wmsMap
+	m.minx, m.miny, m.maxx, m.maxy = info.x-info.tolerance, info.y-info.tolerance, info.x+info.tolerance, info.y+info.tolerance
+	return m.bboxFilter()
+}
+
+// distanceSql is the distance of the quakes from the pixel, in the units of the CRS
+func (info *wmsInfo) distanceSql() string {
+	x := info.x
+	if isWgs84(info.srid) && x > 180 {
+		x -= 360
+	}
+	return fmt.Sprintf("ST_Distance(%s, ST_SetSRID(ST_MakePoint(%g, %g), %d))",
+		transformSql(info.layer.Geometry, info.srid), x, info.y, info.epsgCode())
+}
+
+func (info *wmsInfo) epsgCode() int {
+	if isWgs84(info.srid) {
+		return SRID_WGS84
+	}
+	return info.srid
+}
+
+func getFeatureInfo(h http.Header, b *bytes.Buffer, info *wmsInfo) *result {
+	g := transformSql(info.layer.Geometry, info.srid)
+	sqlPre := "select " + QUAKE_KML_COLUMNS + ", ST_X(" + g + "), ST_Y(" + g + ") from " + info.layer.Table
+	params := &QueryParams{layer: info.layer, cqlFilter: info.cqlFilter, maxFeatures: empty_param_value,
+		filters: []filterNode{info.bboxFilter()}}
+	sqlString, args, err := getSqlQueryString(sqlPre, params)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	sqlString += fmt.Sprintf(" ORDER BY %s limit %d", info.distanceSql(), info.count)
+
+	rows, err := db.Query(sqlString, args...)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer rows.Close()
+
+	quakes := make([]wmsInfoQuake, 0)
+	for rows.Next() {
+		q := wmsInfoQuake{}
+		if err := rows.Scan(append(q.fields(), &q.x, &q.y)...); err != nil {
+			return internalServerError(err)
+		}
+		if q.attributes, err = q.kmlQuake.attributes(); err != nil {
+			return internalServerError(err)
+		}
+		quakes = append(quakes, q)
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError(err)
+	}
+
+	switch info.format {
+	case CONTENT_TYPE_JSON:
+		return writeInfoJson(h, b, info, quakes)
+	case CONTENT_TYPE_HTML:
+		writeInfoHtml(b, info, quakes)
+	default:
+		writeInfoGml(b, info, quakes)
+	}
+	h.Set("Content-Type", info.format)
+	return &statusOK
+}
+
+// wmsInfoQuake is a quake found by GetFeatureInfo, at x,y in the CRS of the map
+type wmsInfoQuake struct {
+	kmlQuake
+	x, y       float64
+	attributes []quakeAttribute
+}
+
+func writeInfoJson(h http.Header, b *bytes.Buffer, info *wmsInfo, quakes []wmsInfoQuake) *result {
+	collection := GeoJsonFeatureCollection{Type: "FeatureCollection", Features: make([]Feature, 0, len(quakes))}
+	if !isWgs84(info.srid) {
+		collection.Crs = &GeoJsonCrs{Type: "name", Properties: map[string]string{"name": "urn:ogc:def:crs:EPSG::" + strconv.Itoa(info.srid)}}
+	}
+	for _, q := range quakes {
+		properties := make(map[string]interface{}, len(q.attributes))
+		for _, a := range q.attributes {
+			properties[a.name] = a.value
+		}
+		collection.Features = append(collection.Features, Feature{Type: "Feature", Id: "quake." + q.publicid,
+			Geometry: FeatureGeometry{Type: "Point", Coordinates: []float64{q.x, q.y}}, Properties: properties})
+	}
+	if err := json.NewEncoder(b).Encode(collection); err != nil {
+		return internalServerError(err)
+	}
+	h.Set("Content-Type", CONTENT_TYPE_JSON)
+	return &statusOK
+}
+
+func writeInfoHtml(b *bytes.Buffer, info *wmsInfo, quakes []wmsInfoQuake) {
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head><title>" + html.EscapeString(info.layer.Title) + "</title></head>\n<body>\n")
+	if len(quakes) == 0 {
+		b.WriteString("<p>No quakes found</p>\n")
+	}
+	for _, q := range quakes {
+		b.WriteString("<table class=\"quake\">\n<caption>quake." + html.EscapeString(q.publicid) + "</caption>\n")
+		for _, a := range q.attributes {
+			b.WriteString("<tr><th>" + a.title + "</th><td>" + html.EscapeString(fmt.Sprint(a.value)) + "</td></tr>\n")
+		}
+		b.WriteString("</table>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+}
+
+func writeInfoGml(b *bytes.Buffer, info *wmsInfo, quakes []wmsInfoQuake) {
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<wfs:FeatureCollection xmlns:wfs="http://www.opengis.net/wfs" xmlns:gml="http://www.opengis.net/gml" xmlns:geonet="http://geonet.org.nz">` + "\n")
+	for _, q := range quakes {
+		b.WriteString("<gml:featureMember>\n<geonet:" + info.layer.Name + " fid=\"quake." + html.EscapeString(q.publicid) + "\">\n")
+		for _, a := range q.attributes {
+			b.WriteString(fmt.Sprintf("<geonet:%s>%s</geonet:%s>\n", a.name, html.EscapeString(fmt.Sprint(a.value)), a.name))
+		}
+		b.WriteString(fmt.Sprintf("<geonet:%s><gml:Point srsName=\"%s\"><gml:pos>%g %g</gml:pos></gml:Point></geonet:%s>\n",
+			info.layer.Geometry, crsName(info.epsgCode()), q.x, q.y, info.layer.Geometry))
+		b.WriteString("</geonet:" + info.layer.Name + ">\n</gml:featureMember>\n")
+	}
+	b.WriteString("</wfs:FeatureCollection>\n")
+}
+
+// quakeRadius is the pixel radius of the circle of a magnitude, scaled like the KML icons
+func quakeRadius(magnitude float64) float64 {
+	return WMS_ICON_SIZE / 2 * getKmlIconSize(magnitude)
+}
+
+// drawQuake draws the circle of a quake centred on the pixel cx,cy
+func drawQuake(img draw.Image, cx, cy, magnitude, depth float64) {
+	radius := quakeRadius(magnitude)
+	bounds := image.Rect(int(math.Floor(cx-radius-1)), int(math.Floor(cy-radius-1)),
+		int(math.Ceil(cx+radius+1)), int(math.Ceil(cy+radius+1)))
+	fill := WMS_DEPTH_COLORS[getQuakeDepthIndex(depth)]
+	draw.DrawMask(img, bounds, &image.Uniform{fill}, image.Point{}, &circleMask{cx, cy, radius, 0}, bounds.Min, draw.Over)
+	draw.DrawMask(img, bounds, &image.Uniform{WMS_OUTLINE_COLOR}, image.Point{}, &circleMask{cx, cy, radius, 1}, bounds.Min, draw.Over)
+}
+
+/**
+ * circleMask is the anti-aliased coverage of a circle, or of its outline of width pixels,
+ * in image coordinates.
+ */
+type circleMask struct {
+	cx, cy, radius float64
+	width          float64 // 0 for the whole circle
+}
+
+func (c *circleMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (c *circleMask) Bounds() image.Rectangle {
+	return image.Rect(int(math.Floor(c.cx-c.radius-1)), int(math.Floor(c.cy-c.radius-1)),
+		int(math.Ceil(c.cx+c.radius+1)), int(math.Ceil(c.cy+c.radius+1)))
+}
+
+func (c *circleMask) At(x, y int) color.Color {
+	d := math.Hypot(float64(x)+0.5-c.cx, float64(y)+0.5-c.cy)
+	coverage := clampUnit(c.radius - d + 0.5)
+	if c.width > 0 {
+		coverage -= clampUnit(c.radius - c.width - d + 0.5)
+	}
+	return color.Alpha{uint8(coverage*0xff + 0.5)}
+}
+
+func clampUnit(f float64) float64 {
+	return math.Max(0, math.Min(1, f))
+}
+
+type wmsCapabilities struct {
+	XMLName    xml.Name      `xml:"WMS_Capabilities"`
+	Version    string        `xml:"version,attr"`
+	Xmlns      string        `xml:"xmlns,attr"`
+	Xlink      string        `xml:"xmlns:xlink,attr"`
+	Service    wmsService    `xml:"Service"`
+	Capability wmsCapability `xml:"Capability"`
+}
+
+type wmsService struct {
+	Name           string            `xml:"Name"`
+	Title          string            `xml:"Title"`
+	Abstract       string            `xml:"Abstract"`
+	OnlineResource wmsOnlineResource `xml:"OnlineResource"`
+	MaxWidth       int               `xml:"MaxWidth"`
+	MaxHeight      int               `xml:"MaxHeight"`
+}
+
+type wmsOnlineResource struct {
+	Type string `xml:"xlink:type,attr"`
+	Href string `xml:"xlink:href,attr"`
+}
+
+type wmsCapability struct {
+	Request    wmsRequest `xml:"Request"`
+	Exceptions []string   `xml:"Exception>Format"`
+	Layer      wmsLayer   `xml:"Layer"`
+}
+
+type wmsRequest struct {
+	GetCapabilities wmsOperation `xml:"GetCapabilities"`
+	GetMap          wmsOperation `xml:"GetMap"`
+	GetFeatureInfo  wmsOperation `xml:"GetFeatureInfo"`
+}
+
+type wmsOperation struct {
+	Formats []string          `xml:"Format"`
+	Get     wmsOnlineResource `xml:"DCPType>HTTP>Get>OnlineResource"`
+}
+
+type wmsLayer struct {
+	Queryable    int                `xml:"queryable,attr"`
+	Opaque       *int               `xml:"opaque,attr,omitempty"`
+	Name         string             `xml:"Name,omitempty"`
+	Title        string             `xml:"Title"`
+	Abstract     string             `xml:"Abstract,omitempty"`
+	Crs          []string           `xml:"CRS"`
+	GeographicBB *wmsGeographicBBox `xml:"EX_GeographicBoundingBox,omitempty"`
+	Layers       []wmsLayer         `xml:"Layer"`
+}
+
+type wmsGeographicBBox struct {
+	West  float64 `xml:"westBoundLongitude"`
+	East  float64 `xml:"eastBoundLongitude"`
+	South float64 `xml:"southBoundLatitude"`
+	North float64 `xml:"northBoundLatitude"`
+}
+
+func getWmsCapabilities(r *http.Request, h http.Header, b *bytes.Buffer) *result {
+	href := wmsOnlineResource{Type: "simple", Href: baseUrl(r) + "/wms?"}
+	opaque := 0
+
+	root := wmsLayer{Title: "GeoNet", Crs: wmsCrs}
+	for _, l := range featureLayers {
+		if !l.isQuake() {
+			continue
+		}
+		root.Layers = append(root.Layers, wmsLayer{Queryable: 1, Name: l.typeName(), Title: l.Title, Opaque: &opaque,
+			Abstract: "Quakes coloured by depth (0-15, 15-40, 40-100, 100-200 and 200+ km) and sized by magnitude",
+			Crs:      wmsCrs, GeographicBB: &wmsGeographicBBox{West: 164, East: -176, South: -49, North: -32}})
+	}
+
+	capabilities := wmsCapabilities{Version: WMS_VERSION, Xmlns: "http://www.opengis.net/wms", Xlink: "http://www.w3.org/1999/xlink",
+		Service: wmsService{Name: "WMS", Title: "GeoNet quakes", Abstract: "Maps of the quakes located by GeoNet",
+			OnlineResource: href, MaxWidth: WMS_MAX_SIZE, MaxHeight: WMS_MAX_SIZE},
+		Capability: wmsCapability{
+			Request: wmsRequest{
+				GetCapabilities: wmsOperation{Formats: []string{"text/xml"}, Get: href},
+				GetMap:          wmsOperation{Formats: []string{CONTENT_TYPE_PNG}, Get: href},
+				GetFeatureInfo:  wmsOperation{Formats: wmsInfoFormats, Get: href},
+			},
+			Exceptions: []string{"text/plain"},
+			Layer:      root,
+		},
+	}
+	return writeXml(h, b, capabilities)
+}
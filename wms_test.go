@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseWmsMap(t *testing.T) {
+	tests := []struct {
+		query                  string
+		srid                   int
+		minx, miny, maxx, maxy float64
+	}{
+		{"version=1.3.0&crs=EPSG:4326&bbox=-48,165,-34,179", SRID_WGS84, 165, -48, 179, -34},
+		{"version=1.3.0&crs=CRS:84&bbox=165,-48,179,-34", SRID_WGS84, 165, -48, 179, -34},
+		{"version=1.1.1&srs=EPSG:4326&bbox=165,-48,179,-34", SRID_WGS84, 165, -48, 179, -34},
+		{"crs=EPSG:2193&bbox=5000000,1000000,6300000,2200000", SRID_NZTM, 1000000, 5000000, 2200000, 6300000},
+		{"crs=EPSG:3857&bbox=18000000,-6000000,20000000,-4000000", SRID_WEB_MERCATOR, 18000000, -6000000, 20000000, -4000000},
+	}
+	for _, test := range tests {
+		v, _ := url.ParseQuery("layers=geonet:quake_search_v1&width=256&height=256&format=image/png&" + test.query)
+		m, err := parseWmsMap(v)
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err)
+			continue
+		}
+		if m.srid != test.srid || m.minx != test.minx || m.miny != test.miny || m.maxx != test.maxx || m.maxy != test.maxy {
+			t.Errorf("%s: got %d %v,%v,%v,%v", test.query, m.srid, m.minx, m.miny, m.maxx, m.maxy)
+		}
+	}
+
+	for _, query := range []string{
+		"layers=geonet:quake_search_v1&crs=EPSG:4326&bbox=-48,165,-34&width=256&height=256",
+		"layers=geonet:quake_search_v1&crs=EPSG:4326&bbox=-34,165,-48,179&width=256&height=256",
+		"layers=geonet:quake_search_v1&crs=EPSG:4326&bbox=-48,165,-34,179&width=0&height=256",
+		"layers=geonet:quake_search_v1&crs=EPSG:4326&bbox=-48,165,-34,179&width=256&height=5000",
+		"layers=geonet:quake_search_v1&crs=CRS:84&bbox=165,-48,1e20,-34&width=256&height=256",
+		"layers=geonet:quake_search_v1&crs=EPSG:4326&bbox=-48,165,-34,179&width=256&height=256&format=image/jpeg",
+		"layers=geonet:quake_search_v1&crs=EPSG:27200&bbox=-48,165,-34,179&width=256&height=256",
+		"layers=geonet:quake_search_v1&bbox=-48,165,-34,179&width=256&height=256",
+		"layers=geonet:nope&crs=EPSG:4326&bbox=-48,165,-34,179&width=256&height=256",
+		"crs=EPSG:4326&bbox=-48,165,-34,179&width=256&height=256",
+	} {
+		v, _ := url.ParseQuery(query)
+		if _, err := parseWmsMap(v); err == nil {
+			t.Errorf("expected error for %s", query)
+		}
+	}
+}
+
+func TestWmsBBoxFilter(t *testing.T) {
+	v, _ := url.ParseQuery("layers=geonet:quake_search_v1&crs=EPSG:2193&bbox=5000000,1000000,6300000,2200000&width=256&height=256")
+	m, err := parseWmsMap(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cql2Sql(m.bboxFilter()); s != "ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(1000000, 5000000, 2200000, 6300000, 2193), 10000), 4326), origin_geom)" {
+		t.Errorf("got %s", s)
+	}
+	if x, y := m.pixel(1600000, 5650000); x != 128 || y != 128 {
+		t.Errorf("expected the centre pixel, got %v %v", x, y)
+	}
+}
+
+func TestDrawQuake(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	drawQuake(img, 32, 32, 6, 10)
+	if c := img.NRGBAAt(32, 32); !similarColor(c, WMS_DEPTH_COLORS[0]) {
+		t.Errorf("expected the centre in the shallow depth colour, got %v", c)
+	}
+	if c := img.NRGBAAt(0, 0); c.A != 0 {
+		t.Errorf("expected the corner to be transparent, got %v", c)
+	}
+	img = image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	drawQuake(img, 32, 32, 6, 250)
+	if c := img.NRGBAAt(32, 32); !similarColor(c, WMS_DEPTH_COLORS[4]) {
+		t.Errorf("expected the centre in the deep depth colour, got %v", c)
+	}
+}
+
+// similarColor allows for the rounding of alpha compositing
+func similarColor(a, b color.NRGBA) bool {
+	return math.Abs(float64(a.R)-float64(b.R)) <= 2 && math.Abs(float64(a.G)-float64(b.G)) <= 2 &&
+		math.Abs(float64(a.B)-float64(b.B)) <= 2 && a.A == b.A
+}
+
+func TestWmsCapabilities(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://wfs.geonet.org.nz/geonet/wms?service=WMS&request=GetCapabilities", nil)
+	h := http.Header{}
+	b := &bytes.Buffer{}
+	if res := wms(r, h, b); !res.ok {
+		t.Fatalf("got %d %s", res.code, res.msg)
+	}
+	for _, s := range []string{"<WMS_Capabilities version=\"1.3.0\"", "<Name>geonet:quake_search_v1</Name>", "<CRS>EPSG:2193</CRS>", "<GetMap>", "<GetFeatureInfo>", `<Layer queryable="1"`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %s in %s", s, b.String())
+		}
+	}
+
+	//the online resource keeps the path prefix of the proxy
+	webServerPublicUrl = "http://wfs.geonet.org.nz/geonet"
+	defer func() { webServerPublicUrl = "" }()
+	r, _ = http.NewRequest("GET", "http://localhost:8081/wms?service=WMS&request=GetCapabilities", nil)
+	b = &bytes.Buffer{}
+	if res := wms(r, h, b); !res.ok || !strings.Contains(b.String(), `xlink:href="http://wfs.geonet.org.nz/geonet/wms?"`) {
+		t.Errorf("got %s %s", res.msg, b.String())
+	}
+
+	r, _ = http.NewRequest("GET", "http://wfs.geonet.org.nz/geonet/wms?service=WMS&request=GetLegendGraphic", nil)
+	if res := wms(r, h, &bytes.Buffer{}); res.ok {
+		t.Errorf("expected an unsupported request")
+	}
+}
+
+func TestParseWmsInfo(t *testing.T) {
+	v, _ := url.ParseQuery("request=GetFeatureInfo&layers=geonet:quake_search_v1&query_layers=geonet:quake_search_v1" +
+		"&crs=EPSG:2193&bbox=5000000,1000000,6300000,2200000&width=1200&height=1300&i=600&j=650&info_format=application/json&feature_count=3")
+	m, err := parseWmsMap(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseWmsInfo(v, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.x != 1600500 || info.y != 5649500 || info.tolerance != 8000 || info.format != CONTENT_TYPE_JSON || info.count != 3 {
+		t.Errorf("got %v %v %v %s %d", info.x, info.y, info.tolerance, info.format, info.count)
+	}
+	if s := cql2Sql(info.bboxFilter()); s != "ST_Contains(ST_Transform(ST_Segmentize(ST_MakeEnvelope(1592500, 5641500, 1608500, 5657500, 2193), 10000), 4326), origin_geom)" {
+		t.Errorf("got %s", s)
+	}
+	if s := info.distanceSql(); s != "ST_Distance(ST_Transform(origin_geom, 2193), ST_SetSRID(ST_MakePoint(1.6005e+06, 5.6495e+06), 2193))" {
+		t.Errorf("got %s", s)
+	}
+
+	for _, query := range []string{
+		"query_layers=geonet:quake_search_v1&i=600",
+		"query_layers=geonet:quake_search_v1&i=1200&j=10",
+		"query_layers=geonet:quake_search_v1&i=10&j=-1",
+		"query_layers=geonet:quake_search_v1&i=10&j=10&info_format=image/png",
+		"query_layers=geonet:quake_search_v1&i=10&j=10&feature_count=0",
+		"query_layers=geonet:quake_search_v1&version=1.1.1&i=10&j=10",
+		"i=10&j=10",
+	} {
+		v, _ := url.ParseQuery(query)
+		if _, err := parseWmsInfo(v, m); err == nil {
+			t.Errorf("expected error for %s", query)
+		}
+	}
+}
+
+func TestFeatureInfoFormats(t *testing.T) {
+	l, err := getLayer(QUAKE_FEATURE_TYPE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &wmsInfo{wmsMap: &wmsMap{layer: l, srid: SRID_NZTM}}
+	q := wmsInfoQuake{x: 1600000, y: 5650000}
+	q.publicid, q.origintime = "2016p858000", "2016-11-13T11:02:56.346Z"
+	q.magnitude.Float64, q.magnitude.Valid = 7.8, true
+	if q.attributes, err = q.kmlQuake.attributes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.attributes) != 4 || q.attributes[1].value != "November 13 2016 at 11:02:56 am" || q.attributes[3].name != "magnitude" {
+		t.Errorf("got %v", q.attributes)
+	}
+
+	b := &bytes.Buffer{}
+	if res := writeInfoJson(http.Header{}, b, info, []wmsInfoQuake{q}); !res.ok {
+		t.Fatal(res.msg)
+	}
+	for _, s := range []string{`"id":"quake.2016p858000"`, `"coordinates":[1600000,5650000]`, `"magnitude":7.8`, `"urn:ogc:def:crs:EPSG::2193"`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %s in %s", s, b.String())
+		}
+	}
+
+	b.Reset()
+	writeInfoHtml(b, info, []wmsInfoQuake{q})
+	if !strings.Contains(b.String(), "<tr><th>Magnitude</th><td>7.8</td></tr>") {
+		t.Errorf("got %s", b.String())
+	}
+
+	b.Reset()
+	writeInfoGml(b, info, []wmsInfoQuake{q})
+	for _, s := range []string{"<geonet:magnitude>7.8</geonet:magnitude>", `<gml:Point srsName="EPSG:2193"><gml:pos>1.6e+06 5.65e+06</gml:pos></gml:Point>`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %s in %s", s, b.String())
+		}
+	}
+}